@@ -4,16 +4,59 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/parsers/smime"
 )
 
+// maxDepth is the nesting depth to which convertible attachments are
+// expanded, set by the --max-depth option.
+var maxDepth = formats.DefaultMaxDepth
+
+// offline, placeholderImages, keepTrackers, sanitize, and defang are set
+// by the --offline, --placeholder-images, --keep-trackers, --sanitize,
+// and --defang options.
+var offline, placeholderImages, keepTrackers, sanitize, defang bool
+
+// fetcher retrieves external images, as configured by the --image-proxy,
+// --image-allow, and --image-cache options; nil uses the default.
+var fetcher formats.ImageFetcher
+
+// smimeRoots is set by the --smime-roots option, and smimeIdentity by
+// --smime-key and --smime-cert. The key is only held in memory.
+var (
+	smimeRoots    *x509.CertPool
+	smimeIdentity *smime.Identity
+)
+
+// convertOptions returns the conversion options set on the command line.
+func convertOptions() formats.Options {
+	opts := formats.Options{MaxDepth: maxDepth, Offline: offline, Placeholders: placeholderImages,
+		KeepTrackers: keepTrackers, Sanitize: sanitize, Defang: defang, Fetcher: fetcher,
+		SMIMERoots: smimeRoots}
+	if smimeIdentity != nil {
+		opts.SMIMEKey, opts.SMIMECert = smimeIdentity.Key, smimeIdentity.Cert
+	}
+	if maxDepth == 0 {
+		opts.MaxDepth = -1
+	}
+	return opts
+}
+
 // convertFile reads a file, auto-detects its format, and returns the
 // converted output files. Exits on error.
 func convertFile(path string) []formats.ConvertedFile {
+	return convertFileWith(path, convertOptions())
+}
+
+// convertFileWith is convertFile with the given options.
+func convertFileWith(path string, opts formats.Options) []formats.ConvertedFile {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
@@ -24,7 +67,7 @@ func convertFile(path string) []formats.ConvertedFile {
 		fmt.Fprintf(os.Stderr, "Unsupported file format: %s\n", filepath.Base(path))
 		os.Exit(1)
 	}
-	files, err := conv.Convert(data)
+	files, err := formats.ExpandWithOptions(context.Background(), conv, bytes.NewReader(data), opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error converting %s: %v\n", path, err)
 		os.Exit(1)
@@ -39,7 +82,7 @@ func writeConvertedFiles(files []formats.ConvertedFile, outDir string) {
 		return
 	}
 	for _, f := range files {
-		if err := writeFile(outDir, f.Name, f.Data); err != nil {
+		if err := writeFile(outDir, f.Name, f.Data, f.ModTime()); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		}
 	}
@@ -50,7 +93,7 @@ func cmdExtract(path, outDir string) {
 	files := convertFile(path)
 	var filtered []formats.ConvertedFile
 	for _, f := range files {
-		if f.Category == "attachment" {
+		if f.Category == formats.CategoryAttachment {
 			filtered = append(filtered, f)
 		}
 	}
@@ -62,7 +105,7 @@ func cmdBody(path, outDir string) {
 	files := convertFile(path)
 	var filtered []formats.ConvertedFile
 	for _, f := range files {
-		if f.Category == "body" {
+		if f.Category == formats.CategoryBody {
 			filtered = append(filtered, f)
 		}
 	}
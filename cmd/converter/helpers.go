@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // humanSize formats a byte count as a human-readable string (e.g. "1.2 KB").
@@ -24,8 +25,9 @@ func humanSize(b int) string {
 }
 
 // writeFile writes data to outDir/name, ensuring the resulting path stays
-// within outDir to prevent directory traversal attacks.
-func writeFile(outDir, name string, data []byte) error {
+// within outDir to prevent directory traversal attacks. A non-zero
+// modTime is applied as the file's access and modification time.
+func writeFile(outDir, name string, data []byte, modTime time.Time) error {
 	if err := os.MkdirAll(outDir, 0o755); err != nil {
 		return fmt.Errorf("creating output directory: %w", err)
 	}
@@ -44,9 +46,19 @@ func writeFile(outDir, name string, data []byte) error {
 		return fmt.Errorf("path traversal blocked: %s", name)
 	}
 
+	// Names may contain folders (e.g. per-message folders from mbox).
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+
 	if err := os.WriteFile(outPath, data, 0o644); err != nil {
 		return fmt.Errorf("writing %s: %w", outPath, err)
 	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(outPath, modTime, modTime); err != nil {
+			return fmt.Errorf("setting times on %s: %w", outPath, err)
+		}
+	}
 	fmt.Printf("Extracted: %s (%s)\n", outPath, humanSize(len(data)))
 	return nil
 }
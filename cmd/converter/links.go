@@ -0,0 +1,85 @@
+// links.go implements the CLI "links" command that lists the hyperlinks
+// of a message's bodies with their real targets and phishing indicators.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+// cmdLinks converts a message without network access and prints the
+// links.json reports of it and its nested messages, as text or, with
+// --json, as a single JSON array.
+func cmdLinks(args []string) {
+	asJSON := false
+	var file string
+	for _, a := range args {
+		if a == "--json" {
+			asJSON = true
+		} else if file == "" {
+			file = a
+		}
+	}
+	if file == "" {
+		requireFile(nil)
+	}
+	opts := convertOptions()
+	opts.Offline = true
+	opts.Placeholders = false
+
+	links := []formats.Link{}
+	for _, f := range convertFileWith(file, opts) {
+		if base := path.Base(f.Name); f.Category != formats.CategoryBody ||
+			base != "links.json" && !strings.HasSuffix(base, "_links.json") {
+			continue
+		}
+		var found []formats.Link
+		if err := json.Unmarshal(f.Data, &found); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", f.Name, err)
+			os.Exit(1)
+		}
+		for i := range found {
+			if dir := path.Dir(f.Name); dir != "." {
+				found[i].Body = dir + "/" + found[i].Body
+			}
+		}
+		links = append(links, found...)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(links)
+		return
+	}
+	if len(links) == 0 {
+		fmt.Println("No links found")
+		return
+	}
+	for i, l := range links {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(l.Target)
+		if l.Text != "" {
+			fmt.Printf("    %-9s%s\n", "Text:", l.Text)
+		}
+		if len(l.Wrappers) > 0 {
+			fmt.Printf("    %-9s%s (%s)\n", "Via:", strings.Join(l.Wrappers, ", "), l.URL)
+		}
+		if l.UnicodeHost != "" {
+			fmt.Printf("    %-9s%s (%s)\n", "Host:", l.Host, l.UnicodeHost)
+		}
+		if len(l.Flags) > 0 {
+			fmt.Printf("    %-9s%s\n", "Flags:", strings.Join(l.Flags, ", "))
+		}
+		fmt.Printf("    %-9s%s\n", "Body:", l.Body)
+	}
+}
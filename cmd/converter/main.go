@@ -1,13 +1,26 @@
 // Converter is a CLI tool and HTTP server for converting and extracting
-// the contents of TNEF (winmail.dat) email attachments.
+// the contents of TNEF (winmail.dat), Outlook .msg, MIME .eml, mbox, and
+// Outlook .pst email files, RTF bodies, and ZIP, tar, and gzip archives.
 package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/avaropoint/converter/formats"
+	_ "github.com/avaropoint/converter/formats/archive"
+	_ "github.com/avaropoint/converter/formats/eml"
+	_ "github.com/avaropoint/converter/formats/mbox"
+	_ "github.com/avaropoint/converter/formats/msg"
+	_ "github.com/avaropoint/converter/formats/pst"
+	_ "github.com/avaropoint/converter/formats/rtf"
 	_ "github.com/avaropoint/converter/formats/tnef"
+	"github.com/avaropoint/converter/parsers/smime"
 )
 
 // version is the application version, embedded in API responses and used
@@ -24,19 +37,72 @@ Usage:
   converter extract <file> [output_dir] Extract attachments
   converter body    <file> [output_dir] Extract message body
   converter dump    <file> [output_dir] Extract everything
+  converter links   <file> [--json]     List links with unwrapped targets
+                                        and phishing indicators (offline)
   converter serve   [port] [options]    Start web interface (default port 8080)
   converter help                        Show this help message
 
+Options:
+  --max-depth <n>     Expand nested convertible attachments (a winmail.dat
+                      inside an .eml, a .msg inside a zip) up to n levels
+                      deep; 0 disables expansion (default %d)
+  --smime-roots <pem> Verify S/MIME signer certificates against the roots
+                      in this PEM file instead of the system roots
+  --smime-key <pem>   Decrypt S/MIME encrypted messages with this RSA
+                      private key (requires --smime-cert; not
+                      available with serve)
+  --smime-cert <pem>  Certificate matching --smime-key
+  --offline           Never access the network: external images are not
+                      fetched and are listed in blocked_images.txt
+  --placeholder-images
+                      With --offline, replace external images with a
+                      local placeholder image
+  --keep-trackers     Keep tracking images (1x1 pixels, known trackers) in
+                      HTML bodies instead of removing them and listing them
+                      in privacy_report.txt
+  --sanitize          Also write a sanitized copy of each HTML body
+                      (body.sanitized.html) without scripts, forms, or
+                      remote stylesheets, safe to open in a browser
+  --defang            Also write defanged copies of the bodies for analysts
+                      (body.defanged.html, body.defanged.txt): links are
+                      not clickable and URLs read hxxps://example[.]com;
+                      HTML-only messages get their text from the HTML
+  --image-proxy <url> Fetch external images through this HTTP proxy; "env"
+                      uses HTTPS_PROXY, HTTP_PROXY, and NO_PROXY
+  --image-allow <domains>
+                      Only fetch external images from these comma-separated
+                      domains and their subdomains
+  --image-cache <dir> Cache fetched external images in this directory
+  --ssrf-policy <json>
+                      Load allowed and denied address ranges, hostname
+                      patterns, and ports for image fetches from this file
+
 Serve options:
   --base-path <path>  Serve under a URL prefix (e.g. /converter)
 
 Examples:
   converter view winmail.dat
+  converter view message.msg
+  converter dump message.eml ./output
+  converter dump archive.mbox ./output
+  converter view mailbox.pst
+  converter dump mailbox.pst ./output
+  converter dump attachments.zip ./output
+  converter body body.rtf ./output
+  converter view signed.eml --smime-roots roots.pem
+  converter dump encrypted.eml ./output --smime-key key.pem --smime-cert cert.pem
+  converter dump message.eml ./output --offline
+  converter dump message.msg ./output --sanitize
+  converter dump winmail.dat ./output --defang --offline
   converter extract winmail.dat ./output
+  converter links winmail.dat
   converter dump winmail.dat ./output
   converter serve 9090
   converter serve 8080 --base-path /converter
-`, version)
+  converter serve 8080 --offline --placeholder-images
+  converter serve 8080 --image-proxy env --image-cache /tmp/images
+  converter serve 8080 --ssrf-policy /etc/converter/ssrf.json
+`, version, formats.DefaultMaxDepth)
 }
 
 func main() {
@@ -46,7 +112,7 @@ func main() {
 	}
 
 	cmd := strings.ToLower(os.Args[1])
-	args := os.Args[2:]
+	args := parseOptions(os.Args[2:])
 
 	switch cmd {
 	case "help", "-h", "--help":
@@ -67,7 +133,15 @@ func main() {
 	case "dump":
 		requireFile(args)
 		cmdDump(args[0], outputDir(args))
+	case "links":
+		requireFile(args)
+		cmdLinks(args)
 	case "serve", "server", "web":
+		if smimeIdentity != nil {
+			// Every upload would be decrypted with the operator's key.
+			fmt.Fprintln(os.Stderr, "Error: --smime-key cannot be used with serve: it would decrypt anything uploaded for that key")
+			os.Exit(1)
+		}
 		port := "8080"
 		basePath := ""
 		for i := 0; i < len(args); i++ {
@@ -86,6 +160,137 @@ func main() {
 	}
 }
 
+// parseOptions applies the options shared by all commands and returns
+// the remaining arguments.
+func parseOptions(args []string) []string {
+	var rest []string
+	var keyPath, certPath string
+	var proxy, allow, cacheDir string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--max-depth" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "Error: invalid --max-depth %q\n", args[i+1])
+				os.Exit(1)
+			}
+			maxDepth = n
+			i++
+			continue
+		}
+		if args[i] == "--smime-roots" && i+1 < len(args) {
+			pool, err := smime.LoadRoots(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			smimeRoots = pool
+			i++
+			continue
+		}
+		if args[i] == "--offline" {
+			offline = true
+			continue
+		}
+		if args[i] == "--placeholder-images" {
+			placeholderImages = true
+			continue
+		}
+		if args[i] == "--keep-trackers" {
+			keepTrackers = true
+			continue
+		}
+		if args[i] == "--sanitize" {
+			sanitize = true
+			continue
+		}
+		if args[i] == "--defang" {
+			defang = true
+			continue
+		}
+		if args[i] == "--image-proxy" && i+1 < len(args) {
+			proxy = args[i+1]
+			i++
+			continue
+		}
+		if args[i] == "--image-allow" && i+1 < len(args) {
+			allow = args[i+1]
+			i++
+			continue
+		}
+		if args[i] == "--image-cache" && i+1 < len(args) {
+			cacheDir = args[i+1]
+			i++
+			continue
+		}
+		if args[i] == "--ssrf-policy" && i+1 < len(args) {
+			policy, err := formats.LoadSSRFPolicy(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			formats.DefaultSSRFPolicy = policy
+			i++
+			continue
+		}
+		if args[i] == "--smime-key" && i+1 < len(args) {
+			keyPath = args[i+1]
+			i++
+			continue
+		}
+		if args[i] == "--smime-cert" && i+1 < len(args) {
+			certPath = args[i+1]
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	if keyPath != "" || certPath != "" {
+		if keyPath == "" || certPath == "" {
+			fmt.Fprintln(os.Stderr, "Error: --smime-key and --smime-cert must be used together")
+			os.Exit(1)
+		}
+		id, err := smime.LoadIdentity(keyPath, certPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		smimeIdentity = id
+	}
+	if proxy != "" || allow != "" || cacheDir != "" {
+		fetcher = newFetcher(proxy, allow, cacheDir)
+	}
+	return rest
+}
+
+// newFetcher builds the image fetcher for the --image-* options: an
+// allowlist in front of a process-wide memory cache, a disk cache and
+// the HTTP fetcher, with the allowlist and disk cache present only if
+// configured.
+func newFetcher(proxy, allow, cacheDir string) formats.ImageFetcher {
+	var selectProxy func(*http.Request) (*url.URL, error)
+	switch proxy {
+	case "":
+	case "env":
+		selectProxy = http.ProxyFromEnvironment
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			fmt.Fprintln(os.Stderr, "Error: invalid --image-proxy URL")
+			os.Exit(1)
+		}
+		selectProxy = http.ProxyURL(u)
+	}
+	var f formats.ImageFetcher = formats.NewHTTPFetcher(selectProxy)
+	if cacheDir != "" {
+		f = &formats.DiskCacheFetcher{Dir: cacheDir, MaxAge: 24 * time.Hour, Next: f}
+	}
+	f = &formats.LRUCacheFetcher{TTL: time.Hour, Next: f}
+	if allow != "" {
+		f = &formats.AllowlistFetcher{Domains: strings.Split(allow, ","), Next: f}
+	}
+	return f
+}
+
 // requireFile exits with an error if no file argument was provided.
 func requireFile(args []string) {
 	if len(args) < 1 {
@@ -5,12 +5,15 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -28,6 +31,10 @@ import (
 	"github.com/avaropoint/converter/web"
 )
 
+// convertTimeout bounds a single conversion request, leaving time to
+// write the response within the server's write timeout.
+const convertTimeout = 45 * time.Second
+
 // session holds the extracted files for a single conversion.
 type session struct {
 	files   []extractedFile
@@ -36,10 +43,23 @@ type session struct {
 
 // extractedFile is a single file produced by conversion.
 type extractedFile struct {
-	Name string `json:"name"`
-	Size int    `json:"size"`
-	Type string `json:"type"`
-	data []byte
+	Name         string     `json:"name"`
+	Size         int        `json:"size"`
+	Type         string     `json:"type"` // Icon category derived from MIMEType.
+	MIMEType     string     `json:"mimeType"`
+	Category     string     `json:"category"`
+	SHA256       string     `json:"sha256"`
+	OriginalName string     `json:"originalName,omitempty"`
+	ContentID    string     `json:"contentId,omitempty"`
+	Inline       bool       `json:"inline,omitempty"`
+	Hidden       bool       `json:"hidden,omitempty"`
+	Parent       string     `json:"parent,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	Modified     *time.Time `json:"modified,omitempty"`
+	Icon         string     `json:"icon,omitempty"` // PNG data URI of the source's own icon.
+	data         []byte
+	modTime      time.Time
 }
 
 // sessionStore manages in-memory conversion results.
@@ -244,6 +264,14 @@ func cmdServe(port, basePath string) {
 	}))
 	slog.SetDefault(logger)
 
+	if offline {
+		slog.Info("offline mode: external images will not be fetched", "placeholders", placeholderImages)
+	} else {
+		p := formats.DefaultSSRFPolicy
+		slog.Info("ssrf policy", "allow", p.Allow, "deny", p.Deny,
+			"allowHosts", p.AllowHosts, "denyHosts", p.DenyHosts, "ports", p.Ports)
+	}
+
 	store := newSessionStore()
 	limiter := newRateLimiter(10, 2)      // 10 burst, 2/sec refill (convert)
 	fileLimiter := newRateLimiter(30, 10) // 30 burst, 10/sec refill (file access)
@@ -422,7 +450,7 @@ func handleIndex(basePath string) http.HandlerFunc {
 func handleInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-store")
-	json.NewEncoder(w).Encode(map[string]string{"version": version})
+	json.NewEncoder(w).Encode(map[string]any{"version": version, "offline": offline})
 }
 
 // convertResponse is the JSON returned after a successful conversion.
@@ -469,7 +497,17 @@ func handleConvert(store *sessionStore, limiter *rateLimiter, hmacKey []byte) ht
 			return
 		}
 
-		items, err := conv.Convert(data)
+		// Bound the conversion, including any image fetches, so a slow
+		// remote server cannot hold the request open.
+		ctx, cancel := context.WithTimeout(r.Context(), convertTimeout)
+		defer cancel()
+		opts := convertOptions()
+		opts.Logger = slog.Default().With("filename", header.Filename)
+		items, err := formats.ExpandWithOptions(ctx, conv, bytes.NewReader(data), opts)
+		if errors.Is(err, context.DeadlineExceeded) {
+			jsonError(w, "Conversion timed out", http.StatusGatewayTimeout)
+			return
+		}
 		if err != nil {
 			jsonError(w, "Conversion failed: "+err.Error(), http.StatusBadRequest)
 			return
@@ -483,10 +521,25 @@ func handleConvert(store *sessionStore, limiter *rateLimiter, hmacKey []byte) ht
 		files := make([]extractedFile, len(items))
 		for i, item := range items {
 			files[i] = extractedFile{
-				Name: item.Name,
-				Size: len(item.Data),
-				Type: guessType(item.Name),
-				data: item.Data,
+				Name:         item.Name,
+				Size:         len(item.Data),
+				Type:         fileType(item.MIMEType),
+				MIMEType:     item.MIMEType,
+				Category:     string(item.Category),
+				SHA256:       item.SHA256,
+				OriginalName: item.OriginalName,
+				ContentID:    item.ContentID,
+				Inline:       item.Inline,
+				Hidden:       item.Hidden,
+				Parent:       item.Parent,
+				Source:       item.Source,
+				Created:      optionalTime(item.Created),
+				Modified:     optionalTime(item.Modified),
+				data:         item.Data,
+				modTime:      item.ModTime(),
+			}
+			if len(item.Icon) > 0 {
+				files[i].Icon = "data:image/png;base64," + base64.StdEncoding.EncodeToString(item.Icon)
 			}
 		}
 
@@ -547,13 +600,13 @@ func handleFile(store *sessionStore, hmacKey []byte, limiter *rateLimiter) http.
 
 		for _, f := range sess.files {
 			if f.Name == name {
-				ct := contentType(f.Name, f.Type)
+				ct := servedType(f.MIMEType)
 				w.Header().Set("Content-Type", ct)
 				w.Header().Set("Content-Disposition", safeDisposition(f.Name))
 				w.Header().Set("Cache-Control", "private, no-store")
 				// Extracted HTML may contain malicious scripts;
 				// block execution with a strict CSP.
-				if f.Type == "html" {
+				if f.MIMEType == "text/html" {
 					w.Header().Set("Content-Security-Policy",
 						"default-src 'none'; style-src 'unsafe-inline'; img-src data:; frame-ancestors 'none'")
 				}
@@ -603,7 +656,11 @@ func handleZip(store *sessionStore, hmacKey []byte, limiter *rateLimiter) http.H
 		// Stream zip directly to the response writer (no buffering).
 		zw := zip.NewWriter(w)
 		for _, f := range sess.files {
-			fw, err := zw.Create(f.Name)
+			fh := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.modTime}
+			if f.modTime.IsZero() {
+				fh.Modified = sess.created
+			}
+			fw, err := zw.CreateHeader(fh)
 			if err != nil {
 				break
 			}
@@ -622,68 +679,58 @@ func jsonError(w http.ResponseWriter, msg string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
-// guessType returns a short type category string based on file extension.
-func guessType(name string) string {
-	lower := strings.ToLower(name)
+// fileType returns the short category the web interface uses to pick
+// a file icon for a MIME type.
+func fileType(mimeType string) string {
 	switch {
-	case strings.HasSuffix(lower, ".html") || strings.HasSuffix(lower, ".htm"):
+	case mimeType == "text/html":
 		return "html"
-	case strings.HasSuffix(lower, ".txt"):
+	case mimeType == "text/plain":
 		return "text"
-	case strings.HasSuffix(lower, ".rtf"):
+	case mimeType == "application/rtf":
 		return "rtf"
-	case strings.HasSuffix(lower, ".png"):
-		return "image"
-	case strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".jpeg"):
-		return "image"
-	case strings.HasSuffix(lower, ".gif"):
+	case strings.HasPrefix(mimeType, "image/"):
 		return "image"
-	case strings.HasSuffix(lower, ".pdf"):
+	case mimeType == "application/pdf":
 		return "pdf"
-	case strings.HasSuffix(lower, ".doc") || strings.HasSuffix(lower, ".docx"):
+	case mimeType == "application/msword", strings.Contains(mimeType, "wordprocessingml"),
+		mimeType == "application/vnd.oasis.opendocument.text":
 		return "document"
-	case strings.HasSuffix(lower, ".xls") || strings.HasSuffix(lower, ".xlsx"):
+	case mimeType == "application/vnd.ms-excel", strings.Contains(mimeType, "spreadsheetml"),
+		mimeType == "application/vnd.oasis.opendocument.spreadsheet":
 		return "spreadsheet"
+	case mimeType == "application/internet-shortcut":
+		return "link"
 	default:
 		return "file"
 	}
 }
 
-// contentType maps a type category from guessType to a MIME content type.
-func contentType(name, fileType string) string {
-	switch fileType {
-	case "html":
+// servedType returns the Content-Type header for serving a file of the
+// given MIME type. Only types that browsers render safely are served
+// as themselves; HTML is served with a restrictive CSP and everything
+// else, including SVG, is served as an opaque download.
+func servedType(mimeType string) string {
+	switch mimeType {
+	case "text/html":
 		return "text/html; charset=utf-8"
-	case "text":
+	case "text/plain", "application/internet-shortcut":
 		return "text/plain; charset=utf-8"
-	case "rtf":
-		return "application/rtf"
-	case "image":
-		return imageMIME(name)
-	case "pdf":
-		return "application/pdf"
+	case "application/rtf", "application/pdf",
+		"image/png", "image/jpeg", "image/gif", "image/bmp", "image/webp":
+		return mimeType
 	default:
 		return "application/octet-stream"
 	}
 }
 
-// imageMIME returns the MIME type for an image file based on its extension.
-func imageMIME(name string) string {
-	lower := strings.ToLower(name)
-	switch {
-	case strings.HasSuffix(lower, ".jpg"), strings.HasSuffix(lower, ".jpeg"):
-		return "image/jpeg"
-	case strings.HasSuffix(lower, ".gif"):
-		return "image/gif"
-	case strings.HasSuffix(lower, ".bmp"):
-		return "image/bmp"
-	case strings.HasSuffix(lower, ".webp"):
-		return "image/webp"
-	case strings.HasSuffix(lower, ".svg"):
-		return "image/svg+xml"
-	default:
-		return "image/png"
+// optionalTime returns a pointer to t, or nil if t is zero, so unknown
+// times are omitted from JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
 }
 
 // safeDisposition returns a Content-Disposition header value with the
@@ -1,5 +1,6 @@
 // view.go implements the CLI "view" command that displays the structure
-// and metadata of a TNEF file.
+// and metadata of a message file (TNEF, Outlook .msg, or MIME .eml) or
+// the folder tree of a mailbox (Outlook .pst).
 
 package main
 
@@ -10,10 +11,30 @@ import (
 	"strings"
 
 	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/parsers/eml"
+	"github.com/avaropoint/converter/parsers/pst"
 	"github.com/avaropoint/converter/parsers/tnef"
 )
 
-// cmdView decodes a TNEF file and prints its structure to stdout.
+// messageDecoder is implemented by converters whose formats decode into
+// the TNEF message model, allowing view to print their structure.
+type messageDecoder interface {
+	Decode(data []byte) (*tnef.Message, error)
+}
+
+// optionsDecoder is implemented by message decoders whose result depends
+// on conversion options, such as S/MIME decryption of .eml files.
+type optionsDecoder interface {
+	DecodeWithOptions(data []byte, opts formats.Options) (*tnef.Message, error)
+}
+
+// mailboxDecoder is implemented by converters for mailbox files that
+// hold a folder hierarchy, allowing view to print the folder tree.
+type mailboxDecoder interface {
+	DecodeFolders(data []byte) (*pst.Folder, error)
+}
+
+// cmdView decodes a message file and prints its structure to stdout.
 func cmdView(path string) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -32,7 +53,30 @@ func cmdView(path string) {
 	}
 	fmt.Printf("Format:      %s\n", conv.Name())
 	fmt.Println(strings.Repeat("─", 60))
-	msg, err := tnef.Decode(data)
+	if mb, ok := conv.(mailboxDecoder); ok {
+		root, err := mb.DecodeFolders(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding: %v\n", err)
+			os.Exit(1)
+		}
+		printFolder(root, "")
+		return
+	}
+	if od, ok := conv.(optionsDecoder); ok {
+		msg, err := od.DecodeWithOptions(data, convertOptions())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding: %v\n", err)
+			os.Exit(1)
+		}
+		printMessage(msg, "")
+		return
+	}
+	dec, ok := conv.(messageDecoder)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "View is not supported for %s files\n", conv.Name())
+		os.Exit(1)
+	}
+	msg, err := dec.Decode(data)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error decoding: %v\n", err)
 		os.Exit(1)
@@ -49,6 +93,14 @@ func methodStr(m int) string {
 		return "embedded message"
 	case tnef.AttachOLE:
 		return "OLE object"
+	case tnef.AttachByReference:
+		return "reference"
+	case tnef.AttachByRefResolve:
+		return "reference, resolve"
+	case tnef.AttachByRefOnly:
+		return "reference only"
+	case tnef.AttachByWebRef:
+		return "web reference"
 	default:
 		return fmt.Sprintf("method=%d", m)
 	}
@@ -56,6 +108,7 @@ func methodStr(m int) string {
 
 // printMessage recursively prints a decoded TNEF message and its attachments.
 func printMessage(msg *tnef.Message, indent string) {
+	eml.UnwrapSMIME(msg, eml.Options{Roots: smimeRoots, Recipient: smimeIdentity})
 	divider := indent + strings.Repeat("─", 60-len(indent))
 	fields := []struct {
 		label string
@@ -72,6 +125,16 @@ func printMessage(msg *tnef.Message, indent string) {
 			fmt.Printf("%s%-13s%s\n", indent, f.label+":", f.value)
 		}
 	}
+	if msg.Encrypted {
+		if msg.DecryptError != "" {
+			fmt.Printf("%sEncrypted:   Yes (not decrypted: %s)\n", indent, msg.DecryptError)
+		} else {
+			fmt.Printf("%sEncrypted:   Yes (decrypted)\n", indent)
+		}
+	}
+	for _, sig := range msg.Signatures {
+		fmt.Printf("%sSigned by:   %s\n", indent, signatureStr(sig))
+	}
 	if len(msg.Body) > 0 {
 		fmt.Printf("%sBody:        Plain text (%s)\n", indent, humanSize(len(msg.Body)))
 	}
@@ -94,9 +157,102 @@ func printMessage(msg *tnef.Message, indent string) {
 	for i, att := range msg.Attachments {
 		name := att.Filename()
 		fmt.Printf("%s  %d. %-36s %8s  [%s]\n", indent, i+1, name, humanSize(len(att.Data)), methodStr(att.Method))
+		if att.IsReference() && att.Pathname != "" {
+			fmt.Printf("%s     Target:    %s\n", indent, att.Pathname)
+		}
+		if att.ProviderType != "" {
+			fmt.Printf("%s     Provider:  %s\n", indent, att.ProviderType)
+		}
+		if r := att.Rendering; r != nil {
+			pos := "hidden"
+			if r.Position != 0xFFFFFFFF {
+				pos = fmt.Sprintf("position %d", r.Position)
+			}
+			fmt.Printf("%s     Rendering: %s, %s, %dx%d\n", indent, r.TypeName(), pos, r.Width, r.Height)
+		}
+		if len(att.MetaFile) > 0 {
+			fmt.Printf("%s     Icon:      WMF (%s)\n", indent, humanSize(len(att.MetaFile)))
+		}
+		if !att.Created.IsZero() {
+			fmt.Printf("%s     Created:   %s\n", indent, att.Created.Format("2006-01-02 15:04:05 MST"))
+		}
+		if !att.Modified.IsZero() {
+			fmt.Printf("%s     Modified:  %s\n", indent, att.Modified.Format("2006-01-02 15:04:05 MST"))
+		}
+		if d := attachDisposition(att); d != "" {
+			fmt.Printf("%s     Flags:     %s\n", indent, d)
+		}
 		if att.EmbeddedMsg != nil {
 			fmt.Printf("%s     └─ Embedded message:\n", indent)
 			printMessage(att.EmbeddedMsg, indent+"        ")
 		}
 	}
 }
+
+// signatureStr describes an S/MIME signer and its verification status.
+func signatureStr(sig *tnef.Signature) string {
+	who := sig.Signer
+	if sig.Email != "" {
+		who += " <" + sig.Email + ">"
+	}
+	if who == "" {
+		who = "unknown signer"
+	}
+	status := "valid, trusted"
+	switch {
+	case !sig.Valid:
+		status = "INVALID"
+	case !sig.Trusted:
+		status = "valid, untrusted"
+	}
+	if sig.Issuer != "" {
+		status += ", issued by " + sig.Issuer
+	}
+	if !sig.SigningTime.IsZero() {
+		status += ", signed " + sig.SigningTime.Format("2006-01-02 15:04:05 MST")
+	}
+	if sig.Error != "" {
+		status += ": " + sig.Error
+	}
+	return strings.TrimSpace(who) + " (" + status + ")"
+}
+
+// attachDisposition summarises an attachment's hidden, inline, and
+// PR_ATTACH_FLAGS state, plus its recorded size and content location.
+func attachDisposition(att *tnef.Attachment) string {
+	var parts []string
+	if att.Hidden {
+		parts = append(parts, "hidden")
+	}
+	if att.Inline() {
+		parts = append(parts, "inline")
+	}
+	if att.Flags&tnef.AttachInvisibleInHTML != 0 {
+		parts = append(parts, "invisible-in-html")
+	}
+	if att.Flags&tnef.AttachInvisibleInRTF != 0 {
+		parts = append(parts, "invisible-in-rtf")
+	}
+	if att.Flags&tnef.AttachMHTMLRef != 0 {
+		parts = append(parts, "mhtml-ref")
+	}
+	if att.Size > 0 {
+		parts = append(parts, "object size "+humanSize(att.Size))
+	}
+	if att.ContentLocation != "" {
+		parts = append(parts, "location "+att.ContentLocation)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printFolder recursively prints a mailbox folder tree with message counts.
+func printFolder(f *pst.Folder, indent string) {
+	name := f.Name
+	if name == "" {
+		name = "(root)"
+	}
+	fmt.Printf("%s%s (%d messages)\n", indent, name, len(f.Messages))
+	for _, child := range f.Children {
+		printFolder(child, indent+"  ")
+	}
+}
@@ -0,0 +1,170 @@
+// Package archive implements ZIP, tar, and gzip converters. They are
+// automatically registered with the formats registry on import.
+//
+// Every regular file in an archive is extracted under its archive path.
+// Nested archives are kept and expanded under "<entry path>_contents/",
+// as formats.Expand names the contents of any attachment. Other
+// recognized entries (a winmail.dat, an .eml) are left to formats.Expand
+// like any attachment; archives found inside them still share the
+// extraction limits below through formats.Options.ArchiveBudget.
+//
+// Extraction is bounded against decompression bombs: the number of
+// entries, the total extracted size, the compression ratio, and the
+// archive nesting depth are all capped. The ratio is checked both for
+// each entry and for all compressed entries together, so many small
+// entries cannot add up to a bomb. Sizes declared in archive headers are
+// never trusted; every read goes through a limited reader.
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+// Extraction limits shared by one top-level conversion, including every
+// nested archive and every archive inside a nested attachment.
+const (
+	maxEntries   = 10000     // Files across all nested archives.
+	maxTotalSize = 512 << 20 // Extracted bytes across all nested archives.
+	maxRatio     = 100       // Uncompressed-to-compressed size ratio.
+	minRatioSize = 1 << 20   // Sizes below this skip the ratio check.
+	maxDepth     = 4         // Archives nested inside the top-level archive.
+)
+
+// Errors returned when an archive exceeds the extraction limits.
+var (
+	ErrTooManyEntries = errors.New("archive contains too many entries")
+	ErrTooLarge       = errors.New("archive expands beyond the size limit")
+	ErrRatio          = errors.New("archive entry exceeds the compression ratio limit")
+	ErrTooDeep        = errors.New("archives nested too deeply")
+)
+
+// budget tracks the limits consumed by one top-level conversion, in the
+// formats.ArchiveBudget its options carry to nested conversions.
+type budget struct {
+	*formats.ArchiveBudget
+}
+
+// add counts one more extracted entry.
+func (b *budget) add() error {
+	b.Entries++
+	if b.Entries > maxEntries {
+		return ErrTooManyEntries
+	}
+	return nil
+}
+
+// read reads an entry from r, enforcing the total size limit and, when
+// compressed is positive, the compression ratio limit for the entry and
+// for the running total. The entry limit caps the read itself, so a bomb
+// is rejected before more than its allowed size is decompressed.
+func (b *budget) read(r io.Reader, compressed int64) ([]byte, error) {
+	remaining := maxTotalSize - b.Total
+	limit := remaining
+	if compressed > 0 && compressed <= remaining/maxRatio {
+		limit = min(remaining, max(compressed*maxRatio, minRatioSize))
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(data))
+	if n > limit {
+		if limit < remaining {
+			return nil, ErrRatio
+		}
+		return nil, ErrTooLarge
+	}
+	if compressed > 0 {
+		b.Packed += compressed
+		b.Unpacked += n
+		if b.Unpacked > minRatioSize && b.Unpacked/b.Packed > maxRatio {
+			return nil, ErrRatio
+		}
+	}
+	b.Total += n
+	return data, nil
+}
+
+// extractor is implemented by the converters in this package so that
+// nested archives share the parent's budget and depth.
+type extractor interface {
+	extract(data []byte, b *budget, depth int) ([]formats.ConvertedFile, error)
+}
+
+// convert extracts the archive read from r with the budget of opts.
+func convert(ctx context.Context, ex extractor, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := ex.extract(data, &budget{opts.ArchiveBudget()}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return files, ctx.Err()
+}
+
+// expand returns the output files for one extracted entry: the raw
+// entry, followed by the contents of a nested archive under
+// "<name>_contents/".
+func expand(name string, data []byte, b *budget, depth int) ([]formats.ConvertedFile, error) {
+	raw := []formats.ConvertedFile{{Name: name, Data: data, Category: formats.CategoryAttachment}}
+	ex, ok := formats.Detect(path.Base(name), data).(extractor)
+	if !ok {
+		return raw, nil
+	}
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	files, err := ex.extract(data, b, depth)
+	if isLimit(err) {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err != nil || len(files) == 0 {
+		return raw, nil
+	}
+	dir := name + formats.ExpandedSuffix
+	for i := range files {
+		if files[i].Parent == "" {
+			files[i].Parent = name
+		} else {
+			files[i].Parent = dir + "/" + files[i].Parent
+		}
+		files[i].Name = dir + "/" + files[i].Name
+	}
+	return append(raw, files...), nil
+}
+
+// isLimit reports whether err is an extraction limit violation, which
+// aborts the whole conversion rather than falling back to the raw entry.
+func isLimit(err error) bool {
+	return errors.Is(err, ErrTooManyEntries) || errors.Is(err, ErrTooLarge) ||
+		errors.Is(err, ErrRatio) || errors.Is(err, ErrTooDeep)
+}
+
+// entryPath turns an archive entry name into a safe relative output path.
+// Absolute paths, "." and ".." components, and backslash separators are
+// neutralized; each remaining component is sanitized.
+func entryPath(name string) string {
+	var parts []string
+	for _, p := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		parts = append(parts, formats.SanitizeFilename(p))
+	}
+	if len(parts) == 0 {
+		return "unnamed"
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func makeZip(t *testing.T, entries map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, entries map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, data := range entries {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		w.Write(data)
+	}
+	w.WriteHeader(&tar.Header{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeGzip(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Name = name
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func names(files []formats.ConvertedFile) map[string]string {
+	out := make(map[string]string)
+	for _, f := range files {
+		out[f.Name] = string(f.Data)
+	}
+	return out
+}
+
+func TestZipNestedAndPaths(t *testing.T) {
+	inner := makeZip(t, map[string][]byte{"deep.txt": []byte("deep")})
+	data := makeZip(t, map[string][]byte{
+		"a.txt":         []byte("hello"),
+		"../../evil.sh": []byte("x"),
+		"dir/inner.zip": inner,
+	})
+	c := &zipConverter{}
+	if !c.Match(data) {
+		t.Fatal("expected Match to return true")
+	}
+	files, err := c.Convert(data)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	got := names(files)
+	for name, want := range map[string]string{
+		"a.txt":                           "hello",
+		"evil.sh":                         "x",
+		"dir/inner.zip":                   string(inner),
+		"dir/inner.zip_contents/deep.txt": "deep",
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %q, want %q (files %v)", name, got[name], want, got)
+		}
+	}
+
+	// Expand names nested contents the same way and does not expand
+	// the kept inner archive a second time.
+	files, err = formats.Expand(c, data, formats.DefaultMaxDepth)
+	if err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	if len(files) != 4 {
+		t.Errorf("Expand: %d files, want 4: %v", len(files), names(files))
+	}
+	for _, f := range files {
+		if f.Name == "dir/inner.zip_contents/deep.txt" && f.Parent != "dir/inner.zip" {
+			t.Errorf("deep.txt Parent = %q", f.Parent)
+		}
+	}
+}
+
+func TestZipSkipsDocuments(t *testing.T) {
+	docx := makeZip(t, map[string][]byte{"[Content_Types].xml": []byte("<Types/>")})
+	if (&zipConverter{}).Match(docx) {
+		t.Fatal("expected Match to return false for an Office document")
+	}
+}
+
+func TestTarGzip(t *testing.T) {
+	tarball := makeTar(t, map[string][]byte{"docs/readme.txt": []byte("read me")})
+	if !(&tarConverter{}).Match(tarball) {
+		t.Fatal("expected tar Match to return true")
+	}
+	c := &gzipConverter{}
+	data := makeGzip("bundle.tar", tarball)
+	if !c.Match(data) {
+		t.Fatal("expected gzip Match to return true")
+	}
+	files, err := c.Convert(data)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	got := names(files)
+	if len(got) != 1 || got["docs/readme.txt"] != "read me" {
+		t.Errorf("unexpected files: %v", got)
+	}
+
+	files, err = c.Convert(makeGzip("notes.txt", []byte("plain")))
+	if err != nil || len(files) != 1 || files[0].Name != "notes.txt" {
+		t.Errorf("plain gzip: files %v, err %v", files, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	bomb := makeZip(t, map[string][]byte{"zeros": make([]byte, 4<<20)})
+	if _, err := (&zipConverter{}).Convert(bomb); !errors.Is(err, ErrRatio) {
+		t.Errorf("ratio bomb: err = %v, want ErrRatio", err)
+	}
+	small := make([]byte, minRatioSize-1024)
+	spread := makeZip(t, map[string][]byte{"a": small, "b": small, "c": small})
+	if _, err := (&zipConverter{}).Convert(spread); !errors.Is(err, ErrRatio) {
+		t.Errorf("small entries: err = %v, want ErrRatio", err)
+	}
+
+	// A bomb is cut off at its ratio limit, not inflated to the size limit.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := (&budget{&formats.ArchiveBudget{}}).read(zeroReader{}, 4096)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrRatio) {
+		t.Errorf("endless entry: err = %v, want ErrRatio", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Errorf("endless entry: allocated %d bytes before rejecting it", alloc)
+	}
+
+	nested := []byte("core")
+	for i := 0; i < maxDepth+2; i++ {
+		nested = makeZip(t, map[string][]byte{"n.zip": nested})
+	}
+	if _, err := (&zipConverter{}).Convert(nested); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("nested archives: err = %v, want ErrTooDeep", err)
+	}
+}
+
+// zeroReader is an endless stream of zeros, like an inflating bomb.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
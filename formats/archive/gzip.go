@@ -0,0 +1,67 @@
+// gzip.go implements the gzip converter on compress/gzip. A gzip stream
+// holding a tar archive (.tar.gz, .tgz) is extracted as that archive.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func init() {
+	formats.Register(&gzipConverter{})
+}
+
+type gzipConverter struct{}
+
+func (c *gzipConverter) Name() string {
+	return "Gzip (.gz, .tgz)"
+}
+
+func (c *gzipConverter) Extensions() []string {
+	return []string{".gz", ".tgz"}
+}
+
+func (c *gzipConverter) Match(data []byte) bool {
+	return len(data) >= 3 && data[0] == 0x1f && data[1] == 0x8b && data[2] == 0x08
+}
+
+func (c *gzipConverter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *gzipConverter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	return convert(ctx, c, r, opts)
+}
+
+func (c *gzipConverter) extract(data []byte, b *budget, depth int) ([]formats.ConvertedFile, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	name := entryPath(zr.Name)
+	if zr.Name == "" {
+		name = "data"
+	}
+	if err := b.add(); err != nil {
+		return nil, err
+	}
+	inner, err := b.read(zr, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	// A compressed tarball is one archive, not two nested ones.
+	if isTar(inner) || strings.HasSuffix(strings.ToLower(name), ".tar") {
+		if files, err := (&tarConverter{}).extract(inner, b, depth); err == nil || isLimit(err) {
+			return files, err
+		}
+	}
+	return expand(name, inner, b, depth+1)
+}
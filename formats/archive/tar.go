@@ -0,0 +1,83 @@
+// tar.go implements the tar archive converter on archive/tar.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func init() {
+	formats.Register(&tarConverter{})
+}
+
+type tarConverter struct{}
+
+func (c *tarConverter) Name() string {
+	return "Tar Archive (.tar)"
+}
+
+func (c *tarConverter) Extensions() []string {
+	return []string{".tar"}
+}
+
+// Match accepts POSIX and GNU tar headers, identified by the "ustar"
+// magic at offset 257. Pre-POSIX archives are detected by extension.
+func (c *tarConverter) Match(data []byte) bool {
+	return isTar(data)
+}
+
+func (c *tarConverter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *tarConverter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	return convert(ctx, c, r, opts)
+}
+
+func (c *tarConverter) extract(data []byte, b *budget, depth int) ([]formats.ConvertedFile, error) {
+	tr := tar.NewReader(bytes.NewReader(data))
+	var files []formats.ConvertedFile
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if len(files) > 0 {
+				break // keep what was read before a truncated tail
+			}
+			return nil, err
+		}
+		// Only regular files; links and devices are never followed.
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := b.add(); err != nil {
+			return nil, err
+		}
+		entry, err := b.read(tr, 0)
+		if isLimit(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		out, err := expand(entryPath(hdr.Name), entry, b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, out...)
+	}
+	return files, nil
+}
+
+// isTar reports whether data starts with a ustar header.
+func isTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
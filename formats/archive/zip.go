@@ -0,0 +1,97 @@
+// zip.go implements the ZIP archive converter on archive/zip.
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func init() {
+	formats.Register(&zipConverter{})
+}
+
+type zipConverter struct{}
+
+func (c *zipConverter) Name() string {
+	return "ZIP Archive (.zip)"
+}
+
+func (c *zipConverter) Extensions() []string {
+	return []string{".zip"}
+}
+
+// Match accepts ZIP local file headers and empty archives, but not
+// Office Open XML, OpenDocument, or Java archives: those are documents
+// that happen to use ZIP as a container.
+func (c *zipConverter) Match(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		return true
+	}
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) || len(data) < 30 {
+		return false
+	}
+	n := int(binary.LittleEndian.Uint16(data[26:28]))
+	if 30+n > len(data) {
+		return true
+	}
+	first := string(data[30 : 30+n])
+	switch {
+	case first == "[Content_Types].xml", first == "mimetype",
+		first == "META-INF/", first == "META-INF/MANIFEST.MF":
+		return false
+	}
+	return true
+}
+
+func (c *zipConverter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *zipConverter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	return convert(ctx, c, r, opts)
+}
+
+func (c *zipConverter) extract(data []byte, b *budget, depth int) ([]formats.ConvertedFile, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var files []formats.ConvertedFile
+	for _, f := range r.File {
+		// Skip directories and encrypted entries, which cannot be read.
+		if f.FileInfo().IsDir() || f.Flags&0x1 != 0 {
+			continue
+		}
+		if err := b.add(); err != nil {
+			return nil, err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		compressed := int64(f.CompressedSize64)
+		if compressed == 0 {
+			compressed = 1
+		}
+		entry, err := b.read(rc, compressed)
+		rc.Close()
+		if isLimit(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		out, err := expand(entryPath(f.Name), entry, b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, out...)
+	}
+	return files, nil
+}
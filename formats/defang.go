@@ -0,0 +1,138 @@
+// defang.go produces "defanged" copies of message bodies for security
+// analysts: every URL, domain and address is rewritten so it can be read
+// and copied but neither clicked nor resolved, for example
+// hxxps://evil[.]example/login.
+
+package formats
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// defangSchemes maps URL schemes to their defanged form.
+var defangSchemes = map[string]string{
+	"http":  "hxxp",
+	"https": "hxxps",
+	"ftp":   "fxp",
+	"ftps":  "fxps",
+}
+
+// DefangURL returns rawURL in a form that is not recognised as a link:
+// http, https and ftp schemes become hxxp, hxxps and fxp, the dots of the
+// host become "[.]", and the @ of mailto addresses becomes "[@]".
+// Defanging a defanged URL leaves it unchanged.
+func DefangURL(rawURL string) string {
+	u := strings.TrimSpace(rawURL)
+	scheme, rest, ok := strings.Cut(u, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#[") {
+		return defangHost(u)
+	}
+	lower := strings.ToLower(scheme)
+	if lower == "mailto" {
+		addr, query, _ := strings.Cut(rest, "?")
+		out := scheme + ":" + defangEmail(addr)
+		if query != "" {
+			out += "?" + query
+		}
+		return out
+	}
+	if d, ok := defangSchemes[lower]; ok {
+		scheme = d
+	}
+	after, found := strings.CutPrefix(rest, "//")
+	if !found {
+		return scheme + ":" + rest
+	}
+	end := strings.IndexAny(after, "/?#")
+	if end < 0 {
+		end = len(after)
+	}
+	return scheme + "://" + defangHost(after[:end]) + after[end:]
+}
+
+// defangHost brackets the dots of a host, leaving brackets already
+// present alone.
+func defangHost(host string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(host, "[.]", "."), ".", "[.]")
+}
+
+// defangEmail brackets the @ and the domain dots of an email address.
+func defangEmail(addr string) string {
+	local, domain, ok := strings.Cut(strings.ReplaceAll(addr, "[@]", "@"), "@")
+	if !ok {
+		return addr
+	}
+	return local + "[@]" + defangHost(domain)
+}
+
+// defangTextRe matches the URLs, email addresses, and www. domains of
+// plain text.
+var defangTextRe = regexp.MustCompile(`(?i)\b(?:https?|ftps?)://[^\s<>"']+|[\w.+-]+@[\w-]+(?:\.[\w-]+)+|\bwww\.[\w-]+(?:\.[\w-]+)+`)
+
+// DefangText defangs every URL, email address, and www. domain in text.
+func DefangText(text []byte) []byte {
+	return defangTextRe.ReplaceAllFunc(text, func(m []byte) []byte {
+		s := string(m)
+		// Keep sentence punctuation that follows a URL out of it.
+		trimmed := strings.TrimRight(s, ".,;:!?)")
+		tail := s[len(trimmed):]
+		switch {
+		case strings.Contains(trimmed, "://"):
+			return []byte(DefangURL(trimmed) + tail)
+		case strings.Contains(trimmed, "@"):
+			return []byte(defangEmail(trimmed) + tail)
+		}
+		return []byte(defangHost(trimmed) + tail)
+	})
+}
+
+// DefangHTML returns a safe, non-clickable copy of html for analysis.
+// The body is first sanitized (see SanitizeHTML). Links lose their
+// href, and their defanged target is shown as a tooltip. Remote images
+// are replaced by PlaceholderImage, while images already embedded as
+// data URIs are kept so the body still renders. URLs, addresses and
+// domains in the text are defanged.
+func DefangHTML(html []byte) []byte {
+	html = RewriteURLs(SanitizeHTML(html), func(rawURL string, kind URLKind) string {
+		switch {
+		case kind == URLLink:
+			return rawURL // handled below, where the attribute can go
+		case kind == URLImage && isRemote(rawURL):
+			return PlaceholderImage
+		case kind == URLOther:
+			return DefangURL(rawURL)
+		}
+		return rawURL
+	})
+
+	var out bytes.Buffer
+	for _, t := range Tokenize(html) {
+		switch {
+		case t.Type == StartTagToken && (t.Tag == "a" || t.Tag == "area"):
+			if href, ok := t.Attr("href"); ok {
+				t.RemoveAttr("href")
+				t.RemoveAttr("target")
+				t.RemoveAttr("rel")
+				t.SetAttr("title", DefangURL(href))
+			}
+			out.Write(t.Bytes())
+		case t.Type == StartTagToken && t.Tag == "img":
+			// Tooltips and alternative text can hold URLs too.
+			for _, key := range []string{"alt", "title"} {
+				if v, ok := t.Attr(key); ok {
+					if d := string(DefangText([]byte(v))); d != v {
+						t.SetAttr(key, d)
+					}
+				}
+			}
+			out.Write(t.Bytes())
+		case t.Type == TextToken && (t.Tag == "" || t.Tag == "title"):
+			out.Write(DefangText(t.Raw))
+		default:
+			out.Write(t.Bytes())
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,116 @@
+// Package eml implements the MIME email (.eml) format converter.
+// It is automatically registered with the formats registry on import.
+//
+// Embedded application/ms-tnef (winmail.dat) parts are decoded and
+// converted along with the message, so their bodies and attachments
+// appear in the output without a second conversion step.
+package eml
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/formats/tnef"
+	parser "github.com/avaropoint/converter/parsers/eml"
+	tnefparser "github.com/avaropoint/converter/parsers/tnef"
+)
+
+// sniffLimit is how much of the input Match inspects for header lines.
+const sniffLimit = 8 << 10
+
+// knownHeaders are header fields that identify an email message. Match
+// requires at least two of them before the first blank line.
+var knownHeaders = map[string]bool{
+	"from": true, "to": true, "cc": true, "subject": true, "date": true,
+	"message-id": true, "mime-version": true, "received": true,
+	"return-path": true, "delivered-to": true, "reply-to": true,
+	"sender": true, "in-reply-to": true, "references": true,
+}
+
+func init() {
+	formats.Register(&converter{})
+}
+
+type converter struct{}
+
+func (c *converter) Name() string {
+	return "MIME Email (.eml)"
+}
+
+func (c *converter) Extensions() []string {
+	return []string{".eml"}
+}
+
+// Match sniffs the leading header block: every line up to the first
+// blank line must be a "Name: value" field or a folded continuation,
+// and at least two well-known email headers must be present.
+func (c *converter) Match(data []byte) bool {
+	if len(data) > sniffLimit {
+		data = data[:sniffLimit]
+	}
+	known := 0
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isFieldName(line[:colon]) {
+			return false
+		}
+		if knownHeaders[strings.ToLower(string(line[:colon]))] {
+			known++
+		}
+	}
+	return known >= 2
+}
+
+func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parser.DecodeWithOptions(data, tnef.EMLOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return tnef.ConvertMessageWithOptions(ctx, msg, opts)
+}
+
+// Decode parses data into a message without converting it, for callers
+// that want to inspect its structure.
+func (c *converter) Decode(data []byte) (*tnefparser.Message, error) {
+	return parser.Decode(data)
+}
+
+// DecodeWithOptions is Decode with the S/MIME settings of opts.
+func (c *converter) DecodeWithOptions(data []byte, opts formats.Options) (*tnefparser.Message, error) {
+	return parser.DecodeWithOptions(data, tnef.EMLOptions(opts))
+}
+
+// isFieldName reports whether b is a valid RFC 5322 header field name:
+// printable ASCII excluding space and colon.
+func isFieldName(b []byte) bool {
+	for _, ch := range b {
+		if ch <= ' ' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
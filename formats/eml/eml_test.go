@@ -0,0 +1,50 @@
+package eml
+
+import (
+	"testing"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func TestConverterName(t *testing.T) {
+	c := &converter{}
+	if c.Name() != "MIME Email (.eml)" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := &converter{}
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"From: a@example.com\r\nSubject: hi\r\n\r\nbody", true},
+		{"Received: from x\r\n\tby y\r\nX-Spam: no\nDate: Mon, 2 Mar 2026 10:00:00 +0000\n\nbody", true},
+		{"Subject: only one known header\r\n\r\n", false},
+		{"From a@example.com Mon Mar  2 10:00:00 2026\nSubject: x\n", false},
+		{"just some text\nFrom: x\nTo: y\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.Match([]byte(tt.input)); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	data := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n" +
+		"Content-Type: text/html\r\n\r\n<p>hello</p>")
+	c := formats.Detect("upload.bin", data)
+	if c == nil || c.Name() != "MIME Email (.eml)" {
+		t.Fatal("expected content sniffing to select the EML converter")
+	}
+	files, err := c.Convert(data)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "body.html" || string(files[0].Data) != "<p>hello</p>" {
+		t.Fatalf("unexpected output: %+v", files)
+	}
+}
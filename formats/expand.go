@@ -0,0 +1,97 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"path"
+)
+
+// DefaultMaxDepth is the nesting depth used by callers of Expand that do
+// not configure their own.
+const DefaultMaxDepth = 8
+
+// ExpandedSuffix is appended to an attachment's name to form the folder
+// holding its expanded outputs, so the attachment itself can be kept.
+// Converters that expand nested files themselves, such as archives
+// inside archives, use the same convention.
+const ExpandedSuffix = "_contents"
+
+// Expand converts data with conv and then recursively converts every
+// attachment output that Detect recognizes, such as a winmail.dat
+// attached to an .eml or a .msg stored inside a TNEF message.
+//
+// A recognized attachment is kept and followed by its own outputs, named
+// "<attachment name>_contents/<output name>" and with Parent set to the
+// attachment's name. If the attachment fails to convert, or nesting
+// would exceed maxDepth levels below the input, it is not expanded. Body
+// outputs are never expanded: they are renderings of the message itself.
+// Archives at every level share one set of extraction limits (see
+// ArchiveBudget). The returned files are annotated with their MIME types
+// and digests.
+func Expand(conv Converter, data []byte, maxDepth int) ([]ConvertedFile, error) {
+	ctx := context.Background()
+	opts := Options{}.withShared()
+	files, err := Adapt(conv).ConvertWithOptions(ctx, bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	x := expander{ctx: ctx, opts: opts}
+	files = x.expandFiles(files, 1, maxDepth)
+	Annotate(files)
+	return files, nil
+}
+
+// expander converts nested attachments with a shared context and options.
+type expander struct {
+	ctx  context.Context
+	opts Options
+}
+
+// expandFiles expands the recognized attachments in files, which were
+// produced at the given depth.
+func (x expander) expandFiles(files []ConvertedFile, depth, maxDepth int) []ConvertedFile {
+	if depth > maxDepth {
+		return files
+	}
+	// Files whose converter already expanded them are left alone.
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		for dir := path.Dir(f.Name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	var out []ConvertedFile
+	for _, f := range files {
+		out = append(out, f)
+		if !dirs[f.Name+ExpandedSuffix] {
+			out = append(out, x.expandFile(f, depth, maxDepth)...)
+		}
+	}
+	return out
+}
+
+// expandFile converts a single output, returning its expanded outputs or
+// nil if it is not expanded.
+func (x expander) expandFile(f ConvertedFile, depth, maxDepth int) []ConvertedFile {
+	if f.Category != CategoryAttachment || len(f.Data) == 0 || x.ctx.Err() != nil {
+		return nil
+	}
+	conv := Detect(path.Base(f.Name), f.Data)
+	if conv == nil {
+		return nil
+	}
+	children, err := ConvertWithOptions(x.ctx, conv, bytes.NewReader(f.Data), x.opts)
+	if err != nil || len(children) == 0 {
+		return nil
+	}
+	dir := f.Name + ExpandedSuffix
+	for i := range children {
+		if children[i].Parent == "" {
+			children[i].Parent = f.Name
+		} else {
+			children[i].Parent = dir + "/" + children[i].Parent
+		}
+		children[i].Name = dir + "/" + children[i].Name
+	}
+	return x.expandFiles(children, depth+1, maxDepth)
+}
@@ -0,0 +1,466 @@
+// fetch.go defines the ImageFetcher interface used to retrieve external
+// images and its implementations: an SSRF-safe HTTP fetcher (optionally
+// through a proxy), a domain allowlist, disk and in-memory LRU caches,
+// and an in-memory fetcher for tests.
+
+package formats
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image fetch errors.
+var (
+	ErrBlocked  = errors.New("fetch: blocked URL")
+	ErrNotImage = errors.New("fetch: not an image")
+	ErrNotFound = errors.New("fetch: not found")
+)
+
+// maxImageSize limits the size of a single fetched image.
+const maxImageSize = 5 << 20
+
+// ImageFetcher retrieves external images referenced by HTML bodies.
+type ImageFetcher interface {
+	// Fetch returns the image at rawURL and its Content-Type. It fails
+	// with ErrBlocked for URLs it refuses to fetch and ErrNotImage if
+	// the response is not an image.
+	Fetch(ctx context.Context, rawURL string) (data []byte, contentType string, err error)
+}
+
+// DefaultFetcher is used when no fetcher is configured: a direct,
+// SSRF-safe HTTP fetcher behind a process-wide memory cache, so images
+// shared by many messages, such as signature logos, are fetched once.
+var DefaultFetcher ImageFetcher = &LRUCacheFetcher{TTL: time.Hour, Next: NewHTTPFetcher(nil)}
+
+// HTTPFetcher fetches images over HTTP and HTTPS. Connections are made
+// only to destinations its SSRFPolicy allows: every resolved IP is
+// checked before connecting, which also defeats DNS rebinding.
+type HTTPFetcher struct {
+	// Policy decides which hosts, addresses and ports may be fetched
+	// from; nil means DefaultSSRFPolicy.
+	Policy *SSRFPolicy
+
+	client *http.Client
+	proxy  func(*http.Request) (*url.URL, error)
+
+	mu      sync.Mutex
+	proxies map[string]bool // host:port of proxies chosen by proxy
+}
+
+// NewHTTPFetcher returns an HTTPFetcher. If proxy is non-nil it selects
+// the proxy for each request, as http.Transport.Proxy does; pass
+// http.ProxyFromEnvironment to honour HTTPS_PROXY and NO_PROXY, or
+// http.ProxyURL for a fixed proxy. The proxy itself may be on a private
+// network. Image hosts are still checked before each request, but the
+// proxy resolves them again, so the proxy should enforce its own egress
+// rules.
+func NewHTTPFetcher(proxy func(*http.Request) (*url.URL, error)) *HTTPFetcher {
+	f := &HTTPFetcher{proxy: proxy, proxies: make(map[string]bool)}
+	transport := &http.Transport{
+		DialContext:           ssrfSafeDialer(f.isProxy, f.policy),
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	if proxy != nil {
+		transport.Proxy = f.selectProxy
+	}
+	f.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		// Validate each redirect target against the SSRF policy.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			// The dialer also checks the resolved IP, so even if the
+			// hostname looks benign, a private IP is still blocked.
+			return f.checkURL(req.Context(), req.URL)
+		},
+	}
+	return f
+}
+
+// selectProxy calls the configured proxy function and records the proxy
+// address so the dialer lets it through.
+func (f *HTTPFetcher) selectProxy(req *http.Request) (*url.URL, error) {
+	u, err := f.proxy(req)
+	if err != nil || u == nil {
+		return u, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	f.mu.Lock()
+	f.proxies[net.JoinHostPort(u.Hostname(), port)] = true
+	f.mu.Unlock()
+	return u, nil
+}
+
+// isProxy reports whether addr is a proxy chosen by selectProxy.
+func (f *HTTPFetcher) isProxy(addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.proxies[addr]
+}
+
+// policy returns the SSRF policy in force.
+func (f *HTTPFetcher) policy() *SSRFPolicy {
+	if f.Policy == nil {
+		return DefaultSSRFPolicy
+	}
+	return f.Policy
+}
+
+// checkURL rejects blocked hostnames and ports and, when a proxy will
+// resolve the host instead of the dialer, hosts that resolve to blocked
+// addresses.
+func (f *HTTPFetcher) checkURL(ctx context.Context, u *url.URL) error {
+	policy := f.policy()
+	host := u.Hostname()
+	if err := policy.CheckHost(host); err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if err := policy.CheckPort(port); err != nil {
+		return err
+	}
+	if f.proxy == nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := checkIP(policy, ip.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIP applies policy to a resolved address.
+func checkIP(policy *SSRFPolicy, ip net.IP) error {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return policy.block(ip.String(), "invalid address")
+	}
+	return policy.CheckAddr(addr)
+}
+
+// Fetch downloads an image of at most 5 MB.
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, "", ErrBlocked
+	}
+	if err := f.checkURL(ctx, parsed); err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetch: HTTP %d", resp.StatusCode)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "image/") {
+		return nil, "", ErrNotImage
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ct, nil
+}
+
+// ssrfSafeDialer returns a DialContext that resolves DNS and checks every
+// resolved IP against the SSRF policy returned by policy BEFORE
+// connecting.  This eliminates the DNS rebinding TOCTOU race that exists
+// when the host check and the actual connection resolve independently.
+// Addresses for which trusted returns true (configured proxies) are
+// dialed without checks.
+func ssrfSafeDialer(trusted func(addr string) bool, policy func() *SSRFPolicy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	resolver := &net.Resolver{}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if trusted(addr) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Block obviously dangerous hostnames and ports before any DNS
+		// lookup.
+		p := policy()
+		if err := p.CheckHost(host); err != nil {
+			return nil, err
+		}
+		if err := p.CheckPort(port); err != nil {
+			return nil, err
+		}
+
+		// Resolve with a tight timeout to prevent hanging on unresolvable hosts.
+		resolveCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+
+		ips, err := resolver.LookupIPAddr(resolveCtx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check ALL resolved IPs -- block if any are denied.
+		for _, ip := range ips {
+			if err := checkIP(p, ip.IP); err != nil {
+				return nil, err
+			}
+		}
+
+		// Connect to the resolved IP directly (bypasses further DNS).
+		// Try each resolved address until one succeeds.
+		for _, ip := range ips {
+			target := net.JoinHostPort(ip.IP.String(), port)
+			conn, err := dialer.DialContext(ctx, network, target)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, errors.New("all addresses failed")
+	}
+}
+
+// AllowlistFetcher fetches only images hosted on the listed domains or
+// their subdomains, delegating to Next (DefaultFetcher if nil).
+type AllowlistFetcher struct {
+	Domains []string
+	Next    ImageFetcher
+}
+
+// Fetch fails with ErrBlocked unless the URL's host is allowed.
+func (a *AllowlistFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, d := range a.Domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+			return next(a.Next).Fetch(ctx, rawURL)
+		}
+	}
+	return nil, "", ErrBlocked
+}
+
+// DiskCacheFetcher caches the images fetched by Next (DefaultFetcher if
+// nil) as files in Dir, named by the SHA-256 of their URL. Entries older
+// than MaxAge are fetched again; a zero MaxAge keeps them forever.
+type DiskCacheFetcher struct {
+	Dir    string
+	MaxAge time.Duration
+	Next   ImageFetcher
+}
+
+// Fetch returns the cached image for rawURL or fetches and stores it.
+// Failures to write the cache are ignored.
+func (d *DiskCacheFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	sum := sha256.Sum256([]byte(rawURL))
+	base := filepath.Join(d.Dir, hex.EncodeToString(sum[:]))
+	if info, err := os.Stat(base); err == nil && (d.MaxAge == 0 || time.Since(info.ModTime()) < d.MaxAge) {
+		data, err1 := os.ReadFile(base)
+		ct, err2 := os.ReadFile(base + ".type")
+		if err1 == nil && err2 == nil {
+			return data, string(ct), nil
+		}
+	}
+	data, ct, err := next(d.Next).Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if os.MkdirAll(d.Dir, 0o700) == nil && writeFileAtomic(base+".type", []byte(ct)) == nil {
+		writeFileAtomic(base, data)
+	}
+	return data, ct, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into
+// place, so concurrent readers never see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// DefaultCacheSize is the LRUCacheFetcher size used when MaxBytes is 0.
+const DefaultCacheSize = 64 << 20
+
+// LRUCacheFetcher caches the images fetched by Next (DefaultFetcher if
+// nil) in memory. Once the cached images total more than MaxBytes (0
+// means DefaultCacheSize) the least recently used are evicted. Entries
+// older than TTL are fetched again; a zero TTL keeps them until evicted.
+// Failed fetches are not cached. An LRUCacheFetcher is safe for
+// concurrent use and is meant to be shared by all conversions in a
+// process; the zero value is ready to use.
+type LRUCacheFetcher struct {
+	MaxBytes int64
+	TTL      time.Duration
+	Next     ImageFetcher
+
+	mu    sync.Mutex
+	size  int64
+	order list.List // of *lruEntry, most recently used first
+	items map[string]*list.Element
+}
+
+// lruEntry is an image cached by LRUCacheFetcher.
+type lruEntry struct {
+	url         string
+	data        []byte
+	contentType string
+	added       time.Time
+}
+
+// Fetch returns the cached image for rawURL or fetches and caches it.
+// The returned data is shared with the cache and must not be modified.
+func (c *LRUCacheFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	if e, ok := c.get(rawURL); ok {
+		return e.data, e.contentType, nil
+	}
+	data, ct, err := next(c.Next).Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	c.put(&lruEntry{url: rawURL, data: data, contentType: ct, added: time.Now()})
+	return data, ct, nil
+}
+
+// get returns the fresh entry for rawURL, marking it recently used.
+func (c *LRUCacheFetcher) get(rawURL string) (*lruEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[rawURL]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if c.TTL > 0 && time.Since(e.added) >= c.TTL {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e, true
+}
+
+// put adds e, evicting the least recently used entries to make room.
+// Images larger than the whole cache are not stored.
+func (c *LRUCacheFetcher) put(e *lruEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit := c.MaxBytes
+	if limit <= 0 {
+		limit = DefaultCacheSize
+	}
+	if int64(len(e.data)) > limit {
+		return
+	}
+	if c.items == nil {
+		c.items = make(map[string]*list.Element)
+	}
+	if el, ok := c.items[e.url]; ok {
+		c.remove(el)
+	}
+	c.items[e.url] = c.order.PushFront(e)
+	c.size += int64(len(e.data))
+	for c.size > limit {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops el from the cache. The caller holds c.mu.
+func (c *LRUCacheFetcher) remove(el *list.Element) {
+	e := c.order.Remove(el).(*lruEntry)
+	delete(c.items, e.url)
+	c.size -= int64(len(e.data))
+}
+
+// MemoryFetcher serves images from memory, keyed by URL, without any
+// network access. It is intended for tests and fixed asset sets.
+type MemoryFetcher map[string][]byte
+
+// Fetch returns the image stored for rawURL, with a sniffed content type.
+func (m MemoryFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	data, ok := m[rawURL]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	ct := http.DetectContentType(data)
+	if !strings.HasPrefix(ct, "image/") {
+		return nil, "", ErrNotImage
+	}
+	return data, ct, nil
+}
+
+// next returns f, or DefaultFetcher if f is nil.
+func next(f ImageFetcher) ImageFetcher {
+	if f == nil {
+		return DefaultFetcher
+	}
+	return f
+}
@@ -8,13 +8,46 @@ package formats
 import (
 	"path/filepath"
 	"strings"
+	"time"
+)
+
+// Category classifies a converted file.
+type Category string
+
+// Categories of converted files.
+const (
+	CategoryBody       Category = "body"       // A rendering of the message itself (body.txt, body.html, an index).
+	CategoryAttachment Category = "attachment" // A file carried by the source.
 )
 
 // ConvertedFile is a single output file produced by a conversion.
 type ConvertedFile struct {
 	Name     string
 	Data     []byte
-	Category string // "body" or "attachment"
+	Category Category
+	MIMEType string // Media type without parameters, e.g. "application/pdf"; see Annotate.
+	SHA256   string // Hex SHA-256 digest of Data; see Annotate.
+
+	OriginalName string // Filename recorded by the source, before sanitizing and prefixing.
+	ContentID    string // MIME Content-ID, for parts referenced by cid: URLs.
+	Inline       bool   // The source shows the file within the body rather than as an attachment.
+	Hidden       bool   // The source marks the file hidden (PR_ATTACHMENT_HIDDEN).
+
+	Parent string // Name of the output this file was expanded from; empty at the top level.
+	Source string // Embedded messages the file came from, e.g. "Fwd.msg/Re.msg"; empty for the outer message.
+	Icon   []byte // PNG icon supplied by the source (e.g. Outlook's attachment icon), if any.
+
+	Created  time.Time // Creation time recorded by the source; zero if unknown.
+	Modified time.Time // Last modification time recorded by the source; zero if unknown.
+}
+
+// ModTime returns the time to stamp on the file when it is written out:
+// Modified, or Created if no modification time is known.
+func (f *ConvertedFile) ModTime() time.Time {
+	if f.Modified.IsZero() {
+		return f.Created
+	}
+	return f.Modified
 }
 
 // Converter handles detection and conversion of a specific file format.
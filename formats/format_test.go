@@ -1,6 +1,19 @@
 package formats
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestSanitizeFilename(t *testing.T) {
 	tests := []struct {
@@ -33,3 +46,542 @@ func TestRegisterAndAll(t *testing.T) {
 		t.Fatal("All() returned negative length")
 	}
 }
+
+// nestConverter turns "NEST:<rest>" into a body plus an attachment
+// holding <rest>, so each level of nesting produces one more level.
+type nestConverter struct{}
+
+func (nestConverter) Name() string         { return "nest" }
+func (nestConverter) Extensions() []string { return nil }
+func (nestConverter) Match(data []byte) bool {
+	return strings.HasPrefix(string(data), "NEST:")
+}
+func (nestConverter) Convert(data []byte) ([]ConvertedFile, error) {
+	return []ConvertedFile{
+		{Name: "body.txt", Data: data, Category: CategoryBody},
+		{Name: "inner.bin", Data: data[len("NEST:"):], Category: CategoryAttachment},
+	}, nil
+}
+
+func TestExpand(t *testing.T) {
+	Register(nestConverter{})
+	defer func() { registry = registry[:len(registry)-1] }()
+
+	files, err := Expand(nestConverter{}, []byte("NEST:NEST:NEST:leaf"), 2)
+	if err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	got := make(map[string]string)
+	for _, f := range files {
+		got[f.Name] = f.Parent
+	}
+	// Expanded attachments are kept next to their outputs.
+	want := map[string]string{
+		"body.txt":                     "",
+		"inner.bin":                    "",
+		"inner.bin_contents/body.txt":  "inner.bin",
+		"inner.bin_contents/inner.bin": "inner.bin",
+		"inner.bin_contents/inner.bin_contents/body.txt": "inner.bin_contents/inner.bin",
+		// The third level is beyond maxDepth and is kept unexpanded.
+		"inner.bin_contents/inner.bin_contents/inner.bin": "inner.bin_contents/inner.bin",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for name, parent := range want {
+		if p, ok := got[name]; !ok || p != parent {
+			t.Errorf("%s: parent %q (present %v), want %q", name, p, ok, parent)
+		}
+	}
+
+	files, _ = Expand(nestConverter{}, []byte("NEST:NEST:leaf"), 0)
+	if len(files) != 2 || files[1].Name != "inner.bin" {
+		t.Errorf("maxDepth 0 should not expand, got %v", files)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	files := []ConvertedFile{
+		{Name: "body.html", Data: []byte("<p>hi</p>")},
+		{Name: "Report.PDF", Data: []byte("%PDF"), MIMEType: "application/octet-stream"},
+		{Name: "scan.bin", Data: []byte("x"), MIMEType: "Image/PNG; name=scan.png"},
+		{Name: "unknown.xyz"},
+	}
+	Annotate(files)
+	want := []string{"text/html", "application/pdf", "image/png", "application/octet-stream"}
+	for i, f := range files {
+		if f.MIMEType != want[i] {
+			t.Errorf("%s: MIMEType = %q, want %q", f.Name, f.MIMEType, want[i])
+		}
+	}
+	// SHA-256 of the empty string.
+	if got := files[3].SHA256; got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("SHA256 = %q", got)
+	}
+}
+
+func TestExpandWithOptions(t *testing.T) {
+	Register(nestConverter{})
+	defer func() { registry = registry[:len(registry)-1] }()
+	ctx := context.Background()
+	input := "NEST:NEST:NEST:leaf"
+
+	// Plain converters run through the adapter with the default depth.
+	files, err := ExpandWithOptions(ctx, nestConverter{}, strings.NewReader(input), Options{})
+	if err != nil || len(files) != 6 {
+		t.Fatalf("default options: %d files, %v", len(files), err)
+	}
+
+	// Unwanted body renderings are dropped at every level.
+	files, _ = ExpandWithOptions(ctx, nestConverter{}, strings.NewReader(input), Options{Bodies: BodyHTML, MaxDepth: -1})
+	if len(files) != 1 || files[0].Name != "inner.bin" {
+		t.Errorf("Bodies: got %v", files)
+	}
+
+	if _, err := ExpandWithOptions(ctx, nestConverter{}, strings.NewReader(input), Options{MaxInputSize: 4}); !errors.Is(err, ErrInputTooLarge) {
+		t.Errorf("MaxInputSize: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ExpandWithOptions(canceled, nestConverter{}, strings.NewReader(input), Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: %v", err)
+	}
+}
+
+func TestBlockExternalImages(t *testing.T) {
+	html := []byte(`<img src="https://t.example/a.gif"><img src="cid:x"><img src="https://t.example/a.gif"><img src="http://b.example/b.png">`)
+	out, urls := BlockExternalImages(html, false)
+	if string(out) != string(html) {
+		t.Errorf("without placeholder html changed: %s", out)
+	}
+	if len(urls) != 2 || urls[0] != "https://t.example/a.gif" || urls[1] != "http://b.example/b.png" {
+		t.Errorf("urls = %q", urls)
+	}
+	out, _ = BlockExternalImages(html, true)
+	if strings.Contains(string(out), "example") || strings.Count(string(out), PlaceholderImage) != 3 || !strings.Contains(string(out), "cid:x") {
+		t.Errorf("with placeholder: %s", out)
+	}
+}
+
+func TestFetchers(t *testing.T) {
+	ctx := context.Background()
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	mem := MemoryFetcher{"https://img.example.com/a.gif": gif}
+
+	html := []byte(`<img src="https://img.example.com/a.gif"><img src="https://other.example/b.gif">`)
+	out := NewImageInliner(Options{Fetcher: mem}).Inline(ctx, html)
+	if !strings.Contains(string(out), `src="data:image/gif;base64,`) || !strings.Contains(string(out), "https://other.example/b.gif") {
+		t.Errorf("inlined: %s", out)
+	}
+
+	allow := &AllowlistFetcher{Domains: []string{"example.com"}, Next: mem}
+	if _, _, err := allow.Fetch(ctx, "https://img.example.com/a.gif"); err != nil {
+		t.Errorf("allowed subdomain: %v", err)
+	}
+	if _, _, err := allow.Fetch(ctx, "https://evilexample.com/a.gif"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("other domain: %v", err)
+	}
+
+	cache := &DiskCacheFetcher{Dir: t.TempDir(), Next: mem}
+	if _, _, err := cache.Fetch(ctx, "https://img.example.com/a.gif"); err != nil {
+		t.Fatalf("cache miss: %v", err)
+	}
+	delete(mem, "https://img.example.com/a.gif")
+	if data, ct, err := cache.Fetch(ctx, "https://img.example.com/a.gif"); err != nil || ct != "image/gif" || string(data) != string(gif) {
+		t.Errorf("cache hit: %q %q %v", data, ct, err)
+	}
+}
+
+// slowFetcher serves a 10-byte image for every URL after a delay,
+// recording the number of concurrent and total fetches.
+type slowFetcher struct {
+	delay              time.Duration
+	active, peak, hits atomic.Int32
+}
+
+func (f *slowFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	f.hits.Add(1)
+	n := f.active.Add(1)
+	defer f.active.Add(-1)
+	for p := f.peak.Load(); n > p && !f.peak.CompareAndSwap(p, n); p = f.peak.Load() {
+	}
+	select {
+	case <-time.After(f.delay):
+		return []byte("GIF89a;;;;"), "image/gif", nil
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+func TestImageInliner(t *testing.T) {
+	ctx := context.Background()
+	var html []byte
+	for i := range 12 {
+		html = fmt.Appendf(html, `<img src="https://i.example/%d.gif">`, i)
+	}
+	inlined := func(out []byte) int { return strings.Count(string(out), "data:image/gif") }
+
+	f := &slowFetcher{delay: 20 * time.Millisecond}
+	out := NewImageInliner(Options{Fetcher: f, FetchConcurrency: 4}).Inline(ctx, html)
+	if inlined(out) != 12 || f.peak.Load() > 4 || f.peak.Load() < 2 {
+		t.Errorf("concurrency: %d inlined, peak %d", inlined(out), f.peak.Load())
+	}
+
+	// The byte budget is shared by every body of a conversion: the
+	// second body reuses the four images that fit and fetches no more.
+	f = &slowFetcher{}
+	in := NewImageInliner(Options{Fetcher: f, FetchMaxBytes: 45, FetchConcurrency: 1})
+	first, second := inlined(in.Inline(ctx, html[:len(html)/2])), inlined(in.Inline(ctx, html))
+	if first != 4 || second != 4 || f.hits.Load() != 5 {
+		t.Errorf("byte budget: %d and %d inlined after %d fetches", first, second, f.hits.Load())
+	}
+
+	f = &slowFetcher{delay: time.Hour}
+	start := time.Now()
+	out = NewImageInliner(Options{Fetcher: f, FetchTimeout: 50 * time.Millisecond}).Inline(ctx, html)
+	if inlined(out) != 0 || time.Since(start) > 5*time.Second {
+		t.Errorf("time budget: %d inlined after %v", inlined(out), time.Since(start))
+	}
+}
+
+func TestLRUCacheFetcher(t *testing.T) {
+	ctx := context.Background()
+	f := &slowFetcher{}
+	c := &LRUCacheFetcher{MaxBytes: 25, TTL: time.Hour, Next: f}
+	for _, u := range []string{"a", "b", "a", "c", "a", "b"} {
+		c.Fetch(ctx, u)
+	}
+	// Only two 10-byte images fit: "c" evicts "b", the least recently
+	// used, which is then fetched again.
+	if f.hits.Load() != 4 {
+		t.Errorf("fetches = %d, want 4", f.hits.Load())
+	}
+
+	c.TTL = time.Nanosecond
+	c.Fetch(ctx, "a")
+	if f.hits.Load() != 5 {
+		t.Errorf("expired entry was not refetched")
+	}
+}
+
+func TestHTTPFetcherProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer proxy.Close()
+	ctx := context.Background()
+
+	// Direct fetches of loopback servers are blocked.
+	if _, _, err := NewHTTPFetcher(nil).Fetch(ctx, proxy.URL+"/a.png"); err == nil {
+		t.Error("loopback fetch was not blocked")
+	}
+
+	// A configured proxy may be on a private address.
+	u, _ := url.Parse(proxy.URL)
+	f := NewHTTPFetcher(http.ProxyURL(u))
+	data, ct, err := f.Fetch(ctx, "http://203.0.113.7/a.png")
+	if err != nil || ct != "image/png" || string(data) != "png" || proxied != "http://203.0.113.7/a.png" {
+		t.Errorf("proxied fetch: %q %q %v (proxy saw %q)", data, ct, err, proxied)
+	}
+	if _, _, err := f.Fetch(ctx, "http://127.0.0.1/a.png"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("blocked host through proxy: %v", err)
+	}
+}
+
+func TestSSRFPolicy(t *testing.T) {
+	var logged strings.Builder
+	policy := &SSRFPolicy{Logger: slog.New(slog.NewTextHandler(&logged, nil))}
+	for _, addr := range []string{"100.64.1.1", "0.1.2.3", "198.19.0.1", "239.1.1.1", "::ffff:127.0.0.1",
+		"64:ff9b::a00:1", "2002:7f00:1::", "fd00::1", "255.255.255.255"} {
+		if err := policy.CheckHost(addr); !errors.Is(err, ErrBlocked) {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+	for _, host := range []string{"8.8.8.8", "2606:4700::1", "images.example.com"} {
+		if err := policy.CheckHost(host); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+	if !strings.Contains(logged.String(), "reason=\"carrier-grade NAT address (100.64.0.0/10)\"") {
+		t.Errorf("block reasons not logged:\n%s", logged.String())
+	}
+
+	path := t.TempDir() + "/ssrf.json"
+	os.WriteFile(path, []byte(`{"allow": ["10.20.0.0/16"], "deny": ["8.8.8.0/24"], "allowHosts": ["img.corp.internal"],
+		"denyHosts": ["*.tracker.example"], "ports": [443]}`), 0o600)
+	policy, err := LoadSSRFPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Logger = slog.New(slog.DiscardHandler)
+	for target, blocked := range map[string]bool{
+		"10.20.3.4": false, "10.21.0.1": true, "8.8.8.8": true, "img.corp.internal": false,
+		"other.internal": true, "a.tracker.example": true, "tracker.example": false,
+	} {
+		if err := policy.CheckHost(target); (err != nil) != blocked {
+			t.Errorf("%s: blocked = %v, want %v", target, err != nil, blocked)
+		}
+	}
+	if policy.CheckPort("443") != nil || policy.CheckPort("8080") == nil {
+		t.Error("port restrictions not applied")
+	}
+}
+
+func TestRemoveTrackers(t *testing.T) {
+	html := `<p>Hi</p><img src="https://cdn.example/logo.png" width="120" height="40">` +
+		`<img width=1 height=1 src="https://news.example/spacer.gif">` +
+		`<IMG SRC="https://x.mailtrack.io/trace/mail/abc.png">` +
+		`<img src="https://mail.example/wf/open?upn=Zx81kLm29QpR7sT4vW" alt="">` +
+		`<img src="https://shop.example/track/cover.jpg?size=large">` +
+		`<img style="display: none" src="http://h.example/i.gif"><img src="cid:x" width="1" height="1">`
+	out, trackers := RemoveTrackers([]byte(html))
+	want := map[string]string{
+		"https://news.example/spacer.gif":                     "1x1 image",
+		"https://x.mailtrack.io/trace/mail/abc.png":           "known tracker domain mailtrack.io",
+		"https://mail.example/wf/open?upn=Zx81kLm29QpR7sT4vW": "tracking URL fingerprint",
+		"http://h.example/i.gif":                              "hidden image",
+	}
+	if len(trackers) != len(want) {
+		t.Fatalf("trackers = %v", trackers)
+	}
+	for _, tr := range trackers {
+		if want[tr.URL] != strings.Join(tr.Reasons, "; ") {
+			t.Errorf("%s: reasons %q, want %q", tr.URL, tr.Reasons, want[tr.URL])
+		}
+	}
+	if string(out) != `<p>Hi</p><img src="https://cdn.example/logo.png" width="120" height="40">`+
+		`<img src="https://shop.example/track/cover.jpg?size=large"><img src="cid:x" width="1" height="1">` {
+		t.Errorf("output: %s", out)
+	}
+	if report := string(PrivacyReport(trackers)); !strings.HasPrefix(report, "Privacy report: 4 tracking image(s) removed\n") {
+		t.Errorf("report: %s", report)
+	}
+
+	// Beacons referenced other than by <img src> are blanked, not fetched.
+	html = `<img src="https://cdn.example/a.png" srcset="https://cdn.example/a2.png 2x, https://x.mailtrack.io/p.png 3x">` +
+		`<picture><source srcset="https://pstmrk.it/open?id=Ab12Cd34Ef56Gh78"></picture>` +
+		`<table background="https://t.yesware.com/t/bg.gif"><tr><td style="background: url('https://mail.example/open.gif?u=Zx81kLm29QpR7sT4vW')">x</td></tr></table>` +
+		`<style>p { background: url(https://app.bananatag.com/b.gif) }</style><a href="https://pstmrk.it/x">link</a>`
+	out, trackers = RemoveTrackers([]byte(html))
+	if len(trackers) != 5 {
+		t.Fatalf("trackers = %v", trackers)
+	}
+	if s := string(out); strings.Count(s, blankImage) != 5 || !strings.Contains(s, "https://cdn.example/a2.png 2x") ||
+		!strings.Contains(s, `href="https://pstmrk.it/x"`) {
+		t.Errorf("output: %s", out)
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	src := `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=https://evil.example">` +
+		`<link rel="stylesheet" href="https://evil.example/a.css"><base href="https://evil.example/">` +
+		`<style>@import url(https://evil.example/b.css); td { color: red; background: url(javascript:alert(1)) } ` +
+		`p { width: expr/**/ession(alert(1)); margin: 0 }</style></head>` +
+		`<body onload="alert(1)"><!-- secret --><script>alert(1)</script>` +
+		`<p style="color: blue; background-image: url('data:image/png;base64,AA;BB'); behavior: url(x.htc)" onclick="x()">Hi <b>there</b></p>` +
+		`<a href="java&#x09;script:alert(1)">bad</a><a href="https://ok.example/" target="_top">good</a><a href="#top">top</a>` +
+		`<form action="https://evil.example/steal">Password: <input name="p"><button>Go</button></form>` +
+		`<img src="data:image/gif;base64,R0lG" onerror="x()"><img src="javascript:x"><svg><script>x</script></svg>` +
+		`<table bgcolor="#fff"><tr><td colspan=2 class="c">cell</td></tr></table></body></html>`
+	out := string(SanitizeHTML([]byte(src)))
+	want := `<!DOCTYPE html><html><head><style> td {color: red} p {margin: 0}</style></head>` +
+		`<body><p style="color: blue; background-image: url(&#39;data:image/png;base64,AA;BB&#39;)">Hi <b>there</b></p>` +
+		`<a>bad</a><a href="https://ok.example/" target="_blank" rel="noopener noreferrer">good</a>` +
+		`<a href="#top" rel="noopener noreferrer">top</a>Password: ` +
+		`<img src="data:image/gif;base64,R0lG"><img>` +
+		`<table bgcolor="#fff"><tr><td colspan="2" class="c">cell</td></tr></table></body></html>`
+	if out != want {
+		t.Errorf("SanitizeHTML:\n got %s\nwant %s", out, want)
+	}
+
+	// Unterminated blocks, braces in strings, and nested rules.
+	for css, want := range map[string]string{
+		`a{background:url(javascript:alert(1));behavior:url(x.htc)`: `a{}`,
+		`a{color:red;behavior:url(x.htc);content:"{"}`:              `a{color: red; content: "{"}`,
+		`@media screen{a{color:red}b{-moz-binding:url(x.xml)`:       `@media screen{a{color: red}b{}}`,
+		`a{behavior:url(x.htc);b{color:red}}`:                       `a{b{color: red}}`,
+		`a{color:red}background:url(javascript:alert(1))`:           `a{color: red}`,
+		`url(x.htc) a{color:red}`:                                   `{color: red}`,
+	} {
+		if got := sanitizeStylesheet(css); got != want {
+			t.Errorf("sanitizeStylesheet(%q) = %q, want %q", css, got, want)
+		}
+	}
+}
+
+func TestUnwrapURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wrappers []string
+	}{
+		{"https://nam02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fa%3Fb%3D1&data=x&reserved=0",
+			"https://example.com/a?b=1", []string{WrapperSafeLinks}},
+		{"https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_path-3Fq-3D1&d=DwMF&c=x",
+			"https://example.com/path?q=1", []string{WrapperURLDefense}},
+		{"https://urldefense.com/v3/__https://google.com:443/search?q=a*test&gs=ps__;Kw!-612Flbf0JvQ3kNJkRi5Jg!Ue6tQ$",
+			"https://google.com:443/search?q=a+test&gs=ps", []string{WrapperURLDefense}},
+		{"https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Furldefense.proofpoint.com%2Fv1%2Furl%3Fu%3Dhttp%253A%252F%252Fexample.org%252F",
+			"http://example.org/", []string{WrapperSafeLinks, WrapperURLDefense}},
+		{"https://protect-eu.mimecast.com/s/AbCdEf?domain=example.net",
+			"https://protect-eu.mimecast.com/s/AbCdEf?domain=example.net", []string{WrapperMimecast}},
+		{"https://url.uk.m.mimecastprotect.com/s/AbCdEf", "https://url.uk.m.mimecastprotect.com/s/AbCdEf", []string{WrapperMimecast}},
+		{"https://evilmimecastprotect.com/s/AbCdEf", "https://evilmimecastprotect.com/s/AbCdEf", nil},
+		{"https://example.com/", "https://example.com/", nil},
+	}
+	for _, tt := range tests {
+		got, wrappers := UnwrapURL(tt.in)
+		if got != tt.want || strings.Join(wrappers, ",") != strings.Join(tt.wrappers, ",") {
+			t.Errorf("UnwrapURL(%s) = %s %v, want %s %v", tt.in, got, wrappers, tt.want, tt.wrappers)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	html := `<a href="https://www.example.com/">Example.com</a>` +
+		`<a href="https://evil.example/login"><b>www.paypal.com</b></a>` +
+		`<a href="https://xn--pypal-4ve.com/">secure</a><a href="https://xn--mnchen-3ya.de/">M&uuml;nchen</a>` +
+		`<a href="http://0x7f.0.0.1/x">x</a><a href="https://paypal.com@evil.example/">y</a>` +
+		`<a href="data:text/html;base64,PHNjcmlwdD4=">open</a><a href=" JavaScript:alert(1)">z</a>` +
+		`<a href="#top">top</a><a href="https://protect-eu.mimecast.com/s/Ab?domain=example.net">https://example.org</a>`
+	links := ExtractLinks([]byte(html), "body.html")
+	want := [][]string{
+		nil,
+		{FlagTextMismatch},
+		{FlagPunycode, FlagHomograph},
+		{FlagPunycode},
+		{FlagIPHost},
+		{FlagUserinfo},
+		{FlagDataURL},
+		{FlagJavaScriptURL},
+		{FlagTextMismatch},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links: %+v", len(links), links)
+	}
+	for i, l := range links {
+		if strings.Join(l.Flags, ",") != strings.Join(want[i], ",") {
+			t.Errorf("%s (%q): flags %v, want %v", l.URL, l.Text, l.Flags, want[i])
+		}
+	}
+	if links[1].Text != "www.paypal.com" || links[2].UnicodeHost != "p\u0430ypal.com" || links[8].Host != "example.net" {
+		t.Errorf("links: %+v", links)
+	}
+	if got, err := decodePunycode("80ak6aa92e"); err != nil || got != "\u0430\u0440\u0440\u04cf\u0435" {
+		t.Errorf("decodePunycode = %q, %v", got, err)
+	}
+}
+
+func TestDefang(t *testing.T) {
+	for in, want := range map[string]string{
+		"https://evil.example/login?a=b.c":   "hxxps://evil[.]example/login?a=b.c",
+		"hxxps://evil[.]example/login":       "hxxps://evil[.]example/login",
+		"HTTP://user@10.0.0.1:8080/x":        "hxxp://user@10[.]0[.]0[.]1:8080/x",
+		"mailto:bob@mail.example?subject=hi": "mailto:bob[@]mail[.]example?subject=hi",
+	} {
+		if got := DefangURL(in); got != want {
+			t.Errorf("DefangURL(%s) = %s, want %s", in, got, want)
+		}
+	}
+
+	text := "Log in at https://evil.example/login. Contact bob@mail.example or www.help.example!"
+	want := "Log in at hxxps://evil[.]example/login. Contact bob[@]mail[.]example or www[.]help[.]example!"
+	if got := string(DefangText([]byte(text))); got != want {
+		t.Errorf("DefangText:\n got %s\nwant %s", got, want)
+	}
+
+	html := `<p>Visit <a href="https://evil.example/a" target="_blank">https://evil.example/a</a></p>` +
+		`<img src="data:image/gif;base64,R0lG"><img src="https://t.example/x.png"><script>alert(1)</script>`
+	got := string(DefangHTML([]byte(html)))
+	wantHTML := `<p>Visit <a title="hxxps://evil[.]example/a">hxxps://evil[.]example/a</a></p>` +
+		`<img src="data:image/gif;base64,R0lG"><img src="` + PlaceholderImage + `">`
+	if got != wantHTML {
+		t.Errorf("DefangHTML:\n got %s\nwant %s", got, wantHTML)
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	html := "<html><head><title>T</title><style>p { color: red }</style></head><body>\n" +
+		"<p>Dear  <b>user</b>,\nplease <a href=\"https://evil.example/login\">sign in</a>.</p>" +
+		"<p><a href=\"mailto:it@example.com\">it@example.com</a><br>Fish &amp; chips</p>\n\n\n" +
+		"<table><tr><td>a</td><td>b</td></tr></table><script>alert(1)</script></body></html>"
+	want := "Dear user, please sign in <https://evil.example/login>.\n\nit@example.com\nFish & chips\n\na b\n"
+	if got := string(HTMLText([]byte(html))); got != want {
+		t.Errorf("HTMLText:\n got %q\nwant %q", got, want)
+	}
+	if got := HTMLText([]byte("<p> </p>")); got != nil {
+		t.Errorf("HTMLText(empty) = %q, want nil", got)
+	}
+}
+
+func TestRewriteURLs(t *testing.T) {
+	src := `<!DOCTYPE html><html><head><style>td { background: url('cid:bg@x') } @import "https://s.example/a.css";</style></head>` +
+		`<body background=https://i.example/body.png><!-- <img src="https://c.example/no.png"> -->` +
+		`<img src='https://i.example/a.png' alt="a &amp; b"><IMG SRC=https://i.example/b.png>` +
+		`<img srcset="https://i.example/1x.png 1x, data:image/png;base64,AA,BB 2x">` +
+		`<p style="background-image:url(&quot;https://i.example/c.png&quot;)">x < y</p>` +
+		`<a href="https://l.example/">link</a><script>var s = '<img src="https://c.example/no.png">';</script></body></html>`
+
+	// With an identity function the input is reproduced exactly.
+	if got := RewriteURLs([]byte(src), func(u string, _ URLKind) string { return u }); string(got) != src {
+		t.Fatalf("identity rewrite changed the input:\n%s", got)
+	}
+
+	var images, links, others []string
+	out := string(RewriteURLs([]byte(src), func(u string, kind URLKind) string {
+		switch kind {
+		case URLImage:
+			images = append(images, u)
+			return "IMG"
+		case URLLink:
+			links = append(links, u)
+		default:
+			others = append(others, u)
+		}
+		return u
+	}))
+	wantImages := []string{"cid:bg@x", "https://i.example/body.png", "https://i.example/a.png", "https://i.example/b.png",
+		"https://i.example/1x.png", "data:image/png;base64,AA,BB", "https://i.example/c.png"}
+	if strings.Join(images, " ") != strings.Join(wantImages, " ") {
+		t.Errorf("images = %q\nwant     %q", images, wantImages)
+	}
+	if len(links) != 1 || links[0] != "https://l.example/" || len(others) != 1 || others[0] != "https://s.example/a.css" {
+		t.Errorf("links = %q, others = %q", links, others)
+	}
+	for _, want := range []string{`url("IMG")`, `<body background="IMG">`, `<img src="IMG" alt="a &amp; b">`, `srcset="IMG 1x, IMG 2x"`,
+		`style="background-image:url(&#34;IMG&#34;)"`, `<!-- <img src="https://c.example/no.png"> -->`, `var s = '<img src="https://c.example/no.png">'`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+
+	cid := ResolveContentIDs([]byte(`<img src="cid:img%40x"><img src="CID:<other>">`), func(id string) string {
+		return map[string]string{"img@x": "data:A", "other": "data:B"}[id]
+	})
+	if string(cid) != `<img src="data:A"><img src="data:B">` {
+		t.Errorf("ResolveContentIDs = %s", cid)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	if got := MessageFolder(3, " Re: a/b "); got != "0003_Re_ a_b" {
+		t.Errorf("MessageFolder = %q", got)
+	}
+	if got := MessageFolder(12, "..."); got != "0012" {
+		t.Errorf("MessageFolder = %q", got)
+	}
+
+	x := NewIndex()
+	x.Add("0001_Invoice", "2024-01-02T03:04:05Z", "@evil <a@example.com>", `=HYPERLINK("http://evil.example","x")`)
+	x.Add("0002", "", "-2+3", "+cmd|' /C calc'!A0")
+	f := x.File()
+	want := "folder,date,from,subject\n" +
+		"0001_Invoice,2024-01-02T03:04:05Z,'@evil <a@example.com>,\"'=HYPERLINK(\"\"http://evil.example\"\",\"\"x\"\")\"\n" +
+		"0002,,'-2+3,'+cmd|' /C calc'!A0\n"
+	if f.Name != "index.csv" || f.Category != CategoryBody || string(f.Data) != want {
+		t.Errorf("index %s:\n%s", f.Name, f.Data)
+	}
+}
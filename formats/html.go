@@ -0,0 +1,500 @@
+// html.go is a small HTML tokenizer and the URL rewriting built on it.
+// All body rewriting (CID resolution, external image inlining, offline
+// blocking) runs through RewriteURLs, so every way of writing an
+// attribute and every place a URL can appear is handled the same way.
+
+package formats
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TokenType is the kind of an HTML token.
+type TokenType int
+
+// Token types.
+const (
+	TextToken     TokenType = iota // Character data, including raw text such as <style> content.
+	StartTagToken                  // <tag ...> or <tag .../>
+	EndTagToken                    // </tag>
+	CommentToken                   // <!-- ... -->
+	DoctypeToken                   // <!DOCTYPE ...>, <?...>, and other markup declarations.
+)
+
+// Attribute is an HTML attribute with a lower-case key and an
+// entity-decoded value.
+type Attribute struct {
+	Key string
+	Val string
+}
+
+// Token is a single piece of HTML. Raw holds its source bytes; tags
+// modified with SetAttr or RemoveAttr are rendered afresh by Bytes.
+type Token struct {
+	Type        TokenType
+	Tag         string // Lower-case tag name; for raw text, the enclosing element (e.g. "style").
+	Attrs       []Attribute
+	SelfClosing bool
+	Raw         []byte
+	dirty       bool
+}
+
+// Attr returns the value of the attribute key and whether it is present.
+func (t *Token) Attr(key string) (string, bool) {
+	for _, a := range t.Attrs {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// SetAttr sets the value of attribute key, adding it if absent.
+func (t *Token) SetAttr(key, val string) {
+	t.dirty = true
+	for i := range t.Attrs {
+		if t.Attrs[i].Key == key {
+			t.Attrs[i].Val = val
+			return
+		}
+	}
+	t.Attrs = append(t.Attrs, Attribute{Key: key, Val: val})
+}
+
+// RemoveAttr deletes every attribute named key.
+func (t *Token) RemoveAttr(key string) {
+	kept := t.Attrs[:0]
+	for _, a := range t.Attrs {
+		if a.Key == key {
+			t.dirty = true
+			continue
+		}
+		kept = append(kept, a)
+	}
+	t.Attrs = kept
+}
+
+// SetText replaces the content of a text token.
+func (t *Token) SetText(s string) {
+	t.Raw = []byte(s)
+}
+
+// Bytes returns the HTML for t: its source if unchanged, or a rendering
+// with double-quoted, escaped attribute values if it was modified.
+func (t *Token) Bytes() []byte {
+	if !t.dirty {
+		return t.Raw
+	}
+	var b bytes.Buffer
+	b.WriteByte('<')
+	b.WriteString(t.Tag)
+	for _, a := range t.Attrs {
+		b.WriteByte(' ')
+		b.WriteString(a.Key)
+		b.WriteString(`="`)
+		b.WriteString(html.EscapeString(a.Val))
+		b.WriteByte('"')
+	}
+	if t.SelfClosing {
+		b.WriteString(" /")
+	}
+	b.WriteByte('>')
+	return b.Bytes()
+}
+
+// rawTextElements hold text that is not parsed as markup.
+var rawTextElements = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true,
+	"xmp": true, "iframe": true, "noembed": true, "noframes": true,
+	"noscript": true, "plaintext": true,
+}
+
+// Tokenize splits src into tokens. It never fails: malformed markup is
+// returned as text, and concatenating the Raw bytes of the tokens
+// reproduces src exactly.
+func Tokenize(src []byte) []Token {
+	var tokens []Token
+	textStart := -1
+	flush := func(end int) {
+		if textStart >= 0 && end > textStart {
+			tokens = append(tokens, Token{Type: TextToken, Raw: src[textStart:end]})
+		}
+		textStart = -1
+	}
+	for pos := 0; pos < len(src); {
+		if src[pos] == '<' {
+			if t, n := readMarkup(src[pos:]); n > 0 {
+				flush(pos)
+				tokens = append(tokens, t)
+				pos += n
+				if t.Type == StartTagToken && !t.SelfClosing && rawTextElements[t.Tag] {
+					end := rawTextEnd(src[pos:], t.Tag)
+					if end > 0 {
+						tokens = append(tokens, Token{Type: TextToken, Tag: t.Tag, Raw: src[pos : pos+end]})
+					}
+					pos += end
+				}
+				continue
+			}
+		}
+		if textStart < 0 {
+			textStart = pos
+		}
+		pos++
+		if next := bytes.IndexByte(src[pos:], '<'); next >= 0 {
+			pos += next
+		} else {
+			pos = len(src)
+		}
+	}
+	flush(len(src))
+	return tokens
+}
+
+// rawTextEnd returns the length of the raw text of element tag at the
+// start of src: everything up to its end tag, or all of src.
+func rawTextEnd(src []byte, tag string) int {
+	if tag == "plaintext" {
+		return len(src)
+	}
+	closing := "</" + tag
+	for i := 0; ; {
+		j := bytes.Index(src[i:], []byte("</"))
+		if j < 0 {
+			return len(src)
+		}
+		i += j
+		if len(src)-i >= len(closing) && strings.EqualFold(string(src[i:i+len(closing)]), closing) {
+			if rest := src[i+len(closing):]; len(rest) == 0 || isSpace(rest[0]) || rest[0] == '>' || rest[0] == '/' {
+				return i
+			}
+		}
+		i += 2
+	}
+}
+
+// readMarkup reads the tag, comment, or declaration at the start of src,
+// which begins with '<'. It returns n == 0 if src does not start markup.
+func readMarkup(src []byte) (Token, int) {
+	if len(src) < 2 {
+		return Token{}, 0
+	}
+	switch c := src[1]; {
+	case bytes.HasPrefix(src, []byte("<!--")):
+		end := bytes.Index(src[4:], []byte("-->"))
+		n := len(src)
+		if end >= 0 {
+			n = 4 + end + 3
+		}
+		return Token{Type: CommentToken, Raw: src[:n]}, n
+	case c == '!' || c == '?':
+		n := len(src)
+		if end := bytes.IndexByte(src, '>'); end >= 0 {
+			n = end + 1
+		}
+		return Token{Type: DoctypeToken, Raw: src[:n]}, n
+	case c == '/':
+		if len(src) < 3 || !isLetter(src[2]) {
+			return Token{}, 0
+		}
+		n := len(src)
+		if end := bytes.IndexByte(src, '>'); end >= 0 {
+			n = end + 1
+		}
+		name := src[2:n]
+		if i := bytes.IndexFunc(name, func(r rune) bool { return r < 0x80 && (isSpace(byte(r)) || r == '/' || r == '>') }); i >= 0 {
+			name = name[:i]
+		}
+		return Token{Type: EndTagToken, Tag: strings.ToLower(string(name)), Raw: src[:n]}, n
+	case isLetter(c):
+		return readStartTag(src)
+	}
+	return Token{}, 0
+}
+
+// readStartTag reads a start tag and its attributes.
+func readStartTag(src []byte) (Token, int) {
+	t := Token{Type: StartTagToken}
+	i := 1
+	for i < len(src) && !isSpace(src[i]) && src[i] != '/' && src[i] != '>' {
+		i++
+	}
+	t.Tag = strings.ToLower(string(src[1:i]))
+	for i < len(src) {
+		for i < len(src) && (isSpace(src[i]) || src[i] == '/') {
+			if src[i] == '/' && i+1 < len(src) && src[i+1] == '>' {
+				t.SelfClosing = true
+			}
+			i++
+		}
+		if i >= len(src) {
+			break
+		}
+		if src[i] == '>' {
+			i++
+			t.Raw = src[:i]
+			return t, i
+		}
+		// Attribute name; a leading '=' is part of the name.
+		start := i
+		i++
+		for i < len(src) && !isSpace(src[i]) && src[i] != '/' && src[i] != '>' && src[i] != '=' {
+			i++
+		}
+		key := strings.ToLower(string(src[start:i]))
+		j := i
+		for j < len(src) && isSpace(src[j]) {
+			j++
+		}
+		if j >= len(src) || src[j] != '=' {
+			t.Attrs = append(t.Attrs, Attribute{Key: key})
+			continue
+		}
+		i = j + 1
+		for i < len(src) && isSpace(src[i]) {
+			i++
+		}
+		var val []byte
+		if i < len(src) && (src[i] == '"' || src[i] == '\'') {
+			q := src[i]
+			end := bytes.IndexByte(src[i+1:], q)
+			if end < 0 {
+				val, i = src[i+1:], len(src)
+			} else {
+				val, i = src[i+1:i+1+end], i+1+end+1
+			}
+		} else {
+			start := i
+			for i < len(src) && !isSpace(src[i]) && src[i] != '>' {
+				i++
+			}
+			val = src[start:i]
+		}
+		t.Attrs = append(t.Attrs, Attribute{Key: key, Val: html.UnescapeString(string(val))})
+	}
+	// Unterminated tag: keep it as text.
+	return Token{}, 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return c|0x20 >= 'a' && c|0x20 <= 'z'
+}
+
+// URLKind classifies where a URL appears in HTML.
+type URLKind int
+
+// URL kinds.
+const (
+	URLImage URLKind = iota // Images: <img> src and srcset, <source>, input type=image, poster, background, CSS url().
+	URLLink                 // Hyperlinks: <a> and <area> href.
+	URLOther                // Other resources: frames, scripts, stylesheets, forms, objects, CSS @import.
+)
+
+// urlKind returns the kind of URL held by attribute key of tag, and
+// whether the attribute holds a URL at all.
+func urlKind(tag, key string, t *Token) (URLKind, bool) {
+	switch key {
+	case "href":
+		if tag == "a" || tag == "area" {
+			return URLLink, true
+		}
+		if tag == "image" { // SVG <image href>
+			return URLImage, true
+		}
+		return URLOther, true
+	case "xlink:href":
+		if tag == "image" {
+			return URLImage, true
+		}
+		return URLLink, true
+	case "src":
+		switch tag {
+		case "img", "source":
+			return URLImage, true
+		case "input":
+			if typ, _ := t.Attr("type"); strings.EqualFold(typ, "image") {
+				return URLImage, true
+			}
+		}
+		return URLOther, true
+	case "background", "poster", "lowsrc", "dynsrc":
+		return URLImage, true
+	case "action", "formaction", "data", "cite", "longdesc", "codebase", "manifest":
+		return URLOther, true
+	}
+	return 0, false
+}
+
+// RewriteURLs calls fn for every URL in html and replaces the URL with
+// the result: URL attributes however they are quoted, each candidate of
+// a srcset, and url() and @import references in style attributes and
+// <style> elements. Attribute values are passed to fn entity-decoded.
+// Tokens are left byte-for-byte unchanged unless fn changes one of
+// their URLs.
+func RewriteURLs(src []byte, fn func(rawURL string, kind URLKind) string) []byte {
+	if len(src) == 0 {
+		return src
+	}
+	tokens := Tokenize(src)
+	var out bytes.Buffer
+	out.Grow(len(src))
+	for i := range tokens {
+		t := &tokens[i]
+		switch {
+		case t.Type == StartTagToken:
+			rewriteTag(t, fn)
+		case t.Type == TextToken && t.Tag == "style":
+			if css := string(t.Raw); css != "" {
+				if rewritten := rewriteCSS(css, fn); rewritten != css {
+					t.SetText(rewritten)
+				}
+			}
+		}
+		out.Write(t.Bytes())
+	}
+	return out.Bytes()
+}
+
+// rewriteTag rewrites the URLs in a start tag's attributes.
+func rewriteTag(t *Token, fn func(string, URLKind) string) {
+	for i := range t.Attrs {
+		a := &t.Attrs[i]
+		var val string
+		switch {
+		case a.Key == "srcset":
+			val = rewriteSrcset(a.Val, fn)
+		case a.Key == "style":
+			val = rewriteCSS(a.Val, fn)
+		default:
+			kind, ok := urlKind(t.Tag, a.Key, t)
+			if !ok {
+				continue
+			}
+			val = fn(strings.TrimSpace(a.Val), kind)
+			if val == strings.TrimSpace(a.Val) {
+				val = a.Val
+			}
+		}
+		if val != a.Val {
+			a.Val = val
+			t.dirty = true
+		}
+	}
+}
+
+// rewriteSrcset rewrites each image candidate URL of a srcset value.
+// A candidate URL is a run of non-space characters (so data: URIs with
+// commas survive); trailing commas end a candidate without descriptors.
+func rewriteSrcset(s string, fn func(string, URLKind) string) string {
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(s); {
+		for i < len(s) && (isSpace(s[i]) || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		start := i
+		for i < len(s) && !isSpace(s[i]) {
+			i++
+		}
+		u := s[start:i]
+		desc := ""
+		if trimmed := strings.TrimRight(u, ","); trimmed != u {
+			u = trimmed
+		} else {
+			dstart := i
+			depth := 0
+			for i < len(s) && (depth > 0 || s[i] != ',') {
+				switch s[i] {
+				case '(':
+					depth++
+				case ')':
+					depth--
+				}
+				i++
+			}
+			desc = strings.TrimSpace(s[dstart:i])
+		}
+		nu := fn(u, URLImage)
+		if nu != u {
+			changed = true
+		}
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(nu)
+		if desc != "" {
+			b.WriteByte(' ')
+			b.WriteString(desc)
+		}
+	}
+	if !changed {
+		return s
+	}
+	return b.String()
+}
+
+// cssURLRe matches url() references and @import strings in CSS.
+var cssURLRe = regexp.MustCompile(`(?i)(url\(\s*)(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))(\s*\))|(@import\s+)(?:"([^"]*)"|'([^']*)')`)
+
+// rewriteCSS rewrites the url() and @import references in CSS text.
+func rewriteCSS(css string, fn func(string, URLKind) string) string {
+	if !strings.Contains(strings.ToLower(css), "url(") && !strings.Contains(strings.ToLower(css), "@import") {
+		return css
+	}
+	return cssURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		g := cssURLRe.FindStringSubmatch(m)
+		if g[6] != "" {
+			u := g[7] + g[8]
+			nu := fn(u, URLOther)
+			if nu == u {
+				return m
+			}
+			return g[6] + cssString(nu)
+		}
+		u := g[2] + g[3] + g[4]
+		nu := fn(u, URLImage)
+		if nu == u {
+			return m
+		}
+		return g[1] + cssString(nu) + g[5]
+	})
+}
+
+// cssString quotes s as a CSS string.
+func cssString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\a `).Replace(s) + `"`
+}
+
+// ResolveContentIDs replaces the cid: URLs in html with the result of
+// lookup for their content-ID, given percent-decoded and without the
+// "cid:" scheme or angle brackets. References for which lookup returns
+// "" are left as-is.
+func ResolveContentIDs(html []byte, lookup func(cid string) string) []byte {
+	if !bytes.Contains(bytes.ToLower(html), []byte("cid:")) {
+		return html
+	}
+	return RewriteURLs(html, func(rawURL string, kind URLKind) string {
+		if len(rawURL) < 4 || !strings.EqualFold(rawURL[:4], "cid:") {
+			return rawURL
+		}
+		cid := rawURL[4:]
+		if unescaped, err := url.PathUnescape(cid); err == nil {
+			cid = unescaped
+		}
+		if r := lookup(strings.Trim(cid, "<>")); r != "" {
+			return r
+		}
+		return rawURL
+	})
+}
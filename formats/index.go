@@ -0,0 +1,75 @@
+// index.go writes the index.csv listing and per-message folder names
+// shared by the mailbox converters (mbox, PST).
+
+package formats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFolderName caps folder names derived from subjects and mailbox
+// folder names.
+const maxFolderName = 60
+
+// FolderName turns a subject or mailbox folder name into a safe path
+// component of at most maxFolderName characters, or "" if nothing is
+// left of it.
+func FolderName(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	if utf8.RuneCountInString(s) > maxFolderName {
+		s = string([]rune(s)[:maxFolderName])
+	}
+	return strings.TrimRight(SanitizeFilename(s), ". ")
+}
+
+// MessageFolder builds a per-message folder name from its 1-based
+// position and subject, e.g. "0007_Quarterly report".
+func MessageFolder(n int, subject string) string {
+	name := fmt.Sprintf("%04d", n)
+	if subject = FolderName(subject); subject != "" {
+		name += "_" + subject
+	}
+	return name
+}
+
+// Index builds the index.csv file of a mailbox conversion, with one row
+// per message giving its folder, date, sender, and subject.
+type Index struct {
+	buf bytes.Buffer
+	w   *csv.Writer
+}
+
+// NewIndex returns an Index holding only the header row.
+func NewIndex() *Index {
+	x := &Index{}
+	x.w = csv.NewWriter(&x.buf)
+	x.w.Write([]string{"folder", "date", "from", "subject"})
+	return x
+}
+
+// Add appends a message row. Cells that a spreadsheet would read as a
+// formula are prefixed with "'".
+func (x *Index) Add(folder, date, from, subject string) {
+	x.w.Write([]string{csvCell(folder), csvCell(date), csvCell(from), csvCell(subject)})
+}
+
+// File returns the index as the index.csv body output.
+func (x *Index) File() ConvertedFile {
+	x.w.Flush()
+	return ConvertedFile{Name: "index.csv", Data: x.buf.Bytes(), Category: CategoryBody}
+}
+
+// csvCell neutralizes a cell that starts like a spreadsheet formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
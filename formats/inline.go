@@ -1,213 +1,203 @@
 // inline.go fetches external images referenced in HTML and converts them
-// to inline data URIs. All network access goes through an SSRF-safe HTTP
-// client that blocks private, loopback, and link-local addresses.
+// to inline data URIs. Images are retrieved through an ImageFetcher; the
+// default one refuses internal addresses (see SSRFPolicy) and keeps
+// popular images in a process-wide memory cache.
 
 package formats
 
 import (
 	"context"
 	"encoding/base64"
-	"errors"
-	"io"
-	"net"
-	"net/http"
-	"net/url"
-	"regexp"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 )
 
-// imgSrcRe matches <img src="..."> attributes for URL replacement.
-var imgSrcRe = regexp.MustCompile(`(<img\b[^>]*?\bsrc=")([^"]+)(")`)
-
-// ssrfSafeDialer returns a DialContext that resolves DNS and checks every
-// resolved IP against the private/loopback/link-local blocklist BEFORE
-// connecting.  This eliminates the DNS rebinding TOCTOU race that exists
-// when isPrivateHost() and the actual connection resolve independently.
-func ssrfSafeDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: 5 * time.Second}
-	resolver := &net.Resolver{}
-
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		host, port, err := net.SplitHostPort(addr)
-		if err != nil {
-			return nil, err
-		}
-
-		// Block obviously dangerous hostnames before any DNS lookup.
-		if isBlockedHostname(host) {
-			return nil, errors.New("blocked host")
-		}
-
-		// Resolve with a tight timeout to prevent hanging on unresolvable hosts.
-		resolveCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
-		defer cancel()
-
-		ips, err := resolver.LookupIPAddr(resolveCtx, host)
-		if err != nil {
-			return nil, err
-		}
-
-		// Check ALL resolved IPs -- block if any are private.
-		for _, ip := range ips {
-			if isBlockedIP(ip.IP) {
-				return nil, errors.New("blocked IP")
-			}
-		}
-
-		// Connect to the resolved IP directly (bypasses further DNS).
-		// Try each resolved address until one succeeds.
-		for _, ip := range ips {
-			target := net.JoinHostPort(ip.IP.String(), port)
-			conn, err := dialer.DialContext(ctx, network, target)
-			if err == nil {
-				return conn, nil
-			}
-		}
-		return nil, errors.New("all addresses failed")
+// InlineExternalImages finds all external image references in html
+// (see RewriteURLs), fetches the image data with DefaultFetcher, and
+// replaces each reference with a data URI. Images that fail to download
+// are left as-is. Only http/https URLs are fetched. Each unique URL is
+// fetched only once to avoid rate limiting. Pass a non-nil cache map to
+// share results across multiple calls.
+func InlineExternalImages(html []byte, cache map[string]string) []byte {
+	in := NewImageInliner(Options{})
+	if cache != nil {
+		in.cache = cache
 	}
+	return in.Inline(context.Background(), html)
 }
 
-// inlineClient uses a custom transport with an SSRF-safe dialer that
-// validates resolved IPs before connecting.
-var inlineClient = &http.Client{
-	Timeout: 10 * time.Second,
-	Transport: &http.Transport{
-		DialContext:           ssrfSafeDialer(),
-		TLSHandshakeTimeout:   5 * time.Second,
-		ResponseHeaderTimeout: 5 * time.Second,
-		MaxIdleConns:          10,
-		MaxIdleConnsPerHost:   2,
-		IdleConnTimeout:       30 * time.Second,
-	},
-	// Validate each redirect target against the SSRF blocklist.
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		if len(via) >= 3 {
-			return errors.New("too many redirects")
-		}
-		host := req.URL.Hostname()
-		if isBlockedHostname(host) {
-			return errors.New("redirect to blocked host")
-		}
-		// The custom dialer will also check the resolved IP, so even if
-		// the hostname looks benign, a private IP will still be blocked.
-		return nil
-	},
+// ImageInliner embeds the external images of the HTML bodies of one
+// conversion. Images are fetched concurrently, up to a limit, and all
+// bodies share a cache and a budget: fetching stops once the total time
+// or number of image bytes allowed for the conversion is used up.
+type ImageInliner struct {
+	fetcher     ImageFetcher
+	concurrency int
+	maxBytes    int64
+	deadline    time.Time
+	log         *slog.Logger
+
+	mu    sync.Mutex
+	cache map[string]string // URL to data URI; "" if the fetch failed
+	used  int64             // image bytes inlined so far
 }
 
-// InlineExternalImages finds all <img src="https://..."> references in html,
-// fetches the image data, and replaces src with a data URI. Images that
-// fail to download are left as-is. Only http/https URLs are fetched.
-// Each unique URL is fetched only once to avoid rate limiting. Pass a
-// non-nil cache map to share results across multiple calls.
-func InlineExternalImages(html []byte, cache map[string]string) []byte {
-	if cache == nil {
-		cache = make(map[string]string)
+// NewImageInliner returns an ImageInliner using the fetcher, limits and
+// logger of opts. Its time budget starts now.
+func NewImageInliner(opts Options) *ImageInliner {
+	return &ImageInliner{
+		fetcher:     next(opts.Fetcher),
+		concurrency: opts.fetchConcurrency(),
+		maxBytes:    opts.fetchMaxBytes(),
+		deadline:    time.Now().Add(opts.fetchTimeout()),
+		log:         opts.Log(),
+		cache:       make(map[string]string),
 	}
+}
 
-	return imgSrcRe.ReplaceAllFunc(html, func(match []byte) []byte {
-		parts := imgSrcRe.FindSubmatch(match)
-		if len(parts) < 4 {
-			return match
-		}
-		prefix := parts[1] // <img ... src="
-		rawURL := string(parts[2])
-		suffix := parts[3] // "
-
-		if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
-			return match
-		}
-
-		if strings.HasPrefix(rawURL, "data:") {
-			return match
-		}
-
-		dataURI, seen := cache[rawURL]
-		if !seen {
-			data, contentType, err := fetchImage(rawURL)
-			if err != nil || len(data) == 0 {
-				cache[rawURL] = ""
-			} else {
-				mime := imageContentType(contentType)
-				b64 := base64.StdEncoding.EncodeToString(data)
-				dataURI = "data:" + mime + ";base64," + b64
-				cache[rawURL] = dataURI
+// Inline replaces the external image references in html with data URIs.
+// Images that fail to download, or that do not fit in the remaining
+// budget or before ctx is done, are left as-is.
+func (in *ImageInliner) Inline(ctx context.Context, html []byte) []byte {
+	var pending []string
+	queued := make(map[string]bool)
+	RewriteURLs(html, func(rawURL string, kind URLKind) string {
+		if kind == URLImage && isRemote(rawURL) && !queued[rawURL] {
+			queued[rawURL] = true
+			if _, seen := in.lookup(rawURL); !seen {
+				pending = append(pending, rawURL)
 			}
 		}
+		return rawURL
+	})
+	if len(queued) == 0 {
+		return html
+	}
+	in.fetchAll(ctx, pending)
 
-		if dataURI == "" {
-			return match
+	return RewriteURLs(html, func(rawURL string, kind URLKind) string {
+		if kind != URLImage || !isRemote(rawURL) {
+			return rawURL
 		}
-
-		var result []byte
-		result = append(result, prefix...)
-		result = append(result, []byte(dataURI)...)
-		result = append(result, suffix...)
-		return result
+		if dataURI, _ := in.lookup(rawURL); dataURI != "" {
+			return dataURI
+		}
+		return rawURL
 	})
 }
 
-// fetchImage downloads an image from rawURL and returns the bytes and content type.
-// Returns empty results (without error) for non-image or blocked URLs.
-func fetchImage(rawURL string) ([]byte, string, error) {
-	// Basic URL validation.
-	parsed, err := url.Parse(rawURL)
-	if err != nil {
-		return nil, "", err
-	}
-	if parsed.Scheme != "http" && parsed.Scheme != "https" {
-		return nil, "", nil
-	}
-
-	// Hostname pre-check (the dialer also checks resolved IPs).
-	if isBlockedHostname(parsed.Hostname()) {
-		return nil, "", nil
-	}
+// lookup returns the cached data URI for rawURL and whether it has been
+// fetched before.
+func (in *ImageInliner) lookup(rawURL string) (string, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	dataURI, seen := in.cache[rawURL]
+	return dataURI, seen
+}
 
-	resp, err := inlineClient.Get(rawURL)
-	if err != nil {
-		return nil, "", err
-	}
-	defer resp.Body.Close()
+// exhausted reports whether the byte budget is used up.
+func (in *ImageInliner) exhausted() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.used >= in.maxBytes
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", nil
+// fetchAll fetches urls with at most in.concurrency requests in flight,
+// until the deadline or the byte budget is reached.
+func (in *ImageInliner) fetchAll(ctx context.Context, urls []string) {
+	ctx, cancel := context.WithDeadline(ctx, in.deadline)
+	defer cancel()
+
+	sem := make(chan struct{}, in.concurrency)
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil || in.exhausted() {
+			in.log.Debug("image fetch budget exhausted", "skipped", len(urls)-i)
+			break
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			in.fetch(ctx, rawURL)
+		})
 	}
+	wg.Wait()
+}
 
-	ct := resp.Header.Get("Content-Type")
-	if !strings.HasPrefix(ct, "image/") {
-		return nil, "", nil
+// fetch fetches one image and records the result, unless it no longer
+// fits in the byte budget.
+func (in *ImageInliner) fetch(ctx context.Context, rawURL string) {
+	data, contentType, err := in.fetcher.Fetch(ctx, rawURL)
+	if err != nil || len(data) == 0 {
+		if err != nil {
+			in.log.Debug("external image not inlined", "url", rawURL, "error", err)
+		}
+		// A fetch cut short by the time budget is not a failure of the
+		// image itself, so it is not remembered.
+		if ctx.Err() == nil {
+			in.mu.Lock()
+			in.cache[rawURL] = ""
+			in.mu.Unlock()
+		}
+		return
 	}
 
-	// Limit to 5 MB per image.
-	data, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
-	if err != nil {
-		return nil, "", err
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.used+int64(len(data)) > in.maxBytes {
+		// Stop fetching rather than downloading images that are
+		// unlikely to fit either.
+		in.used = in.maxBytes
+		in.log.Debug("external image not inlined", "url", rawURL, "error", "image byte budget exceeded")
+		return
 	}
-	return data, ct, nil
+	in.used += int64(len(data))
+	in.cache[rawURL] = "data:" + imageContentType(contentType) + ";base64," + base64.StdEncoding.EncodeToString(data)
 }
 
-// isBlockedHostname returns true if the hostname should be blocked
-// without needing DNS resolution.
-func isBlockedHostname(host string) bool {
-	lower := strings.ToLower(host)
-	if lower == "localhost" || strings.HasSuffix(lower, ".local") ||
-		lower == "metadata.google.internal" ||
-		strings.HasSuffix(lower, ".internal") {
-		return true
-	}
-	// Also block if the host is a raw IP that is private.
-	if ip := net.ParseIP(host); ip != nil {
-		return isBlockedIP(ip)
-	}
-	return false
+// isRemote reports whether rawURL is an http or https URL.
+func isRemote(rawURL string) bool {
+	lower := strings.ToLower(rawURL)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
 }
 
-// isBlockedIP returns true if the IP address is in a range that should
-// not be fetched (private, loopback, link-local, unspecified).
-func isBlockedIP(ip net.IP) bool {
-	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
-		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+// placeholderSVG is the picture behind PlaceholderImage: a small grey
+// picture frame.
+const placeholderSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="32" height="32" viewBox="0 0 32 32">` +
+	`<rect x="1" y="1" width="30" height="30" fill="#eee" stroke="#bbb"/>` +
+	`<path d="M6 25l7-9 5 6 3-3 5 6z" fill="#bbb"/><circle cx="22" cy="10" r="3" fill="#bbb"/></svg>`
+
+// PlaceholderImage is the data URI substituted for external images by
+// BlockExternalImages.
+var PlaceholderImage = "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(placeholderSVG))
+
+// BlockExternalImages finds the http and https image references in
+// html (see RewriteURLs) without fetching them, for offline conversion.
+// It returns the distinct URLs in order of appearance and, if placeholder
+// is set, html with each of those references replaced by
+// PlaceholderImage; otherwise html is returned unchanged.
+func BlockExternalImages(html []byte, placeholder bool) ([]byte, []string) {
+	var urls []string
+	seen := make(map[string]bool)
+	out := RewriteURLs(html, func(rawURL string, kind URLKind) string {
+		if kind != URLImage || !isRemote(rawURL) {
+			return rawURL
+		}
+		if !seen[rawURL] {
+			seen[rawURL] = true
+			urls = append(urls, rawURL)
+		}
+		if !placeholder {
+			return rawURL
+		}
+		return PlaceholderImage
+	})
+	return out, urls
 }
 
 // imageContentType normalises a Content-Type header to a standard image MIME type.
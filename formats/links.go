@@ -0,0 +1,311 @@
+// links.go extracts the hyperlinks of HTML bodies for triage: links
+// rewritten by mail security gateways are unwrapped to their real
+// target, and common phishing indicators are flagged.
+
+package formats
+
+import (
+	"encoding/base64"
+	"html"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Link is a hyperlink found in a message body.
+type Link struct {
+	Body        string   `json:"body"`                  // output name of the body holding the link
+	URL         string   `json:"url"`                   // the href as written
+	Target      string   `json:"target"`                // URL with gateway rewriting undone
+	Host        string   `json:"host,omitempty"`        // host the link leads to
+	UnicodeHost string   `json:"unicodeHost,omitempty"` // Host with punycode labels decoded, if different
+	Text        string   `json:"text,omitempty"`        // display text
+	Wrappers    []string `json:"wrappers,omitempty"`    // gateways that rewrote the link, outermost first
+	Flags       []string `json:"flags,omitempty"`       // phishing indicators
+}
+
+// Link flags.
+const (
+	FlagTextMismatch  = "text-mismatch"  // display text names a different host
+	FlagPunycode      = "punycode"       // host is an internationalised domain name
+	FlagHomograph     = "homograph"      // host mixes scripts or imitates Latin letters
+	FlagIPHost        = "ip-host"        // host is an IP address
+	FlagUserinfo      = "userinfo"       // URL carries credentials before the host
+	FlagDataURL       = "data-url"       // data: link
+	FlagJavaScriptURL = "javascript-url" // javascript: or vbscript: link
+)
+
+// Gateways recognised by UnwrapURL.
+const (
+	WrapperSafeLinks  = "safelinks"  // Microsoft Defender Safe Links
+	WrapperURLDefense = "urldefense" // Proofpoint URL Defense
+	WrapperMimecast   = "mimecast"   // Mimecast URL Protect
+)
+
+// ExtractLinks returns the <a> and <area> links of html in order of
+// appearance, unwrapped and flagged, with Body set to body. An <a>
+// without an href is read from its data-href, where renderers keep
+// targets they do not make clickable.
+func ExtractLinks(html []byte, body string) []Link {
+	var links []Link
+	var text []string
+	open := -1 // index in links of the <a> whose text is being read
+	for _, t := range Tokenize(html) {
+		switch {
+		case t.Type == StartTagToken && (t.Tag == "a" || t.Tag == "area"):
+			if open >= 0 {
+				links[open].setText(text)
+				open = -1
+			}
+			href, ok := t.Attr("href")
+			if !ok && t.Tag == "a" {
+				href, ok = t.Attr("data-href")
+			}
+			if !ok || strings.TrimSpace(href) == "" || strings.HasPrefix(strings.TrimSpace(href), "#") {
+				continue
+			}
+			links = append(links, newLink(strings.TrimSpace(href), body))
+			if t.Tag == "a" {
+				open, text = len(links)-1, nil
+			} else if alt, _ := t.Attr("alt"); alt != "" {
+				links[len(links)-1].setText([]string{alt})
+			}
+		case t.Type == EndTagToken && t.Tag == "a" && open >= 0:
+			links[open].setText(text)
+			open = -1
+		case t.Type == TextToken && t.Tag == "" && open >= 0:
+			text = append(text, string(t.Raw))
+		}
+	}
+	if open >= 0 {
+		links[open].setText(text)
+	}
+	return links
+}
+
+// newLink returns the unwrapped, partially flagged Link for href; the
+// text-dependent flags are added by setText.
+func newLink(href, body string) Link {
+	l := Link{Body: body, URL: href}
+	l.Target, l.Wrappers = UnwrapURL(href)
+	u, err := url.Parse(l.Target)
+	if err == nil {
+		l.Host = strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+		if len(l.Wrappers) > 0 && l.Wrappers[len(l.Wrappers)-1] == WrapperMimecast {
+			l.Host = strings.ToLower(u.Query().Get("domain"))
+		}
+		if u.User != nil {
+			l.Flags = append(l.Flags, FlagUserinfo)
+		}
+	}
+	switch scheme := strings.ToLower(strings.TrimSpace(strings.SplitN(l.Target, ":", 2)[0])); scheme {
+	case "data":
+		l.Flags = append(l.Flags, FlagDataURL)
+	case "javascript", "vbscript":
+		l.Flags = append(l.Flags, FlagJavaScriptURL)
+	}
+	if l.Host != "" {
+		if uh := unicodeHost(l.Host); uh != l.Host || !isASCII(l.Host) {
+			l.UnicodeHost = uh
+			l.Flags = append(l.Flags, FlagPunycode)
+			if isHomograph(uh) {
+				l.Flags = append(l.Flags, FlagHomograph)
+			}
+		}
+		if isIPHost(l.Host) {
+			l.Flags = append(l.Flags, FlagIPHost)
+		}
+	}
+	return l
+}
+
+// setText records the display text of l and flags it if it names a
+// different host than the link leads to.
+func (l *Link) setText(parts []string) {
+	l.Text = strings.Join(strings.Fields(html.UnescapeString(strings.Join(parts, " "))), " ")
+	if th := textHost(l.Text); th != "" && l.Host != "" && !sameSite(th, l.Host) {
+		l.Flags = append(l.Flags, FlagTextMismatch)
+	}
+}
+
+// UnwrapURL undoes the rewriting of rawURL by Safe Links, URL Defense
+// (versions 1 to 3), and Mimecast, including links wrapped by more than
+// one gateway. It returns the real target and the gateways found,
+// outermost first. Mimecast links do not contain their target, so they
+// are returned unchanged; the destination domain is in their "domain"
+// query parameter.
+func UnwrapURL(rawURL string) (string, []string) {
+	var wrappers []string
+	for range 5 {
+		target, wrapper := unwrapOnce(rawURL)
+		if wrapper == "" {
+			break
+		}
+		wrappers = append(wrappers, wrapper)
+		if target == rawURL {
+			break
+		}
+		rawURL = target
+	}
+	return rawURL, wrappers
+}
+
+// unwrapOnce removes one layer of gateway rewriting.
+func unwrapOnce(rawURL string) (string, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL, ""
+	}
+	host := strings.ToLower(u.Hostname())
+	q := u.Query()
+	switch {
+	case strings.HasSuffix(host, ".safelinks.protection.outlook.com") && q.Get("url") != "":
+		return q.Get("url"), WrapperSafeLinks
+	case host == "urldefense.proofpoint.com" && u.Path == "/v1/url" && q.Get("u") != "":
+		return q.Get("u"), WrapperURLDefense
+	case host == "urldefense.proofpoint.com" && u.Path == "/v2/url" && q.Get("u") != "":
+		v2 := strings.NewReplacer("-", "%", "_", "/").Replace(q.Get("u"))
+		if target, err := url.PathUnescape(v2); err == nil {
+			return target, WrapperURLDefense
+		}
+	case host == "urldefense.com" && strings.HasPrefix(u.Path, "/v3/__"):
+		if target, ok := decodeURLDefenseV3(rawURL); ok {
+			return target, WrapperURLDefense
+		}
+	case host == "mimecastprotect.com" || strings.HasSuffix(host, ".mimecastprotect.com") ||
+		(strings.HasSuffix(host, ".mimecast.com") && strings.HasPrefix(u.Path, "/s/")):
+		return rawURL, WrapperMimecast
+	}
+	return rawURL, ""
+}
+
+// urlDefenseV3Re matches a URL Defense v3 link: the target with some
+// characters replaced by "*", and the replaced characters in base64.
+var urlDefenseV3Re = regexp.MustCompile(`v3/__(.+?)__;(.*?)!`)
+
+// urlDefenseRuns maps the character after "**" in a v3 link to the
+// number of characters replaced, starting at 2.
+const urlDefenseRuns = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// decodeURLDefenseV3 recovers the target of a URL Defense v3 link.
+func decodeURLDefenseV3(rawURL string) (string, bool) {
+	m := urlDefenseV3Re.FindStringSubmatch(rawURL)
+	if m == nil {
+		return "", false
+	}
+	encoded, err := url.PathUnescape(m[1])
+	if err != nil {
+		encoded = m[1]
+	}
+	replaced, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m[2], "="))
+	if err != nil {
+		return "", false
+	}
+	chars := []rune(string(replaced))
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '*' {
+			b.WriteByte(encoded[i])
+			continue
+		}
+		n := 1
+		if i+2 < len(encoded) && encoded[i+1] == '*' {
+			n = strings.IndexByte(urlDefenseRuns, encoded[i+2]) + 2
+			if n < 2 {
+				return "", false
+			}
+			i += 2
+		}
+		if next+n > len(chars) {
+			return "", false
+		}
+		b.WriteString(string(chars[next : next+n]))
+		next += n
+	}
+	return b.String(), true
+}
+
+// commonTLDs are the top-level domains textHost accepts for display
+// text without a scheme or "www.", to tell domains from file names.
+var commonTLDs = map[string]bool{
+	"com": true, "net": true, "org": true, "edu": true, "gov": true,
+	"mil": true, "int": true, "io": true, "co": true, "info": true,
+	"biz": true, "me": true, "us": true, "uk": true, "ca": true,
+	"au": true, "de": true, "fr": true, "nl": true, "be": true,
+	"ch": true, "at": true, "it": true, "es": true, "se": true,
+	"no": true, "dk": true, "fi": true, "ie": true, "pl": true,
+	"ru": true, "cn": true, "jp": true, "in": true, "br": true,
+	"app": true, "dev": true, "online": true, "site": true,
+}
+
+// textDomainRe matches display text that is a bare domain, optionally
+// followed by a path.
+var textDomainRe = regexp.MustCompile(`^((?:[\p{L}\p{N}-]+\.)+([\p{L}]{2,}))\.?(?:[/:?#]\S*)?$`)
+
+// textHost returns the host named by link display text that looks like
+// a URL or domain, or "".
+func textHost(text string) string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" || strings.ContainsAny(text, " \t") {
+		return ""
+	}
+	if u, err := url.Parse(text); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return strings.TrimSuffix(u.Hostname(), ".")
+	}
+	if m := textDomainRe.FindStringSubmatch(text); m != nil && (strings.HasPrefix(text, "www.") || commonTLDs[m[2]]) {
+		return m[1]
+	}
+	return ""
+}
+
+// sameSite reports whether hosts a and b are equal, ignoring a leading
+// "www.", or one is a subdomain of the other.
+func sameSite(a, b string) bool {
+	a, b = strings.TrimPrefix(a, "www."), strings.TrimPrefix(b, "www.")
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// ipHostRe matches IPv4 hosts in the decimal, octal, and hexadecimal
+// forms browsers accept, such as 3232235777 or 0x7f.1.
+var ipHostRe = regexp.MustCompile(`^(0x[0-9a-f]+|[0-9]+)(\.(0x[0-9a-f]+|[0-9]+)){0,3}$`)
+
+// isIPHost reports whether host is an IP address literal.
+func isIPHost(host string) bool {
+	return net.ParseIP(strings.Trim(host, "[]")) != nil || ipHostRe.MatchString(host)
+}
+
+// isHomograph reports whether a label of host mixes Latin, Cyrillic and
+// Greek letters, or is written only in Cyrillic or Greek under an ASCII
+// top-level domain, the usual ways of imitating a Latin domain name.
+func isHomograph(host string) bool {
+	labels := strings.Split(host, ".")
+	asciiTLD := isASCII(labels[len(labels)-1])
+	for _, label := range labels {
+		var latin, other bool
+		for _, r := range label {
+			switch {
+			case unicode.Is(unicode.Latin, r):
+				latin = true
+			case unicode.Is(unicode.Cyrillic, r), unicode.Is(unicode.Greek, r):
+				other = true
+			}
+		}
+		if other && (latin || asciiTLD) {
+			return true
+		}
+	}
+	return false
+}
+
+// isASCII reports whether s contains only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
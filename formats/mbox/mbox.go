@@ -0,0 +1,94 @@
+// Package mbox implements the Unix mailbox (mbox) format converter.
+// It is automatically registered with the formats registry on import.
+//
+// Each message is decoded through the MIME pipeline (which also unpacks
+// winmail.dat parts) and written to its own numbered folder. An
+// index.csv file lists every message with its folder, date, sender, and
+// subject.
+package mbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/formats/tnef"
+	"github.com/avaropoint/converter/parsers/eml"
+	parser "github.com/avaropoint/converter/parsers/mbox"
+	tnefparser "github.com/avaropoint/converter/parsers/tnef"
+)
+
+func init() {
+	formats.Register(&converter{})
+}
+
+type converter struct{}
+
+func (c *converter) Name() string {
+	return "Unix Mailbox (mbox)"
+}
+
+func (c *converter) Extensions() []string {
+	return []string{".mbox", ".mbx"}
+}
+
+func (c *converter) Match(data []byte) bool {
+	return parser.IsMbox(data)
+}
+
+func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := parser.Split(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []formats.ConvertedFile
+	index := formats.NewIndex()
+
+	for i, m := range msgs {
+		msg, err := eml.DecodeWithOptions(m.Data, tnef.EMLOptions(opts))
+		if err != nil {
+			folder := fmt.Sprintf("%04d", i+1)
+			index.Add(folder, "", "", "(unparseable message: "+err.Error()+")")
+			files = append(files, formats.ConvertedFile{
+				Name:     folder + "/message.eml",
+				Data:     m.Data,
+				Category: formats.CategoryAttachment,
+			})
+			continue
+		}
+
+		subject := msg.GetAttrString(tnefparser.MAPISubject)
+		folder := formats.MessageFolder(i+1, subject)
+		date := ""
+		if t := msg.GetAttrTime(tnefparser.MAPIClientSubmitTime); !t.IsZero() {
+			date = t.Format(time.RFC3339)
+		}
+		from := msg.GetAttrString(tnefparser.MAPISenderName)
+		if email := msg.GetAttrString(tnefparser.MAPISenderEmail); email != "" && email != from {
+			from += " <" + email + ">"
+		}
+		index.Add(folder, date, from, subject)
+
+		converted, err := tnef.ConvertMessageWithOptions(ctx, msg, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range converted {
+			f.Name = folder + "/" + f.Name
+			files = append(files, f)
+		}
+	}
+	return append(files, index.File()), nil
+}
@@ -0,0 +1,45 @@
+package mbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConverterName(t *testing.T) {
+	c := &converter{}
+	if c.Name() != "Unix Mailbox (mbox)" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+}
+
+func TestConvert(t *testing.T) {
+	data := "From a@example.com Mon Mar  2 10:00:00 2026\n" +
+		"From: Alice <a@example.com>\nSubject: Hello/World\n" +
+		"Date: Mon, 02 Mar 2026 10:00:00 +0000\n\nhi\n\n" +
+		"From b@example.com Mon Mar  2 11:00:00 2026\n" +
+		"From: b@example.com\n\nno subject\n"
+
+	c := &converter{}
+	if !c.Match([]byte(data)) {
+		t.Fatal("expected Match to return true")
+	}
+	files, err := c.Convert([]byte(data))
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+
+	names := make(map[string]string)
+	for _, f := range files {
+		names[f.Name] = string(f.Data)
+	}
+	if names["0001_Hello_World/body.txt"] != "hi\n" {
+		t.Errorf("missing first message body, got %v", names)
+	}
+	if _, ok := names["0002/body.txt"]; !ok {
+		t.Errorf("missing second message body, got %v", names)
+	}
+	index := names["index.csv"]
+	if !strings.Contains(index, "0001_Hello_World,2026-03-02T10:00:00Z,Alice <a@example.com>,Hello/World") {
+		t.Errorf("unexpected index:\n%s", index)
+	}
+}
@@ -0,0 +1,94 @@
+package formats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"path"
+	"strings"
+)
+
+// mimeTypes maps lower-case file extensions to media types. It is used
+// instead of mime.TypeByExtension so results do not depend on the host's
+// mime.types files.
+var mimeTypes = map[string]string{
+	".txt":  "text/plain",
+	".htm":  "text/html",
+	".html": "text/html",
+	".csv":  "text/csv",
+	".xml":  "application/xml",
+	".json": "application/json",
+	".rtf":  "application/rtf",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".bmp":  "image/bmp",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".ico":  "image/x-icon",
+	".wmf":  "image/wmf",
+	".emf":  "image/emf",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".tar":  "application/x-tar",
+	".eml":  "message/rfc822",
+	".msg":  "application/vnd.ms-outlook",
+	".pst":  "application/vnd.ms-outlook-pst",
+	".mbox": "application/mbox",
+	".dat":  "application/ms-tnef",
+	".tnef": "application/ms-tnef",
+	".ics":  "text/calendar",
+	".vcf":  "text/vcard",
+	".p7m":  "application/pkcs7-mime",
+	".p7s":  "application/pkcs7-signature",
+	".url":  "application/internet-shortcut",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".mp4":  "video/mp4",
+}
+
+// MIMEType returns the media type for a file name based on its
+// extension, or "application/octet-stream" if the extension is unknown.
+func MIMEType(name string) string {
+	if t, ok := mimeTypes[strings.ToLower(path.Ext(name))]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Annotate fills in the metadata that can be derived from a file's name
+// and content: the SHA-256 digest and, when the source declared no
+// specific type, the MIME type. Declared types are normalized to a
+// lower-case media type without parameters.
+func Annotate(files []ConvertedFile) {
+	for i := range files {
+		f := &files[i]
+		if f.MIMEType != "" {
+			if mt, _, err := mime.ParseMediaType(f.MIMEType); err == nil {
+				f.MIMEType = mt
+			} else {
+				f.MIMEType = ""
+			}
+		}
+		if f.MIMEType == "" || f.MIMEType == "application/octet-stream" {
+			f.MIMEType = MIMEType(f.Name)
+		}
+		if f.SHA256 == "" {
+			sum := sha256.Sum256(f.Data)
+			f.SHA256 = hex.EncodeToString(sum[:])
+		}
+	}
+}
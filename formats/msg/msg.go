@@ -0,0 +1,60 @@
+// Package msg implements the Outlook .msg format converter.
+// It is automatically registered with the formats registry on import.
+package msg
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/formats/tnef"
+	"github.com/avaropoint/converter/parsers/cfb"
+	parser "github.com/avaropoint/converter/parsers/msg"
+	tnefparser "github.com/avaropoint/converter/parsers/tnef"
+)
+
+func init() {
+	formats.Register(&converter{})
+}
+
+type converter struct{}
+
+func (c *converter) Name() string {
+	return "Outlook Message (.msg)"
+}
+
+func (c *converter) Extensions() []string {
+	return []string{".msg"}
+}
+
+// Match checks for the compound file signature and, because Word and
+// Excel documents share that container, for the MSG property stream.
+func (c *converter) Match(data []byte) bool {
+	if len(data) < len(cfb.Signature) || !bytes.Equal(data[:len(cfb.Signature)], cfb.Signature) {
+		return false
+	}
+	return parser.IsMessage(data)
+}
+
+func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parser.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return tnef.ConvertMessageWithOptions(ctx, msg, opts)
+}
+
+// Decode parses data into a message without converting it, for callers
+// that want to inspect its structure.
+func (c *converter) Decode(data []byte) (*tnefparser.Message, error) {
+	return parser.Decode(data)
+}
@@ -0,0 +1,42 @@
+package msg
+
+import (
+	"testing"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/parsers/cfb"
+)
+
+func TestConverterName(t *testing.T) {
+	c := &converter{}
+	if c.Name() != "Outlook Message (.msg)" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := &converter{}
+	if c.Match([]byte{0x78, 0x9f, 0x3e, 0x22}) {
+		t.Fatal("expected Match to return false for TNEF data")
+	}
+	// A bare signature without a valid container is not a message.
+	data := make([]byte, 512)
+	copy(data, cfb.Signature)
+	if c.Match(data) {
+		t.Fatal("expected Match to return false for an empty compound file")
+	}
+}
+
+func TestDetectByExtension(t *testing.T) {
+	c := formats.Detect("mail.MSG", []byte("garbage"))
+	if c == nil || c.Name() != "Outlook Message (.msg)" {
+		t.Fatal("expected .msg extension to select the MSG converter")
+	}
+}
+
+func TestConvertInvalidData(t *testing.T) {
+	c := &converter{}
+	if _, err := c.Convert([]byte{0, 1, 2, 3}); err == nil {
+		t.Fatal("expected error converting invalid data")
+	}
+}
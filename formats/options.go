@@ -0,0 +1,337 @@
+// options.go defines conversion options and the context-aware
+// OptionsConverter extension of the Converter interface.
+
+package formats
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrInputTooLarge is returned when an input exceeds Options.MaxInputSize.
+var ErrInputTooLarge = errors.New("input exceeds size limit")
+
+// BodyFormat is a set of message body renderings.
+type BodyFormat uint8
+
+// Body renderings a message conversion can produce.
+const (
+	BodyText    BodyFormat = 1 << iota // body.txt
+	BodyHTML                           // body.html
+	BodyRTF                            // body.rtf
+	BodyRTFHTML                        // body_from_rtf.html, HTML de-encapsulated from RTF
+
+	AllBodies = BodyText | BodyHTML | BodyRTF | BodyRTFHTML
+)
+
+// Options configures a conversion. The zero value converts everything
+// with the defaults used by Convert and Expand.
+type Options struct {
+	// Offline disables all network access, such as fetching external
+	// images referenced by HTML bodies. The images that were not fetched
+	// are listed in a blocked_images.txt output.
+	Offline bool
+
+	// Fetcher retrieves external images when not offline; nil means
+	// DefaultFetcher.
+	Fetcher ImageFetcher
+
+	// FetchConcurrency limits how many external images are fetched at
+	// once; 0 means DefaultFetchConcurrency.
+	FetchConcurrency int
+
+	// FetchTimeout bounds the total time spent fetching external images
+	// for one conversion, including nested messages; 0 means
+	// DefaultFetchTimeout.
+	FetchTimeout time.Duration
+
+	// FetchMaxBytes bounds the total size of the external images inlined
+	// by one conversion; 0 means DefaultFetchMaxBytes.
+	FetchMaxBytes int64
+
+	// KeepTrackers leaves tracking images (see RemoveTrackers) in HTML
+	// bodies. By default they are removed, before any image is fetched,
+	// and listed in a privacy_report.txt output.
+	KeepTrackers bool
+
+	// Sanitize adds a sanitized copy of each HTML body (see
+	// SanitizeHTML), named like the original with a .sanitized.html
+	// extension, that is safe to open outside the web interface.
+	Sanitize bool
+
+	// Defang adds defanged copies of the bodies for analysts (see
+	// DefangHTML and DefangText), named like the originals with a
+	// .defanged.html or .defanged.txt extension.
+	Defang bool
+
+	// SMIMERoots verifies the certificate chains of S/MIME signers; nil
+	// means the system roots.
+	SMIMERoots *x509.CertPool
+
+	// SMIMEKey decrypts S/MIME encrypted messages addressed to it; nil
+	// leaves them encrypted. SMIMECert, if set, selects the recipient
+	// entry matching the key. Anyone who can submit input to a
+	// conversion with a key set can have content encrypted to that key
+	// decrypted, so services converting untrusted uploads must not set
+	// it. Keys are only held in memory.
+	SMIMEKey  *rsa.PrivateKey
+	SMIMECert *x509.Certificate
+
+	// Placeholders replaces external images with PlaceholderImage in
+	// offline mode, instead of leaving their remote URLs in place.
+	Placeholders bool
+
+	// MaxInputSize limits the number of bytes read from the input;
+	// 0 means no limit.
+	MaxInputSize int64
+
+	// MaxDepth limits how deeply ExpandWithOptions converts nested
+	// attachments: 0 means DefaultMaxDepth and a negative value
+	// disables expansion.
+	MaxDepth int
+
+	// Bodies selects which body renderings are emitted; 0 means all.
+	// Body outputs that are not renderings (such as an mbox index) are
+	// always kept.
+	Bodies BodyFormat
+
+	// Logger receives diagnostics such as failed image fetches; nil
+	// discards them.
+	Logger *slog.Logger
+
+	// inliner carries the image cache and fetch budget of a conversion
+	// to the conversions of its nested attachments.
+	inliner *ImageInliner
+
+	// archive carries the archive extraction budget of a conversion to
+	// the conversions of its nested attachments.
+	archive *ArchiveBudget
+}
+
+// ArchiveBudget counts what the archive converters have extracted during
+// one conversion, including every nested attachment, so that their
+// extraction limits apply to the conversion as a whole. The limits
+// themselves are enforced by the archive converters.
+type ArchiveBudget struct {
+	Entries  int   // entries extracted
+	Total    int64 // bytes extracted
+	Packed   int64 // compressed size of the entries with a known one
+	Unpacked int64 // extracted size of those entries
+}
+
+// Defaults for the external image fetch limits in Options.
+const (
+	DefaultFetchConcurrency = 6
+	DefaultFetchTimeout     = 30 * time.Second
+	DefaultFetchMaxBytes    = 25 << 20
+)
+
+// Log returns the configured logger, or one that discards everything.
+func (o Options) Log() *slog.Logger {
+	if o.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return o.Logger
+}
+
+// Wants reports whether the body rendering b should be emitted.
+func (o Options) Wants(b BodyFormat) bool {
+	return o.Bodies == 0 || o.Bodies&b != 0
+}
+
+// ImageInliner returns the ImageInliner of the conversion o belongs to,
+// or a new one if o is not part of a conversion started by
+// ConvertWithOptions or ExpandWithOptions.
+func (o Options) ImageInliner() *ImageInliner {
+	if o.inliner != nil {
+		return o.inliner
+	}
+	return NewImageInliner(o)
+}
+
+// ArchiveBudget returns the ArchiveBudget of the conversion o belongs
+// to, or a new one if o is not part of a conversion started by
+// ConvertWithOptions, Expand, or ExpandWithOptions.
+func (o Options) ArchiveBudget() *ArchiveBudget {
+	if o.archive != nil {
+		return o.archive
+	}
+	return new(ArchiveBudget)
+}
+
+// withShared returns o with an ImageInliner and an ArchiveBudget shared
+// by everything converted with it.
+func (o Options) withShared() Options {
+	if o.inliner == nil && !o.Offline {
+		o.inliner = NewImageInliner(o)
+	}
+	if o.archive == nil {
+		o.archive = new(ArchiveBudget)
+	}
+	return o
+}
+
+func (o Options) fetchConcurrency() int {
+	if o.FetchConcurrency <= 0 {
+		return DefaultFetchConcurrency
+	}
+	return o.FetchConcurrency
+}
+
+func (o Options) fetchTimeout() time.Duration {
+	if o.FetchTimeout <= 0 {
+		return DefaultFetchTimeout
+	}
+	return o.FetchTimeout
+}
+
+func (o Options) fetchMaxBytes() int64 {
+	if o.FetchMaxBytes <= 0 {
+		return DefaultFetchMaxBytes
+	}
+	return o.FetchMaxBytes
+}
+
+// depth returns the expansion depth to use for MaxDepth.
+func (o Options) depth() int {
+	switch {
+	case o.MaxDepth < 0:
+		return 0
+	case o.MaxDepth == 0:
+		return DefaultMaxDepth
+	}
+	return o.MaxDepth
+}
+
+// OptionsConverter is implemented by converters that accept a context
+// and options. The context cancels or bounds the conversion, including
+// any network access it performs.
+type OptionsConverter interface {
+	Converter
+	ConvertWithOptions(ctx context.Context, r io.Reader, opts Options) ([]ConvertedFile, error)
+}
+
+// Adapt returns c as an OptionsConverter. Converters that do not
+// implement it natively are wrapped: the input is read subject to
+// MaxInputSize and the context is checked before and after Convert.
+func Adapt(c Converter) OptionsConverter {
+	if oc, ok := c.(OptionsConverter); ok {
+		return oc
+	}
+	return adapter{c}
+}
+
+// adapter runs a plain Converter through the OptionsConverter interface.
+type adapter struct {
+	Converter
+}
+
+func (a adapter) ConvertWithOptions(ctx context.Context, r io.Reader, opts Options) ([]ConvertedFile, error) {
+	data, err := ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := a.Convert(data)
+	if err != nil {
+		return nil, err
+	}
+	return files, ctx.Err()
+}
+
+// ReadInput reads all of r, failing with ErrInputTooLarge if it holds
+// more than opts.MaxInputSize bytes.
+func ReadInput(r io.Reader, opts Options) ([]byte, error) {
+	if opts.MaxInputSize <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, opts.MaxInputSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > opts.MaxInputSize {
+		return nil, ErrInputTooLarge
+	}
+	return data, nil
+}
+
+// ConvertWithOptions converts r with conv, adapting conv if needed, and
+// drops the body renderings opts does not ask for.
+func ConvertWithOptions(ctx context.Context, conv Converter, r io.Reader, opts Options) ([]ConvertedFile, error) {
+	opts = opts.withShared()
+	files, err := Adapt(conv).ConvertWithOptions(ctx, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	return filterBodies(files, opts), nil
+}
+
+// ExpandWithOptions is Expand with a context and options: nested
+// attachments are converted with the same options, up to opts.MaxDepth
+// levels, and expansion stops when ctx is done. The whole expansion
+// shares one external image fetch budget and one archive extraction
+// budget.
+func ExpandWithOptions(ctx context.Context, conv Converter, r io.Reader, opts Options) ([]ConvertedFile, error) {
+	opts = opts.withShared()
+	files, err := ConvertWithOptions(ctx, conv, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	x := expander{ctx: ctx, opts: opts}
+	files = x.expandFiles(files, 1, opts.depth())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	Annotate(files)
+	return files, nil
+}
+
+// filterBodies removes the body renderings that opts does not want.
+func filterBodies(files []ConvertedFile, opts Options) []ConvertedFile {
+	if opts.Bodies == 0 {
+		return files
+	}
+	out := files[:0:0]
+	for _, f := range files {
+		if f.Category == CategoryBody {
+			if b := bodyFormat(f.Name); b != 0 && !opts.Wants(b) {
+				continue
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// bodyFormat returns the rendering a body output holds, judged by its
+// conventional name, or 0 if it is not a body rendering.
+func bodyFormat(name string) BodyFormat {
+	base := path.Base(name)
+	switch {
+	case hasSuffix(base, "body_from_rtf.html"), hasSuffix(base, "body_from_rtf.sanitized.html"),
+		hasSuffix(base, "body_from_rtf.defanged.html"):
+		return BodyRTFHTML
+	case hasSuffix(base, "body.html"), hasSuffix(base, "body.sanitized.html"), hasSuffix(base, "body.defanged.html"):
+		return BodyHTML
+	case hasSuffix(base, "body.txt"), hasSuffix(base, "body.defanged.txt"):
+		return BodyText
+	case hasSuffix(base, "body.rtf"):
+		return BodyRTF
+	}
+	return 0
+}
+
+// hasSuffix reports whether name is suffix or ends in "_"+suffix, the
+// form used for the bodies of embedded messages.
+func hasSuffix(name, suffix string) bool {
+	return name == suffix || strings.HasSuffix(name, "_"+suffix)
+}
@@ -0,0 +1,139 @@
+// Package pst implements the Outlook Personal Storage Table (.pst / .ost)
+// format converter. It is automatically registered with the formats
+// registry on import.
+//
+// The folder hierarchy is exported as nested output folders. Each message
+// is converted through the shared TNEF pipeline and written to its own
+// numbered folder inside its mailbox folder. An index.csv file lists every
+// message with its folder, date, sender, and subject.
+package pst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/formats/tnef"
+	parser "github.com/avaropoint/converter/parsers/pst"
+	tnefparser "github.com/avaropoint/converter/parsers/tnef"
+)
+
+func init() {
+	formats.Register(&converter{})
+}
+
+type converter struct{}
+
+func (c *converter) Name() string {
+	return "Outlook Data File (.pst)"
+}
+
+func (c *converter) Extensions() []string {
+	return []string{".pst", ".ost"}
+}
+
+func (c *converter) Match(data []byte) bool {
+	return parser.IsPST(data)
+}
+
+// DecodeFolders returns the folder hierarchy of a PST file.
+func (c *converter) DecodeFolders(data []byte) (*parser.Folder, error) {
+	f, err := parser.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	return f.FolderTree()
+}
+
+func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parser.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	root, err := f.FolderTree()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []formats.ConvertedFile
+	index := formats.NewIndex()
+
+	var walk func(fld *parser.Folder, path string) error
+	walk = func(fld *parser.Folder, path string) error {
+		for i, nid := range fld.Messages {
+			msg, err := f.Message(nid)
+			if err != nil {
+				index.Add(joinPath(path, fmt.Sprintf("%04d", i+1)), "", "", "(unreadable message: "+err.Error()+")")
+				continue
+			}
+			subject := msg.GetAttrString(tnefparser.MAPISubject)
+			folder := joinPath(path, formats.MessageFolder(i+1, subject))
+			date := ""
+			if t := msg.GetAttrTime(tnefparser.MAPIClientSubmitTime); !t.IsZero() {
+				date = t.Format(time.RFC3339)
+			}
+			from := msg.GetAttrString(tnefparser.MAPISenderName)
+			if email := msg.GetAttrString(tnefparser.MAPISenderEmail); email != "" && email != from {
+				from += " <" + email + ">"
+			}
+
+			converted, err := tnef.ConvertMessageWithOptions(ctx, msg, opts)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				index.Add(folder, date, from, "(unconvertible message: "+err.Error()+")")
+				continue
+			}
+			index.Add(folder, date, from, subject)
+			for _, out := range converted {
+				out.Name = folder + "/" + out.Name
+				files = append(files, out)
+			}
+		}
+
+		// Sibling folders may share a display name; keep their paths distinct.
+		seen := make(map[string]int)
+		for _, child := range fld.Children {
+			name := formats.FolderName(child.Name)
+			if name == "" {
+				name = "Folder"
+			}
+			seen[strings.ToLower(name)]++
+			if n := seen[strings.ToLower(name)]; n > 1 {
+				name = fmt.Sprintf("%s (%d)", name, n)
+			}
+			if err := walk(child, joinPath(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return append(files, index.File()), nil
+}
+
+// joinPath appends name to a slash-separated output path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "/" + name
+}
@@ -0,0 +1,40 @@
+package pst
+
+import (
+	"testing"
+
+	"github.com/avaropoint/converter/formats"
+)
+
+func TestConverterName(t *testing.T) {
+	c := &converter{}
+	if c.Name() != "Outlook Data File (.pst)" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := &converter{}
+	if !c.Match([]byte("!BDN\x00\x00\x00\x00SM\x17\x00")) {
+		t.Fatal("expected Match to return true for a PST header")
+	}
+	if c.Match([]byte("!BDN\x00\x00\x00\x00XX\x17\x00")) {
+		t.Fatal("expected Match to return false for an unknown client magic")
+	}
+}
+
+func TestDetectByExtension(t *testing.T) {
+	for _, name := range []string{"archive.pst", "cache.OST"} {
+		c := formats.Detect(name, []byte("garbage"))
+		if c == nil || c.Name() != "Outlook Data File (.pst)" {
+			t.Fatalf("expected %s to select the PST converter", name)
+		}
+	}
+}
+
+func TestConvertInvalidData(t *testing.T) {
+	c := &converter{}
+	if _, err := c.Convert([]byte{0, 1, 2, 3}); err == nil {
+		t.Fatal("expected error converting invalid data")
+	}
+}
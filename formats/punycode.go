@@ -0,0 +1,116 @@
+// punycode.go decodes the Punycode (RFC 3492) labels of internationalised
+// domain names, so link reports can show and check the Unicode form.
+
+package formats
+
+import (
+	"errors"
+	"strings"
+)
+
+// errPunycode is returned for malformed Punycode.
+var errPunycode = errors.New("invalid punycode")
+
+// Punycode parameters from RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// unicodeHost returns host with its "xn--" labels decoded. Labels that
+// fail to decode are kept as they are.
+func unicodeHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if rest, ok := strings.CutPrefix(strings.ToLower(label), "xn--"); ok {
+			if decoded, err := decodePunycode(rest); err == nil {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// decodePunycode decodes a Punycode string without its "xn--" prefix.
+func decodePunycode(s string) (string, error) {
+	var output []rune
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= 0x80 {
+				return "", errPunycode
+			}
+			output = append(output, rune(s[i]))
+		}
+		s = s[b+1:]
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errPunycode
+			}
+			digit := punyDigit(s[pos])
+			pos++
+			if digit < 0 || digit > (1<<30-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := min(max(k-bias, punyTMin), punyTMax)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+			if w > 1<<30 {
+				return "", errPunycode
+			}
+		}
+		count := len(output) + 1
+		bias = punyAdapt(i-oldi, count, oldi == 0)
+		n += i / count
+		i %= count
+		if n > 0x10FFFF {
+			return "", errPunycode
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
+
+// punyDigit returns the value of a Punycode digit, or -1.
+func punyDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	}
+	return -1
+}
+
+// punyAdapt is the bias adaptation function of RFC 3492 section 6.1.
+func punyAdapt(delta, count int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / count
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
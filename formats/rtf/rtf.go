@@ -0,0 +1,93 @@
+// Package rtf implements the Rich Text Format converter for standalone
+// .rtf files and raw PR_RTF_COMPRESSED blobs (LZFu or MELA). It is
+// automatically registered with the formats registry on import.
+//
+// HTML-encapsulated RTF is de-encapsulated to its original HTML; other
+// RTF is rendered to HTML. Both are also rendered to plain text, and
+// embedded \pict images and \objdata objects are extracted as
+// attachments.
+package rtf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/formats/tnef"
+	tnefparser "github.com/avaropoint/converter/parsers/tnef"
+)
+
+// Compressed RTF header signatures at offset 8.
+const (
+	sigLZFu = 0x75465A4C // "LZFu"
+	sigMELA = 0x414C454D // "MELA"
+)
+
+func init() {
+	formats.Register(&converter{})
+}
+
+type converter struct{}
+
+func (c *converter) Name() string {
+	return "Rich Text Format (.rtf)"
+}
+
+func (c *converter) Extensions() []string {
+	return []string{".rtf"}
+}
+
+func (c *converter) Match(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(`{\rtf`)) || isCompressed(data)
+}
+
+func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return tnef.ConvertMessageWithOptions(ctx, msg, opts)
+}
+
+// Decode renders data into a message whose bodies and attachments hold
+// the RTF, its HTML and text renderings, and its pictures.
+func (c *converter) Decode(data []byte) (*tnefparser.Message, error) {
+	rtf := data
+	if isCompressed(data) {
+		var err error
+		if rtf, err = tnefparser.DecompressRTF(data); err != nil {
+			return nil, err
+		}
+	}
+
+	r := tnefparser.RenderRTF(rtf)
+	msg := &tnefparser.Message{
+		Body:        r.Text,
+		BodyRTF:     rtf,
+		BodyRTFHTML: tnefparser.DeencapsulateHTML(rtf),
+	}
+	if msg.BodyRTFHTML == nil {
+		msg.BodyRTFHTML = r.HTML
+	}
+	msg.Attachments = r.Attachments()
+	return msg, nil
+}
+
+// isCompressed reports whether data starts with a compressed RTF header.
+func isCompressed(data []byte) bool {
+	if len(data) < 16 {
+		return false
+	}
+	sig := binary.LittleEndian.Uint32(data[8:12])
+	return sig == sigLZFu || sig == sigMELA
+}
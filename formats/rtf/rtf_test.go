@@ -0,0 +1,42 @@
+package rtf
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestConverterName(t *testing.T) {
+	c := &converter{}
+	if c.Name() != "Rich Text Format (.rtf)" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+}
+
+func TestConvertCompressed(t *testing.T) {
+	rtf := `{\rtf1\ansi Hello\par {\pict\pngblip 89504e47}}`
+	data := make([]byte, 16, 16+len(rtf))
+	binary.LittleEndian.PutUint32(data[0:], uint32(12+len(rtf)))
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(rtf)))
+	binary.LittleEndian.PutUint32(data[8:], sigMELA)
+	data = append(data, rtf...)
+
+	c := &converter{}
+	if !c.Match(data) || !c.Match([]byte(rtf)) {
+		t.Fatal("expected Match to return true for MELA and plain RTF")
+	}
+	files, err := c.Convert(data)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	got := make(map[string]string)
+	for _, f := range files {
+		got[f.Name] = string(f.Data)
+	}
+	if got["body.txt"] != "Hello" || got["body.rtf"] != rtf || got["rtf_image001.png"] != "\x89PNG" {
+		t.Errorf("unexpected files: %q", got)
+	}
+	if !strings.Contains(got["body_from_rtf.html"], "data:image/png;base64,") {
+		t.Errorf("picture not inlined:\n%s", got["body_from_rtf.html"])
+	}
+}
@@ -0,0 +1,324 @@
+// sanitize.go is an allowlist HTML sanitizer for message bodies. It
+// keeps the markup and inline styles mail clients render and removes
+// anything that can run script, submit data, navigate, or load remote
+// stylesheets, so a sanitized body is safe to open outside the web UI's
+// Content-Security-Policy.
+
+package formats
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// allowedElements are the elements SanitizeHTML keeps. Other elements
+// are removed but their content is kept, except for dropElements.
+var allowedElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "style": true,
+	"a": true, "abbr": true, "address": true, "b": true, "big": true,
+	"blockquote": true, "br": true, "caption": true, "center": true,
+	"cite": true, "code": true, "col": true, "colgroup": true, "dd": true,
+	"del": true, "dfn": true, "div": true, "dl": true, "dt": true,
+	"em": true, "font": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "hr": true, "i": true, "img": true,
+	"ins": true, "kbd": true, "li": true, "mark": true, "ol": true,
+	"p": true, "pre": true, "q": true, "s": true, "samp": true,
+	"small": true, "span": true, "strike": true, "strong": true,
+	"sub": true, "sup": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "tt": true,
+	"u": true, "ul": true, "var": true, "wbr": true,
+}
+
+// dropElements are removed together with their content.
+var dropElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "applet": true, "embed": true, "noscript": true,
+	"noembed": true, "noframes": true, "template": true, "svg": true,
+	"math": true, "textarea": true, "select": true, "button": true,
+	"xmp": true, "plaintext": true,
+}
+
+// voidElements have no content or end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// allowedAttrs are the attributes SanitizeHTML keeps. Event handlers and
+// anything that submits or navigates are absent.
+var allowedAttrs = map[string]bool{
+	"abbr": true, "align": true, "alt": true, "background": true,
+	"bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "cite": true, "class": true, "color": true,
+	"cols": true, "colspan": true, "datetime": true, "dir": true,
+	"face": true, "headers": true, "height": true, "href": true,
+	"hspace": true, "id": true, "lang": true, "nowrap": true,
+	"rows": true, "rowspan": true, "scope": true, "size": true,
+	"span": true, "src": true, "start": true, "style": true,
+	"summary": true, "target": true, "title": true, "type": true,
+	"valign": true, "vspace": true, "width": true,
+}
+
+// SanitizeHTML returns html with only allowlisted elements and
+// attributes. Scripts, frames, plugins, forms and their controls,
+// comments, <meta>, <link> and <base> are removed; links are limited
+// to http, https, mailto, tel, and fragments; images to http, https,
+// cid, and data:image URLs. Inline styles and <style> elements are
+// kept without @import, expression(), script URLs, or other url()
+// references.
+func SanitizeHTML(html []byte) []byte {
+	var out bytes.Buffer
+	var skip string // element whose content is being dropped
+	depth := 0
+	for _, t := range Tokenize(html) {
+		if skip != "" {
+			switch {
+			case t.Type == StartTagToken && t.Tag == skip && !t.SelfClosing:
+				depth++
+			case t.Type == EndTagToken && t.Tag == skip:
+				if depth--; depth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch t.Type {
+		case DoctypeToken:
+			if bytes.HasPrefix(bytes.ToLower(t.Raw), []byte("<!doctype")) {
+				out.Write(t.Raw)
+			}
+		case TextToken:
+			if t.Tag == "style" {
+				out.WriteString(sanitizeStylesheet(string(t.Raw)))
+			} else {
+				out.Write(t.Raw)
+			}
+		case StartTagToken:
+			if dropElements[t.Tag] {
+				if !t.SelfClosing && !voidElements[t.Tag] {
+					skip, depth = t.Tag, 1
+				}
+				continue
+			}
+			if allowedElements[t.Tag] {
+				sanitizeAttrs(&t)
+				out.Write(t.Bytes())
+			}
+		case EndTagToken:
+			if allowedElements[t.Tag] && !voidElements[t.Tag] {
+				out.WriteString("</" + t.Tag + ">")
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+// sanitizeAttrs removes the attributes of t that are not allowlisted or
+// hold unsafe values, and makes links open without a referrer or
+// opener. The tag is always re-rendered.
+func sanitizeAttrs(t *Token) {
+	kept := t.Attrs[:0]
+	for _, a := range t.Attrs {
+		if !allowedAttrs[a.Key] {
+			continue
+		}
+		switch a.Key {
+		case "href":
+			if !strings.HasPrefix(strings.TrimSpace(a.Val), "#") && !safeURL(a.Val, "http", "https", "mailto", "tel") {
+				continue
+			}
+		case "src", "background":
+			if !safeImageURL(a.Val) {
+				continue
+			}
+		case "style":
+			if a.Val = sanitizeDeclarations(a.Val); a.Val == "" {
+				continue
+			}
+		case "target":
+			a.Val = "_blank"
+		}
+		kept = append(kept, a)
+	}
+	t.Attrs = kept
+	t.dirty = true
+	if _, ok := t.Attr("href"); ok && t.Tag == "a" {
+		t.SetAttr("rel", "noopener noreferrer")
+	}
+}
+
+// safeURL reports whether rawURL is an absolute URL with one of
+// schemes. Whitespace and control characters, which browsers
+// ignore inside schemes, are disregarded.
+func safeURL(rawURL string, schemes ...string) bool {
+	u := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(rawURL))
+	scheme, _, ok := strings.Cut(u, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return false
+	}
+	for _, s := range schemes {
+		if scheme == s {
+			return true
+		}
+	}
+	return false
+}
+
+// safeImageURL reports whether rawURL may be loaded as an image.
+func safeImageURL(rawURL string) bool {
+	if safeURL(rawURL, "http", "https", "cid") {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(rawURL)), "data:image/")
+}
+
+// Patterns used to clean CSS.
+var (
+	cssCommentRe   = regexp.MustCompile(`(?s)/\*.*?(\*/|$)`)
+	cssStatementRe = regexp.MustCompile(`(?i)@(import|charset|namespace)[^;{}]*;?`)
+	cssPropertyRe  = regexp.MustCompile(`^-?[a-z][a-z0-9-]*$`)
+)
+
+// cleanCSS removes comments and backslashes from css, so neither can
+// be used to disguise a keyword.
+func cleanCSS(css string) string {
+	return strings.ReplaceAll(cssCommentRe.ReplaceAllString(css, ""), `\`, "")
+}
+
+// sanitizeStylesheet returns the content of a <style> element without
+// @import, @charset, or @namespace rules, and with every declaration
+// block sanitized. Braces inside strings do not open or close blocks,
+// blocks left open at the end are closed, and text outside any block
+// that is not followed by one is dropped.
+func sanitizeStylesheet(css string) string {
+	css = cssStatementRe.ReplaceAllString(cleanCSS(css), "")
+	var b strings.Builder
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i <= len(css); i++ {
+		var c byte
+		if i < len(css) {
+			c = css[i]
+			switch {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c != '{' && c != '}':
+				continue
+			}
+		}
+		switch {
+		case c == '{':
+			b.WriteString(sanitizePrelude(css[start:i]))
+			b.WriteByte('{')
+			depth++
+		case depth > 0:
+			// The end of a block, or of the input inside one.
+			b.WriteString(sanitizeDeclarations(css[start:i]))
+			b.WriteByte('}')
+			depth--
+			if i == len(css) {
+				b.WriteString(strings.Repeat("}", depth))
+			}
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+// sanitizePrelude returns the selector or at-rule prelude s that opens
+// a block, after sanitizing any declarations that precede it inside an
+// enclosing block. A prelude that could load or run anything is dropped.
+func sanitizePrelude(s string) string {
+	parts := splitDeclarations(s)
+	s = parts[len(parts)-1]
+	if strings.Contains(strings.ToLower(s), "url(") || !safeCSSValue(s) {
+		s = ""
+	}
+	if len(parts) == 1 {
+		return s
+	}
+	decls := sanitizeDeclarations(strings.Join(parts[:len(parts)-1], ";"))
+	if decls == "" {
+		return s
+	}
+	return decls + "; " + s
+}
+
+// sanitizeDeclarations returns the safe declarations of a style
+// attribute or declaration block. Declarations that can run script or
+// load anything but an image URL are dropped.
+func sanitizeDeclarations(css string) string {
+	var kept []string
+	for _, decl := range splitDeclarations(cleanCSS(css)) {
+		name, value, ok := strings.Cut(decl, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !ok || value == "" || !cssPropertyRe.MatchString(name) ||
+			name == "behavior" || name == "-moz-binding" || !safeCSSValue(value) {
+			continue
+		}
+		kept = append(kept, name+": "+value)
+	}
+	return strings.Join(kept, "; ")
+}
+
+// safeCSSValue reports whether a declaration value is free of script
+// and of url() references other than images.
+func safeCSSValue(value string) bool {
+	lower := strings.ToLower(value)
+	for _, bad := range []string{"expression(", "javascript:", "vbscript:", "@import", "<"} {
+		if strings.Contains(lower, bad) {
+			return false
+		}
+	}
+	urls := cssURLRe.FindAllStringSubmatch(value, -1)
+	if len(urls) != strings.Count(lower, "url(") {
+		return false
+	}
+	for _, g := range urls {
+		if g[6] != "" || !safeImageURL(g[2]+g[3]+g[4]) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitDeclarations splits CSS declarations at semicolons outside
+// quotes and parentheses, so data URLs stay whole.
+func splitDeclarations(css string) []string {
+	var decls []string
+	var quote byte
+	parens, start := 0, 0
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			parens++
+		case c == ')' && parens > 0:
+			parens--
+		case c == ';' && parens == 0:
+			decls = append(decls, css[start:i])
+			start = i + 1
+		}
+	}
+	return append(decls, css[start:])
+}
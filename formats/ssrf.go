@@ -0,0 +1,193 @@
+// ssrf.go defines SSRFPolicy, which decides the hosts, addresses and
+// ports external image fetches may connect to.
+
+package formats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SSRFPolicy restricts the destinations of external image fetches.
+// Addresses in the built-in deny ranges (private, loopback, link-local,
+// CGNAT, multicast, NAT64 and other special-purpose networks) are always
+// refused unless an Allow range covers them; operator Deny ranges and
+// DenyHosts patterns take precedence over everything else. Every refusal
+// is logged with its reason.
+//
+// A policy can be loaded from a JSON file with LoadSSRFPolicy:
+//
+//	{
+//	  "allow": ["10.20.0.0/16"],
+//	  "deny": ["203.0.113.0/24"],
+//	  "allowHosts": ["images.corp.internal"],
+//	  "denyHosts": ["*.corp.example"],
+//	  "ports": [80, 443]
+//	}
+type SSRFPolicy struct {
+	// Allow lists ranges exempt from the built-in deny ranges, such as an
+	// internal image server.
+	Allow []netip.Prefix `json:"allow"`
+
+	// Deny lists additional ranges to refuse.
+	Deny []netip.Prefix `json:"deny"`
+
+	// AllowHosts lists hostname patterns exempt from the built-in
+	// hostname blocks (localhost, *.local, *.internal). Their addresses
+	// are still checked. A pattern is a hostname, which matches only
+	// itself, or "*." and a domain, which matches its subdomains.
+	AllowHosts []string `json:"allowHosts"`
+
+	// DenyHosts lists hostname patterns to refuse.
+	DenyHosts []string `json:"denyHosts"`
+
+	// Ports lists the ports that may be connected to; empty allows any.
+	Ports []uint16 `json:"ports"`
+
+	// Logger receives a warning for every refusal; nil means
+	// slog.Default().
+	Logger *slog.Logger `json:"-"`
+}
+
+// DefaultSSRFPolicy applies to HTTPFetchers without a Policy. It may be
+// replaced at startup, before any image is fetched.
+var DefaultSSRFPolicy = &SSRFPolicy{}
+
+// deniedRange is a built-in deny range and the reason it is refused.
+type deniedRange struct {
+	prefix netip.Prefix
+	reason string
+}
+
+// deniedRanges are the special-purpose networks no image is fetched from.
+var deniedRanges = []deniedRange{
+	{netip.MustParsePrefix("0.0.0.0/8"), "this-network address"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private address"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "carrier-grade NAT address"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback address"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local address"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private address"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "IETF protocol assignment"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private address"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking address"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast address"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved address"},
+	{netip.MustParsePrefix("::/128"), "unspecified address"},
+	{netip.MustParsePrefix("::1/128"), "loopback address"},
+	{netip.MustParsePrefix("64:ff9b::/96"), "NAT64 address"},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "NAT64 address"},
+	{netip.MustParsePrefix("2001::/32"), "Teredo address"},
+	{netip.MustParsePrefix("2002::/16"), "6to4 address"},
+	{netip.MustParsePrefix("fc00::/7"), "unique local address"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local address"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast address"},
+}
+
+// deniedHosts are the built-in hostname patterns that name internal
+// services, such as cloud metadata endpoints.
+var deniedHosts = []string{"localhost", "*.localhost", "*.local", "*.internal"}
+
+// LoadSSRFPolicy reads a policy from a JSON file.
+func LoadSSRFPolicy(path string) (*SSRFPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	p := new(SSRFPolicy)
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("ssrf policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// CheckHost refuses blocked hostnames and, if host is an IP literal,
+// blocked addresses. Hostnames must still be checked with CheckAddr once
+// resolved.
+func (p *SSRFPolicy) CheckHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return p.CheckAddr(ip)
+	}
+	if pattern := matchHost(p.DenyHosts, host); pattern != "" {
+		return p.block(host, "hostname matches denied pattern "+pattern)
+	}
+	if matchHost(p.AllowHosts, host) != "" {
+		return nil
+	}
+	if pattern := matchHost(deniedHosts, host); pattern != "" {
+		return p.block(host, "internal hostname ("+pattern+")")
+	}
+	return nil
+}
+
+// CheckAddr refuses addresses in a Deny range or, unless an Allow range
+// covers them, in a built-in deny range. IPv4-mapped IPv6 addresses are
+// judged by the IPv4 address they map to.
+func (p *SSRFPolicy) CheckAddr(ip netip.Addr) error {
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range p.Deny {
+		if prefix.Contains(ip) {
+			return p.block(ip.String(), "address in denied range "+prefix.String())
+		}
+	}
+	for _, prefix := range p.Allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	for _, r := range deniedRanges {
+		if r.prefix.Contains(ip) {
+			return p.block(ip.String(), r.reason+" ("+r.prefix.String()+")")
+		}
+	}
+	return nil
+}
+
+// CheckPort refuses ports not in Ports.
+func (p *SSRFPolicy) CheckPort(port string) error {
+	if len(p.Ports) == 0 {
+		return nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err == nil {
+		for _, allowed := range p.Ports {
+			if uint16(n) == allowed {
+				return nil
+			}
+		}
+	}
+	return p.block(port, "port not allowed")
+}
+
+// block logs a refusal and returns the matching ErrBlocked error.
+func (p *SSRFPolicy) block(target, reason string) error {
+	log := p.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	log.Warn("ssrf: connection blocked", "target", target, "reason", reason)
+	return fmt.Errorf("%w: %s: %s", ErrBlocked, target, reason)
+}
+
+// matchHost returns the first of patterns that matches host, or "".
+func matchHost(patterns []string, host string) string {
+	for _, pattern := range patterns {
+		pat := strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if domain, ok := strings.CutPrefix(pat, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return pattern
+			}
+		} else if host == pat {
+			return pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+// text.go renders HTML bodies as plain text, for outputs such as the
+// defanged text of messages that have no text body of their own.
+
+package formats
+
+import (
+	"html"
+	"strings"
+)
+
+// textBlocks are the elements that start and end a line of text.
+var textBlocks = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "figcaption": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "header": true, "hr": true,
+	"li": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "tr": true, "ul": true,
+}
+
+// HTMLText returns a plain-text rendering of html. Block elements and
+// <br> start new lines, runs of blank lines and spaces are collapsed,
+// and script, style and other raw text is dropped. A link whose text
+// does not already show its target is followed by the target in angle
+// brackets, read from its href or, failing that, its data-href.
+func HTMLText(src []byte) []byte {
+	var b strings.Builder
+	href, start := "", -1 // target and text offset of the open <a>
+	for _, t := range Tokenize(src) {
+		switch t.Type {
+		case TextToken:
+			if t.Tag == "" {
+				b.WriteString(strings.Map(flattenSpace, html.UnescapeString(string(t.Raw))))
+			}
+		case StartTagToken:
+			switch {
+			case t.Tag == "br" || textBlocks[t.Tag]:
+				b.WriteByte('\n')
+			case t.Tag == "td" || t.Tag == "th":
+				b.WriteByte(' ')
+			case t.Tag == "a":
+				var ok bool
+				if href, ok = t.Attr("href"); !ok {
+					href, _ = t.Attr("data-href")
+				}
+				href, start = strings.TrimSpace(href), b.Len()
+			}
+		case EndTagToken:
+			switch {
+			case textBlocks[t.Tag]:
+				b.WriteByte('\n')
+			case t.Tag == "a" && start >= 0:
+				if text := strings.Join(strings.Fields(b.String()[start:]), " "); showTarget(href, text) {
+					b.WriteString(" <" + href + ">")
+				}
+				start = -1
+			}
+		}
+	}
+
+	var lines []string
+	blank := true // drops leading and repeated blank lines
+	for line := range strings.SplitSeq(b.String(), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && blank {
+			continue
+		}
+		blank = line == ""
+		lines = append(lines, line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// flattenSpace turns line breaks and tabs in HTML text into spaces, since
+// only markup breaks lines.
+func flattenSpace(r rune) rune {
+	switch r {
+	case '\n', '\r', '\t', '\f':
+		return ' '
+	}
+	return r
+}
+
+// showTarget reports whether a link to href with display text text
+// should have its target written after the text.
+func showTarget(href, text string) bool {
+	return href != "" && !strings.HasPrefix(href, "#") &&
+		text != href && text != strings.TrimPrefix(href, "mailto:")
+}
@@ -3,12 +3,22 @@
 package tnef
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
 	"strings"
 
 	"github.com/avaropoint/converter/formats"
+	"github.com/avaropoint/converter/parsers/eml"
+	"github.com/avaropoint/converter/parsers/smime"
 	parser "github.com/avaropoint/converter/parsers/tnef"
+	"github.com/avaropoint/converter/parsers/wmf"
 )
 
 const tnefSignature = 0x223e9f78
@@ -35,62 +45,264 @@ func (c *converter) Match(data []byte) bool {
 }
 
 func (c *converter) Convert(data []byte) ([]formats.ConvertedFile, error) {
+	return c.ConvertWithOptions(context.Background(), bytes.NewReader(data), formats.Options{})
+}
+
+func (c *converter) ConvertWithOptions(ctx context.Context, r io.Reader, opts formats.Options) ([]formats.ConvertedFile, error) {
+	data, err := formats.ReadInput(r, opts)
+	if err != nil {
+		return nil, err
+	}
 	msg, err := parser.Decode(data)
 	if err != nil {
 		return nil, err
 	}
-	return collectAll(msg, ""), nil
+	return ConvertMessageWithOptions(ctx, msg, opts)
+}
+
+// Decode parses data into a message without converting it, for callers
+// that want to inspect its structure.
+func (c *converter) Decode(data []byte) (*parser.Message, error) {
+	return parser.Decode(data)
+}
+
+// ConvertMessage extracts all bodies and attachments from an already
+// decoded message. Other formats that decode into the TNEF message model
+// (such as Outlook .msg) use it to share body and attachment handling.
+func ConvertMessage(msg *parser.Message) []formats.ConvertedFile {
+	files, _ := ConvertMessageWithOptions(context.Background(), msg, formats.Options{})
+	return files
+}
+
+// ConvertMessageWithOptions is ConvertMessage with a context and options.
+// External images are not fetched in offline mode, body renderings not
+// selected by opts are skipped, and it returns ctx's error if ctx is
+// done before the conversion completes.
+func ConvertMessageWithOptions(ctx context.Context, msg *parser.Message, opts formats.Options) ([]formats.ConvertedFile, error) {
+	c := &collector{ctx: ctx, opts: opts, images: opts.ImageInliner()}
+	files := c.collectAll(msg, "", "")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	uniqueNames(files)
+	return files, nil
+}
+
+// uniqueNames renames outputs whose name, ignoring case, is already used
+// by an earlier output, such as an attachment that has the name of a
+// body rendering or of another attachment, by adding " (n)" before the
+// extension. Otherwise writing the outputs would overwrite files.
+func uniqueNames(files []formats.ConvertedFile) {
+	used := make(map[string]bool)
+	for i := range files {
+		name := files[i].Name
+		if used[strings.ToLower(name)] {
+			ext := path.Ext(name)
+			for n := 2; used[strings.ToLower(name)]; n++ {
+				name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(files[i].Name, ext), n, ext)
+			}
+			files[i].Name = name
+		}
+		used[strings.ToLower(name)] = true
+	}
+}
+
+// EMLOptions returns the S/MIME settings and logger of opts in the form
+// the eml parser takes.
+func EMLOptions(opts formats.Options) eml.Options {
+	o := eml.Options{Roots: opts.SMIMERoots, Logger: opts.Logger}
+	if opts.SMIMEKey != nil {
+		o.Recipient = &smime.Identity{Key: opts.SMIMEKey, Cert: opts.SMIMECert}
+	}
+	return o
+}
+
+// collector holds the context, options and image inliner of a message
+// conversion.
+type collector struct {
+	ctx    context.Context
+	opts   formats.Options
+	images *formats.ImageInliner
 }
 
 // collectAll recursively extracts all bodies and attachments from a decoded
-// TNEF message, resolving content-IDs and inlining external images.
-func collectAll(msg *parser.Message, prefix string) []formats.ConvertedFile {
+// TNEF message, unwrapping S/MIME signed content, resolving content-IDs,
+// and inlining external images. Outputs of embedded messages are named
+// with prefix and record source, the path of embedded message filenames.
+func (c *collector) collectAll(msg *parser.Message, prefix, source string) []formats.ConvertedFile {
 	var files []formats.ConvertedFile
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	eml.UnwrapSMIME(msg, EMLOptions(c.opts))
 
 	if len(msg.BodyHTML) > 0 || len(msg.BodyRTFHTML) > 0 {
-		msg.ResolveContentIDs(func(att *parser.Attachment) string {
+		dataURI := func(att *parser.Attachment) string {
 			if len(att.Data) == 0 {
 				return ""
 			}
-			mime := mimeFromName(att.Filename())
+			mime := formats.MIMEType(att.Filename())
 			b64 := base64.StdEncoding.EncodeToString(att.Data)
 			return "data:" + mime + ";base64," + b64
-		})
+		}
+		// Placeholders for other files link to the extracted attachment
+		// rather than copying it into the body.
+		placeholder := func(att *parser.Attachment) string {
+			if len(att.Data) == 0 || att.EmbeddedMsg != nil {
+				return ""
+			}
+			if att.IsImage() {
+				return dataURI(att)
+			}
+			return (&url.URL{Path: attachmentName(att, prefix)}).String()
+		}
+		msg.ResolvePlaceholders(placeholder)
+		msg.ResolveContentIDs(dataURI)
+	}
+
+	// Remove tracking images first, so that neither fetching nor
+	// blocking the remaining images can report the message as opened.
+	var trackers []formats.Tracker
+	if !c.opts.KeepTrackers {
+		trackers = c.removeTrackers(msg)
 	}
 
 	// Fetch and embed any remaining external images so the HTML is
-	// fully self-contained and viewable offline. Share the cache so
-	// duplicate URLs across bodies are only fetched once.
-	imgCache := make(map[string]string)
-	msg.BodyHTML = formats.InlineExternalImages(msg.BodyHTML, imgCache)
-	msg.BodyRTFHTML = formats.InlineExternalImages(msg.BodyRTFHTML, imgCache)
+	// fully self-contained and viewable offline. The inliner is shared
+	// by all bodies of the conversion, so duplicate URLs are only
+	// fetched once and the fetch budget covers them all.
+	// In offline mode, record the images instead of fetching them.
+	var blocked []string
+	if c.opts.Offline {
+		blocked = c.blockImages(msg)
+	} else {
+		if c.opts.Wants(formats.BodyHTML) {
+			msg.BodyHTML = c.images.Inline(c.ctx, msg.BodyHTML)
+		}
+		if c.opts.Wants(formats.BodyRTFHTML) {
+			msg.BodyRTFHTML = c.images.Inline(c.ctx, msg.BodyRTFHTML)
+		}
+	}
 
-	if len(msg.Body) > 0 {
+	if len(msg.Body) > 0 && c.opts.Wants(formats.BodyText) {
 		files = append(files, formats.ConvertedFile{
 			Name:     prefixed(prefix, "body.txt"),
+			Source:   source,
 			Data:     msg.Body,
-			Category: "body",
+			Category: formats.CategoryBody,
 		})
 	}
-	if len(msg.BodyHTML) > 0 {
+	if c.opts.Defang && c.opts.Wants(formats.BodyText) {
+		// Messages without a text body get one rendered from their HTML.
+		text := msg.Body
+		if len(text) == 0 && len(msg.BodyHTML) > 0 {
+			text = formats.HTMLText(msg.BodyHTML)
+		} else if len(text) == 0 {
+			text = formats.HTMLText(msg.BodyRTFHTML)
+		}
+		if len(text) > 0 {
+			files = append(files, formats.ConvertedFile{
+				Name:     prefixed(prefix, "body.defanged.txt"),
+				Source:   source,
+				Data:     formats.DefangText(text),
+				Category: formats.CategoryBody,
+			})
+		}
+	}
+	if len(msg.BodyHTML) > 0 && c.opts.Wants(formats.BodyHTML) {
 		files = append(files, formats.ConvertedFile{
 			Name:     prefixed(prefix, "body.html"),
+			Source:   source,
 			Data:     msg.BodyHTML,
-			Category: "body",
+			Category: formats.CategoryBody,
 		})
+		if c.opts.Sanitize {
+			files = append(files, formats.ConvertedFile{
+				Name:     prefixed(prefix, "body.sanitized.html"),
+				Source:   source,
+				Data:     formats.SanitizeHTML(msg.BodyHTML),
+				Category: formats.CategoryBody,
+			})
+		}
+		if c.opts.Defang {
+			files = append(files, formats.ConvertedFile{
+				Name:     prefixed(prefix, "body.defanged.html"),
+				Source:   source,
+				Data:     formats.DefangHTML(msg.BodyHTML),
+				Category: formats.CategoryBody,
+			})
+		}
 	}
-	if len(msg.BodyRTF) > 0 {
+	if len(msg.BodyRTF) > 0 && c.opts.Wants(formats.BodyRTF) {
 		files = append(files, formats.ConvertedFile{
 			Name:     prefixed(prefix, "body.rtf"),
+			Source:   source,
 			Data:     msg.BodyRTF,
-			Category: "body",
+			Category: formats.CategoryBody,
 		})
 	}
-	if len(msg.BodyRTFHTML) > 0 {
+	if len(msg.BodyRTFHTML) > 0 && c.opts.Wants(formats.BodyRTFHTML) {
 		files = append(files, formats.ConvertedFile{
 			Name:     prefixed(prefix, "body_from_rtf.html"),
+			Source:   source,
 			Data:     msg.BodyRTFHTML,
-			Category: "body",
+			Category: formats.CategoryBody,
+		})
+		if c.opts.Sanitize {
+			files = append(files, formats.ConvertedFile{
+				Name:     prefixed(prefix, "body_from_rtf.sanitized.html"),
+				Source:   source,
+				Data:     formats.SanitizeHTML(msg.BodyRTFHTML),
+				Category: formats.CategoryBody,
+			})
+		}
+		if c.opts.Defang {
+			files = append(files, formats.ConvertedFile{
+				Name:     prefixed(prefix, "body_from_rtf.defanged.html"),
+				Source:   source,
+				Data:     formats.DefangHTML(msg.BodyRTFHTML),
+				Category: formats.CategoryBody,
+			})
+		}
+	}
+
+	if len(blocked) > 0 {
+		files = append(files, formats.ConvertedFile{
+			Name:     prefixed(prefix, "blocked_images.txt"),
+			Source:   source,
+			Data:     []byte(strings.Join(blocked, "\n") + "\n"),
+			Category: formats.CategoryBody,
+		})
+	}
+
+	if len(trackers) > 0 {
+		files = append(files, formats.ConvertedFile{
+			Name:     prefixed(prefix, "privacy_report.txt"),
+			Source:   source,
+			Data:     formats.PrivacyReport(trackers),
+			Category: formats.CategoryBody,
+		})
+	}
+
+	// Links are reported only for the HTML bodies emitted above.
+	var links []formats.Link
+	if c.opts.Wants(formats.BodyHTML) {
+		links = formats.ExtractLinks(msg.BodyHTML, prefixed(prefix, "body.html"))
+	}
+	if c.opts.Wants(formats.BodyRTFHTML) {
+		links = append(links, formats.ExtractLinks(msg.BodyRTFHTML, prefixed(prefix, "body_from_rtf.html"))...)
+	}
+	if len(links) > 0 {
+		var data bytes.Buffer
+		enc := json.NewEncoder(&data)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(links)
+		files = append(files, formats.ConvertedFile{
+			Name:     prefixed(prefix, "links.json"),
+			Source:   source,
+			Data:     data.Bytes(),
+			Category: formats.CategoryBody,
 		})
 	}
 
@@ -100,23 +312,118 @@ func collectAll(msg *parser.Message, prefix string) []formats.ConvertedFile {
 			if prefix != "" {
 				sub = prefix + "_" + sub
 			}
-			files = append(files, collectAll(att.EmbeddedMsg, sub)...)
+			files = append(files, c.collectAll(att.EmbeddedMsg, sub, prefixedPath(source, att.Filename()))...)
 		} else if len(att.Data) > 0 {
-			name := formats.SanitizeFilename(att.Filename())
+			f := attachmentFile(att, attachmentName(att, prefix), source)
+			f.Data = att.Data
+			f.MIMEType = att.MimeType
+			if len(att.MetaFile) > 0 {
+				f.Icon, _ = wmf.ToPNG(att.MetaFile)
+			}
+			files = append(files, f)
+		} else if target := att.TargetURL(); att.IsReference() && safeShortcut(target) {
+			name := formats.SanitizeFilename(att.Filename()) + ".url"
 			if prefix != "" {
 				name = prefix + "_" + name
 			}
-			files = append(files, formats.ConvertedFile{
-				Name:     name,
-				Data:     att.Data,
-				Category: "attachment",
-			})
+			f := attachmentFile(att, name, source)
+			f.Data = InternetShortcut(target)
+			files = append(files, f)
 		}
 	}
 
 	return files
 }
 
+// attachmentName returns the output name of a file attachment of the
+// message whose outputs are named with prefix.
+func attachmentName(att *parser.Attachment, prefix string) string {
+	name := formats.SanitizeFilename(att.Filename())
+	if prefix != "" {
+		name = prefix + "_" + name
+	}
+	return name
+}
+
+// blockImages lists the distinct external images of the message's HTML
+// bodies without fetching them, replacing them with a placeholder if
+// requested.
+func (c *collector) blockImages(msg *parser.Message) []string {
+	var blocked []string
+	seen := make(map[string]bool)
+	for _, body := range []*[]byte{&msg.BodyHTML, &msg.BodyRTFHTML} {
+		var urls []string
+		*body, urls = formats.BlockExternalImages(*body, c.opts.Placeholders)
+		for _, u := range urls {
+			if !seen[u] {
+				seen[u] = true
+				blocked = append(blocked, u)
+				c.opts.Log().Debug("external image not fetched (offline)", "url", u)
+			}
+		}
+	}
+	return blocked
+}
+
+// removeTrackers strips tracking images from the message's HTML bodies
+// and returns the distinct ones removed.
+func (c *collector) removeTrackers(msg *parser.Message) []formats.Tracker {
+	var removed []formats.Tracker
+	seen := make(map[string]bool)
+	for _, body := range []*[]byte{&msg.BodyHTML, &msg.BodyRTFHTML} {
+		var trackers []formats.Tracker
+		*body, trackers = formats.RemoveTrackers(*body)
+		for _, t := range trackers {
+			if !seen[t.URL] {
+				seen[t.URL] = true
+				removed = append(removed, t)
+				c.opts.Log().Debug("tracking image removed", "url", t.URL, "reasons", t.Reasons)
+			}
+		}
+	}
+	return removed
+}
+
+// attachmentFile returns an output for att carrying the metadata the
+// source recorded about it; the caller supplies the content.
+func attachmentFile(att *parser.Attachment, name, source string) formats.ConvertedFile {
+	return formats.ConvertedFile{
+		Name:         name,
+		Category:     formats.CategoryAttachment,
+		OriginalName: att.Filename(),
+		ContentID:    att.ContentID,
+		Inline:       att.Inline(),
+		Hidden:       att.Hidden,
+		Source:       source,
+		Created:      att.Created,
+		Modified:     att.Modified,
+	}
+}
+
+// InternetShortcut returns a Windows .url file pointing at target, used
+// to represent reference and cloud attachments that carry no content.
+func InternetShortcut(target string) []byte {
+	target = strings.NewReplacer("\r", "", "\n", "").Replace(target)
+	return []byte("[InternetShortcut]\r\nURL=" + target + "\r\n")
+}
+
+// safeShortcut reports whether target may be written as an Internet
+// shortcut. Only http, https, and mailto targets qualify: opening a
+// shortcut to a file: URL or UNC path sends the user's Windows
+// credentials to the host named by the sender, and other schemes launch
+// arbitrary protocol handlers. Other targets are only shown by view.
+func safeShortcut(target string) bool {
+	scheme, _, ok := strings.Cut(target, ":")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
 // prefixed prepends a prefix to a filename with an underscore separator.
 func prefixed(prefix, name string) string {
 	if prefix != "" {
@@ -125,23 +432,10 @@ func prefixed(prefix, name string) string {
 	return name
 }
 
-// mimeFromName returns a MIME type based on file extension.
-func mimeFromName(name string) string {
-	lower := strings.ToLower(name)
-	switch {
-	case strings.HasSuffix(lower, ".png"):
-		return "image/png"
-	case strings.HasSuffix(lower, ".jpg"), strings.HasSuffix(lower, ".jpeg"):
-		return "image/jpeg"
-	case strings.HasSuffix(lower, ".gif"):
-		return "image/gif"
-	case strings.HasSuffix(lower, ".bmp"):
-		return "image/bmp"
-	case strings.HasSuffix(lower, ".svg"):
-		return "image/svg+xml"
-	case strings.HasSuffix(lower, ".webp"):
-		return "image/webp"
-	default:
-		return "application/octet-stream"
+// prefixedPath appends name to a slash-separated source path.
+func prefixedPath(source, name string) string {
+	if source != "" {
+		return source + "/" + name
 	}
+	return name
 }
@@ -1,10 +1,14 @@
 package tnef
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/avaropoint/converter/formats"
+	parser "github.com/avaropoint/converter/parsers/tnef"
 )
 
 func TestConverterName(t *testing.T) {
@@ -58,3 +62,125 @@ func TestConvertInvalidData(t *testing.T) {
 		t.Fatal("expected error converting invalid data")
 	}
 }
+
+func TestConvertReferenceAttachment(t *testing.T) {
+	msg := &parser.Message{Body: []byte("see link")}
+	msg.Attachments = append(msg.Attachments, &parser.Attachment{
+		LongName: "Plan.docx",
+		Method:   parser.AttachByWebRef,
+		Pathname: "https://contoso.sharepoint.com/Plan.docx",
+	})
+	files := ConvertMessage(msg)
+	if len(files) != 2 || files[1].Name != "Plan.docx.url" {
+		t.Fatalf("unexpected outputs: %+v", files)
+	}
+	if want := "URL=https://contoso.sharepoint.com/Plan.docx"; !strings.Contains(string(files[1].Data), want) {
+		t.Errorf("shortcut = %q, want it to contain %q", files[1].Data, want)
+	}
+
+	// UNC paths and other schemes are never written as shortcuts.
+	for _, target := range []string{`\\attacker\share\Plan.docx`, "file://attacker/share", "ms-msdt:/id"} {
+		msg.Attachments[0].Pathname = target
+		if files := ConvertMessage(msg); len(files) != 1 {
+			t.Errorf("%s: unexpected outputs: %+v", target, files)
+		}
+	}
+}
+
+func TestConvertDuplicateNames(t *testing.T) {
+	msg := &parser.Message{Body: []byte("two scans")}
+	for _, name := range []string{"scan.png", "SCAN.png", "body.txt"} {
+		msg.Attachments = append(msg.Attachments, &parser.Attachment{
+			LongName: name,
+			Method:   parser.AttachByValue,
+			Data:     []byte("x"),
+		})
+	}
+	var names []string
+	for _, f := range ConvertMessage(msg) {
+		names = append(names, f.Name)
+	}
+	if got, want := strings.Join(names, ","), "body.txt,scan.png,SCAN (2).png,body (2).txt"; got != want {
+		t.Errorf("names = %s, want %s", got, want)
+	}
+}
+
+func TestConvertLinks(t *testing.T) {
+	msg := &parser.Message{
+		BodyHTML:    []byte(`<a href="https://example.com/">example</a>`),
+		BodyRTFHTML: parser.RenderRTF([]byte(`{\rtf1 {\field{\*\fldinst HYPERLINK "javascript:alert(1)"}{\fldrslt click}}}`)).HTML,
+	}
+	reports := func(opts formats.Options) []formats.Link {
+		files, err := ConvertMessageWithOptions(context.Background(), msg, opts)
+		if err != nil {
+			t.Fatalf("Convert: %v", err)
+		}
+		for _, f := range files {
+			if f.Name == "links.json" {
+				var links []formats.Link
+				if err := json.Unmarshal(f.Data, &links); err != nil {
+					t.Fatalf("links.json: %v", err)
+				}
+				return links
+			}
+		}
+		return nil
+	}
+
+	links := reports(formats.Options{})
+	if len(links) != 2 || links[1].Body != "body_from_rtf.html" ||
+		strings.Join(links[1].Flags, ",") != formats.FlagJavaScriptURL {
+		t.Errorf("links = %+v", links)
+	}
+	if links := reports(formats.Options{Bodies: formats.BodyHTML}); len(links) != 1 || links[0].Body != "body.html" {
+		t.Errorf("HTML body only: links = %+v", links)
+	}
+	if links := reports(formats.Options{Bodies: formats.BodyText}); links != nil {
+		t.Errorf("text body only: links = %+v", links)
+	}
+}
+
+func TestConvertDefangedText(t *testing.T) {
+	for _, msg := range []*parser.Message{
+		{BodyHTML: []byte(`<p>Reset at <a href="https://evil.example/reset">this page</a></p>`)},
+		{BodyRTFHTML: parser.RenderRTF([]byte(`{\rtf1 {\field{\*\fldinst HYPERLINK "https://evil.example/reset"}{\fldrslt this page}}}`)).HTML},
+	} {
+		files, err := ConvertMessageWithOptions(context.Background(), msg, formats.Options{Defang: true})
+		if err != nil {
+			t.Fatalf("Convert: %v", err)
+		}
+		var text string
+		for _, f := range files {
+			if f.Name == "body.defanged.txt" {
+				text = string(f.Data)
+			}
+		}
+		if !strings.Contains(text, "this page <hxxps://evil[.]example/reset>") {
+			t.Errorf("body.defanged.txt = %q", text)
+		}
+	}
+}
+
+func TestConvertPlaceholders(t *testing.T) {
+	msg := &parser.Message{BodyRTFHTML: parser.RenderRTF([]byte(`{\rtf1 See \objattph and \objattph}`)).HTML}
+	for i, name := range []string{"chart.png", "Q3 report.pdf"} {
+		msg.Attachments = append(msg.Attachments, &parser.Attachment{
+			LongName:  name,
+			Method:    parser.AttachByValue,
+			Data:      []byte("data"),
+			Rendering: &parser.Rendering{Type: parser.RenderFile, Position: uint32(i)},
+		})
+	}
+	for _, f := range ConvertMessage(msg) {
+		if f.Name != "body_from_rtf.html" {
+			continue
+		}
+		body := string(f.Data)
+		if !strings.Contains(body, `<img src="data:image/png;base64,ZGF0YQ==" alt="chart.png">`) ||
+			!strings.Contains(body, `<a href="Q3%20report.pdf" download="Q3 report.pdf">`) {
+			t.Errorf("body_from_rtf.html = %s", body)
+		}
+		return
+	}
+	t.Fatal("no body_from_rtf.html")
+}
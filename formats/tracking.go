@@ -0,0 +1,209 @@
+// tracking.go detects tracking pixels (web beacons) in HTML bodies:
+// remote images whose only purpose is to tell the sender that, when and
+// where a message was opened. They are removed before external images
+// are fetched, so converting a message never confirms it was read.
+
+package formats
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tracker is a tracking image removed from an HTML body.
+type Tracker struct {
+	URL     string
+	Reasons []string // why the image was judged a tracker
+}
+
+// TrackerDomains lists hosts that serve only tracking images; their
+// subdomains match too. It may be extended at startup.
+var TrackerDomains = []string{
+	"mailtrack.io",
+	"t.yesware.com",
+	"app.bananatag.com",
+	"mailfoogae.appspot.com",
+	"pstmrk.it",
+	"open.convertkit-mail.com",
+}
+
+// trackingSegments are path segments, without extension, used by mail
+// services for open-tracking endpoints.
+var trackingSegments = map[string]bool{
+	"open": true, "opened": true, "opens": true, "pixel": true,
+	"beacon": true, "track": true, "tracking": true, "trk": true,
+	"1x1": true,
+}
+
+// opaqueTokenRe matches the long identifiers trackers embed to tell
+// recipients apart.
+var opaqueTokenRe = regexp.MustCompile(`^[A-Za-z0-9_\-.=%]{16,}$`)
+
+// blankImage is a transparent 1x1 GIF that replaces tracking images
+// referenced other than by an <img> src.
+const blankImage = "data:image/gif;base64,R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7"
+
+// RemoveTrackers deletes the <img> elements of html that look like
+// tracking beacons and returns the result and the removed images, in
+// order of appearance. Only http and https images are considered. An
+// image is a tracker if it is sized 1x1 or smaller, hidden, hosted on one
+// of TrackerDomains, or fetched from an open-tracking path carrying a
+// per-recipient identifier. Other image references (srcset candidates,
+// <source>, background attributes, CSS url()) on a tracker domain or
+// with a tracking fingerprint are replaced with a blank image.
+func RemoveTrackers(html []byte) ([]byte, []Tracker) {
+	tokens := Tokenize(html)
+	var trackers []Tracker
+	var out bytes.Buffer
+	for i := range tokens {
+		t := &tokens[i]
+		if t.Type == StartTagToken && t.Tag == "img" {
+			src, _ := t.Attr("src")
+			src = strings.TrimSpace(src)
+			if isRemote(src) {
+				if reasons := trackingReasons(t, src); len(reasons) > 0 {
+					trackers = append(trackers, Tracker{URL: src, Reasons: reasons})
+					continue
+				}
+			}
+		}
+		out.Write(t.Bytes())
+	}
+	result := RewriteURLs(out.Bytes(), func(rawURL string, kind URLKind) string {
+		if kind != URLImage || !isRemote(rawURL) {
+			return rawURL
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return rawURL
+		}
+		if reasons := urlTrackingReasons(u); len(reasons) > 0 {
+			trackers = append(trackers, Tracker{URL: rawURL, Reasons: reasons})
+			return blankImage
+		}
+		return rawURL
+	})
+	if len(trackers) == 0 {
+		return html, nil
+	}
+	return result, trackers
+}
+
+// trackingReasons returns why the image t, loaded from src, looks like a
+// tracking beacon, or nil if it does not.
+func trackingReasons(t *Token, src string) []string {
+	var reasons []string
+	style := cssDeclarations(t)
+	width, hasWidth := dimension(t, style, "width")
+	height, hasHeight := dimension(t, style, "height")
+	switch {
+	case (hasWidth && width == 0) || (hasHeight && height == 0):
+		reasons = append(reasons, "zero-size image")
+	case hasWidth && hasHeight && width <= 1 && height <= 1:
+		reasons = append(reasons, "1x1 image")
+	}
+	if style["display"] == "none" || style["visibility"] == "hidden" {
+		reasons = append(reasons, "hidden image")
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return reasons
+	}
+	return append(reasons, urlTrackingReasons(u)...)
+}
+
+// urlTrackingReasons returns why the image URL u alone looks like a
+// tracking beacon, or nil if it does not.
+func urlTrackingReasons(u *url.URL) []string {
+	var reasons []string
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, d := range TrackerDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			reasons = append(reasons, "known tracker domain "+d)
+			break
+		}
+	}
+	if hasTrackingFingerprint(u) {
+		reasons = append(reasons, "tracking URL fingerprint")
+	}
+	return reasons
+}
+
+// hasTrackingFingerprint reports whether u has an open-tracking path
+// segment and a query parameter holding an opaque identifier made of
+// both letters and digits.
+func hasTrackingFingerprint(u *url.URL) bool {
+	tracking := false
+	for _, s := range strings.Split(strings.ToLower(u.Path), "/") {
+		if trackingSegments[strings.TrimSuffix(s, path.Ext(s))] {
+			tracking = true
+			break
+		}
+	}
+	if !tracking {
+		return false
+	}
+	for _, values := range u.Query() {
+		for _, v := range values {
+			if opaqueTokenRe.MatchString(v) && strings.ContainsAny(v, "0123456789") &&
+				strings.IndexFunc(v, isLetterRune) >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLetterRune reports whether r is an ASCII letter.
+func isLetterRune(r rune) bool {
+	return r < 0x80 && isLetter(byte(r))
+}
+
+// cssDeclarations parses the style attribute of t into lower-case
+// property names and values.
+func cssDeclarations(t *Token) map[string]string {
+	style, _ := t.Attr("style")
+	decls := make(map[string]string)
+	for _, decl := range strings.Split(style, ";") {
+		name, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		decls[strings.ToLower(strings.TrimSpace(name))] = strings.ToLower(value)
+	}
+	return decls
+}
+
+// dimension returns the pixel size set for the image by its name
+// attribute or style property, and whether one is set.
+func dimension(t *Token, style map[string]string, name string) (float64, bool) {
+	v, ok := style[name]
+	if !ok {
+		if v, ok = t.Attr(name); !ok {
+			return 0, false
+		}
+	}
+	v = strings.TrimSuffix(strings.TrimSpace(strings.ToLower(v)), "px")
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// PrivacyReport describes the trackers removed from a message.
+func PrivacyReport(trackers []Tracker) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Privacy report: %d tracking image(s) removed\n", len(trackers))
+	for _, t := range trackers {
+		fmt.Fprintf(&b, "\n%s\n    %s\n", t.URL, strings.Join(t.Reasons, "; "))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,358 @@
+// Package cfb reads Microsoft Compound File Binary containers (MS-CFB),
+// the OLE2 structured storage format used by Outlook .msg files.
+//
+// The whole container is held in memory; streams are assembled on demand
+// by following their FAT or mini FAT sector chains. Every chain walk is
+// bounded so that crafted files cannot cause unbounded loops.
+//
+// Zero external dependencies.
+package cfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Signature is the 8-byte magic number at the start of every compound file.
+var Signature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// Special sector numbers.
+const (
+	maxRegSect = 0xFFFFFFFA
+	difSect    = 0xFFFFFFFC
+	fatSect    = 0xFFFFFFFD
+	endOfChain = 0xFFFFFFFE
+	freeSect   = 0xFFFFFFFF
+	noStream   = 0xFFFFFFFF
+)
+
+// Directory entry object types.
+const (
+	TypeStorage = 1
+	TypeStream  = 2
+	TypeRoot    = 5
+)
+
+const (
+	headerSize   = 512
+	dirEntrySize = 128
+	difatInHdr   = 109
+)
+
+// ErrBadSignature is returned when the input is not a compound file.
+var ErrBadSignature = errors.New("not a compound file")
+
+// ErrCorrupt is returned when the container structure is inconsistent.
+var ErrCorrupt = errors.New("corrupt compound file")
+
+// File is a parsed compound file.
+type File struct {
+	data           []byte
+	sectorSize     int
+	miniSectorSize int
+	miniCutoff     uint64
+	fat            []uint32
+	miniFAT        []uint32
+	miniStream     []byte
+	entries        []*Entry
+	Root           *Entry // Root storage entry.
+}
+
+// Entry is a storage or stream in the directory tree.
+type Entry struct {
+	Name     string   // Entry name (UTF-16 decoded).
+	Type     int      // TypeStorage, TypeStream, or TypeRoot.
+	Children []*Entry // Child entries of a storage, sorted by name.
+	start    uint32
+	size     uint64
+	left     uint32
+	right    uint32
+	child    uint32
+}
+
+// IsStorage reports whether the entry is a storage (directory).
+func (e *Entry) IsStorage() bool {
+	return e.Type == TypeStorage || e.Type == TypeRoot
+}
+
+// Size returns the stream size in bytes.
+func (e *Entry) Size() int64 {
+	return int64(e.size)
+}
+
+// Child returns the direct child with the given name, compared
+// case-insensitively as MS-CFB requires, or nil if absent.
+func (e *Entry) Child(name string) *Entry {
+	for _, c := range e.Children {
+		if strings.EqualFold(c.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Open parses a compound file held in data.
+func Open(data []byte) (*File, error) {
+	if len(data) < headerSize || !bytes.Equal(data[:8], Signature) {
+		return nil, ErrBadSignature
+	}
+	shift := binary.LittleEndian.Uint16(data[30:32])
+	miniShift := binary.LittleEndian.Uint16(data[32:34])
+	if shift != 9 && shift != 12 {
+		return nil, ErrCorrupt
+	}
+	if miniShift != 6 {
+		return nil, ErrCorrupt
+	}
+	f := &File{
+		data:           data,
+		sectorSize:     1 << shift,
+		miniSectorSize: 1 << miniShift,
+		miniCutoff:     uint64(binary.LittleEndian.Uint32(data[56:60])),
+	}
+
+	if err := f.loadFAT(); err != nil {
+		return nil, err
+	}
+
+	dirStart := binary.LittleEndian.Uint32(data[48:52])
+	dir, err := f.readChain(dirStart, f.fat, f.sectorAt, f.sectorSize, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.loadEntries(dir); err != nil {
+		return nil, err
+	}
+
+	miniFATStart := binary.LittleEndian.Uint32(data[60:64])
+	if miniFATStart != endOfChain && miniFATStart != freeSect {
+		raw, err := f.readChain(miniFATStart, f.fat, f.sectorAt, f.sectorSize, -1)
+		if err != nil {
+			return nil, err
+		}
+		f.miniFAT = toUint32s(raw)
+	}
+	if f.Root.start != endOfChain && f.Root.size > 0 {
+		ms, err := f.readChain(f.Root.start, f.fat, f.sectorAt, f.sectorSize, int64(f.Root.size))
+		if err != nil {
+			return nil, err
+		}
+		f.miniStream = ms
+	}
+	return f, nil
+}
+
+// ReadStream returns the contents of a stream entry.
+func (f *File) ReadStream(e *Entry) ([]byte, error) {
+	if e.Type != TypeStream {
+		return nil, errors.New("cfb: not a stream: " + e.Name)
+	}
+	if e.size == 0 {
+		return []byte{}, nil
+	}
+	if e.size < f.miniCutoff {
+		return f.readChain(e.start, f.miniFAT, f.miniSectorAt, f.miniSectorSize, int64(e.size))
+	}
+	return f.readChain(e.start, f.fat, f.sectorAt, f.sectorSize, int64(e.size))
+}
+
+// loadFAT assembles the sector allocation table from the header DIFAT
+// entries and any chained DIFAT sectors.
+func (f *File) loadFAT() error {
+	hdr := f.data
+	numFAT := int(binary.LittleEndian.Uint32(hdr[44:48]))
+	maxSectors := len(f.data) / f.sectorSize
+	if numFAT > maxSectors {
+		return ErrCorrupt
+	}
+
+	var fatSectors []uint32
+	for i := 0; i < difatInHdr && len(fatSectors) < numFAT; i++ {
+		s := binary.LittleEndian.Uint32(hdr[76+i*4:])
+		if s > maxRegSect {
+			break
+		}
+		fatSectors = append(fatSectors, s)
+	}
+
+	difat := binary.LittleEndian.Uint32(hdr[68:72])
+	perSector := f.sectorSize/4 - 1
+	for hops := 0; difat <= maxRegSect && len(fatSectors) < numFAT; hops++ {
+		if hops > maxSectors {
+			return ErrCorrupt
+		}
+		sec, ok := f.sectorAt(difat)
+		if !ok {
+			return ErrCorrupt
+		}
+		for i := 0; i < perSector && len(fatSectors) < numFAT; i++ {
+			s := binary.LittleEndian.Uint32(sec[i*4:])
+			if s > maxRegSect {
+				continue
+			}
+			fatSectors = append(fatSectors, s)
+		}
+		difat = binary.LittleEndian.Uint32(sec[perSector*4:])
+	}
+
+	f.fat = make([]uint32, 0, len(fatSectors)*f.sectorSize/4)
+	for _, s := range fatSectors {
+		sec, ok := f.sectorAt(s)
+		if !ok {
+			return ErrCorrupt
+		}
+		f.fat = append(f.fat, toUint32s(sec)...)
+	}
+	return nil
+}
+
+// loadEntries decodes the directory stream and links the red-black tree
+// of each storage into a sorted Children slice.
+func (f *File) loadEntries(dir []byte) error {
+	for off := 0; off+dirEntrySize <= len(dir); off += dirEntrySize {
+		raw := dir[off : off+dirEntrySize]
+		nameLen := int(binary.LittleEndian.Uint16(raw[64:66]))
+		if nameLen > 64 {
+			nameLen = 64
+		}
+		e := &Entry{
+			Name:  decodeName(raw[:nameLen]),
+			Type:  int(raw[66]),
+			left:  binary.LittleEndian.Uint32(raw[68:72]),
+			right: binary.LittleEndian.Uint32(raw[72:76]),
+			child: binary.LittleEndian.Uint32(raw[76:80]),
+			start: binary.LittleEndian.Uint32(raw[116:120]),
+			size:  binary.LittleEndian.Uint64(raw[120:128]),
+		}
+		if f.sectorSize == 512 {
+			// Version 3 files only define the low 32 bits of the size.
+			e.size &= 0xFFFFFFFF
+		}
+		f.entries = append(f.entries, e)
+	}
+	if len(f.entries) == 0 || f.entries[0].Type != TypeRoot {
+		return ErrCorrupt
+	}
+	f.Root = f.entries[0]
+
+	visited := make([]bool, len(f.entries))
+	visited[0] = true
+	var link func(parent *Entry, id uint32, depth int)
+	link = func(parent *Entry, id uint32, depth int) {
+		if id == noStream || int(id) >= len(f.entries) || visited[id] || depth > len(f.entries) {
+			return
+		}
+		visited[id] = true
+		e := f.entries[id]
+		if e.Type != TypeStorage && e.Type != TypeStream {
+			return
+		}
+		parent.Children = append(parent.Children, e)
+		link(parent, e.left, depth+1)
+		link(parent, e.right, depth+1)
+		if e.IsStorage() {
+			link(e, e.child, depth+1)
+		}
+	}
+	link(f.Root, f.Root.child, 0)
+
+	for _, e := range f.entries {
+		sort.Slice(e.Children, func(i, j int) bool {
+			return e.Children[i].Name < e.Children[j].Name
+		})
+	}
+	return nil
+}
+
+// readChain follows a sector chain through table and concatenates the
+// sectors. If size is non-negative the result is truncated to size bytes.
+// A chain that visits a sector twice is corrupt.
+func (f *File) readChain(start uint32, table []uint32, sector func(uint32) ([]byte, bool), secSize int, size int64) ([]byte, error) {
+	var out []byte
+	if size >= 0 {
+		if size > int64(len(f.data)) {
+			return nil, ErrCorrupt
+		}
+		out = make([]byte, 0, size)
+	}
+	cur := start
+	visited := make(map[uint32]bool)
+	for cur != endOfChain {
+		if cur > maxRegSect || int(cur) >= len(table) || visited[cur] {
+			if size >= 0 && int64(len(out)) >= size {
+				break
+			}
+			return nil, ErrCorrupt
+		}
+		visited[cur] = true
+		sec, ok := sector(cur)
+		if !ok {
+			return nil, ErrCorrupt
+		}
+		out = append(out, sec...)
+		if size >= 0 && int64(len(out)) >= size {
+			break
+		}
+		cur = table[cur]
+	}
+	if size >= 0 {
+		if int64(len(out)) < size {
+			return nil, ErrCorrupt
+		}
+		out = out[:size]
+	}
+	return out, nil
+}
+
+// sectorAt returns the bytes of regular sector n.
+func (f *File) sectorAt(n uint32) ([]byte, bool) {
+	off := (int64(n) + 1) * int64(f.sectorSize)
+	end := off + int64(f.sectorSize)
+	if end > int64(len(f.data)) {
+		// Tolerate a short final sector, as some writers truncate it.
+		if off < int64(len(f.data)) {
+			sec := make([]byte, f.sectorSize)
+			copy(sec, f.data[off:])
+			return sec, true
+		}
+		return nil, false
+	}
+	return f.data[off:end], true
+}
+
+// miniSectorAt returns the bytes of mini sector n within the mini stream.
+func (f *File) miniSectorAt(n uint32) ([]byte, bool) {
+	off := int64(n) * int64(f.miniSectorSize)
+	end := off + int64(f.miniSectorSize)
+	if end > int64(len(f.miniStream)) {
+		return nil, false
+	}
+	return f.miniStream[off:end], true
+}
+
+// toUint32s reinterprets b as a little-endian uint32 slice.
+func toUint32s(b []byte) []uint32 {
+	out := make([]uint32, len(b)/4)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return out
+}
+
+// decodeName converts a UTF-16LE directory entry name, dropping the
+// terminating null.
+func decodeName(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,212 @@
+package cfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// node describes a storage or stream for buildCFB.
+type node struct {
+	name     string
+	data     []byte
+	children []*node
+}
+
+// buildCFB writes a minimal version 3 compound file containing tree.
+// Streams under 4096 bytes are placed in the mini stream.
+func buildCFB(tree []*node) []byte {
+	const ss = 512
+	type ent struct {
+		n     *node
+		typ   byte
+		child uint32
+		right uint32
+		start uint32
+		size  uint64
+	}
+	ents := []*ent{{n: &node{name: "Root Entry", children: tree}, typ: TypeRoot}}
+	var add func(parent int)
+	add = func(parent int) {
+		prev := -1
+		for _, c := range ents[parent].n.children {
+			e := &ent{n: c, typ: TypeStream, child: noStream, right: noStream}
+			if c.data == nil {
+				e.typ = TypeStorage
+			}
+			ents = append(ents, e)
+			idx := len(ents) - 1
+			if prev < 0 {
+				ents[parent].child = uint32(idx)
+			} else {
+				ents[prev].right = uint32(idx)
+			}
+			prev = idx
+			if e.typ == TypeStorage {
+				add(idx)
+			}
+		}
+		if prev < 0 {
+			ents[parent].child = noStream
+		}
+	}
+	ents[0].right = noStream
+	add(0)
+
+	var mini []byte
+	var miniFAT []uint32
+	var sectors [][]byte
+	var fat []uint32
+	chain := func(data []byte, unit int, table *[]uint32, store func([]byte)) uint32 {
+		if len(data) == 0 {
+			return endOfChain
+		}
+		start := uint32(len(*table))
+		n := (len(data) + unit - 1) / unit
+		for i := 0; i < n; i++ {
+			chunk := make([]byte, unit)
+			copy(chunk, data[i*unit:])
+			store(chunk)
+			next := uint32(len(*table) + 1)
+			if i == n-1 {
+				next = endOfChain
+			}
+			*table = append(*table, next)
+		}
+		return start
+	}
+	big := func(b []byte) uint32 {
+		return chain(b, ss, &fat, func(c []byte) { sectors = append(sectors, c) })
+	}
+	for _, e := range ents[1:] {
+		if e.typ != TypeStream {
+			continue
+		}
+		e.size = uint64(len(e.n.data))
+		if len(e.n.data) < 4096 {
+			e.start = chain(e.n.data, 64, &miniFAT, func(c []byte) { mini = append(mini, c...) })
+		} else {
+			e.start = big(e.n.data)
+		}
+	}
+	ents[0].start = big(mini)
+	ents[0].size = uint64(len(mini))
+
+	var mf bytes.Buffer
+	for _, v := range miniFAT {
+		binary.Write(&mf, binary.LittleEndian, v)
+	}
+	miniFATStart := big(mf.Bytes())
+
+	var dir bytes.Buffer
+	for _, e := range ents {
+		raw := make([]byte, dirEntrySize)
+		u := utf16.Encode([]rune(e.n.name))
+		for i, c := range u {
+			binary.LittleEndian.PutUint16(raw[i*2:], c)
+		}
+		binary.LittleEndian.PutUint16(raw[64:], uint16(len(u)*2+2))
+		raw[66] = e.typ
+		binary.LittleEndian.PutUint32(raw[68:], noStream)
+		binary.LittleEndian.PutUint32(raw[72:], e.right)
+		binary.LittleEndian.PutUint32(raw[76:], e.child)
+		binary.LittleEndian.PutUint32(raw[116:], e.start)
+		binary.LittleEndian.PutUint64(raw[120:], e.size)
+		dir.Write(raw)
+	}
+	dirStart := big(dir.Bytes())
+
+	// One FAT sector holds 128 entries, enough for these tests.
+	fatSector := uint32(len(fat))
+	fat = append(fat, fatSect)
+	fatBytes := make([]byte, ss)
+	for i := range fatBytes {
+		fatBytes[i] = 0xFF
+	}
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	sectors = append(sectors, fatBytes)
+
+	hdr := make([]byte, headerSize)
+	copy(hdr, Signature)
+	binary.LittleEndian.PutUint16(hdr[24:], 0x3E)
+	binary.LittleEndian.PutUint16(hdr[26:], 3)
+	binary.LittleEndian.PutUint16(hdr[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(hdr[30:], 9)
+	binary.LittleEndian.PutUint16(hdr[32:], 6)
+	binary.LittleEndian.PutUint32(hdr[44:], 1)
+	binary.LittleEndian.PutUint32(hdr[48:], dirStart)
+	binary.LittleEndian.PutUint32(hdr[56:], 4096)
+	binary.LittleEndian.PutUint32(hdr[60:], miniFATStart)
+	binary.LittleEndian.PutUint32(hdr[64:], 1)
+	binary.LittleEndian.PutUint32(hdr[68:], endOfChain)
+	for i := 0; i < difatInHdr; i++ {
+		binary.LittleEndian.PutUint32(hdr[76+i*4:], freeSect)
+	}
+	binary.LittleEndian.PutUint32(hdr[76:], fatSector)
+
+	out := hdr
+	for _, s := range sectors {
+		out = append(out, s...)
+	}
+	return out
+}
+
+func TestOpenBadSignature(t *testing.T) {
+	if _, err := Open([]byte("not a compound file")); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature, got %v", err)
+	}
+	if _, err := Open(make([]byte, 1024)); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature for zeroed data, got %v", err)
+	}
+}
+
+func TestReadStreams(t *testing.T) {
+	small := []byte("hello, mini stream")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 400)
+	data := buildCFB([]*node{
+		{name: "small", data: small},
+		{name: "sub", children: []*node{
+			{name: "large", data: large},
+		}},
+	})
+
+	f, err := Open(data)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s := f.Root.Child("SMALL")
+	if s == nil {
+		t.Fatal("small stream not found (lookup must be case-insensitive)")
+	}
+	got, err := f.ReadStream(s)
+	if err != nil || !bytes.Equal(got, small) {
+		t.Fatalf("small stream = %q, %v", got, err)
+	}
+
+	sub := f.Root.Child("sub")
+	if sub == nil || !sub.IsStorage() {
+		t.Fatal("storage sub not found")
+	}
+	l := sub.Child("large")
+	if l == nil {
+		t.Fatal("large stream not found")
+	}
+	got, err = f.ReadStream(l)
+	if err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("large stream mismatch (%d bytes), %v", len(got), err)
+	}
+	if _, err := f.ReadStream(sub); err == nil {
+		t.Fatal("expected error reading a storage as a stream")
+	}
+}
+
+func TestReadChainLoop(t *testing.T) {
+	f := &File{}
+	sector := func(uint32) ([]byte, bool) { return make([]byte, 512), true }
+	if _, err := f.readChain(0, []uint32{1, 0}, sector, 512, -1); err != ErrCorrupt {
+		t.Fatalf("looping chain: got %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,146 @@
+// charset.go converts message text to UTF-8: UTF-16 and the single-byte
+// character sets common in email are decoded, and text in any other
+// charset has its undecodable bytes replaced with U+FFFD.
+
+package eml
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// toUTF8 converts data in the named charset to valid UTF-8 and reports
+// whether the charset is known. Unlabelled 8-bit text is decoded as
+// Windows-1252; invalid sequences in UTF-8 or in an unknown charset are
+// replaced with U+FFFD.
+func toUTF8(charset string, data []byte) ([]byte, bool) {
+	switch c := normalizeCharset(charset); c {
+	case "", "us-ascii", "windows-1252":
+		return decodeSingleByte(data, &windows1252), true
+	case "utf-8":
+		return bytes.ToValidUTF8(data, []byte("\uFFFD")), true
+	case "iso-8859-1":
+		return decodeSingleByte(data, nil), true
+	case "utf-16le", "utf-16be", "utf-16":
+		return decodeUTF16(data, c == "utf-16be"), true
+	default:
+		if table := singleByteCharsets[c]; table != nil {
+			return decodeSingleByte(data, table), true
+		}
+		return bytes.ToValidUTF8(data, []byte("\uFFFD")), false
+	}
+}
+
+// charsetReader adapts toUTF8 for mime.WordDecoder.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	out, _ := toUTF8(charset, data)
+	return bytes.NewReader(out), nil
+}
+
+// isoCharsetRe matches the spellings of ISO-8859 part names.
+var isoCharsetRe = regexp.MustCompile(`^iso[-_ ]?8859[-_ ]?(\d+)`)
+
+// latinCharsets maps the ISO-8859 Latin alphabet aliases to their parts.
+var latinCharsets = map[string]string{
+	"latin1": "1", "latin2": "2", "latin3": "3", "latin4": "4",
+	"latin5": "9", "latin6": "10", "latin7": "13", "latin8": "14",
+	"latin9": "15", "latin10": "16", "cyrillic": "5", "arabic": "6",
+	"greek": "7", "hebrew": "8",
+}
+
+// normalizeCharset maps charset aliases to a canonical name.
+func normalizeCharset(charset string) string {
+	c := strings.ToLower(strings.Trim(charset, `" `))
+	switch c {
+	case "utf8":
+		return "utf-8"
+	case "ascii", "us":
+		return "us-ascii"
+	case "unicode", "ucs-2", "utf-16":
+		return "utf-16"
+	case "koi8r":
+		return "koi8-r"
+	case "koi8u":
+		return "koi8-u"
+	}
+	if m := isoCharsetRe.FindStringSubmatch(c); m != nil {
+		return "iso-8859-" + m[1]
+	}
+	if part := latinCharsets[strings.NewReplacer("-", "", "_", "").Replace(c)]; part != "" {
+		return "iso-8859-" + part
+	}
+	if c == "l1" {
+		return "iso-8859-1"
+	}
+	for _, prefix := range []string{"windows-", "windows", "x-cp", "cp", "win-", "win"} {
+		if n, ok := strings.CutPrefix(c, prefix); ok && len(n) == 4 && strings.HasPrefix(n, "125") {
+			return "windows-" + n
+		}
+	}
+	return c
+}
+
+// windows1252 is Windows-1252 (Western European), the usual charset of
+// unlabelled 8-bit mail.
+var windows1252 = func() (t [128]rune) {
+	copy(t[:32], tnef.CP1252High[:])
+	for i := 32; i < 128; i++ {
+		t[i] = rune(0x80 + i)
+	}
+	return t
+}()
+
+// decodeSingleByte converts text in a single-byte charset to UTF-8,
+// mapping bytes 0x80-0xFF through high, or as latin-1 if high is nil.
+// Input that is already valid UTF-8 is returned unchanged, since
+// mislabelled parts are common and 8-bit text almost never forms valid
+// multibyte sequences.
+func decodeSingleByte(data []byte, high *[128]rune) []byte {
+	if utf8.Valid(data) {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) + len(data)/4)
+	for _, b := range data {
+		switch {
+		case b < 0x80:
+			buf.WriteByte(b)
+		case high != nil:
+			buf.WriteRune(high[b-0x80])
+		default:
+			buf.WriteRune(rune(b))
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodeUTF16 converts UTF-16 text to UTF-8, honouring a byte order mark.
+func decodeUTF16(data []byte, bigEndian bool) []byte {
+	if len(data) >= 2 {
+		switch {
+		case data[0] == 0xFF && data[1] == 0xFE:
+			bigEndian, data = false, data[2:]
+		case data[0] == 0xFE && data[1] == 0xFF:
+			bigEndian, data = true, data[2:]
+		}
+	}
+	u := make([]uint16, len(data)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			u[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return []byte(string(utf16.Decode(u)))
+}
@@ -0,0 +1,356 @@
+// Package eml decodes RFC 5322 / MIME email messages into the same
+// Message and Attachment types used by the TNEF parser, so that bodies,
+// content-ID resolution, and attachment handling are shared.
+//
+// Headers are decoded with RFC 2047 encoded-word support, attachment
+// filenames with RFC 2231 parameter continuations, and part bodies from
+// base64 or quoted-printable. Embedded message/rfc822 parts and
+// application/ms-tnef (winmail.dat) parts are decoded into nested
+// messages.
+//
+// Standard library only.
+package eml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/converter/parsers/smime"
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// maxDepth bounds multipart and embedded message nesting.
+const maxDepth = 32
+
+// ErrTooDeep is returned when MIME nesting exceeds maxDepth.
+var ErrTooDeep = errors.New("MIME structure nested too deeply")
+
+// wordDecoder decodes RFC 2047 encoded-words in headers and filenames.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Options configures the S/MIME handling of DecodeWithOptions and
+// UnwrapSMIME. The zero value verifies signers against the system roots
+// and leaves encrypted content encrypted.
+type Options struct {
+	Roots     *x509.CertPool  // Trusted roots for signer chains; nil means the system roots.
+	Recipient *smime.Identity // Key that decrypts enveloped content; nil disables decryption.
+	Logger    *slog.Logger    // Receives diagnostics such as unknown charsets; nil discards them.
+}
+
+// Decode parses a raw RFC 5322 message and returns the decoded Message.
+// Encrypted S/MIME content is left encrypted; see DecodeWithOptions.
+func Decode(data []byte) (*tnef.Message, error) {
+	return DecodeWithOptions(data, Options{})
+}
+
+// DecodeWithOptions is Decode with S/MIME options.
+func DecodeWithOptions(data []byte, opts Options) (*tnef.Message, error) {
+	return decode(data, 0, opts)
+}
+
+// decode parses a message at the given embedding depth.
+func decode(data []byte, depth int, opts Options) (*tnef.Message, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &tnef.Message{}
+	msg.ApplyAttributes(headerAttrs(m.Header))
+	msg.Recipients = recipients(m.Header)
+
+	w := &walker{msg: msg, depth: depth, opts: opts}
+	w.walk(textproto.MIMEHeader(m.Header), body, 0)
+	return msg, nil
+}
+
+// headerAttrs maps the envelope headers onto the MAPI properties that
+// view and the converters read.
+func headerAttrs(h mail.Header) []tnef.MAPIAttr {
+	var attrs []tnef.MAPIAttr
+	if s := h.Get("Subject"); s != "" {
+		attrs = append(attrs, tnef.StringAttr(tnef.MAPISubject, decodeHeader(s)))
+	}
+	if from := h.Get("From"); from != "" {
+		addrParser := &mail.AddressParser{WordDecoder: wordDecoder}
+		if a, err := addrParser.Parse(from); err == nil {
+			name := a.Name
+			if name == "" {
+				name = a.Address
+			}
+			attrs = append(attrs,
+				tnef.StringAttr(tnef.MAPISenderName, name),
+				tnef.StringAttr(tnef.MAPISenderEmail, a.Address))
+		} else {
+			attrs = append(attrs, tnef.StringAttr(tnef.MAPISenderName, decodeHeader(from)))
+		}
+	}
+	if to := displayList(h, "To"); to != "" {
+		attrs = append(attrs, tnef.StringAttr(tnef.MAPIDisplayTo, to))
+	}
+	if cc := displayList(h, "Cc"); cc != "" {
+		attrs = append(attrs, tnef.StringAttr(tnef.MAPIDisplayCc, cc))
+	}
+	if d, err := h.Date(); err == nil {
+		attrs = append(attrs, tnef.TimeAttr(tnef.MAPIClientSubmitTime, d))
+	}
+	if id := h.Get("Message-ID"); id != "" {
+		attrs = append(attrs, tnef.StringAttr(tnef.MAPIInternetMsgID, strings.TrimSpace(id)))
+	}
+	return attrs
+}
+
+// displayList formats an address header as a "; "-separated list of
+// display names, in the style of PR_DISPLAY_TO.
+func displayList(h mail.Header, key string) string {
+	raw := h.Get(key)
+	if raw == "" {
+		return ""
+	}
+	addrParser := &mail.AddressParser{WordDecoder: wordDecoder}
+	list, err := addrParser.ParseList(raw)
+	if err != nil {
+		return decodeHeader(raw)
+	}
+	names := make([]string, 0, len(list))
+	for _, a := range list {
+		if a.Name != "" {
+			names = append(names, a.Name)
+		} else {
+			names = append(names, a.Address)
+		}
+	}
+	return strings.Join(names, "; ")
+}
+
+// recipients builds recipient table rows from the To, Cc, and Bcc headers.
+func recipients(h mail.Header) []*tnef.Recipient {
+	var out []*tnef.Recipient
+	addrParser := &mail.AddressParser{WordDecoder: wordDecoder}
+	for _, f := range []struct {
+		key string
+		typ int
+	}{{"To", tnef.RecipientTo}, {"Cc", tnef.RecipientCc}, {"Bcc", tnef.RecipientBcc}} {
+		list, err := addrParser.ParseList(h.Get(f.key))
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			typ := make([]byte, 4)
+			binary.LittleEndian.PutUint32(typ, uint32(f.typ))
+			out = append(out, tnef.NewRecipient([]tnef.MAPIAttr{
+				tnef.StringAttr(tnef.MAPIDisplayName, a.Name),
+				tnef.StringAttr(tnef.MAPISMTPAddress, a.Address),
+				{Type: tnef.PropTypeLong, Name: tnef.MAPIRecipientType, Data: typ},
+			}))
+		}
+	}
+	return out
+}
+
+// walker accumulates bodies and attachments while descending the MIME tree.
+type walker struct {
+	msg   *tnef.Message
+	depth int // embedding depth of msg
+	parts int // leaf parts seen, used to name unnamed attachments
+	opts  Options
+}
+
+// text converts a text body part to UTF-8, logging an unknown charset.
+func (w *walker) text(charset string, data []byte) []byte {
+	out, ok := toUTF8(charset, data)
+	if !ok && w.opts.Logger != nil {
+		w.opts.Logger.Warn("unknown charset; undecodable bytes replaced", "charset", charset)
+	}
+	return out
+}
+
+// walk processes one MIME entity, recursing into multipart containers.
+func (w *walker) walk(h textproto.MIMEHeader, body []byte, level int) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && level < maxDepth {
+		signed := mediaType == "multipart/signed"
+		if signed {
+			w.verifyDetached(body, params["boundary"])
+		}
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				break
+			}
+			data, err := io.ReadAll(p)
+			if !signed || !isSignaturePart(p.Header) {
+				w.walk(p.Header, data, level+1)
+			}
+			if err != nil {
+				break
+			}
+		}
+		return
+	}
+
+	w.parts++
+	data := decodeTransfer(h.Get("Content-Transfer-Encoding"), body)
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := filename(dparams, params)
+	isAttachment := disposition == "attachment" || name != ""
+
+	switch {
+	case isPKCS7Mime(mediaType, name) && level < maxDepth && w.unwrapPKCS7(data, level):
+		// The signed or decrypted entity was walked in place of this part.
+	case mediaType == "message/rfc822":
+		w.addEmbedded(name, data, func() (*tnef.Message, error) { return decode(data, w.depth+1, w.opts) })
+	case mediaType == "application/ms-tnef" || strings.EqualFold(name, "winmail.dat"):
+		w.addEmbedded(name, data, func() (*tnef.Message, error) { return tnef.Decode(data) })
+	case !isAttachment && mediaType == "text/plain" && w.msg.Body == nil:
+		w.msg.Body = w.text(params["charset"], data)
+	case !isAttachment && mediaType == "text/html" && w.msg.BodyHTML == nil:
+		w.msg.BodyHTML = w.text(params["charset"], data)
+	default:
+		if name == "" {
+			name = "part" + strconv.Itoa(w.parts) + extensionFor(mediaType)
+		}
+		w.msg.Attachments = append(w.msg.Attachments, &tnef.Attachment{
+			LongName:        name,
+			Data:            data,
+			MimeType:        mediaType,
+			ContentID:       strings.Trim(h.Get("Content-ID"), "<> \t"),
+			ContentLocation: h.Get("Content-Location"),
+			Method:          tnef.AttachByValue,
+			Disposition:     disposition,
+			Created:         dispositionDate(dparams["creation-date"]),
+			Modified:        dispositionDate(dparams["modification-date"]),
+		})
+	}
+}
+
+// dispositionDate parses an RFC 2183 creation-date or modification-date
+// parameter, returning the zero time if it is absent or malformed.
+func dispositionDate(v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := mail.ParseDate(v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// addEmbedded attaches a nested message. If it cannot be decoded the
+// raw part is kept as a plain file attachment instead.
+func (w *walker) addEmbedded(name string, data []byte, decodeFn func() (*tnef.Message, error)) {
+	att := &tnef.Attachment{LongName: name, Data: data, Method: tnef.AttachByValue}
+	if sub, err := decodeFn(); err == nil {
+		att.EmbeddedMsg = sub
+		att.Method = tnef.AttachEmbeddedMsg
+		if att.LongName == "" {
+			att.LongName = sub.GetAttrString(tnef.MAPISubject)
+		}
+	}
+	if att.LongName == "" {
+		att.LongName = "message" + strconv.Itoa(w.parts) + ".eml"
+	}
+	w.msg.Attachments = append(w.msg.Attachments, att)
+}
+
+// filename returns the decoded attachment filename from the
+// Content-Disposition filename parameter or the Content-Type name
+// parameter. RFC 2231 encoding is handled by mime.ParseMediaType;
+// RFC 2047 encoded-words, which many mailers use instead, are decoded here.
+func filename(dparams, params map[string]string) string {
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	return decodeHeader(name)
+}
+
+// decodeHeader decodes RFC 2047 encoded-words, leaving s as it is if it
+// contains none or is malformed, and returns valid UTF-8.
+func decodeHeader(s string) string {
+	if strings.Contains(s, "=?") {
+		if d, err := wordDecoder.DecodeHeader(s); err == nil {
+			s = d
+		}
+	}
+	// Raw 8-bit header text carries no charset.
+	b, _ := toUTF8("", []byte(s))
+	return string(b)
+}
+
+// decodeTransfer reverses the Content-Transfer-Encoding of a part body.
+// Decoding is lenient: malformed input yields as much data as could be
+// recovered rather than an error.
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := make([]byte, 0, len(body))
+		for _, b := range body {
+			if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '+' || b == '/' {
+				clean = append(clean, b)
+			}
+		}
+		out := make([]byte, base64.RawStdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.RawStdEncoding.Decode(out, clean[:len(clean)/4*4+trailing(len(clean)%4)])
+		return out[:n]
+	case "quoted-printable":
+		out, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return out
+	default:
+		return body
+	}
+}
+
+// trailing returns how many bytes of an incomplete final base64 quantum
+// can be decoded (a single leftover character carries no full byte).
+func trailing(n int) int {
+	if n == 1 {
+		return 0
+	}
+	return n
+}
+
+// extensionFor returns a file extension for a media type, used to name
+// attachments that have no filename.
+func extensionFor(mediaType string) string {
+	switch mediaType {
+	case "text/plain":
+		return ".txt"
+	case "text/html":
+		return ".html"
+	case "text/calendar":
+		return ".ics"
+	case "image/jpeg":
+		return ".jpg"
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
@@ -0,0 +1,142 @@
+package eml
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+const sample = "From: =?UTF-8?Q?J=C3=BCrgen?= <jurgen@example.com>\r\n" +
+	"To: Alice <alice@example.com>, bob@example.com\r\n" +
+	"Subject: =?ISO-8859-1?Q?Gr=FC=DFe?=\r\n" +
+	"Date: Mon, 02 Mar 2026 10:00:00 +0100\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Sch=F6ne Gr=FC=DFe\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p><img src=\"cid:logo@x\"></p>\r\n" +
+	"--alt--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo@x>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf;\r\n" +
+	"  modification-date=\"Sun, 01 Mar 2026 12:00:00 +0000\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/ms-tnef; name=\"winmail.dat\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"eJ8+IgAA\r\n" +
+	"--outer--\r\n"
+
+func TestDecode(t *testing.T) {
+	msg, err := Decode([]byte(sample))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got := msg.GetAttrString(tnef.MAPISubject); got != "Grüße" {
+		t.Errorf("subject = %q", got)
+	}
+	if got := msg.GetAttrString(tnef.MAPISenderName); got != "Jürgen" {
+		t.Errorf("sender = %q", got)
+	}
+	if got := msg.GetAttrString(tnef.MAPIDisplayTo); got != "Alice; bob@example.com" {
+		t.Errorf("to = %q", got)
+	}
+	if len(msg.Recipients) != 2 || msg.Recipients[1].Email != "bob@example.com" {
+		t.Errorf("unexpected recipients: %+v", msg.Recipients)
+	}
+	if msg.GetAttrTime(tnef.MAPIClientSubmitTime).IsZero() {
+		t.Error("date not decoded")
+	}
+	if got := strings.TrimSpace(string(msg.Body)); got != "Schöne Grüße" {
+		t.Errorf("body = %q", got)
+	}
+	if !strings.Contains(string(msg.BodyHTML), "cid:logo@x") {
+		t.Errorf("html body = %q", msg.BodyHTML)
+	}
+
+	if len(msg.Attachments) != 3 {
+		t.Fatalf("expected 3 attachments, got %d", len(msg.Attachments))
+	}
+	img := msg.Attachments[0]
+	if img.ContentID != "logo@x" || string(img.Data) != "\x89PNG\r\n" {
+		t.Errorf("inline image = %+v", img)
+	}
+	if pdf := msg.Attachments[1]; pdf.Filename() != "résumé.pdf" || string(pdf.Data) != "%PDF-1" {
+		t.Errorf("pdf attachment = %q %q", pdf.Filename(), pdf.Data)
+	}
+	if pdf := msg.Attachments[1]; pdf.Disposition != "attachment" || pdf.Modified.Format(time.RFC3339) != "2026-03-01T12:00:00Z" {
+		t.Errorf("pdf disposition = %q, modified = %v", pdf.Disposition, pdf.Modified)
+	}
+	if w := msg.Attachments[2]; w.EmbeddedMsg == nil || w.Method != tnef.AttachEmbeddedMsg {
+		t.Errorf("winmail.dat part was not decoded as TNEF: %+v", w)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := Decode([]byte("no header block")); err == nil {
+		t.Fatal("expected error for input without headers")
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	for _, tt := range []struct {
+		charset string
+		in      []byte
+		want    string
+		known   bool
+	}{
+		{"windows-1252", []byte{0x93, 'h', 'i', 0x94}, "“hi”", true},
+		{"latin1", []byte("already ü"), "already ü", true},
+		{"ISO-8859-2", []byte{'Z', 0xB3, 'o', 't', 'y'}, "Złoty", true},
+		{"iso_8859-15", []byte{0xA4, '5'}, "€5", true},
+		{"KOI8-R", []byte{0xF0, 0xD2, 0xC9, 0xD7, 0xC5, 0xD4}, "Привет", true},
+		{"cp1251", []byte{0xCF, 0xF0, 0xE8}, "При", true},
+		{"", []byte{'c', 'a', 'f', 0xE9}, "café", true},
+		{"utf-8", []byte{'a', 0xFF, 'b'}, "a\uFFFDb", true},
+		{"shift_jis", []byte{0x82, 0xA0, 'x'}, "\uFFFDx", false},
+	} {
+		got, known := toUTF8(tt.charset, tt.in)
+		if string(got) != tt.want || known != tt.known {
+			t.Errorf("toUTF8(%q) = %q, %v; want %q, %v", tt.charset, got, known, tt.want, tt.known)
+		}
+	}
+}
+
+func TestRawParts(t *testing.T) {
+	body := "preamble\r\n--b\r\nContent-Type: text/plain\r\n\r\nsigned\r\n--b\r\n" +
+		"Content-Type: application/pkcs7-signature\r\n\r\nsig\r\n--b--\r\n"
+	parts := rawParts([]byte(body), "b")
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	if got := string(parts[0]); got != "Content-Type: text/plain\r\n\r\nsigned" {
+		t.Errorf("first part = %q", got)
+	}
+	if h, _, err := readEntity(parts[1]); err != nil || !isSignaturePart(h) {
+		t.Errorf("second part is not a signature: %v %v", h, err)
+	}
+	if got := string(canonicalCRLF([]byte("a\nb\r\nc"))); got != "a\r\nb\r\nc" {
+		t.Errorf("canonicalCRLF = %q", got)
+	}
+}
@@ -0,0 +1,236 @@
+// smime.go unwraps S/MIME messages: opaque application/pkcs7-mime
+// signed-data, encrypted enveloped-data (when a key is configured),
+// multipart/signed (detached) entities, and the smime.p7m attachments that
+// Outlook stores for IPM.Note.SMIME messages.
+
+package eml
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/avaropoint/converter/parsers/smime"
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// isPKCS7Mime reports whether a part is an application/pkcs7-mime entity.
+func isPKCS7Mime(mediaType, name string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime" ||
+		strings.EqualFold(path.Ext(name), ".p7m")
+}
+
+// isSignaturePart reports whether h describes a detached signature part.
+func isSignaturePart(h textproto.MIMEHeader) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "application/pkcs7-signature" || mediaType == "application/x-pkcs7-signature"
+}
+
+// openSigned decodes an opaque signed-data structure and returns the
+// header and body of the signed MIME entity along with its signers.
+func (w *walker) openSigned(data []byte) (textproto.MIMEHeader, []byte, []*smime.Signer, error) {
+	sd, err := smime.ParseSigned(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sd.Content == nil {
+		return nil, nil, nil, smime.ErrNotSigned
+	}
+	h, body, err := readEntity(sd.Content)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return h, body, sd.Verify(nil, w.opts.Roots), nil
+}
+
+// openEnveloped decrypts an enveloped-data structure with the configured
+// recipient key and returns the header and body of the MIME entity inside.
+func (w *walker) openEnveloped(data []byte) (textproto.MIMEHeader, []byte, error) {
+	plain, err := smime.Decrypt(data, w.opts.Recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readEntity(plain)
+}
+
+// unwrapPKCS7 walks the entity inside an opaque signed-data or enveloped
+// part, recording its signers or decryption state. It returns false if
+// the part could not be opened, in which case it is kept as an attachment.
+func (w *walker) unwrapPKCS7(data []byte, level int) bool {
+	switch smime.Kind(data) {
+	case smime.KindSigned:
+		h, body, signers, err := w.openSigned(data)
+		if err != nil {
+			return false
+		}
+		w.addSignatures(signers)
+		w.walk(h, body, level+1)
+		return true
+	case smime.KindEnveloped:
+		w.msg.Encrypted = true
+		h, body, err := w.openEnveloped(data)
+		if err != nil {
+			w.msg.DecryptError = err.Error()
+			return false
+		}
+		w.msg.DecryptError = ""
+		w.walk(h, body, level+1)
+		return true
+	}
+	return false
+}
+
+// verifyDetached verifies a multipart/signed entity: the first part is
+// the signed content and the second the detached signature.
+func (w *walker) verifyDetached(body []byte, boundary string) {
+	parts := rawParts(body, boundary)
+	if len(parts) < 2 {
+		return
+	}
+	h, sigBody, err := readEntity(parts[1])
+	if err != nil || !isSignaturePart(h) {
+		return
+	}
+	sd, err := smime.ParseSigned(decodeTransfer(h.Get("Content-Transfer-Encoding"), sigBody))
+	if err != nil {
+		w.msg.Signatures = append(w.msg.Signatures, &tnef.Signature{Error: err.Error()})
+		return
+	}
+	w.addSignatures(sd.Verify(canonicalCRLF(parts[0]), w.opts.Roots))
+}
+
+// addSignatures records verification results on the message.
+func (w *walker) addSignatures(signers []*smime.Signer) {
+	for _, s := range signers {
+		sig := &tnef.Signature{
+			Signer:      s.Name(),
+			Email:       s.Email(),
+			SigningTime: s.SigningTime,
+			Valid:       s.Valid,
+			Trusted:     s.Trusted,
+		}
+		if s.Certificate != nil {
+			sig.Issuer = s.Certificate.Issuer.CommonName
+		}
+		if s.Err != nil {
+			sig.Error = s.Err.Error()
+		}
+		w.msg.Signatures = append(w.msg.Signatures, sig)
+	}
+}
+
+// UnwrapSMIME replaces the smime.p7m attachment of an Outlook S/MIME
+// message (message class IPM.Note.SMIME or IPM.Note.SMIME.MultipartSigned)
+// with the bodies and attachments of the MIME entity it carries,
+// decrypting it if opts.Recipient is set, and records the signers,
+// verified against opts.Roots. Other messages and messages already
+// unwrapped are left unchanged.
+func UnwrapSMIME(msg *tnef.Message, opts Options) {
+	class := strings.ToUpper(msg.GetAttrString(tnef.MAPIMessageClass))
+	if !strings.HasPrefix(class, "IPM.NOTE.SMIME") || len(msg.Signatures) > 0 || msg.Encrypted {
+		return
+	}
+	for i, att := range msg.Attachments {
+		if len(att.Data) == 0 || att.EmbeddedMsg != nil {
+			continue
+		}
+		rest := append(append([]*tnef.Attachment(nil), msg.Attachments[:i]...), msg.Attachments[i+1:]...)
+		w := &walker{msg: msg, opts: opts}
+
+		switch smime.Kind(att.Data) {
+		case smime.KindSigned:
+			h, body, signers, err := w.openSigned(att.Data)
+			if err != nil {
+				return
+			}
+			msg.Attachments = rest
+			w.addSignatures(signers)
+			w.walk(h, body, 0)
+			return
+		case smime.KindEnveloped:
+			msg.Encrypted = true
+			h, body, err := w.openEnveloped(att.Data)
+			if err != nil {
+				msg.DecryptError = err.Error()
+				return
+			}
+			msg.Attachments = rest
+			w.walk(h, body, 0)
+			return
+		}
+		// MultipartSigned messages store the whole multipart/signed
+		// entity, headers included, as the attachment.
+		if h, body, err := readEntity(att.Data); err == nil {
+			if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt == "multipart/signed" {
+				msg.Attachments = rest
+				w.walk(h, body, 0)
+				return
+			}
+		}
+	}
+}
+
+// readEntity splits a MIME entity into its header and body.
+func readEntity(data []byte) (textproto.MIMEHeader, []byte, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(r.R)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, body, nil
+}
+
+// rawParts returns the undecoded parts (headers and body) of a multipart
+// body, as needed to verify a detached signature over the exact bytes.
+func rawParts(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		i := bytes.Index(body[pos:], delim)
+		if i < 0 {
+			break
+		}
+		i += pos
+		if i > 0 && body[i-1] != '\n' {
+			pos = i + len(delim)
+			continue
+		}
+		if start >= 0 {
+			// The line break before a delimiter belongs to the delimiter.
+			end := i
+			if end > start && body[end-1] == '\n' {
+				end--
+			}
+			if end > start && body[end-1] == '\r' {
+				end--
+			}
+			parts = append(parts, body[start:end])
+		}
+		if bytes.HasPrefix(body[i+len(delim):], []byte("--")) {
+			break
+		}
+		nl := bytes.IndexByte(body[i:], '\n')
+		if nl < 0 {
+			break
+		}
+		start = i + nl + 1
+		pos = start
+	}
+	return parts
+}
+
+// canonicalCRLF converts line endings to CRLF, the canonical form over
+// which S/MIME signatures are computed.
+func canonicalCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
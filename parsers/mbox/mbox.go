@@ -0,0 +1,191 @@
+// Package mbox splits Unix mailbox files into individual RFC 5322
+// messages.
+//
+// It handles the common variants: mboxo and mboxrd, where messages are
+// delimited by "From " lines and body lines beginning with "From " are
+// quoted with '>', and mboxcl/mboxcl2, where a Content-Length header
+// gives the body size. When a Content-Length header points exactly at the
+// next delimiter it is trusted and the body is left unquoted (mboxcl2);
+// otherwise messages are split on "From " lines and mboxrd unquoting is
+// applied.
+//
+// Zero external dependencies.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ErrNotMbox is returned when the input does not start with a "From " line.
+var ErrNotMbox = errors.New("not an mbox file")
+
+// maxMessages bounds the number of messages returned from one mailbox.
+const maxMessages = 100000
+
+// Message is a single message extracted from a mailbox.
+type Message struct {
+	Envelope string // The "From " separator line, without the "From " prefix.
+	Data     []byte // The RFC 5322 message, unquoted.
+}
+
+var fromLine = []byte("From ")
+
+// IsMbox reports whether data starts like an mbox file: a "From " line
+// followed by a header field.
+func IsMbox(data []byte) bool {
+	if !bytes.HasPrefix(data, fromLine) {
+		return false
+	}
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 {
+		return false
+	}
+	next := data[nl+1:]
+	if end := bytes.IndexByte(next, '\n'); end >= 0 {
+		next = next[:end]
+	}
+	colon := bytes.IndexByte(next, ':')
+	return colon > 0 && bytes.IndexByte(next[:colon], ' ') < 0
+}
+
+// Split returns the messages contained in an mbox file.
+func Split(data []byte) ([]Message, error) {
+	if !bytes.HasPrefix(data, fromLine) {
+		return nil, ErrNotMbox
+	}
+	var msgs []Message
+	pos := 0
+	for pos < len(data) && len(msgs) < maxMessages {
+		nl := bytes.IndexByte(data[pos:], '\n')
+		if nl < 0 {
+			break
+		}
+		envelope := strings.TrimRight(string(data[pos+len(fromLine):pos+nl]), "\r")
+		start := pos + nl + 1
+
+		if end, ok := contentLengthEnd(data, start); ok {
+			msgs = append(msgs, Message{Envelope: envelope, Data: data[start:end]})
+			pos = skipBlankLines(data, end)
+			continue
+		}
+
+		end := nextFromLine(data, start)
+		msgs = append(msgs, Message{Envelope: envelope, Data: unquote(trimSeparator(data[start:end]))})
+		pos = end
+	}
+	return msgs, nil
+}
+
+// contentLengthEnd returns the end offset of the message starting at
+// start if its Content-Length header is present and lands exactly on the
+// next "From " line (after optional blank lines) or on end of file.
+func contentLengthEnd(data []byte, start int) (int, bool) {
+	hdrEnd := headerEnd(data, start)
+	if hdrEnd < 0 {
+		return 0, false
+	}
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[start:hdrEnd])))
+	hdr, _ := tp.ReadMIMEHeader()
+	v := hdr.Get("Content-Length")
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 || hdrEnd+n > len(data) {
+		return 0, false
+	}
+	end := hdrEnd + n
+	next := skipBlankLines(data, end)
+	if next == len(data) || bytes.HasPrefix(data[next:], fromLine) {
+		return end, true
+	}
+	return 0, false
+}
+
+// headerEnd returns the offset just past the blank line ending the
+// header block that starts at start, or -1 if there is none.
+func headerEnd(data []byte, start int) int {
+	for i := start; i < len(data); {
+		nl := bytes.IndexByte(data[i:], '\n')
+		if nl < 0 {
+			return -1
+		}
+		line := bytes.TrimRight(data[i:i+nl], "\r")
+		i += nl + 1
+		if len(line) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextFromLine returns the offset of the next line starting with "From ",
+// or len(data) if there is none.
+func nextFromLine(data []byte, start int) int {
+	for i := start; i < len(data); {
+		nl := bytes.IndexByte(data[i:], '\n')
+		if nl < 0 {
+			return len(data)
+		}
+		i += nl + 1
+		if bytes.HasPrefix(data[i:], fromLine) {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// skipBlankLines advances past empty lines starting at pos.
+func skipBlankLines(data []byte, pos int) int {
+	for pos < len(data) {
+		switch {
+		case data[pos] == '\n':
+			pos++
+		case data[pos] == '\r' && pos+1 < len(data) && data[pos+1] == '\n':
+			pos += 2
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// trimSeparator removes the single blank line that precedes the next
+// "From " delimiter.
+func trimSeparator(msg []byte) []byte {
+	switch {
+	case bytes.HasSuffix(msg, []byte("\r\n\r\n")):
+		return msg[:len(msg)-2]
+	case bytes.HasSuffix(msg, []byte("\n\n")):
+		return msg[:len(msg)-1]
+	}
+	return msg
+}
+
+// unquote reverses mboxrd "From " quoting: one '>' is removed from every
+// line matching ^>+From .
+func unquote(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte(">From ")) {
+		return msg
+	}
+	var out bytes.Buffer
+	out.Grow(len(msg))
+	for len(msg) > 0 {
+		line := msg
+		if nl := bytes.IndexByte(msg, '\n'); nl >= 0 {
+			line, msg = msg[:nl+1], msg[nl+1:]
+		} else {
+			msg = nil
+		}
+		if trimmed := bytes.TrimLeft(line, ">"); len(trimmed) < len(line) && bytes.HasPrefix(trimmed, fromLine) {
+			line = line[1:]
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,69 @@
+package mbox
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitMboxrd(t *testing.T) {
+	data := "From alice@example.com Mon Mar  2 10:00:00 2026\n" +
+		"Subject: one\n\n" +
+		"first body\n" +
+		">From the start\n" +
+		">>From deeper\n\n" +
+		"From bob@example.com Mon Mar  2 11:00:00 2026\n" +
+		"Subject: two\n\n" +
+		"second body\n"
+
+	msgs, err := Split([]byte(data))
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if !strings.HasPrefix(msgs[0].Envelope, "alice@example.com") {
+		t.Errorf("envelope = %q", msgs[0].Envelope)
+	}
+	want := "Subject: one\n\nfirst body\nFrom the start\n>From deeper\n"
+	if string(msgs[0].Data) != want {
+		t.Errorf("message 1 = %q, want %q", msgs[0].Data, want)
+	}
+	if string(msgs[1].Data) != "Subject: two\n\nsecond body\n" {
+		t.Errorf("message 2 = %q", msgs[1].Data)
+	}
+}
+
+func TestSplitContentLength(t *testing.T) {
+	// mboxcl2: an unquoted "From " line inside the body is covered by
+	// Content-Length and must not start a new message.
+	body := "line\nFrom inside the body\n"
+	data := "From a@example.com Mon Mar  2 10:00:00 2026\n" +
+		"Subject: cl\nContent-Length: " + strconv.Itoa(len(body)) + "\n\n" + body + "\n" +
+		"From b@example.com Mon Mar  2 11:00:00 2026\n" +
+		"Subject: next\n\nx\n"
+
+	msgs, err := Split([]byte(data))
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if !strings.HasSuffix(string(msgs[0].Data), body) {
+		t.Errorf("message 1 = %q", msgs[0].Data)
+	}
+}
+
+func TestIsMbox(t *testing.T) {
+	if !IsMbox([]byte("From x@y Mon Mar  2 10:00:00 2026\r\nReturn-Path: <x@y>\r\n")) {
+		t.Error("expected mbox to be recognised")
+	}
+	if IsMbox([]byte("From: x@y\nSubject: z\n")) {
+		t.Error("an email header block is not an mbox")
+	}
+	if _, err := Split([]byte("hello")); err != ErrNotMbox {
+		t.Errorf("expected ErrNotMbox, got %v", err)
+	}
+}
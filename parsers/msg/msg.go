@@ -0,0 +1,234 @@
+// Package msg decodes Outlook .msg files (MS-OXMSG) into the same
+// Message and Attachment types used by the TNEF parser, so that bodies,
+// content-ID resolution, and attachment handling are shared.
+//
+// A .msg file is a compound file whose root storage holds the message
+// properties. Fixed-size values live in the __properties_version1.0
+// stream; variable-size values live in __substg1.0_IIIITTTT streams.
+// Attachments, recipients, and embedded messages are sub-storages.
+//
+// Zero external dependencies.
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/avaropoint/converter/parsers/cfb"
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// Storage and stream name prefixes defined by MS-OXMSG.
+const (
+	propStream    = "__properties_version1.0"
+	substgPrefix  = "__substg1.0_"
+	attachPrefix  = "__attach_version1.0_#"
+	recipPrefix   = "__recip_version1.0_#"
+	embeddedStore = "__substg1.0_3701000D"
+	nameidStore   = "__nameid_version1.0"
+	nameidEntries = "__substg1.0_00030102"
+	nameidStrings = "__substg1.0_00040102"
+)
+
+// Property stream header sizes for each storage kind.
+const (
+	headerTopLevel = 32
+	headerEmbedded = 24
+	headerChild    = 8
+)
+
+// propEntrySize is the size of one fixed-length property stream entry.
+const propEntrySize = 16
+
+// maxDepth bounds embedded message nesting to stop crafted recursion.
+const maxDepth = 16
+
+// ErrNotMessage is returned when a compound file has no message properties.
+var ErrNotMessage = errors.New("not an Outlook message")
+
+// IsMessage reports whether data is a compound file containing an
+// Outlook message (as opposed to a Word or Excel document).
+func IsMessage(data []byte) bool {
+	f, err := cfb.Open(data)
+	if err != nil {
+		return false
+	}
+	return f.Root.Child(propStream) != nil
+}
+
+// Decode parses a .msg file and returns the decoded Message.
+func Decode(data []byte) (*tnef.Message, error) {
+	f, err := cfb.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.Root.Child(propStream) == nil {
+		return nil, ErrNotMessage
+	}
+	return decodeMessage(f, f.Root, headerTopLevel, 0, nameMap(f))
+}
+
+// nameMap reads the named property map shared by the message and its
+// embedded messages, or returns nil if the file has none.
+func nameMap(f *cfb.File) map[int]string {
+	st := f.Root.Child(nameidStore)
+	if st == nil || !st.IsStorage() {
+		return nil
+	}
+	var streams [2][]byte
+	for k, name := range []string{nameidEntries, nameidStrings} {
+		e := st.Child(name)
+		if e == nil || e.IsStorage() {
+			return nil
+		}
+		data, err := f.ReadStream(e)
+		if err != nil {
+			return nil
+		}
+		streams[k] = data
+	}
+	return tnef.DecodeNameMap(streams[0], streams[1])
+}
+
+// decodeMessage reads the message stored in storage st.
+func decodeMessage(f *cfb.File, st *cfb.Entry, hdrSize, depth int, names map[int]string) (*tnef.Message, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msg: embedded messages nested too deeply")
+	}
+	msg := &tnef.Message{}
+	msg.ApplyAttributes(readProps(f, st, hdrSize, names))
+
+	for _, c := range st.Children {
+		if !c.IsStorage() {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(c.Name, recipPrefix):
+			msg.Recipients = append(msg.Recipients, tnef.NewRecipient(readProps(f, c, headerChild, names)))
+		case strings.HasPrefix(c.Name, attachPrefix):
+			msg.Attachments = append(msg.Attachments, decodeAttachment(f, c, depth, names))
+		}
+	}
+	return msg, nil
+}
+
+// decodeAttachment reads an attachment storage, decoding an embedded
+// message if one is present.
+func decodeAttachment(f *cfb.File, st *cfb.Entry, depth int, names map[int]string) *tnef.Attachment {
+	att := &tnef.Attachment{}
+	attrs := readProps(f, st, headerChild, names)
+	att.ApplyAttributes(attrs)
+
+	for _, a := range attrs {
+		if a.Name == tnef.MAPIAttachDataObj && a.Type == tnef.PropTypeBinary {
+			att.Data = a.Data
+		}
+	}
+
+	if sub := st.Child(embeddedStore); sub != nil && sub.IsStorage() && sub.Child(propStream) != nil {
+		if m, err := decodeMessage(f, sub, headerEmbedded, depth+1, names); err == nil {
+			att.EmbeddedMsg = m
+			if att.Method == 0 {
+				att.Method = tnef.AttachEmbeddedMsg
+			}
+		}
+	}
+	return att
+}
+
+// readProps collects the properties of a storage: variable-length values
+// from __substg1.0_ streams and fixed-length values from the property
+// stream. The result is ordered by property ID, with named properties
+// labelled from names.
+func readProps(f *cfb.File, st *cfb.Entry, hdrSize int, names map[int]string) []tnef.MAPIAttr {
+	var attrs []tnef.MAPIAttr
+	seen := make(map[uint32]bool)
+
+	for _, c := range st.Children {
+		if c.IsStorage() || !strings.HasPrefix(c.Name, substgPrefix) {
+			continue
+		}
+		tag, ok := parseTag(c.Name[len(substgPrefix):])
+		if !ok {
+			continue
+		}
+		pt := int(tag & 0xFFFF)
+		if pt&0x1000 != 0 {
+			// Multi-valued variable properties are split across
+			// indexed streams; they are not needed for conversion.
+			continue
+		}
+		data, err := f.ReadStream(c)
+		if err != nil {
+			continue
+		}
+		seen[tag] = true
+		attrs = append(attrs, tnef.MAPIAttr{Type: pt, Name: int(tag >> 16), Data: data})
+	}
+
+	if ps := st.Child(propStream); ps != nil && !ps.IsStorage() {
+		if raw, err := f.ReadStream(ps); err == nil && len(raw) >= hdrSize {
+			attrs = append(attrs, parseFixedProps(raw[hdrSize:], seen)...)
+		}
+	}
+
+	sort.SliceStable(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	tnef.NameAttrs(attrs, names)
+	return attrs
+}
+
+// parseFixedProps decodes 16-byte property stream entries, skipping
+// variable-length properties whose values were read from streams.
+func parseFixedProps(raw []byte, seen map[uint32]bool) []tnef.MAPIAttr {
+	var attrs []tnef.MAPIAttr
+	for off := 0; off+propEntrySize <= len(raw); off += propEntrySize {
+		tag := binary.LittleEndian.Uint32(raw[off : off+4])
+		if seen[tag] {
+			continue
+		}
+		pt := int(tag & 0xFFFF)
+		size := fixedSize(pt)
+		if size <= 0 {
+			continue
+		}
+		val := raw[off+8 : off+8+size]
+		attrs = append(attrs, tnef.MAPIAttr{
+			Type: pt,
+			Name: int(tag >> 16),
+			Data: append([]byte(nil), val...),
+		})
+	}
+	return attrs
+}
+
+// fixedSize returns the inline value size of a fixed-length property
+// type in the property stream, or 0 for variable-length types. Short
+// and boolean values are widened to 4 bytes to match TNEF encoding.
+func fixedSize(pt int) int {
+	switch pt {
+	case 0x0002, 0x000B: // PT_SHORT, PT_BOOLEAN
+		return 4
+	case 0x0003, 0x0004, 0x000A: // PT_LONG, PT_FLOAT, PT_ERROR
+		return 4
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040: // PT_DOUBLE, PT_CURRENCY, PT_APPTIME, PT_I8, PT_SYSTIME
+		return 8
+	default:
+		return 0
+	}
+}
+
+// parseTag decodes the 8 hex digits of a __substg1.0_ stream name into
+// a property tag (ID in the high word, type in the low word).
+func parseTag(s string) (uint32, bool) {
+	if len(s) < 8 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[:8], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(v), true
+}
@@ -0,0 +1,272 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/avaropoint/converter/parsers/cfb"
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// node describes a storage or stream for buildCFB.
+type node struct {
+	name     string
+	data     []byte
+	children []*node
+}
+
+// buildCFB writes a minimal version 3 compound file containing tree,
+// laid out as in the cfb package tests. Streams under 4096 bytes are
+// placed in the mini stream.
+func buildCFB(tree []*node) []byte {
+	const (
+		ss         = 512
+		endOfChain = 0xFFFFFFFE
+		noStream   = 0xFFFFFFFF
+	)
+	type ent struct {
+		n     *node
+		typ   byte
+		child uint32
+		right uint32
+		start uint32
+		size  uint64
+	}
+	ents := []*ent{{n: &node{name: "Root Entry", children: tree}, typ: cfb.TypeRoot, right: noStream}}
+	var add func(parent int)
+	add = func(parent int) {
+		ents[parent].child = noStream
+		prev := -1
+		for _, c := range ents[parent].n.children {
+			e := &ent{n: c, typ: cfb.TypeStream, child: noStream, right: noStream}
+			if c.data == nil {
+				e.typ = cfb.TypeStorage
+			}
+			ents = append(ents, e)
+			idx := len(ents) - 1
+			if prev < 0 {
+				ents[parent].child = uint32(idx)
+			} else {
+				ents[prev].right = uint32(idx)
+			}
+			prev = idx
+			if e.typ == cfb.TypeStorage {
+				add(idx)
+			}
+		}
+	}
+	add(0)
+
+	var mini, sectors []byte
+	var miniFAT, fat []uint32
+	chain := func(data []byte, unit int, table *[]uint32, store *[]byte) uint32 {
+		if len(data) == 0 {
+			return endOfChain
+		}
+		start := uint32(len(*table))
+		n := (len(data) + unit - 1) / unit
+		for i := 0; i < n; i++ {
+			chunk := make([]byte, unit)
+			copy(chunk, data[i*unit:])
+			*store = append(*store, chunk...)
+			next := uint32(len(*table) + 1)
+			if i == n-1 {
+				next = endOfChain
+			}
+			*table = append(*table, next)
+		}
+		return start
+	}
+	for _, e := range ents[1:] {
+		if e.typ == cfb.TypeStream {
+			e.size = uint64(len(e.n.data))
+			e.start = chain(e.n.data, 64, &miniFAT, &mini)
+		}
+	}
+	ents[0].start = chain(mini, ss, &fat, &sectors)
+	ents[0].size = uint64(len(mini))
+	var mf []byte
+	for _, v := range miniFAT {
+		mf = binary.LittleEndian.AppendUint32(mf, v)
+	}
+	miniFATStart := chain(mf, ss, &fat, &sectors)
+
+	var dir []byte
+	for _, e := range ents {
+		raw := make([]byte, 128)
+		u := utf16.Encode([]rune(e.n.name))
+		for i, c := range u {
+			binary.LittleEndian.PutUint16(raw[i*2:], c)
+		}
+		binary.LittleEndian.PutUint16(raw[64:], uint16(len(u)*2+2))
+		raw[66] = e.typ
+		binary.LittleEndian.PutUint32(raw[68:], noStream)
+		binary.LittleEndian.PutUint32(raw[72:], e.right)
+		binary.LittleEndian.PutUint32(raw[76:], e.child)
+		binary.LittleEndian.PutUint32(raw[116:], e.start)
+		binary.LittleEndian.PutUint64(raw[120:], e.size)
+		dir = append(dir, raw...)
+	}
+	dirStart := chain(dir, ss, &fat, &sectors)
+
+	// One FAT sector holds 128 entries, enough for these tests.
+	fatSector := uint32(len(fat))
+	fat = append(fat, 0xFFFFFFFD)
+	fatBytes := bytes.Repeat([]byte{0xFF}, ss)
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	sectors = append(sectors, fatBytes...)
+
+	hdr := make([]byte, ss)
+	copy(hdr, cfb.Signature)
+	binary.LittleEndian.PutUint16(hdr[24:], 0x3E)
+	binary.LittleEndian.PutUint16(hdr[26:], 3)
+	binary.LittleEndian.PutUint16(hdr[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(hdr[30:], 9)
+	binary.LittleEndian.PutUint16(hdr[32:], 6)
+	binary.LittleEndian.PutUint32(hdr[44:], 1)
+	binary.LittleEndian.PutUint32(hdr[48:], dirStart)
+	binary.LittleEndian.PutUint32(hdr[56:], 4096)
+	binary.LittleEndian.PutUint32(hdr[60:], miniFATStart)
+	binary.LittleEndian.PutUint32(hdr[64:], uint32((len(miniFAT)*4+ss-1)/ss))
+	binary.LittleEndian.PutUint32(hdr[68:], endOfChain)
+	for i := 0; i < 109; i++ {
+		binary.LittleEndian.PutUint32(hdr[76+i*4:], 0xFFFFFFFF)
+	}
+	binary.LittleEndian.PutUint32(hdr[76:], fatSector)
+	return append(hdr, sectors...)
+}
+
+// unicode encodes s as a PT_UNICODE stream value.
+func unicode(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// props builds a property stream: a header of hdrSize bytes followed by
+// a fixed-length PT_LONG entry for each tag.
+func props(hdrSize int, longs map[uint32]uint32) []byte {
+	b := make([]byte, hdrSize)
+	for tag, v := range longs {
+		e := make([]byte, propEntrySize)
+		binary.LittleEndian.PutUint32(e[0:], tag)
+		binary.LittleEndian.PutUint32(e[8:], v)
+		b = append(b, e...)
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	pdf := []byte("%PDF-1.4 attachment data")
+	data := buildCFB([]*node{
+		{name: propStream, data: props(headerTopLevel, nil)},
+		{name: "__substg1.0_0037001F", data: unicode("Quarterly report")},
+		{name: "__substg1.0_1000001F", data: unicode("Plain body")},
+		{name: "__substg1.0_10130102", data: []byte("<p>HTML body</p>")},
+		{name: recipPrefix + "00000000", children: []*node{
+			{name: propStream, data: props(headerChild, map[uint32]uint32{0x0C150003: tnef.RecipientCc})},
+			{name: "__substg1.0_3001001F", data: unicode("Alice Example")},
+			{name: "__substg1.0_39FE001F", data: unicode("alice@example.com")},
+		}},
+		{name: attachPrefix + "00000000", children: []*node{
+			{name: propStream, data: props(headerChild, map[uint32]uint32{0x37050003: tnef.AttachByValue})},
+			{name: "__substg1.0_3707001F", data: unicode("report.pdf")},
+			{name: "__substg1.0_37010102", data: pdf},
+		}},
+		{name: attachPrefix + "00000001", children: []*node{
+			{name: propStream, data: props(headerChild, map[uint32]uint32{0x37050003: tnef.AttachEmbeddedMsg})},
+			{name: "__substg1.0_3001001F", data: unicode("Forwarded")},
+			{name: embeddedStore, children: []*node{
+				{name: propStream, data: props(headerEmbedded, nil)},
+				{name: "__substg1.0_0037001F", data: unicode("Inner subject")},
+				{name: "__substg1.0_1000001F", data: unicode("Inner body")},
+			}},
+		}},
+	})
+	if !IsMessage(data) {
+		t.Fatal("IsMessage returned false for a message")
+	}
+	msg, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got := msg.GetAttrString(tnef.MAPISubject); got != "Quarterly report" {
+		t.Errorf("subject = %q", got)
+	}
+	if string(msg.Body) != "Plain body" || string(msg.BodyHTML) != "<p>HTML body</p>" {
+		t.Errorf("bodies = %q, %q", msg.Body, msg.BodyHTML)
+	}
+	if len(msg.Recipients) != 1 {
+		t.Fatalf("recipients = %d, want 1", len(msg.Recipients))
+	}
+	if r := msg.Recipients[0]; r.Name != "Alice Example" || r.Email != "alice@example.com" || r.Type != tnef.RecipientCc {
+		t.Errorf("recipient = %+v", r)
+	}
+	if len(msg.Attachments) != 2 {
+		t.Fatalf("attachments = %d, want 2", len(msg.Attachments))
+	}
+	if a := msg.Attachments[0]; a.LongName != "report.pdf" || a.Method != tnef.AttachByValue || !bytes.Equal(a.Data, pdf) {
+		t.Errorf("attachment = %q method %d data %q", a.LongName, a.Method, a.Data)
+	}
+	a := msg.Attachments[1]
+	if a.Method != tnef.AttachEmbeddedMsg || a.EmbeddedMsg == nil {
+		t.Fatalf("embedded attachment = method %d, message %v", a.Method, a.EmbeddedMsg)
+	}
+	if got := a.EmbeddedMsg.GetAttrString(tnef.MAPISubject); got != "Inner subject" || string(a.EmbeddedMsg.Body) != "Inner body" {
+		t.Errorf("embedded message = %q, %q", got, a.EmbeddedMsg.Body)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := Decode([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error for non-compound data")
+	}
+	if IsMessage([]byte{1, 2, 3}) {
+		t.Fatal("IsMessage returned true for non-compound data")
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tag, ok := parseTag("0037001F")
+	if !ok || tag != 0x0037001F {
+		t.Fatalf("parseTag = %08X, %v", tag, ok)
+	}
+	if _, ok := parseTag("0037"); ok {
+		t.Fatal("expected failure for short tag")
+	}
+	if _, ok := parseTag("zzzzzzzz"); ok {
+		t.Fatal("expected failure for non-hex tag")
+	}
+}
+
+func TestParseFixedProps(t *testing.T) {
+	entry := func(tag, val uint32) []byte {
+		b := make([]byte, propEntrySize)
+		binary.LittleEndian.PutUint32(b[0:], tag)
+		binary.LittleEndian.PutUint32(b[8:], val)
+		return b
+	}
+	var raw []byte
+	raw = append(raw, entry(0x37050003, 5)...)  // PR_ATTACH_METHOD = 5
+	raw = append(raw, entry(0x0037001F, 40)...) // PR_SUBJECT, variable: skipped
+	raw = append(raw, entry(0x0E1B000B, 1)...)  // PR_HASATTACH = true
+
+	attrs := parseFixedProps(raw, map[uint32]bool{})
+	if len(attrs) != 2 {
+		t.Fatalf("expected 2 fixed props, got %d", len(attrs))
+	}
+	if attrs[0].Name != 0x3705 || binary.LittleEndian.Uint32(attrs[0].Data) != 5 {
+		t.Fatalf("unexpected first prop: %+v", attrs[0])
+	}
+
+	seen := map[uint32]bool{0x37050003: true}
+	if got := parseFixedProps(raw, seen); len(got) != 1 {
+		t.Fatalf("expected seen tag to be skipped, got %d props", len(got))
+	}
+}
@@ -0,0 +1,339 @@
+// ltp.go implements the Lists, Tables, and Properties layer: heap-on-node
+// allocations, BTH B-trees, property contexts, and table contexts.
+
+package pst
+
+import (
+	"encoding/binary"
+
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// Heap-on-node signatures.
+const (
+	hnSignature = 0xEC
+	clientTC    = 0x7C
+	clientBTH   = 0xB5
+	clientPC    = 0xBC
+)
+
+// node is an opened NBT node or subnode: its data blocks and subnodes.
+type node struct {
+	f      *File
+	blocks [][]byte
+	subs   map[uint32]subnode
+}
+
+// openNode opens a top-level node by NID.
+func (f *File) openNode(nid uint32) (*node, error) {
+	ne, ok := f.nodes[nid]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return f.openData(ne.bidData, ne.bidSub)
+}
+
+// openData opens the node whose data and subnode trees start at the
+// given block IDs.
+func (f *File) openData(bidData, bidSub uint64) (*node, error) {
+	blocks, err := f.dataBlocks(bidData)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := f.subnodes(bidSub)
+	if err != nil {
+		return nil, err
+	}
+	return &node{f: f, blocks: blocks, subs: subs}, nil
+}
+
+// sub opens a subnode of n.
+func (n *node) sub(nid uint32) (*node, error) {
+	s, ok := n.subs[nid]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return n.f.openData(s.bidData, s.bidSub)
+}
+
+// bytes returns the node data as one contiguous slice.
+func (n *node) bytes() []byte {
+	if len(n.blocks) == 1 {
+		return n.blocks[0]
+	}
+	var out []byte
+	for _, b := range n.blocks {
+		out = append(out, b...)
+	}
+	return out
+}
+
+// heap returns the node's client signature and user root HID after
+// validating its heap-on-node header.
+func (n *node) heap() (client byte, root uint32, err error) {
+	if len(n.blocks) == 0 || len(n.blocks[0]) < 12 || n.blocks[0][2] != hnSignature {
+		return 0, 0, ErrCorrupt
+	}
+	b := n.blocks[0]
+	return b[3], binary.LittleEndian.Uint32(b[4:8]), nil
+}
+
+// alloc returns the heap allocation identified by hid.
+func (n *node) alloc(hid uint32) ([]byte, error) {
+	if hid == 0 {
+		return nil, nil
+	}
+	index := int(hid>>5) & 0x7FF
+	blk := int(hid >> 16)
+	if hid&0x1F != 0 || index == 0 || blk >= len(n.blocks) {
+		return nil, ErrCorrupt
+	}
+	b := n.blocks[blk]
+	if len(b) < 2 {
+		return nil, ErrCorrupt
+	}
+	pm := int(binary.LittleEndian.Uint16(b[0:2]))
+	if pm+4 > len(b) {
+		return nil, ErrCorrupt
+	}
+	count := int(binary.LittleEndian.Uint16(b[pm : pm+2]))
+	if index > count || pm+4+(count+1)*2 > len(b) {
+		return nil, ErrCorrupt
+	}
+	start := int(binary.LittleEndian.Uint16(b[pm+4+(index-1)*2:]))
+	end := int(binary.LittleEndian.Uint16(b[pm+4+index*2:]))
+	if start > end || end > len(b) {
+		return nil, ErrCorrupt
+	}
+	return b[start:end], nil
+}
+
+// hnid resolves a heap-or-node ID: a heap allocation if it is a HID,
+// otherwise the data of the subnode it names.
+func (n *node) hnid(id uint32) ([]byte, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if id&0x1F == 0 {
+		return n.alloc(id)
+	}
+	s, err := n.sub(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.bytes(), nil
+}
+
+// bthRecords returns every leaf record (key followed by data) of the
+// BTH whose header is at hid. Intermediate pages that are reached twice
+// or trees with more than maxBTHRecords records are corrupt.
+func (n *node) bthRecords(hid uint32) (keySize int, records [][]byte, err error) {
+	hdr, err := n.alloc(hid)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(hdr) < 8 || hdr[0] != clientBTH {
+		return 0, nil, ErrCorrupt
+	}
+	cbKey, cbEnt, levels := int(hdr[1]), int(hdr[2]), int(hdr[3])
+	if cbKey == 0 || levels > maxTreeDepth {
+		return 0, nil, ErrCorrupt
+	}
+
+	visited := make(map[uint32]bool)
+	var walk func(hid uint32, level int) error
+	walk = func(hid uint32, level int) error {
+		if visited[hid] {
+			return ErrCorrupt
+		}
+		visited[hid] = true
+		data, err := n.alloc(hid)
+		if err != nil {
+			return err
+		}
+		if level == 0 {
+			size := cbKey + cbEnt
+			for off := 0; off+size <= len(data); off += size {
+				if len(records) == maxBTHRecords {
+					return ErrCorrupt
+				}
+				records = append(records, data[off:off+size])
+			}
+			return nil
+		}
+		size := cbKey + 4
+		for off := 0; off+size <= len(data); off += size {
+			if err := walk(binary.LittleEndian.Uint32(data[off+cbKey:]), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(binary.LittleEndian.Uint32(hdr[4:8]), levels); err != nil {
+		return 0, nil, err
+	}
+	return cbKey, records, nil
+}
+
+// properties decodes the node's property context into MAPI attributes.
+func (n *node) properties() ([]tnef.MAPIAttr, error) {
+	client, root, err := n.heap()
+	if err != nil {
+		return nil, err
+	}
+	if client != clientPC {
+		return nil, ErrCorrupt
+	}
+	keySize, records, err := n.bthRecords(root)
+	if err != nil {
+		return nil, err
+	}
+	if keySize != 2 {
+		return nil, ErrCorrupt
+	}
+
+	attrs := make([]tnef.MAPIAttr, 0, len(records))
+	for _, r := range records {
+		if len(r) < 8 {
+			continue
+		}
+		id := int(binary.LittleEndian.Uint16(r[0:2]))
+		pt := int(binary.LittleEndian.Uint16(r[2:4]))
+		v := r[4:8]
+		if pt&0x1000 != 0 {
+			continue // multi-valued properties are not needed for conversion
+		}
+		var data []byte
+		if size := inlineSize(pt); size > 0 {
+			data = append([]byte(nil), v[:size]...)
+		} else {
+			data, err = n.hnid(binary.LittleEndian.Uint32(v))
+			if err != nil {
+				continue
+			}
+		}
+		attrs = append(attrs, tnef.MAPIAttr{Type: pt, Name: id, Data: data})
+	}
+	tnef.NameAttrs(attrs, n.f.names)
+	return attrs, nil
+}
+
+// table decodes the node's table context, returning each row as the row
+// ID and its MAPI attributes.
+func (n *node) table() ([]tableRow, error) {
+	client, root, err := n.heap()
+	if err != nil {
+		return nil, err
+	}
+	if client != clientTC {
+		return nil, ErrCorrupt
+	}
+	info, err := n.alloc(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(info) < 22 || info[0] != clientTC {
+		return nil, ErrCorrupt
+	}
+	cols := int(info[1])
+	ceb := int(binary.LittleEndian.Uint16(info[6:8]))
+	rowSize := int(binary.LittleEndian.Uint16(info[8:10]))
+	rowsID := binary.LittleEndian.Uint32(info[14:18])
+	if len(info) < 22+cols*8 || rowSize == 0 || ceb+(cols+7)/8 > rowSize {
+		return nil, ErrCorrupt
+	}
+
+	type column struct {
+		tag          uint32
+		ib, cb, iBit int
+	}
+	desc := make([]column, cols)
+	for i := range desc {
+		c := info[22+i*8:]
+		desc[i] = column{
+			tag:  binary.LittleEndian.Uint32(c[0:4]),
+			ib:   int(binary.LittleEndian.Uint16(c[4:6])),
+			cb:   int(c[6]),
+			iBit: int(c[7]),
+		}
+		if desc[i].ib+desc[i].cb > rowSize || ceb+desc[i].iBit/8 >= rowSize {
+			return nil, ErrCorrupt
+		}
+	}
+
+	// Rows never span data blocks, so split each block separately.
+	var blocks [][]byte
+	switch {
+	case rowsID == 0:
+	case rowsID&0x1F == 0:
+		b, err := n.alloc(rowsID)
+		if err != nil {
+			return nil, err
+		}
+		blocks = [][]byte{b}
+	default:
+		s, err := n.sub(rowsID)
+		if err != nil {
+			return nil, err
+		}
+		blocks = s.blocks
+	}
+
+	var rows []tableRow
+	for _, b := range blocks {
+		for off := 0; off+rowSize <= len(b); off += rowSize {
+			row := b[off : off+rowSize]
+			tr := tableRow{id: binary.LittleEndian.Uint32(row[0:4])}
+			for _, c := range desc {
+				if row[ceb+c.iBit/8]&(0x80>>(c.iBit%8)) == 0 {
+					continue
+				}
+				pt := int(c.tag & 0xFFFF)
+				if pt&0x1000 != 0 {
+					continue
+				}
+				v := row[c.ib : c.ib+c.cb]
+				var data []byte
+				if fixedSize(pt) > 0 {
+					data = append([]byte(nil), v...)
+				} else if len(v) >= 4 {
+					data, err = n.hnid(binary.LittleEndian.Uint32(v))
+					if err != nil {
+						continue
+					}
+				}
+				tr.attrs = append(tr.attrs, tnef.MAPIAttr{Type: pt, Name: int(c.tag >> 16), Data: data})
+			}
+			rows = append(rows, tr)
+		}
+	}
+	return rows, nil
+}
+
+// tableRow is one decoded table context row.
+type tableRow struct {
+	id    uint32
+	attrs []tnef.MAPIAttr
+}
+
+// inlineSize returns how many bytes of a property context value are
+// stored inline for pt, or 0 if the value is referenced by HNID.
+func inlineSize(pt int) int {
+	switch pt {
+	case 0x0002, 0x0003, 0x0004, 0x000A, 0x000B: // PT_SHORT, PT_LONG, PT_FLOAT, PT_ERROR, PT_BOOLEAN
+		return 4
+	}
+	return 0
+}
+
+// fixedSize returns the inline size of a fixed-length property type in a
+// table context row, or 0 for types stored by HNID.
+func fixedSize(pt int) int {
+	switch pt {
+	case 0x0002, 0x0003, 0x0004, 0x000A, 0x000B:
+		return 4
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		return 8
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+// messaging.go implements the Messaging layer: the folder hierarchy and
+// messages with their recipients and attachments.
+
+package pst
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// Well-known node IDs and NID types.
+const (
+	nidNameToIDMap     = 0x61
+	nidRootFolder      = 0x122
+	nidAttachmentTable = 0x671
+	nidRecipientTable  = 0x692
+	nidTypeMask        = 0x1F
+	nidTypeFolder      = 0x02
+	nidTypeMessage     = 0x04
+	nidTypeHierarchy   = 0x0D
+	nidTypeContents    = 0x0E
+)
+
+// Folder property IDs.
+const (
+	propContentCount = 0x3602 // PR_CONTENT_COUNT
+)
+
+// maxFolderDepth bounds folder nesting to stop crafted hierarchy loops.
+const maxFolderDepth = 64
+
+// maxEmbeddedDepth bounds embedded message nesting.
+const maxEmbeddedDepth = 16
+
+// Folder is one folder of the mailbox hierarchy.
+type Folder struct {
+	Name     string    // Display name (PR_DISPLAY_NAME).
+	NID      uint32    // Node ID of the folder.
+	Count    int       // Message count reported by PR_CONTENT_COUNT.
+	Children []*Folder // Subfolders, in hierarchy table order.
+	Messages []uint32  // Node IDs of the messages in the contents table.
+}
+
+// FolderTree returns the folder hierarchy starting at the root folder.
+// Subfolders that cannot be read are skipped.
+func (f *File) FolderTree() (*Folder, error) {
+	return f.folder(nidRootFolder, 0, make(map[uint32]bool))
+}
+
+// folder reads the folder node nid and its subfolders.
+func (f *File) folder(nid uint32, depth int, visited map[uint32]bool) (*Folder, error) {
+	if depth > maxFolderDepth || visited[nid] {
+		return nil, ErrCorrupt
+	}
+	visited[nid] = true
+
+	n, err := f.openNode(nid)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := n.properties()
+	if err != nil {
+		return nil, err
+	}
+	fld := &Folder{NID: nid}
+	for i := range attrs {
+		switch attrs[i].Name {
+		case tnef.MAPIDisplayName:
+			fld.Name = attrs[i].Text()
+		case propContentCount:
+			if len(attrs[i].Data) >= 4 {
+				fld.Count = int(binary.LittleEndian.Uint32(attrs[i].Data))
+			}
+		}
+	}
+
+	base := nid &^ nidTypeMask
+	for _, row := range f.tableRows(base | nidTypeContents) {
+		if row.id&nidTypeMask == nidTypeMessage {
+			fld.Messages = append(fld.Messages, row.id)
+		}
+	}
+	for _, row := range f.tableRows(base | nidTypeHierarchy) {
+		if row.id&nidTypeMask != nidTypeFolder {
+			continue
+		}
+		child, err := f.folder(row.id, depth+1, visited)
+		if err != nil {
+			continue
+		}
+		fld.Children = append(fld.Children, child)
+	}
+	return fld, nil
+}
+
+// tableRows returns the rows of the table context node nid, or nil if it
+// is missing or unreadable.
+func (f *File) tableRows(nid uint32) []tableRow {
+	n, err := f.openNode(nid)
+	if err != nil {
+		return nil
+	}
+	rows, err := n.table()
+	if err != nil {
+		return nil
+	}
+	return rows
+}
+
+// Name-to-ID map properties ([MS-PST] 2.4.7).
+const (
+	propNameidEntries = 0x0003 // PidTagNameidStreamEntry
+	propNameidStrings = 0x0004 // PidTagNameidStreamString
+)
+
+// loadNameMap reads the named property map so that named properties of
+// messages and attachments can be recognised. A missing or unreadable
+// map leaves named properties unlabelled.
+func (f *File) loadNameMap() {
+	n, err := f.openNode(nidNameToIDMap)
+	if err != nil {
+		return
+	}
+	attrs, err := n.properties()
+	if err != nil {
+		return
+	}
+	var entries, strs []byte
+	for _, a := range attrs {
+		switch a.Name {
+		case propNameidEntries:
+			entries = a.Data
+		case propNameidStrings:
+			strs = a.Data
+		}
+	}
+	f.names = tnef.DecodeNameMap(entries, strs)
+}
+
+// Message decodes the message node nid, including its recipients and
+// attachments.
+func (f *File) Message(nid uint32) (*tnef.Message, error) {
+	n, err := f.openNode(nid)
+	if err != nil {
+		return nil, err
+	}
+	return n.message(0)
+}
+
+// message decodes the message stored in n.
+func (n *node) message(depth int) (*tnef.Message, error) {
+	if depth > maxEmbeddedDepth {
+		return nil, errors.New("pst: embedded messages nested too deeply")
+	}
+	attrs, err := n.properties()
+	if err != nil {
+		return nil, err
+	}
+	msg := &tnef.Message{}
+	msg.ApplyAttributes(attrs)
+
+	if t, err := n.subTable(nidRecipientTable); err == nil {
+		for _, row := range t {
+			msg.Recipients = append(msg.Recipients, tnef.NewRecipient(row.attrs))
+		}
+	}
+
+	t, err := n.subTable(nidAttachmentTable)
+	if err != nil {
+		return msg, nil
+	}
+	for _, row := range t {
+		an, err := n.sub(row.id)
+		if err != nil {
+			continue
+		}
+		if att := an.attachment(depth); att != nil {
+			msg.Attachments = append(msg.Attachments, att)
+		}
+	}
+	return msg, nil
+}
+
+// subTable decodes the table context stored in subnode nid.
+func (n *node) subTable(nid uint32) ([]tableRow, error) {
+	s, err := n.sub(nid)
+	if err != nil {
+		return nil, err
+	}
+	return s.table()
+}
+
+// attachment decodes the attachment stored in n, or returns nil if its
+// property context is unreadable.
+func (n *node) attachment(depth int) *tnef.Attachment {
+	attrs, err := n.properties()
+	if err != nil {
+		return nil
+	}
+	att := &tnef.Attachment{}
+	att.ApplyAttributes(attrs)
+	for _, a := range attrs {
+		if a.Name != tnef.MAPIAttachDataObj {
+			continue
+		}
+		if a.Type != tnef.PropTypeObject {
+			att.Data = a.Data
+			continue
+		}
+		// PT_OBJECT values hold the subnode NID and size of the object.
+		if len(a.Data) < 8 {
+			continue
+		}
+		obj, err := n.sub(binary.LittleEndian.Uint32(a.Data[0:4]))
+		if err != nil {
+			continue
+		}
+		if att.Method == tnef.AttachEmbeddedMsg {
+			if em, err := obj.message(depth + 1); err == nil {
+				att.EmbeddedMsg = em
+			}
+			continue
+		}
+		att.Data = obj.bytes()
+	}
+	return att
+}
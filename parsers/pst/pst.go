@@ -0,0 +1,347 @@
+// Package pst reads Outlook Personal Storage Table files (.pst, and .ost
+// files in the same layout) as specified by MS-PST.
+//
+// The reader implements the three layers of the format:
+//
+//   - NDB: the header, node and block B-trees, data blocks, XBLOCK data
+//     trees, and subnode trees. Unicode and ANSI files are supported,
+//     unencoded or with NDB_CRYPT_PERMUTE ("compressible") encoding.
+//   - LTP: heap-on-node allocations, BTH B-trees, property contexts, and
+//     table contexts.
+//   - Messaging: the folder hierarchy, contents tables, and messages with
+//     their recipients and attachments, decoded into the TNEF message
+//     model so that bodies and attachments use the shared pipeline.
+//
+// The whole file is held in memory. Every tree walk is bounded so that
+// crafted files cannot cause unbounded recursion or loops.
+//
+// Zero external dependencies.
+package pst
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Header constants.
+const (
+	headerMagic       = 0x4E444221 // "!BDN"
+	clientMagicPST    = 0x4D53     // "SM"
+	clientMagicOST    = 0x4F53     // "SO"
+	verANSIMin        = 14
+	verANSIMax        = 15
+	verUnicode        = 23
+	pageSize          = 512
+	ptypeBBT          = 0x80
+	ptypeNBT          = 0x81
+	maxTreeDepth      = 16
+	maxDataTreeBlocks = 1 << 20
+	maxBTHRecords     = 1 << 20
+)
+
+// Errors returned by Open.
+var (
+	ErrBadSignature        = errors.New("not a PST file")
+	ErrUnsupportedVersion  = errors.New("unsupported PST version (only ANSI and Unicode 512-byte page files are supported)")
+	ErrUnsupportedCrypt    = errors.New("unsupported PST encryption (cyclic encoding)")
+	ErrCorrupt             = errors.New("corrupt PST file")
+	ErrNodeNotFound        = errors.New("PST node not found")
+	errBlockNotFound       = errors.New("PST block not found")
+	errUnexpectedBlockType = errors.New("unexpected PST block type")
+)
+
+// File is an opened PST file.
+type File struct {
+	data    []byte
+	unicode bool
+	crypt   byte
+	nodes   map[uint32]nodeEntry
+	blocks  map[uint64]blockEntry
+	names   map[int]string // Named property map (NID_NAME_TO_ID_MAP).
+}
+
+// nodeEntry is a leaf entry of the node B-tree (NBT).
+type nodeEntry struct {
+	bidData uint64
+	bidSub  uint64
+	parent  uint32
+}
+
+// blockEntry is a leaf entry of the block B-tree (BBT).
+type blockEntry struct {
+	ib uint64
+	cb int
+}
+
+// IsPST reports whether data starts with a PST or OST header.
+func IsPST(data []byte) bool {
+	if len(data) < 12 || binary.LittleEndian.Uint32(data[0:4]) != headerMagic {
+		return false
+	}
+	client := binary.LittleEndian.Uint16(data[8:10])
+	return client == clientMagicPST || client == clientMagicOST
+}
+
+// Open parses the header of a PST file held in data and loads its node
+// and block B-trees.
+func Open(data []byte) (*File, error) {
+	if !IsPST(data) {
+		return nil, ErrBadSignature
+	}
+	f := &File{
+		data:   data,
+		nodes:  make(map[uint32]nodeEntry),
+		blocks: make(map[uint64]blockEntry),
+	}
+
+	ver := binary.LittleEndian.Uint16(data[10:12])
+	var nbtIB, bbtIB uint64
+	switch {
+	case ver >= verANSIMin && ver <= verANSIMax:
+		if len(data) < 512 {
+			return nil, ErrCorrupt
+		}
+		nbtIB = uint64(binary.LittleEndian.Uint32(data[188:192]))
+		bbtIB = uint64(binary.LittleEndian.Uint32(data[196:200]))
+		f.crypt = data[461]
+	case ver == verUnicode:
+		if len(data) < 564 {
+			return nil, ErrCorrupt
+		}
+		f.unicode = true
+		nbtIB = binary.LittleEndian.Uint64(data[224:232])
+		bbtIB = binary.LittleEndian.Uint64(data[240:248])
+		f.crypt = data[513]
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	if f.crypt != cryptNone && f.crypt != cryptPermute {
+		return nil, ErrUnsupportedCrypt
+	}
+
+	visited := make(map[uint64]bool)
+	if err := f.loadTree(bbtIB, ptypeBBT, 0, visited); err != nil {
+		return nil, err
+	}
+	if err := f.loadTree(nbtIB, ptypeNBT, 0, visited); err != nil {
+		return nil, err
+	}
+	f.loadNameMap()
+	return f, nil
+}
+
+// loadTree walks a node or block B-tree page and records its leaf entries.
+func (f *File) loadTree(ib uint64, ptype byte, depth int, visited map[uint64]bool) error {
+	if depth > maxTreeDepth || visited[ib] {
+		return ErrCorrupt
+	}
+	visited[ib] = true
+	if ib+pageSize > uint64(len(f.data)) {
+		return ErrCorrupt
+	}
+	page := f.data[ib : ib+pageSize]
+
+	var cEnt, cbEnt, cLevel int
+	var trailer int
+	if f.unicode {
+		cEnt, cbEnt, cLevel = int(page[488]), int(page[490]), int(page[491])
+		trailer = 496
+	} else {
+		cEnt, cbEnt, cLevel = int(page[496]), int(page[498]), int(page[499])
+		trailer = 500
+	}
+	if page[trailer] != ptype || cbEnt == 0 || cEnt*cbEnt > trailer {
+		return ErrCorrupt
+	}
+
+	for i := 0; i < cEnt; i++ {
+		e := page[i*cbEnt : (i+1)*cbEnt]
+		if cLevel > 0 {
+			// BTENTRY: key, then BREF (bid, ib).
+			var child uint64
+			if f.unicode {
+				child = binary.LittleEndian.Uint64(e[16:24])
+			} else {
+				child = uint64(binary.LittleEndian.Uint32(e[8:12]))
+			}
+			if err := f.loadTree(child, ptype, depth+1, visited); err != nil {
+				return err
+			}
+			continue
+		}
+		if ptype == ptypeNBT {
+			f.addNode(e)
+		} else {
+			f.addBlock(e)
+		}
+	}
+	return nil
+}
+
+// addNode records an NBTENTRY.
+func (f *File) addNode(e []byte) {
+	if f.unicode {
+		f.nodes[binary.LittleEndian.Uint32(e[0:4])] = nodeEntry{
+			bidData: binary.LittleEndian.Uint64(e[8:16]),
+			bidSub:  binary.LittleEndian.Uint64(e[16:24]),
+			parent:  binary.LittleEndian.Uint32(e[24:28]),
+		}
+		return
+	}
+	f.nodes[binary.LittleEndian.Uint32(e[0:4])] = nodeEntry{
+		bidData: uint64(binary.LittleEndian.Uint32(e[4:8])),
+		bidSub:  uint64(binary.LittleEndian.Uint32(e[8:12])),
+		parent:  binary.LittleEndian.Uint32(e[12:16]),
+	}
+}
+
+// addBlock records a BBTENTRY.
+func (f *File) addBlock(e []byte) {
+	if f.unicode {
+		f.blocks[binary.LittleEndian.Uint64(e[0:8])&^1] = blockEntry{
+			ib: binary.LittleEndian.Uint64(e[8:16]),
+			cb: int(binary.LittleEndian.Uint16(e[16:18])),
+		}
+		return
+	}
+	f.blocks[uint64(binary.LittleEndian.Uint32(e[0:4]))&^1] = blockEntry{
+		ib: uint64(binary.LittleEndian.Uint32(e[4:8])),
+		cb: int(binary.LittleEndian.Uint16(e[8:10])),
+	}
+}
+
+// block returns the raw contents of a block, decoded if the file uses
+// permute encoding. Internal blocks (XBLOCKs, subnode blocks) are never
+// encoded.
+func (f *File) block(bid uint64) ([]byte, error) {
+	be, ok := f.blocks[bid&^1]
+	if !ok {
+		return nil, errBlockNotFound
+	}
+	end := be.ib + uint64(be.cb)
+	if end > uint64(len(f.data)) || end < be.ib {
+		return nil, ErrCorrupt
+	}
+	b := f.data[be.ib:end]
+	if isInternal(bid) || f.crypt != cryptPermute {
+		return b, nil
+	}
+	return decodePermute(b), nil
+}
+
+// dataBlocks returns the data blocks of a node's data tree: a single
+// data block, or the leaves of an XBLOCK / XXBLOCK tree.
+func (f *File) dataBlocks(bid uint64) ([][]byte, error) {
+	if bid == 0 {
+		return nil, nil
+	}
+	var out [][]byte
+	var walk func(bid uint64, depth int) error
+	walk = func(bid uint64, depth int) error {
+		b, err := f.block(bid)
+		if err != nil {
+			return err
+		}
+		if !isInternal(bid) {
+			if len(out) >= maxDataTreeBlocks {
+				return ErrCorrupt
+			}
+			out = append(out, b)
+			return nil
+		}
+		if depth > 2 || len(b) < 8 || b[0] != 0x01 {
+			return errUnexpectedBlockType
+		}
+		for _, child := range f.bids(b[8:], int(binary.LittleEndian.Uint16(b[2:4]))) {
+			if err := walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(bid, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// bids decodes up to n block IDs from b.
+func (f *File) bids(b []byte, n int) []uint64 {
+	size := 4
+	if f.unicode {
+		size = 8
+	}
+	if n*size > len(b) {
+		n = len(b) / size
+	}
+	out := make([]uint64, n)
+	for i := range out {
+		if f.unicode {
+			out[i] = binary.LittleEndian.Uint64(b[i*8:])
+		} else {
+			out[i] = uint64(binary.LittleEndian.Uint32(b[i*4:]))
+		}
+	}
+	return out
+}
+
+// subnode is an entry of a node's subnode tree.
+type subnode struct {
+	bidData uint64
+	bidSub  uint64
+}
+
+// subnodes loads the subnode tree rooted at bid (SLBLOCK / SIBLOCK).
+func (f *File) subnodes(bid uint64) (map[uint32]subnode, error) {
+	out := make(map[uint32]subnode)
+	if bid == 0 {
+		return out, nil
+	}
+	var walk func(bid uint64, depth int) error
+	walk = func(bid uint64, depth int) error {
+		if depth > maxTreeDepth {
+			return ErrCorrupt
+		}
+		b, err := f.block(bid)
+		if err != nil {
+			return err
+		}
+		if len(b) < 4 || b[0] != 0x02 {
+			return errUnexpectedBlockType
+		}
+		level := b[1]
+		n := int(binary.LittleEndian.Uint16(b[2:4]))
+		hdr, idSize := 4, 4
+		if f.unicode {
+			hdr, idSize = 8, 8
+		}
+		entSize := idSize * 3 // SLENTRY: nid, bidData, bidSub
+		if level > 0 {
+			entSize = idSize * 2 // SIENTRY: nid, bid
+		}
+		for i := 0; i < n; i++ {
+			off := hdr + i*entSize
+			if off+entSize > len(b) {
+				return ErrCorrupt
+			}
+			ids := f.bids(b[off:off+entSize], entSize/idSize)
+			if level > 0 {
+				if err := walk(ids[1], depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			out[uint32(ids[0])] = subnode{bidData: ids[1], bidSub: ids[2]}
+		}
+		return nil
+	}
+	if err := walk(bid, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// isInternal reports whether a BID refers to an internal block.
+func isInternal(bid uint64) bool {
+	return bid&0x02 != 0
+}
@@ -0,0 +1,282 @@
+package pst
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/avaropoint/converter/parsers/tnef"
+)
+
+// builder writes minimal Unicode PST files for tests.
+type builder struct {
+	crypt  byte
+	blocks [][]byte
+	bids   []uint64
+	nodes  [][3]uint64 // nid, bidData, bidSub
+	next   uint64
+}
+
+func (b *builder) block(data []byte, internal bool) uint64 {
+	b.next += 4
+	bid := b.next
+	if internal {
+		bid |= 2
+	} else if b.crypt == cryptPermute {
+		var enc [256]byte
+		for i, v := range permuteDecode {
+			enc[v] = byte(i)
+		}
+		out := make([]byte, len(data))
+		for i, c := range data {
+			out[i] = enc[c]
+		}
+		data = out
+	}
+	b.blocks = append(b.blocks, data)
+	b.bids = append(b.bids, bid)
+	return bid
+}
+
+func (b *builder) node(nid uint32, data []byte, sub uint64) {
+	b.nodes = append(b.nodes, [3]uint64{uint64(nid), b.block(data, false), sub})
+}
+
+// subnodes writes an SLBLOCK mapping each NID to a data block.
+func (b *builder) subnodes(nids []uint32, data [][]byte, subs []uint64) uint64 {
+	out := make([]byte, 8, 8+len(nids)*24)
+	out[0] = 0x02
+	binary.LittleEndian.PutUint16(out[2:], uint16(len(nids)))
+	for i, nid := range nids {
+		out = binary.LittleEndian.AppendUint64(out, uint64(nid))
+		out = binary.LittleEndian.AppendUint64(out, b.block(data[i], false))
+		out = binary.LittleEndian.AppendUint64(out, subs[i])
+	}
+	return b.block(out, true)
+}
+
+func (b *builder) bytes() []byte {
+	out := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(out[0:], headerMagic)
+	binary.LittleEndian.PutUint16(out[8:], clientMagicPST)
+	binary.LittleEndian.PutUint16(out[10:], verUnicode)
+	out[513] = b.crypt
+
+	ibs := make([]uint64, len(b.blocks))
+	for i, blk := range b.blocks {
+		ibs[i] = uint64(len(out))
+		out = append(out, blk...)
+	}
+	for len(out)%pageSize != 0 {
+		out = append(out, 0)
+	}
+
+	bbt := make([]byte, pageSize)
+	for i := range b.blocks {
+		e := bbt[i*24:]
+		binary.LittleEndian.PutUint64(e[0:], b.bids[i])
+		binary.LittleEndian.PutUint64(e[8:], ibs[i])
+		binary.LittleEndian.PutUint16(e[16:], uint16(len(b.blocks[i])))
+	}
+	bbt[488], bbt[490], bbt[496] = byte(len(b.blocks)), 24, ptypeBBT
+	binary.LittleEndian.PutUint64(out[240:], uint64(len(out)))
+	out = append(out, bbt...)
+
+	nbt := make([]byte, pageSize)
+	for i, n := range b.nodes {
+		e := nbt[i*32:]
+		binary.LittleEndian.PutUint64(e[0:], n[0])
+		binary.LittleEndian.PutUint64(e[8:], n[1])
+		binary.LittleEndian.PutUint64(e[16:], n[2])
+	}
+	nbt[488], nbt[490], nbt[496] = byte(len(b.nodes)), 32, ptypeNBT
+	binary.LittleEndian.PutUint64(out[224:], uint64(len(out)))
+	return append(out, nbt...)
+}
+
+// heap builds a heap-on-node whose allocations get HIDs 0x20, 0x40, ...
+func heap(client byte, allocs [][]byte) []byte {
+	out := make([]byte, 12)
+	out[2], out[3] = hnSignature, client
+	binary.LittleEndian.PutUint32(out[4:], 0x20)
+	offsets := []uint16{uint16(len(out))}
+	for _, a := range allocs {
+		out = append(out, a...)
+		offsets = append(offsets, uint16(len(out)))
+	}
+	binary.LittleEndian.PutUint16(out[0:], uint16(len(out)))
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(allocs)))
+	out = binary.LittleEndian.AppendUint16(out, 0)
+	for _, o := range offsets {
+		out = binary.LittleEndian.AppendUint16(out, o)
+	}
+	return out
+}
+
+type prop struct {
+	tag   uint32
+	value []byte
+}
+
+func unicode(s string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, c)
+	}
+	return out
+}
+
+func long(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+// pc builds a property context; 4-byte types are stored inline.
+func pc(props []prop) []byte {
+	hdr := []byte{clientBTH, 2, 6, 0, 0x40, 0, 0, 0}
+	var recs []byte
+	allocs := [][]byte{hdr, nil}
+	for _, p := range props {
+		recs = binary.LittleEndian.AppendUint32(recs, p.tag>>16|p.tag<<16)
+		if inlineSize(int(p.tag&0xFFFF)) > 0 {
+			recs = append(recs, p.value...)
+			continue
+		}
+		allocs = append(allocs, p.value)
+		recs = binary.LittleEndian.AppendUint32(recs, uint32(len(allocs))<<5)
+	}
+	allocs[1] = recs
+	return heap(clientPC, allocs)
+}
+
+// tc builds a table context with one 4-byte column per tag, all present.
+func tc(tags []uint32, rows [][][]byte) []byte {
+	cols := len(tags)
+	rowSize := cols*4 + (cols+7)/8
+	info := []byte{clientTC, byte(cols)}
+	for _, v := range []uint16{uint16(cols * 4), uint16(cols * 4), uint16(cols * 4), uint16(rowSize)} {
+		info = binary.LittleEndian.AppendUint16(info, v)
+	}
+	info = binary.LittleEndian.AppendUint32(info, 0)
+	if len(rows) > 0 {
+		info = binary.LittleEndian.AppendUint32(info, 0x40)
+	} else {
+		info = binary.LittleEndian.AppendUint32(info, 0)
+	}
+	info = binary.LittleEndian.AppendUint32(info, 0)
+	for i, t := range tags {
+		info = binary.LittleEndian.AppendUint32(info, t)
+		info = binary.LittleEndian.AppendUint16(info, uint16(i*4))
+		info = append(info, 4, byte(i))
+	}
+
+	allocs := [][]byte{info, nil}
+	var data []byte
+	for _, r := range rows {
+		for i, v := range r {
+			if fixedSize(int(tags[i]&0xFFFF)) > 0 {
+				data = append(data, v...)
+				continue
+			}
+			allocs = append(allocs, v)
+			data = binary.LittleEndian.AppendUint32(data, uint32(len(allocs))<<5)
+		}
+		for i := 0; i < (cols+7)/8; i++ {
+			data = append(data, 0xFF)
+		}
+	}
+	allocs[1] = data
+	return heap(clientTC, allocs)
+}
+
+const rowIDTag = 0x67F20003
+
+func buildPST(crypt byte) []byte {
+	b := &builder{crypt: crypt}
+	b.node(nidRootFolder, pc([]prop{{0x3001001F, unicode("Root")}}), 0)
+	b.node(0x12D, tc([]uint32{rowIDTag}, [][][]byte{{long(0x8022)}}), 0)
+	b.node(0x12E, tc([]uint32{rowIDTag}, nil), 0)
+	b.node(0x8022, pc([]prop{{0x3001001F, unicode("Inbox")}, {0x36020003, long(1)}}), 0)
+	b.node(0x802D, tc([]uint32{rowIDTag}, nil), 0)
+	b.node(0x802E, tc([]uint32{rowIDTag}, [][][]byte{{long(0x200024)}}), 0)
+
+	recips := tc([]uint32{rowIDTag, 0x3001001F, 0x39FE001F, 0x0C150003},
+		[][][]byte{{long(0), unicode("Bob"), unicode("bob@example.com"), long(1)}})
+	attachments := tc([]uint32{rowIDTag}, [][][]byte{{long(0x8005)}})
+	attachment := pc([]prop{
+		{0x37050003, long(tnef.AttachByValue)},
+		{0x3707001F, unicode("notes.txt")},
+		{0x37010102, []byte("attached text")},
+	})
+	sub := b.subnodes([]uint32{nidAttachmentTable, nidRecipientTable, 0x8005},
+		[][]byte{attachments, recips, attachment}, []uint64{0, 0, 0})
+	b.node(0x200024, pc([]prop{
+		{0x0037001F, unicode("Hello")},
+		{0x1000001F, unicode("Hi there")},
+	}), sub)
+	return b.bytes()
+}
+
+func TestIsPST(t *testing.T) {
+	if !IsPST(buildPST(cryptNone)) {
+		t.Error("IsPST = false for a PST file")
+	}
+	if IsPST([]byte("!BDN plain text")) || IsPST(nil) {
+		t.Error("IsPST = true for non-PST data")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	if _, err := Open([]byte("not a pst")); err != ErrBadSignature {
+		t.Errorf("Open(garbage) error = %v, want ErrBadSignature", err)
+	}
+	data := buildPST(cryptNone)
+	binary.LittleEndian.PutUint16(data[10:], 99)
+	if _, err := Open(data); err != ErrUnsupportedVersion {
+		t.Errorf("Open(version 99) error = %v, want ErrUnsupportedVersion", err)
+	}
+	data = buildPST(cryptNone)
+	data[513] = cryptCyclic
+	if _, err := Open(data); err != ErrUnsupportedCrypt {
+		t.Errorf("Open(cyclic) error = %v, want ErrUnsupportedCrypt", err)
+	}
+}
+
+func TestFolderTreeAndMessage(t *testing.T) {
+	for _, crypt := range []byte{cryptNone, cryptPermute} {
+		f, err := Open(buildPST(crypt))
+		if err != nil {
+			t.Fatalf("crypt %d: Open: %v", crypt, err)
+		}
+		root, err := f.FolderTree()
+		if err != nil {
+			t.Fatalf("crypt %d: FolderTree: %v", crypt, err)
+		}
+		if root.Name != "Root" || len(root.Children) != 1 {
+			t.Fatalf("crypt %d: root = %+v", crypt, root)
+		}
+		inbox := root.Children[0]
+		if inbox.Name != "Inbox" || inbox.Count != 1 || len(inbox.Messages) != 1 {
+			t.Fatalf("crypt %d: inbox = %+v", crypt, inbox)
+		}
+
+		msg, err := f.Message(inbox.Messages[0])
+		if err != nil {
+			t.Fatalf("crypt %d: Message: %v", crypt, err)
+		}
+		if got := msg.GetAttrString(tnef.MAPISubject); got != "Hello" {
+			t.Errorf("crypt %d: subject = %q", crypt, got)
+		}
+		if string(msg.Body) != "Hi there" {
+			t.Errorf("crypt %d: body = %q", crypt, msg.Body)
+		}
+		if len(msg.Recipients) != 1 || msg.Recipients[0].Email != "bob@example.com" || msg.Recipients[0].Type != tnef.RecipientTo {
+			t.Errorf("crypt %d: recipients = %+v", crypt, msg.Recipients)
+		}
+		if len(msg.Attachments) != 1 {
+			t.Fatalf("crypt %d: %d attachments, want 1", crypt, len(msg.Attachments))
+		}
+		if a := msg.Attachments[0]; a.Filename() != "notes.txt" || string(a.Data) != "attached text" {
+			t.Errorf("crypt %d: attachment = %q %q", crypt, a.Filename(), a.Data)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// ber.go converts BER-encoded CMS structures to DER so that they can be
+// decoded with encoding/asn1.
+
+package smime
+
+import "errors"
+
+// maxBERDepth bounds nesting of constructed values.
+const maxBERDepth = 64
+
+var errBER = errors.New("smime: malformed BER")
+
+// toDER re-encodes a BER value as DER: indefinite lengths become
+// definite, and constructed OCTET STRINGs (as written by Outlook when
+// streaming large content) are flattened into primitive ones. It returns
+// the encoding of the first value in b.
+func toDER(b []byte) ([]byte, error) {
+	out, _, err := berValue(b, 0)
+	return out, err
+}
+
+// berValue re-encodes the value at the start of b and returns its DER
+// encoding and the number of bytes of b it used.
+func berValue(b []byte, depth int) ([]byte, int, error) {
+	if depth > maxBERDepth {
+		return nil, 0, errBER
+	}
+	if len(b) < 2 {
+		return nil, 0, errBER
+	}
+	// Identifier octets, including the high tag number form.
+	pos := 1
+	if b[0]&0x1F == 0x1F {
+		for pos < len(b) && b[pos]&0x80 != 0 {
+			pos++
+		}
+		pos++
+		if pos >= len(b) {
+			return nil, 0, errBER
+		}
+	}
+	ident := b[:pos]
+	constructed := b[0]&0x20 != 0
+
+	// Length octets.
+	l := int(b[pos])
+	pos++
+	indefinite := false
+	switch {
+	case l == 0x80:
+		if !constructed {
+			return nil, 0, errBER
+		}
+		indefinite = true
+	case l > 0x80:
+		n := l & 0x7F
+		if n > 4 || pos+n > len(b) {
+			return nil, 0, errBER
+		}
+		l = 0
+		for k := 0; k < n; k++ {
+			l = l<<8 | int(b[pos+k])
+		}
+		pos += n
+	}
+	if !indefinite && (l < 0 || pos+l > len(b)) {
+		return nil, 0, errBER
+	}
+
+	if !constructed {
+		return appendTLV(nil, ident, b[pos:pos+l]), pos + l, nil
+	}
+
+	// Constructed: re-encode each child.
+	var content []byte
+	end := pos + l
+	for {
+		if indefinite {
+			if pos+2 > len(b) {
+				return nil, 0, errBER
+			}
+			if b[pos] == 0 && b[pos+1] == 0 {
+				pos += 2
+				break
+			}
+		} else if pos >= end {
+			break
+		}
+		child, n, err := berValue(b[pos:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !indefinite && pos+n > end {
+			return nil, 0, errBER
+		}
+		content = append(content, child...)
+		pos += n
+	}
+
+	// A constructed OCTET STRING (universal tag 4) is the concatenation
+	// of its primitive segments.
+	if len(ident) == 1 && ident[0] == 0x24 {
+		var flat []byte
+		for rest := content; len(rest) > 0; {
+			_, seg, n, err := splitTLV(rest)
+			if err != nil {
+				return nil, 0, err
+			}
+			flat = append(flat, seg...)
+			rest = rest[n:]
+		}
+		return appendTLV(nil, []byte{0x04}, flat), pos, nil
+	}
+	return appendTLV(nil, ident, content), pos, nil
+}
+
+// splitTLV splits a DER value into its identifier and contents and
+// returns the total length.
+func splitTLV(b []byte) (ident, content []byte, n int, err error) {
+	if len(b) < 2 || b[0]&0x1F == 0x1F {
+		return nil, nil, 0, errBER
+	}
+	pos, l := 2, int(b[1])
+	if l > 0x80 {
+		k := l & 0x7F
+		if k > 4 || 2+k > len(b) {
+			return nil, nil, 0, errBER
+		}
+		l = 0
+		for i := 0; i < k; i++ {
+			l = l<<8 | int(b[2+i])
+		}
+		pos += k
+	} else if l == 0x80 {
+		return nil, nil, 0, errBER
+	}
+	if l < 0 || pos+l > len(b) {
+		return nil, nil, 0, errBER
+	}
+	return b[:1], b[pos : pos+l], pos + l, nil
+}
+
+// appendTLV appends a DER value with the given identifier and contents.
+func appendTLV(dst, ident, content []byte) []byte {
+	dst = append(dst, ident...)
+	switch n := len(content); {
+	case n < 0x80:
+		dst = append(dst, byte(n))
+	case n < 0x100:
+		dst = append(dst, 0x81, byte(n))
+	case n < 0x10000:
+		dst = append(dst, 0x82, byte(n>>8), byte(n))
+	case n < 0x1000000:
+		dst = append(dst, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, content...)
+}
@@ -0,0 +1,394 @@
+// decrypt.go decrypts CMS enveloped-data and authenticated
+// enveloped-data (AES-GCM) with an RSA key transport recipient key.
+
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Object identifiers for decryption.
+var (
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+
+	oidRSAOAEP = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidMGF1    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// Decryption errors.
+var (
+	ErrNotEnveloped = errors.New("smime: not enveloped-data")
+	ErrNoRecipient  = errors.New("smime: message is not encrypted for this key")
+	ErrNoKey        = errors.New("smime: no decryption key configured")
+	ErrDecrypt      = errors.New("smime: decryption failed")
+)
+
+// Identity is a recipient private key and, optionally, its certificate,
+// used to select the matching recipient of an encrypted message. It is
+// held only in memory.
+type Identity struct {
+	Key  *rsa.PrivateKey
+	Cert *x509.Certificate
+}
+
+// LoadIdentity reads an RSA private key (PKCS#1 or PKCS#8 PEM) and an
+// optional certificate PEM file. Errors never include key material.
+func LoadIdentity(keyPath, certPath string) (*Identity, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(data)
+	for i := range data {
+		data[i] = 0
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smime: %s: %w", keyPath, err)
+	}
+	id := &Identity{Key: key}
+	if certPath == "" {
+		return id, nil
+	}
+	data, err = os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("smime: %s: no certificate found", certPath)
+	}
+	if id.Cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("smime: %s: %w", certPath, err)
+	}
+	if pub, ok := id.Cert.PublicKey.(*rsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return nil, fmt.Errorf("smime: %s does not match the private key", certPath)
+	}
+	return id, nil
+}
+
+// parseKey decodes the first RSA private key in a PEM file.
+func parseKey(data []byte) (*rsa.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no RSA private key found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			if rk, ok := k.(*rsa.PrivateKey); ok {
+				return rk, nil
+			}
+			return nil, errors.New("private key is not RSA")
+		}
+	}
+}
+
+// envelopedData is the CMS EnvelopedData structure.
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// authEnvelopedData is the CMS AuthEnvelopedData structure (RFC 5083).
+type authEnvelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	AuthAttrs            asn1.RawValue `asn1:"optional,tag:1"`
+	MAC                  []byte
+	UnauthAttrs          asn1.RawValue `asn1:"optional,tag:2"`
+}
+
+// encryptedContentInfo holds the encrypted content and its algorithm.
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// keyTransRecipientInfo is an RSA key transport recipient.
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+// oaepParams is RSAES-OAEP-params (RFC 4055); absent fields mean SHA-1.
+type oaepParams struct {
+	Hash pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:0"`
+	MGF  pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+}
+
+// gcmParams is GCMParameters (RFC 5084).
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"optional,default:12"`
+}
+
+// Decrypt decrypts an enveloped-data or authenticated enveloped-data
+// structure (an encrypted smime.p7m) with id and returns the plaintext
+// MIME entity.
+func Decrypt(data []byte, id *Identity) ([]byte, error) {
+	if id == nil || id.Key == nil {
+		return nil, ErrNoKey
+	}
+	ci, err := parseContentInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		recipients []asn1.RawValue
+		eci        encryptedContentInfo
+		aad, mac   []byte
+		auth       bool
+	)
+	switch {
+	case ci.ContentType.Equal(oidEnvelopedData):
+		var ed envelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+			return nil, fmt.Errorf("smime: decoding enveloped-data: %w", err)
+		}
+		recipients, eci = ed.RecipientInfos, ed.EncryptedContentInfo
+	case ci.ContentType.Equal(oidAuthEnvelopedData):
+		var ad authEnvelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &ad); err != nil {
+			return nil, fmt.Errorf("smime: decoding auth-enveloped-data: %w", err)
+		}
+		recipients, eci, mac, auth = ad.RecipientInfos, ad.EncryptedContentInfo, ad.MAC, true
+		if len(ad.AuthAttrs.FullBytes) > 0 {
+			aad = append([]byte{0x31}, ad.AuthAttrs.FullBytes[1:]...)
+		}
+	default:
+		return nil, ErrNotEnveloped
+	}
+
+	ceks, matched, err := unwrapKeys(recipients, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, cek := range ceks {
+			clear(cek)
+		}
+	}()
+	// A key recovered from a recipient that does not name id's
+	// certificate may be garbage: PKCS#1 v1.5 unwrapping with the wrong
+	// key can succeed. Such keys are only trusted if the content decrypts.
+	for _, cek := range ceks {
+		out, err := decryptContent(cek, eci, auth, mac, aad)
+		if err == nil || matched || !errors.Is(err, ErrDecrypt) {
+			return out, err
+		}
+	}
+	return nil, ErrNoRecipient
+}
+
+// decryptContent decrypts the encrypted content of eci with cek. For
+// authenticated enveloped-data, mac is the tag and aad the authenticated
+// attributes.
+func decryptContent(cek []byte, eci encryptedContentInfo, auth bool, mac, aad []byte) ([]byte, error) {
+	ciphertext := encryptedBytes(eci.EncryptedContent)
+	alg := eci.ContentEncryptionAlgorithm
+	switch {
+	case alg.Algorithm.Equal(oidAES128CBC), alg.Algorithm.Equal(oidAES192CBC), alg.Algorithm.Equal(oidAES256CBC):
+		var iv []byte
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &iv); err != nil {
+			return nil, ErrDecrypt
+		}
+		return decryptCBC(cek, iv, ciphertext)
+	case alg.Algorithm.Equal(oidAES128GCM), alg.Algorithm.Equal(oidAES192GCM), alg.Algorithm.Equal(oidAES256GCM):
+		var p gcmParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, ErrDecrypt
+		}
+		if !auth {
+			// GCM in plain enveloped-data carries the tag at the end.
+			if p.ICVLen < 12 || p.ICVLen > 16 || len(ciphertext) < p.ICVLen {
+				return nil, ErrDecrypt
+			}
+			ciphertext, mac = ciphertext[:len(ciphertext)-p.ICVLen], ciphertext[len(ciphertext)-p.ICVLen:]
+		}
+		return decryptGCM(cek, p, ciphertext, mac, aad)
+	}
+	return nil, ErrUnsupported
+}
+
+// unwrapKeys recovers the content-encryption key from the key transport
+// recipient matching id's certificate, reporting matched, or else every
+// key that id's key recovers from any recipient, in order.
+func unwrapKeys(recipients []asn1.RawValue, id *Identity) (ceks [][]byte, matched bool, err error) {
+	var ktris []keyTransRecipientInfo
+	for _, r := range recipients {
+		var ktri keyTransRecipientInfo
+		// Other recipient kinds (key agreement, KEK) are context-tagged.
+		if r.Class != asn1.ClassUniversal || r.Tag != asn1.TagSequence {
+			continue
+		}
+		if _, err := asn1.Unmarshal(r.FullBytes, &ktri); err != nil {
+			continue
+		}
+		if id.Cert != nil && matchesCert(ktri.RID, id.Cert) {
+			cek, err := decryptKey(&ktri, id.Key)
+			if err != nil {
+				return nil, true, err
+			}
+			return [][]byte{cek}, true, nil
+		}
+		ktris = append(ktris, ktri)
+	}
+	for i := range ktris {
+		if cek, err := decryptKey(&ktris[i], id.Key); err == nil {
+			ceks = append(ceks, cek)
+		}
+	}
+	return ceks, false, nil
+}
+
+// matchesCert reports whether a recipient identifier names cert.
+func matchesCert(rid asn1.RawValue, cert *x509.Certificate) bool {
+	if rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(cert.SubjectKeyId, rid.Bytes)
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil || ias.Serial == nil {
+		return false
+	}
+	return bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) && cert.SerialNumber.Cmp(ias.Serial) == 0
+}
+
+// decryptKey decrypts a transported key with RSA PKCS#1 v1.5 or OAEP.
+func decryptKey(ktri *keyTransRecipientInfo, key *rsa.PrivateKey) ([]byte, error) {
+	alg := ktri.KeyEncryptionAlgorithm
+	switch {
+	case alg.Algorithm.Equal(oidRSA):
+		cek, err := rsa.DecryptPKCS1v15(nil, key, ktri.EncryptedKey)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return cek, nil
+	case alg.Algorithm.Equal(oidRSAOAEP):
+		hash, mgfHash, ok := crypto.SHA1, crypto.SHA1, true
+		if len(alg.Parameters.FullBytes) > 0 {
+			var p oaepParams
+			if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+				return nil, ErrDecrypt
+			}
+			if len(p.Hash.Algorithm) > 0 {
+				if hash, ok = hashFor(p.Hash.Algorithm); !ok {
+					return nil, ErrUnsupported
+				}
+			}
+			if len(p.MGF.Algorithm) > 0 {
+				var mgf pkix.AlgorithmIdentifier
+				if !p.MGF.Algorithm.Equal(oidMGF1) {
+					return nil, ErrUnsupported
+				}
+				if _, err := asn1.Unmarshal(p.MGF.Parameters.FullBytes, &mgf); err != nil {
+					return nil, ErrDecrypt
+				}
+				if mgfHash, ok = hashFor(mgf.Algorithm); !ok {
+					return nil, ErrUnsupported
+				}
+			}
+		}
+		cek, err := key.Decrypt(nil, ktri.EncryptedKey, &rsa.OAEPOptions{Hash: hash, MGFHash: mgfHash})
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return cek, nil
+	}
+	return nil, ErrUnsupported
+}
+
+// encryptedBytes returns the contents of an [0] IMPLICIT OCTET STRING,
+// concatenating the segments of a constructed encoding.
+func encryptedBytes(v asn1.RawValue) []byte {
+	if !v.IsCompound {
+		return v.Bytes
+	}
+	var out []byte
+	for rest := v.Bytes; len(rest) > 0; {
+		_, seg, n, err := splitTLV(rest)
+		if err != nil {
+			break
+		}
+		out = append(out, seg...)
+		rest = rest[n:]
+	}
+	return out
+}
+
+// decryptCBC decrypts AES-CBC content and removes PKCS#7 padding.
+func decryptCBC(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil || len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrDecrypt
+	}
+	out := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, ciphertext)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(out) {
+		return nil, ErrDecrypt
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, ErrDecrypt
+		}
+	}
+	return out[:len(out)-pad], nil
+}
+
+// decryptGCM decrypts and authenticates AES-GCM content.
+func decryptGCM(key []byte, p gcmParams, ciphertext, tag, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	var gcm cipher.AEAD
+	switch {
+	case p.ICVLen == 16:
+		gcm, err = cipher.NewGCMWithNonceSize(block, len(p.Nonce))
+	case len(p.Nonce) == 12:
+		gcm, err = cipher.NewGCMWithTagSize(block, p.ICVLen)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil || len(tag) != gcm.Overhead() {
+		return nil, ErrDecrypt
+	}
+	out, err := gcm.Open(nil, p.Nonce, append(append([]byte(nil), ciphertext...), tag...), aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return out, nil
+}
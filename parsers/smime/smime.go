@@ -0,0 +1,428 @@
+// Package smime decodes S/MIME (CMS, RFC 5652) structures: it unwraps
+// signed-data to recover the signed MIME entity and verifies signatures
+// and signer certificate chains with crypto/x509.
+//
+// Both DER and the BER indefinite-length encoding produced by Outlook
+// are accepted.
+//
+// Zero external dependencies.
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Content types.
+const (
+	KindData      = "data"
+	KindSigned    = "signed-data"
+	KindEnveloped = "enveloped-data"
+)
+
+// Object identifiers.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey   = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA1 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA2 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3} // prefix of the SHA-2 variants
+)
+
+// Errors returned by the parser.
+var (
+	ErrNotCMS       = errors.New("smime: not a CMS structure")
+	ErrNotSigned    = errors.New("smime: not signed-data")
+	ErrUnsupported  = errors.New("smime: unsupported algorithm")
+	ErrNoSignerCert = errors.New("smime: signer certificate not included")
+	ErrDigest       = errors.New("smime: content digest mismatch")
+)
+
+// LoadRoots reads a PEM file of trusted root certificates.
+func LoadRoots(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("smime: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// contentInfo is the outer CMS ContentInfo structure.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signedData is the CMS SignedData structure.
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// encapContentInfo holds the signed content, absent for detached
+// signatures.
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signerInfo is one signer of a SignedData.
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// issuerAndSerial identifies a certificate by issuer and serial number.
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// attribute is a signed or unsigned signer attribute.
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// SignedData is a decoded CMS signed-data structure.
+type SignedData struct {
+	Content      []byte              // Encapsulated content; nil for a detached signature.
+	Certificates []*x509.Certificate // Certificates included by the signer.
+	signers      []signerInfo
+}
+
+// Signer is the verification result for one signer.
+type Signer struct {
+	Certificate *x509.Certificate // Signer certificate, if included.
+	SigningTime time.Time         // Signing time attribute, if present.
+	Valid       bool              // The signature matches the content.
+	Trusted     bool              // The certificate chains to a trusted root.
+	Err         error             // Why validation or trust failed, if it did.
+}
+
+// Name returns the signer's common name, or its full subject.
+func (s *Signer) Name() string {
+	if s.Certificate == nil {
+		return ""
+	}
+	if cn := s.Certificate.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return s.Certificate.Subject.String()
+}
+
+// Email returns the signer's email address from the certificate.
+func (s *Signer) Email() string {
+	if s.Certificate == nil {
+		return ""
+	}
+	if len(s.Certificate.EmailAddresses) > 0 {
+		return s.Certificate.EmailAddresses[0]
+	}
+	for _, n := range s.Certificate.Subject.Names {
+		if n.Type.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}) {
+			if v, ok := n.Value.(string); ok {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// parseContentInfo decodes the outer ContentInfo of data.
+func parseContentInfo(data []byte) (*contentInfo, error) {
+	der, err := toDER(data)
+	if err != nil {
+		return nil, ErrNotCMS
+	}
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil || len(rest) > 0 {
+		return nil, ErrNotCMS
+	}
+	return &ci, nil
+}
+
+// Kind returns the content type of a CMS structure (KindSigned,
+// KindEnveloped for enveloped or authenticated-enveloped data, or
+// KindData), or "" if data is not CMS.
+func Kind(data []byte) string {
+	if len(data) < 2 || data[0] != 0x30 {
+		return ""
+	}
+	ci, err := parseContentInfo(data)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case ci.ContentType.Equal(oidSignedData):
+		return KindSigned
+	case ci.ContentType.Equal(oidEnvelopedData), ci.ContentType.Equal(oidAuthEnvelopedData):
+		return KindEnveloped
+	case ci.ContentType.Equal(oidData):
+		return KindData
+	}
+	return ""
+}
+
+// ParseSigned decodes a signed-data structure (an smime.p7m or
+// smime.p7s file).
+func ParseSigned(data []byte) (*SignedData, error) {
+	ci, err := parseContentInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, ErrNotSigned
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("smime: decoding signed-data: %w", err)
+	}
+	out := &SignedData{signers: sd.SignerInfos}
+
+	if len(sd.EncapContentInfo.EContent.Bytes) > 0 {
+		var content []byte
+		if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &content); err != nil {
+			return nil, fmt.Errorf("smime: decoding content: %w", err)
+		}
+		out.Content = content
+	}
+
+	// Parse certificates one by one, skipping other certificate choices
+	// (attribute certificates) that crypto/x509 cannot decode.
+	for rest := sd.Certificates.Bytes; len(rest) > 0; {
+		var raw asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+			break
+		}
+		if c, err := x509.ParseCertificate(raw.FullBytes); err == nil {
+			out.Certificates = append(out.Certificates, c)
+		}
+	}
+	return out, nil
+}
+
+// Verify checks each signer's signature over content (or the
+// encapsulated content if content is nil) and its certificate chain
+// against roots (the system roots if nil).
+func (s *SignedData) Verify(content []byte, roots *x509.CertPool) []*Signer {
+	if content == nil {
+		content = s.Content
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range s.Certificates {
+		intermediates.AddCert(c)
+	}
+	out := make([]*Signer, 0, len(s.signers))
+	for i := range s.signers {
+		out = append(out, s.verifySigner(&s.signers[i], content, roots, intermediates))
+	}
+	return out
+}
+
+// verifySigner verifies one signerInfo.
+func (s *SignedData) verifySigner(si *signerInfo, content []byte, roots, intermediates *x509.CertPool) *Signer {
+	res := &Signer{Certificate: s.findCert(si.SID)}
+	if res.Certificate == nil {
+		res.Err = ErrNoSignerCert
+		return res
+	}
+	hash, ok := hashFor(si.DigestAlgorithm.Algorithm)
+	if !ok {
+		res.Err = ErrUnsupported
+		return res
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	// With signed attributes the signature covers their DER encoding
+	// (as a SET), and the messageDigest attribute covers the content.
+	signed := content
+	if len(si.SignedAttrs.Bytes) > 0 {
+		attrs, err := parseAttributes(si.SignedAttrs.Bytes)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		var md []byte
+		for _, a := range attrs {
+			switch {
+			case a.Type.Equal(oidMessageDigest):
+				asn1.Unmarshal(a.Values.Bytes, &md)
+			case a.Type.Equal(oidSigningTime):
+				var t time.Time
+				if _, err := asn1.Unmarshal(a.Values.Bytes, &t); err == nil {
+					res.SigningTime = t.UTC()
+				}
+			}
+		}
+		if !bytes.Equal(md, digest) {
+			res.Err = ErrDigest
+			return res
+		}
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	}
+
+	algo, ok := signatureAlgorithm(si.SignatureAlgorithm.Algorithm, si.DigestAlgorithm.Algorithm)
+	if !ok {
+		res.Err = ErrUnsupported
+		return res
+	}
+	if err := res.Certificate.CheckSignature(algo, signed, si.Signature); err != nil {
+		res.Err = fmt.Errorf("smime: invalid signature: %w", err)
+		return res
+	}
+	res.Valid = true
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		CurrentTime:   res.SigningTime,
+	}
+	if _, err := res.Certificate.Verify(opts); err != nil {
+		res.Err = fmt.Errorf("smime: untrusted certificate: %w", err)
+		return res
+	}
+	res.Trusted = true
+	return res
+}
+
+// findCert returns the included certificate identified by sid: an
+// IssuerAndSerialNumber, or a [0] SubjectKeyIdentifier.
+func (s *SignedData) findCert(sid asn1.RawValue) *x509.Certificate {
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		for _, c := range s.Certificates {
+			if bytes.Equal(c.SubjectKeyId, sid.Bytes) {
+				return c
+			}
+		}
+		return nil
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil || ias.Serial == nil {
+		return nil
+	}
+	for _, c := range s.Certificates {
+		if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) && c.SerialNumber.Cmp(ias.Serial) == 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseAttributes decodes the contents of a SET OF Attribute.
+func parseAttributes(b []byte) ([]attribute, error) {
+	var attrs []attribute
+	for len(b) > 0 {
+		var a attribute
+		var err error
+		if b, err = asn1.Unmarshal(b, &a); err != nil {
+			return nil, fmt.Errorf("smime: decoding attributes: %w", err)
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs, nil
+}
+
+// hashFor returns the hash function for a digest algorithm OID.
+func hashFor(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, true
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// signatureAlgorithm maps a signer's signature and digest algorithms to
+// the x509 signature algorithm used to check it.
+func signatureAlgorithm(sig, digest asn1.ObjectIdentifier) (x509.SignatureAlgorithm, bool) {
+	hash, ok := hashFor(digest)
+	if !ok {
+		return 0, false
+	}
+	rsa := sig.Equal(oidRSA) || sig.Equal(oidSHA1WithRSA) || sig.Equal(oidSHA256WithRSA) ||
+		sig.Equal(oidSHA384WithRSA) || sig.Equal(oidSHA512WithRSA)
+	ecdsa := sig.Equal(oidECPublicKey) || sig.Equal(oidECDSAWithSHA1) ||
+		(len(sig) == len(oidECDSAWithSHA2)+1 && sig[:len(oidECDSAWithSHA2)].Equal(oidECDSAWithSHA2))
+	switch {
+	case rsa:
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, true
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, true
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, true
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, true
+		}
+	case ecdsa:
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1, true
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, true
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, true
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, true
+		}
+	}
+	return 0, false
+}
+
+// DecodePEM returns the DER bytes of a PEM-armoured CMS structure
+// ("-----BEGIN PKCS7-----"), or data unchanged if it is not PEM.
+func DecodePEM(data []byte) []byte {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes
+	}
+	return data
+}
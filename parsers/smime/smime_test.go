@@ -0,0 +1,251 @@
+package smime
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testPKI creates a root CA and a signer certificate issued by it.
+func testPKI(t *testing.T) (root, leaf *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ = x509.ParseCertificate(caDER)
+
+	key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(der)
+	return root, leaf, key
+}
+
+// sign builds a DER signed-data structure over content with signed
+// attributes. If detached is set the content is not encapsulated.
+func sign(t *testing.T, content []byte, leaf *x509.Certificate, key *ecdsa.PrivateKey, detached bool) []byte {
+	t.Helper()
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	digest := sha256.Sum256(content)
+	mdValue := must(asn1.Marshal(digest[:]))
+	ctValue := must(asn1.Marshal(oidData))
+	var attrs []byte
+	attrs = append(attrs, must(asn1.Marshal(attribute{Type: oidContentType, Values: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: ctValue}}))...)
+	attrs = append(attrs, must(asn1.Marshal(attribute{Type: oidMessageDigest, Values: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: mdValue}}))...)
+
+	set := must(asn1.Marshal(asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: attrs}))
+	h := sha256.Sum256(set)
+	sig := must(ecdsa.SignASN1(rand.Reader, key, h[:]))
+
+	sid := must(asn1.Marshal(issuerAndSerial{Issuer: asn1.RawValue{FullBytes: leaf.RawIssuer}, Serial: leaf.SerialNumber}))
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: leaf.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          sig,
+		}},
+	}
+	if !detached {
+		sd.EncapContentInfo.EContent = asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: must(asn1.Marshal(content))}
+	}
+	inner := must(asn1.Marshal(sd))
+	return must(asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: inner},
+	}))
+}
+
+func TestVerify(t *testing.T) {
+	root, leaf, key := testPKI(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	content := []byte("Content-Type: text/plain\r\n\r\nhello\r\n")
+
+	der := sign(t, content, leaf, key, false)
+	if Kind(der) != KindSigned {
+		t.Fatalf("Kind = %q", Kind(der))
+	}
+	sd, err := ParseSigned(der)
+	if err != nil {
+		t.Fatalf("ParseSigned: %v", err)
+	}
+	if !bytes.Equal(sd.Content, content) {
+		t.Errorf("Content = %q", sd.Content)
+	}
+	signers := sd.Verify(nil, roots)
+	if len(signers) != 1 || !signers[0].Valid || !signers[0].Trusted || signers[0].Err != nil {
+		t.Fatalf("signers = %+v", signers[0])
+	}
+	if signers[0].Name() != "Alice" || signers[0].Email() != "alice@example.com" {
+		t.Errorf("signer = %q <%s>", signers[0].Name(), signers[0].Email())
+	}
+
+	// An empty pool does not trust the signer, but the signature is valid.
+	if s := sd.Verify(nil, x509.NewCertPool())[0]; !s.Valid || s.Trusted || s.Err == nil {
+		t.Errorf("untrusted: %+v", s)
+	}
+
+	// Detached signatures verify against the supplied content only.
+	det, err := ParseSigned(sign(t, content, leaf, key, true))
+	if err != nil {
+		t.Fatalf("ParseSigned(detached): %v", err)
+	}
+	if s := det.Verify(content, roots)[0]; !s.Trusted {
+		t.Errorf("detached: %+v", s)
+	}
+	if s := det.Verify([]byte("tampered"), roots)[0]; s.Valid || s.Err != ErrDigest {
+		t.Errorf("tampered: %+v", s)
+	}
+}
+
+func TestToDER(t *testing.T) {
+	// SEQUENCE (indefinite) { OCTET STRING (constructed, indefinite)
+	// { "ab", "c" } }
+	ber := []byte{0x30, 0x80, 0x24, 0x80, 0x04, 0x02, 'a', 'b', 0x04, 0x01, 'c', 0x00, 0x00, 0x00, 0x00}
+	want := []byte{0x30, 0x05, 0x04, 0x03, 'a', 'b', 'c'}
+	got, err := toDER(ber)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("toDER = % x, %v; want % x", got, err, want)
+	}
+	if _, err := toDER([]byte{0x30, 0x80, 0x04}); err == nil {
+		t.Error("expected error for truncated BER")
+	}
+	if Kind([]byte("not cms")) != "" {
+		t.Error("Kind of non-CMS data should be empty")
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("Content-Type: text/plain\r\n\r\nsecret\r\n")
+
+	// AES-256-CBC content with PKCS#7 padding.
+	cek, iv := make([]byte, 32), make([]byte, aes.BlockSize)
+	rand.Read(cek)
+	rand.Read(iv)
+	pad := aes.BlockSize - len(content)%aes.BlockSize
+	padded := append(append([]byte(nil), content...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := aes.NewCipher(cek)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	issuer := must(asn1.Marshal(pkix.Name{CommonName: "CA"}.ToRDNSequence()))
+	recipient := func(serial int64, cek []byte) []byte {
+		ias := must(asn1.Marshal(issuerAndSerial{Issuer: asn1.RawValue{FullBytes: issuer}, Serial: big.NewInt(serial)}))
+		return must(asn1.Marshal(keyTransRecipientInfo{
+			RID:                    asn1.RawValue{FullBytes: ias},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           must(rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, cek)),
+		}))
+	}
+	ktri := recipient(7, cek)
+	cert := &x509.Certificate{RawIssuer: issuer, SerialNumber: big.NewInt(7)}
+	// A recipient that unwraps to a wrong key, as PKCS#1 v1.5 transport
+	// with another recipient's key can, comes first.
+	bogus := recipient(8, make([]byte, 32))
+	ed := must(asn1.Marshal(envelopedData{
+		RecipientInfos: []asn1.RawValue{{FullBytes: bogus}, {FullBytes: ktri}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: must(asn1.Marshal(iv))}},
+			EncryptedContent:           asn1.RawValue{Class: 2, Tag: 0, Bytes: ciphertext},
+		},
+	}))
+	der := must(asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: ed},
+	}))
+
+	if Kind(der) != KindEnveloped {
+		t.Fatalf("Kind = %q", Kind(der))
+	}
+	got, err := Decrypt(der, &Identity{Key: key})
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+	if got, err := Decrypt(der, &Identity{Key: key, Cert: cert}); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Decrypt with certificate = %q, %v", got, err)
+	}
+	if _, err := Decrypt(der, nil); err != ErrNoKey {
+		t.Errorf("nil identity: %v", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := Decrypt(der, &Identity{Key: other}); err != ErrNoRecipient {
+		t.Errorf("wrong key: %v", err)
+	}
+
+	// A negative GCM tag length must be rejected, not sliced with.
+	params := must(asn1.Marshal(gcmParams{Nonce: make([]byte, 12), ICVLen: -4}))
+	ed = must(asn1.Marshal(envelopedData{
+		RecipientInfos: []asn1.RawValue{{FullBytes: ktri}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedContent:           asn1.RawValue{Class: 2, Tag: 0, Bytes: ciphertext},
+		},
+	}))
+	der = must(asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: ed},
+	}))
+	if _, err := Decrypt(der, &Identity{Key: key, Cert: cert}); err != ErrDecrypt {
+		t.Errorf("negative ICV length: %v", err)
+	}
+	if _, err := Decrypt(der, &Identity{Key: key}); err != ErrNoRecipient {
+		t.Errorf("negative ICV length, no certificate: %v", err)
+	}
+}
@@ -19,37 +19,107 @@ const (
 
 // TNEF attribute IDs.
 const (
-	attrAttachData     = 0x800F
-	attrAttachTitle    = 0x8010
-	attrAttachRendData = 0x9002
-	attrMAPIProps      = 0x9003
-	attrAttachment     = 0x9005
+	attrAttachData       = 0x800F
+	attrAttachTitle      = 0x8010
+	attrAttachMetaFile   = 0x8011
+	attrAttachCreateDate = 0x8012
+	attrAttachModifyDate = 0x8013
+	attrAttachRendData   = 0x9002
+	attrMAPIProps        = 0x9003
+	attrAttachment       = 0x9005
 )
 
 // MAPI property IDs used during decoding.
 const (
-	MAPISubject         = 0x0037 // PR_SUBJECT
-	MAPISenderName      = 0x0C1A // PR_SENDER_NAME
-	MAPISenderEmail     = 0x0C1F // PR_SENDER_EMAIL_ADDRESS
-	MAPIDisplayTo       = 0x0E04 // PR_DISPLAY_TO
-	MAPIDisplayCc       = 0x0E03 // PR_DISPLAY_CC
-	MAPIBody            = 0x1000 // PR_BODY
-	MAPIRtfCompressed   = 0x1009 // PR_RTF_COMPRESSED
-	MAPIBodyHTML        = 0x1013 // PR_BODY_HTML
-	MAPIAttachDataObj   = 0x3701 // PR_ATTACH_DATA_OBJ
-	MAPIAttachFilename  = 0x3704 // PR_ATTACH_FILENAME
-	MAPIAttachMethod    = 0x3705 // PR_ATTACH_METHOD
-	MAPIAttachLongFname = 0x3707 // PR_ATTACH_LONG_FILENAME
-	MAPIAttachMimeTag   = 0x370E // PR_ATTACH_MIME_TAG
-	MAPIAttachContentID = 0x3712 // PR_ATTACH_CONTENT_ID
+	MAPISubject          = 0x0037 // PR_SUBJECT
+	MAPISenderName       = 0x0C1A // PR_SENDER_NAME
+	MAPISenderEmail      = 0x0C1F // PR_SENDER_EMAIL_ADDRESS
+	MAPIDisplayTo        = 0x0E04 // PR_DISPLAY_TO
+	MAPIDisplayCc        = 0x0E03 // PR_DISPLAY_CC
+	MAPIBody             = 0x1000 // PR_BODY
+	MAPIRtfCompressed    = 0x1009 // PR_RTF_COMPRESSED
+	MAPIBodyHTML         = 0x1013 // PR_BODY_HTML
+	MAPIAttachDataObj    = 0x3701 // PR_ATTACH_DATA_OBJ
+	MAPIAttachFilename   = 0x3704 // PR_ATTACH_FILENAME
+	MAPIAttachMethod     = 0x3705 // PR_ATTACH_METHOD
+	MAPIAttachLongFname  = 0x3707 // PR_ATTACH_LONG_FILENAME
+	MAPIAttachMimeTag    = 0x370E // PR_ATTACH_MIME_TAG
+	MAPIAttachContentID  = 0x3712 // PR_ATTACH_CONTENT_ID
+	MAPIAttachRendering  = 0x3709 // PR_ATTACH_RENDERING
+	MAPIRenderingPos     = 0x370B // PR_RENDERING_POSITION
+	MAPIAttachExtension  = 0x3703 // PR_ATTACH_EXTENSION
+	MAPIAttachPathname   = 0x3708 // PR_ATTACH_PATHNAME
+	MAPIAttachLongPath   = 0x370D // PR_ATTACH_LONG_PATHNAME
+	MAPIAttachContentLoc = 0x3713 // PR_ATTACH_CONTENT_LOCATION
+	MAPIAttachFlags      = 0x3714 // PR_ATTACH_FLAGS
+	MAPIAttachSize       = 0x0E20 // PR_ATTACH_SIZE
+	MAPIAttachHidden     = 0x7FFE // PR_ATTACHMENT_HIDDEN
+	MAPICreationTime     = 0x3007 // PR_CREATION_TIME
+	MAPILastModTime      = 0x3008 // PR_LAST_MODIFICATION_TIME
+	MAPIMessageClass     = 0x001A // PR_MESSAGE_CLASS
+	MAPIClientSubmitTime = 0x0039 // PR_CLIENT_SUBMIT_TIME
+	MAPIDeliveryTime     = 0x0E06 // PR_MESSAGE_DELIVERY_TIME
+	MAPIInternetMsgID    = 0x1035 // PR_INTERNET_MESSAGE_ID
+	MAPIRecipientType    = 0x0C15 // PR_RECIPIENT_TYPE
+	MAPIDisplayName      = 0x3001 // PR_DISPLAY_NAME
+	MAPIEmailAddress     = 0x3003 // PR_EMAIL_ADDRESS
+	MAPISMTPAddress      = 0x39FE // PR_SMTP_ADDRESS
+)
+
+// MAPI property types.
+const (
+	PropTypeLong    = 0x0003 // PT_LONG
+	PropTypeBoolean = 0x000B // PT_BOOLEAN
+	PropTypeSysTime = 0x0040 // PT_SYSTIME
+	PropTypeString8 = 0x001E // PT_STRING8
+	PropTypeUnicode = 0x001F // PT_UNICODE
+	PropTypeBinary  = 0x0102 // PT_BINARY
+	PropTypeObject  = 0x000D // PT_OBJECT
+)
+
+// Recipient types from PR_RECIPIENT_TYPE.
+const (
+	RecipientTo  = 1
+	RecipientCc  = 2
+	RecipientBcc = 3
 )
 
 // Attachment method constants from PR_ATTACH_METHOD.
 const (
-	AttachByValue     = 1
-	AttachEmbeddedMsg = 5
-	AttachOLE         = 6
+	AttachByValue      = 1
+	AttachByReference  = 2
+	AttachByRefResolve = 3
+	AttachByRefOnly    = 4
+	AttachEmbeddedMsg  = 5
+	AttachOLE          = 6
+	AttachByWebRef     = 7 // Cloud attachment (OneDrive, SharePoint, ...).
+)
+
+// Named properties of reference attachments (PSETID_Attachment).
+const (
+	NameProviderType     = "AttachmentProviderType"        // e.g. "OneDrivePro"
+	NameProviderEndpoint = "AttachmentProviderEndpointUrl" // Provider API endpoint.
+	NamePermissionType   = "AttachmentPermissionType"      // Sharing permission, as a number.
+)
+
+// Attachment flags from PR_ATTACH_FLAGS.
+const (
+	AttachInvisibleInHTML = 0x00000001 // ATT_INVISIBLE_IN_HTML
+	AttachInvisibleInRTF  = 0x00000002 // ATT_INVISIBLE_IN_RTF
+	AttachMHTMLRef        = 0x00000004 // ATT_MHTML_REF: referenced by the HTML body.
 )
 
+// Rendering types from the attAttachRendData structure.
+const (
+	RenderNone    = 0
+	RenderFile    = 1
+	RenderOLE     = 2
+	RenderPicture = 3
+)
+
+// RenderMacBinary is set in Rendering.Flags when the attachment data is
+// in MacBinary format.
+const RenderMacBinary = 0x00000001
+
 // ErrBadSignature is returned when the input is not a valid TNEF stream.
 var ErrBadSignature = errors.New("not a valid TNEF file")
@@ -6,6 +6,7 @@ package tnef
 import (
 	"encoding/binary"
 	"strings"
+	"time"
 )
 
 // Decode parses a raw TNEF byte stream and returns the decoded Message.
@@ -34,7 +35,7 @@ func Decode(data []byte) (*Message, error) {
 		offset = end
 
 		if lv == lvlAttachment && id == attrAttachRendData {
-			cur = &Attachment{}
+			cur = &Attachment{Rendering: parseRendData(d)}
 			msg.Attachments = append(msg.Attachments, cur)
 			continue
 		}
@@ -45,6 +46,16 @@ func Decode(data []byte) (*Message, error) {
 				cur.Title = cleanStr(string(d))
 			case attrAttachData:
 				cur.Data = d
+			case attrAttachMetaFile:
+				cur.MetaFile = d
+			case attrAttachCreateDate:
+				if t := parseDate(d); !t.IsZero() && cur.Created.IsZero() {
+					cur.Created = t
+				}
+			case attrAttachModifyDate:
+				if t := parseDate(d); !t.IsZero() && cur.Modified.IsZero() {
+					cur.Modified = t
+				}
 			case attrAttachment:
 				parseAttachProps(cur, d)
 			}
@@ -52,56 +63,57 @@ func Decode(data []byte) (*Message, error) {
 		}
 
 		if id == attrMAPIProps {
-			attrs := decodeMAPI(d)
-			msg.Attributes = append(msg.Attributes, attrs...)
-			for _, a := range attrs {
-				switch a.Name {
-				case MAPIBody:
-					msg.Body = a.Data
-				case MAPIBodyHTML:
-					msg.BodyHTML = a.Data
-				case MAPIRtfCompressed:
-					if rtf, err := DecompressRTF(a.Data); err == nil {
-						msg.BodyRTF = rtf
-						if html := DeencapsulateHTML(rtf); html != nil {
-							msg.BodyRTFHTML = html
-						}
-					}
-				}
-			}
+			msg.ApplyAttributes(decodeMAPI(d))
 		}
 	}
 
 	return msg, nil
 }
 
+// parseRendData decodes the 14-byte attAttachRendData structure, or
+// returns nil if d is too short.
+func parseRendData(d []byte) *Rendering {
+	if len(d) < 14 {
+		return nil
+	}
+	return &Rendering{
+		Type:     int(binary.LittleEndian.Uint16(d[0:2])),
+		Position: binary.LittleEndian.Uint32(d[2:6]),
+		Width:    int(binary.LittleEndian.Uint16(d[6:8])),
+		Height:   int(binary.LittleEndian.Uint16(d[8:10])),
+		Flags:    binary.LittleEndian.Uint32(d[10:14]),
+	}
+}
+
+// parseDate decodes a TNEF atpDate value: year, month, day, hour,
+// minute, second, and day of week as 16-bit words. The time zone is not
+// recorded, so UTC is assumed.
+func parseDate(d []byte) time.Time {
+	if len(d) < 12 {
+		return time.Time{}
+	}
+	var v [6]int
+	for k := range v {
+		v[k] = int(binary.LittleEndian.Uint16(d[2*k:]))
+	}
+	if v[0] == 0 || v[1] < 1 || v[1] > 12 || v[2] < 1 || v[2] > 31 {
+		return time.Time{}
+	}
+	return time.Date(v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, time.UTC)
+}
+
 // parseAttachProps decodes the MAPI properties for a single attachment,
 // populating filename, MIME type, content-ID, method, and embedded data.
 func parseAttachProps(att *Attachment, data []byte) {
 	attrs := decodeMAPI(data)
-	var obj []byte
+	att.ApplyAttributes(attrs)
 
+	var obj []byte
 	for _, a := range attrs {
-		switch a.Name {
-		case MAPIAttachFilename:
-			if att.Title == "" {
-				att.Title = cleanStr(string(a.Data))
-			}
-		case MAPIAttachLongFname:
-			att.LongName = cleanStr(string(a.Data))
-		case MAPIAttachMimeTag:
-			att.MimeType = cleanStr(string(a.Data))
-		case MAPIAttachContentID:
-			att.ContentID = cleanStr(string(a.Data))
-		case MAPIAttachMethod:
-			if len(a.Data) >= 4 {
-				att.Method = int(binary.LittleEndian.Uint32(a.Data))
-			}
-		case MAPIAttachDataObj:
+		if a.Name == MAPIAttachDataObj {
 			obj = a.Data
 		}
 	}
-
 	if len(obj) > 0 && len(att.Data) == 0 {
 		resolveNested(att, obj)
 	}
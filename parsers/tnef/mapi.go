@@ -2,7 +2,11 @@
 
 package tnef
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
 
 // decodeMAPI parses a raw MAPI property stream into a slice of MAPIAttr,
 // handling fixed-size, variable-length, multi-valued, and named properties.
@@ -34,6 +38,7 @@ func decodeMAPI(data []byte) []MAPIAttr {
 		}
 
 		// Named properties carry extra GUID + kind header.
+		var name string
 		if pid >= 0x8000 && pid <= 0xFFFE {
 			if off+16 > len(data) {
 				break
@@ -54,7 +59,12 @@ func decodeMAPI(data []byte) []MAPIAttr {
 					break
 				}
 				nl := int(binary.LittleEndian.Uint32(data[off : off+4]))
-				off += 4 + nl + padTo4(nl)
+				off += 4
+				if nl < 0 || off+nl > len(data) {
+					break
+				}
+				name = utf16String(data[off : off+nl])
+				off += nl + padTo4(nl)
 			}
 		}
 
@@ -92,7 +102,7 @@ func decodeMAPI(data []byte) []MAPIAttr {
 		if !ok {
 			break
 		}
-		attrs = append(attrs, MAPIAttr{Type: bt, Name: pid, Data: ad})
+		attrs = append(attrs, MAPIAttr{Type: bt, Name: pid, Data: ad, PropName: name})
 	}
 	return attrs
 }
@@ -120,3 +130,47 @@ func fixedPropSize(pt int) int {
 func padTo4(n int) int {
 	return (4 - n%4) % 4
 }
+
+// DecodeNameMap decodes a named property map, as stored in the MSG
+// __nameid_version1.0 storage and the PST name-to-ID map, into property
+// ID → name for properties named by string. entries holds 8-byte NAMEID
+// records and names the length-prefixed UTF-16LE string stream.
+func DecodeNameMap(entries, names []byte) map[int]string {
+	m := make(map[int]string)
+	for off := 0; off+8 <= len(entries); off += 8 {
+		id := binary.LittleEndian.Uint32(entries[off:])
+		kind := binary.LittleEndian.Uint16(entries[off+4:]) & 1
+		idx := int(binary.LittleEndian.Uint16(entries[off+6:]))
+		if kind == 0 {
+			continue // numeric name; only string names are resolved
+		}
+		pos := int(id)
+		if pos < 0 || pos+4 > len(names) {
+			continue
+		}
+		n := int(binary.LittleEndian.Uint32(names[pos:]))
+		if n < 0 || pos+4+n > len(names) {
+			continue
+		}
+		m[0x8000+idx] = utf16String(names[pos+4 : pos+4+n])
+	}
+	return m
+}
+
+// NameAttrs sets PropName on the named properties in attrs found in m.
+func NameAttrs(attrs []MAPIAttr, m map[int]string) {
+	for i := range attrs {
+		if name, ok := m[attrs[i].Name]; ok && attrs[i].PropName == "" {
+			attrs[i].PropName = name
+		}
+	}
+}
+
+// utf16String decodes UTF-16LE bytes, dropping any terminating NUL.
+func utf16String(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, binary.LittleEndian.Uint16(b[i:]))
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
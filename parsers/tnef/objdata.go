@@ -0,0 +1,154 @@
+// objdata.go unwraps OLE objects embedded in RTF \objdata groups into
+// their native payloads.
+
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+	"strings"
+
+	"github.com/avaropoint/converter/parsers/cfb"
+)
+
+// OLE1 object header constants ([MS-OLEDS] 2.2.4).
+const (
+	ole1Version     = 0x0501
+	ole1FormatEmbed = 2
+)
+
+// RTFObject is an OLE object embedded in an RTF document with \objdata.
+type RTFObject struct {
+	Name      string // Stable name such as "rtf_object001.docx", or the packaged file's name.
+	ClassName string // OLE class, e.g. "Package" or "Word.Document.12".
+	Data      []byte // Native payload: the packaged file or document.
+}
+
+// objectExtensions maps OLE class name prefixes to file extensions for
+// objects whose native data is a document.
+var objectExtensions = []struct{ prefix, ext string }{
+	{"Word.Document.12", ".docx"},
+	{"Word.Document", ".doc"},
+	{"Excel.Sheet.12", ".xlsx"},
+	{"Excel.Sheet", ".xls"},
+	{"PowerPoint.Show.12", ".pptx"},
+	{"PowerPoint.Show", ".ppt"},
+	{"AcroExch.Document", ".pdf"},
+	{"PBrush", ".bmp"},
+	{"Paint.Picture", ".bmp"},
+}
+
+// unwrapObject decodes an OLE1 embedded object and returns its class name,
+// a suggested filename (empty if unknown), and its native payload.
+func unwrapObject(data []byte) (class, filename string, payload []byte, ok bool) {
+	if len(data) < 8 || binary.LittleEndian.Uint32(data[0:4])&0xFFFF != ole1Version ||
+		binary.LittleEndian.Uint32(data[4:8]) != ole1FormatEmbed {
+		return "", "", nil, false
+	}
+	pos := 8
+	var strs [3]string // ClassName, TopicName, ItemName
+	for k := range strs {
+		if pos+4 > len(data) {
+			return "", "", nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if n < 0 || pos+n > len(data) {
+			return "", "", nil, false
+		}
+		strs[k] = strings.TrimRight(string(data[pos:pos+n]), "\x00")
+		pos += n
+	}
+	if pos+4 > len(data) {
+		return "", "", nil, false
+	}
+	size := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	if size < 0 || pos+size > len(data) {
+		size = len(data) - pos
+	}
+	class, native := strs[0], data[pos:pos+size]
+
+	if class == "Package" {
+		if name, content, ok := unwrapPackage(native); ok {
+			return class, name, content, true
+		}
+	}
+	if bytes.HasPrefix(native, cfb.Signature) {
+		if name, content, ok := unwrapCompound(native); ok {
+			return class, name, content, true
+		}
+	}
+	return class, "", native, true
+}
+
+// unwrapPackage decodes the native data of an OLE Packager object: a
+// label, source path, temporary path, and the file contents.
+func unwrapPackage(native []byte) (name string, content []byte, ok bool) {
+	if len(native) < 2 {
+		return "", nil, false
+	}
+	pos := 2 // signature
+	cstr := func() (string, bool) {
+		end := bytes.IndexByte(native[pos:], 0)
+		if end < 0 {
+			return "", false
+		}
+		s := string(native[pos : pos+end])
+		pos += end + 1
+		return s, true
+	}
+	label, ok1 := cstr()
+	source, ok2 := cstr()
+	if !ok1 || !ok2 || pos+8 > len(native) {
+		return "", nil, false
+	}
+	pos += 4 // reserved, type
+	tempLen := int(binary.LittleEndian.Uint32(native[pos:]))
+	pos += 4
+	if tempLen < 0 || pos+tempLen+4 > len(native) {
+		return "", nil, false
+	}
+	pos += tempLen
+	size := int(binary.LittleEndian.Uint32(native[pos:]))
+	pos += 4
+	if size < 0 || pos+size > len(native) {
+		return "", nil, false
+	}
+	name = label
+	if name == "" {
+		name = path.Base(strings.ReplaceAll(source, "\\", "/"))
+	}
+	return name, native[pos : pos+size], true
+}
+
+// unwrapCompound extracts the payload of an OLE2 compound object: an
+// Office Open XML package stream or an Ole10Native packaged file.
+func unwrapCompound(native []byte) (name string, content []byte, ok bool) {
+	f, err := cfb.Open(native)
+	if err != nil {
+		return "", nil, false
+	}
+	if e := f.Root.Child("Package"); e != nil && !e.IsStorage() {
+		if data, err := f.ReadStream(e); err == nil {
+			return "", data, true
+		}
+	}
+	if e := f.Root.Child("\x01Ole10Native"); e != nil && !e.IsStorage() {
+		if data, err := f.ReadStream(e); err == nil && len(data) > 4 {
+			return unwrapPackage(data[4:])
+		}
+	}
+	return "", nil, false
+}
+
+// objectExtension returns the file extension for an OLE class name.
+func objectExtension(class string) string {
+	for _, e := range objectExtensions {
+		if strings.HasPrefix(class, e.prefix) {
+			return e.ext
+		}
+	}
+	return ".bin"
+}
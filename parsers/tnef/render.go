@@ -0,0 +1,685 @@
+// render.go renders RTF bodies that are not HTML-encapsulated into plain
+// text and simple HTML, extracting embedded \pict images and \objdata
+// objects along the way.
+
+package tnef
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxRTFDepth bounds group nesting; deeper groups are skipped.
+const maxRTFDepth = 512
+
+// placeholderMarker marks the position of an \objattph placeholder in
+// rendered HTML until ResolvePlaceholders replaces it.
+const placeholderMarker = "<!--objattph:%d-->"
+
+// RTFPicture is an image embedded in an RTF document with \pict.
+type RTFPicture struct {
+	Name     string // Stable name such as "rtf_image001.png".
+	MimeType string // MIME type derived from the picture kind.
+	Data     []byte // Decoded picture bytes.
+	Width    int    // Display width in pixels, if given (\picwgoal).
+	Height   int    // Display height in pixels, if given (\pichgoal).
+}
+
+// RenderedRTF is the result of RenderRTF.
+type RenderedRTF struct {
+	Text     []byte       // Plain text rendering.
+	HTML     []byte       // Standalone HTML document; pictures and objects are referenced as cid:<Name>.
+	Pictures []RTFPicture // Embedded pictures, in document order.
+	Objects  []RTFObject  // Embedded OLE objects, in document order.
+
+	// Placeholders counts the \objattph attachment placeholders, which
+	// appear in HTML as <!--objattph:N--> markers numbered from 1.
+	Placeholders int
+}
+
+// Attachments returns the pictures and objects as attachments whose
+// Content-IDs match the cid: references in HTML.
+func (r *RenderedRTF) Attachments() []*Attachment {
+	var atts []*Attachment
+	for _, p := range r.Pictures {
+		atts = append(atts, &Attachment{
+			LongName:  p.Name,
+			Data:      p.Data,
+			MimeType:  p.MimeType,
+			ContentID: p.Name,
+			Method:    AttachByValue,
+		})
+	}
+	for _, o := range r.Objects {
+		atts = append(atts, &Attachment{
+			LongName:  o.Name,
+			Data:      o.Data,
+			ContentID: o.Name,
+			Method:    AttachByValue,
+		})
+	}
+	return atts
+}
+
+// rtfDest identifies what a group's text is for.
+type rtfDest int
+
+const (
+	destText    rtfDest = iota // Visible document text.
+	destSkip                   // Ignored destination (font table, metadata, ...).
+	destPict                   // Hex picture data.
+	destFldInst                // Field instruction text.
+	destObjData                // Hex OLE object data.
+)
+
+// rtfField collects the instruction of a \field group.
+type rtfField struct {
+	instr strings.Builder
+}
+
+// rtfState is the formatting state of one RTF group.
+type rtfState struct {
+	dest       rtfDest
+	uc         int
+	bold       bool
+	italic     bool
+	underline  bool
+	pict       *rtfPict
+	obj        *[]byte // Hex digits of the current \objdata group.
+	field      *rtfField
+	close      string // HTML written when this group ends.
+	ownsPict   bool   // This group started the picture.
+	ownsObj    bool   // This group started the object data.
+	groupStart bool   // No token has been read in this group yet.
+	ignorable  bool   // The group began with \*.
+}
+
+// rtfPict accumulates one picture's properties and hex data.
+type rtfPict struct {
+	kind          string
+	hex           []byte
+	raw           []byte
+	width, height int
+}
+
+// rtfRenderer holds the output of a rendering pass.
+type rtfRenderer struct {
+	text         bytes.Buffer
+	html         bytes.Buffer
+	pictures     []RTFPicture
+	objects      []RTFObject
+	placeholders int
+	skip         int  // Characters still to skip after \uN.
+	surrogate    rune // High surrogate of a \uN pair awaiting its low half.
+
+	openBold, openItalic, openUnderline bool
+}
+
+// skippedDestinations are destination control words whose content is
+// never rendered as document text.
+var skippedDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true,
+	"listtable": true, "listoverridetable": true, "rsidtbl": true,
+	"generator": true, "xmlnstbl": true, "themedata": true,
+	"colorschememapping": true, "latentstyles": true, "datastore": true,
+	"header": true, "headerl": true, "headerr": true, "headerf": true,
+	"footer": true, "footerl": true, "footerr": true, "footerf": true,
+	"nonshppict": true, "objclass": true, "objname": true,
+	"filetbl": true, "revtbl": true, "pgdsctbl": true, "mmathPr": true,
+}
+
+// renderedDestinations are \* destinations whose content is rendered.
+var renderedDestinations = map[string]bool{
+	"shppict": true, "fldinst": true, "objattph": true,
+}
+
+// RenderRTF renders an RTF document to plain text and HTML. Character
+// formatting (bold, italic, underline), paragraphs, tabs, Unicode escapes,
+// and HYPERLINK fields are kept; tables and layout are flattened.
+// Hyperlinks other than http, https, and mailto are written with an
+// inert data-href instead of href. 8-bit text is decoded as
+// Windows-1252.
+func RenderRTF(rtf []byte) *RenderedRTF {
+	r := &rtfRenderer{}
+	r.run(rtf)
+	if r.surrogate != 0 {
+		r.text.WriteRune(utf8.RuneError)
+		r.html.WriteRune(utf8.RuneError)
+	}
+
+	var doc bytes.Buffer
+	doc.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"></head>\n")
+	doc.WriteString("<body><div style=\"white-space: pre-wrap; font-family: sans-serif\">")
+	doc.Write(r.html.Bytes())
+	doc.WriteString("</div></body></html>\n")
+
+	return &RenderedRTF{
+		Text:         bytes.TrimRight(r.text.Bytes(), "\r\n\t "),
+		HTML:         doc.Bytes(),
+		Pictures:     r.pictures,
+		Objects:      r.objects,
+		Placeholders: r.placeholders,
+	}
+}
+
+// run tokenizes rtf and renders it.
+func (r *rtfRenderer) run(rtf []byte) {
+	stack := []rtfState{{uc: 1}}
+	n := len(rtf)
+	for i := 0; i < n; {
+		st := &stack[len(stack)-1]
+		c := rtf[i]
+		switch c {
+		case '{':
+			next := *st
+			next.close, next.ownsPict, next.ownsObj, next.ignorable = "", false, false, false
+			next.groupStart = true
+			if len(stack) >= maxRTFDepth {
+				next.dest = destSkip
+			}
+			stack = append(stack, next)
+			r.skip = 0
+			i++
+			continue
+		case '}':
+			if len(stack) > 1 {
+				r.endGroup(st)
+				stack = stack[:len(stack)-1]
+			}
+			r.skip = 0
+			i++
+			continue
+		case '\r', '\n':
+			i++
+			continue
+		case '\\':
+			i = r.control(rtf, i, &stack)
+			continue
+		}
+		st.groupStart = false
+		r.char(st, c)
+		i++
+	}
+	r.closeFormat()
+}
+
+// endGroup finishes a group that is about to be popped.
+func (r *rtfRenderer) endGroup(st *rtfState) {
+	if st.ownsPict && st.pict != nil {
+		r.addPicture(st.pict)
+	}
+	if st.ownsObj && st.obj != nil {
+		r.addObject(*st.obj)
+	}
+	if st.close != "" {
+		r.closeFormat()
+		r.html.WriteString(st.close)
+	}
+}
+
+// control handles the control word or symbol at rtf[i] and returns the
+// offset after it.
+func (r *rtfRenderer) control(rtf []byte, i int, stack *[]rtfState) int {
+	st := &(*stack)[len(*stack)-1]
+	n := len(rtf)
+	if i+1 >= n {
+		return n
+	}
+	c := rtf[i+1]
+
+	// Control symbols.
+	if !isAlpha(c) {
+		first := st.groupStart
+		st.groupStart = false
+		switch c {
+		case '*':
+			if first {
+				st.ignorable = true
+				st.groupStart = true
+			}
+		case '\'':
+			if i+3 < n {
+				hi, lo := unhex(rtf[i+2]), unhex(rtf[i+3])
+				if hi >= 0 && lo >= 0 {
+					r.char(st, byte(hi<<4|lo))
+				}
+				return i + 4
+			}
+			return n
+		case '\\', '{', '}':
+			r.char(st, c)
+		case '~':
+			r.emit(st, ' ')
+		case '_':
+			r.emit(st, '‑')
+		case '\r', '\n':
+			r.emit(st, '\n')
+		}
+		return i + 2
+	}
+
+	// Control word with optional numeric parameter.
+	j := i + 1
+	for j < n && isAlpha(rtf[j]) {
+		j++
+	}
+	word := string(rtf[i+1 : j])
+	param, hasParam := 0, false
+	if j < n && (rtf[j] == '-' || (rtf[j] >= '0' && rtf[j] <= '9')) {
+		k := j
+		if rtf[k] == '-' {
+			k++
+		}
+		for k < n && rtf[k] >= '0' && rtf[k] <= '9' {
+			k++
+		}
+		if v, err := strconv.Atoi(string(rtf[j:k])); err == nil {
+			param, hasParam = v, true
+		}
+		j = k
+	}
+	if j < n && rtf[j] == ' ' {
+		j++
+	}
+
+	// \bin counts raw bytes; never let it reach past the input.
+	if word == "bin" && param > n-j {
+		param = n - j
+	}
+
+	first := st.groupStart
+	st.groupStart = false
+
+	if st.dest == destSkip {
+		if word == "bin" && hasParam && param > 0 {
+			return j + param
+		}
+		return j
+	}
+
+	// Destinations.
+	switch {
+	case word == "pict":
+		st.dest = destPict
+		st.pict = &rtfPict{}
+		st.ownsPict = true
+		return j
+	case word == "objdata":
+		st.dest = destObjData
+		st.obj = new([]byte)
+		st.ownsObj = true
+		return j
+	case word == "fldinst":
+		if st.field != nil {
+			st.dest = destFldInst
+		} else {
+			st.dest = destSkip
+		}
+		return j
+	case word == "fldrslt":
+		st.dest = destText
+		if st.field != nil {
+			if url := hyperlinkTarget(st.field.instr.String()); url != "" {
+				// Other targets stay inert but visible to link extraction.
+				attr := "data-href"
+				if linkableURL(url) {
+					attr = "href"
+				}
+				r.closeFormat()
+				fmt.Fprintf(&r.html, "<a %s=\"%s\">", attr, html.EscapeString(url))
+				st.close = "</a>"
+			}
+		}
+		return j
+	case word == "field":
+		st.field = &rtfField{}
+		return j
+	case skippedDestinations[word]:
+		st.dest = destSkip
+		return j
+	case first && st.ignorable && !renderedDestinations[word]:
+		st.dest = destSkip
+		return j
+	}
+
+	if st.dest == destPict {
+		r.pictWord(st.pict, word, param)
+		if word == "bin" && hasParam && param > 0 {
+			st.pict.raw = append(st.pict.raw, rtf[j:j+param]...)
+			return j + param
+		}
+		return j
+	}
+
+	switch word {
+	case "bin":
+		if hasParam && param > 0 {
+			return j + param
+		}
+	case "par", "line", "sect", "page", "row":
+		r.emit(st, '\n')
+	case "tab", "cell":
+		r.emit(st, '\t')
+	case "emdash":
+		r.emit(st, '—')
+	case "endash":
+		r.emit(st, '–')
+	case "bullet":
+		r.emit(st, '•')
+	case "lquote":
+		r.emit(st, '‘')
+	case "rquote":
+		r.emit(st, '’')
+	case "ldblquote":
+		r.emit(st, '“')
+	case "rdblquote":
+		r.emit(st, '”')
+	case "emspace", "enspace", "qmspace":
+		r.emit(st, ' ')
+	case "u":
+		if hasParam {
+			if param < 0 {
+				param += 65536
+			}
+			r.unicode(st, rune(param))
+			r.skip = st.uc
+		}
+	case "objattph":
+		if st.dest == destText {
+			r.closeFormat()
+			r.placeholders++
+			fmt.Fprintf(&r.html, placeholderMarker, r.placeholders)
+		}
+	case "uc":
+		if hasParam && param >= 0 {
+			st.uc = param
+		}
+	case "b":
+		st.bold = !hasParam || param != 0
+	case "i":
+		st.italic = !hasParam || param != 0
+	case "ul":
+		st.underline = !hasParam || param != 0
+	case "ulnone":
+		st.underline = false
+	case "plain":
+		st.bold, st.italic, st.underline = false, false, false
+	}
+	return j
+}
+
+// char handles one literal byte in the current destination.
+func (r *rtfRenderer) char(st *rtfState, c byte) {
+	switch st.dest {
+	case destPict:
+		if unhex(c) >= 0 {
+			st.pict.hex = append(st.pict.hex, c)
+		}
+	case destObjData:
+		if unhex(c) >= 0 {
+			*st.obj = append(*st.obj, c)
+		}
+	case destFldInst:
+		st.field.instr.WriteByte(c)
+	case destText:
+		if c < 0x80 {
+			r.emit(st, rune(c))
+		} else {
+			r.emit(st, cp1252(c))
+		}
+	}
+}
+
+// unicode emits the UTF-16 code unit of a \uN control word, joining a
+// surrogate pair into one rune. Unpaired surrogates become U+FFFD.
+func (r *rtfRenderer) unicode(st *rtfState, ch rune) {
+	if st.dest != destText {
+		return
+	}
+	high := r.surrogate
+	r.surrogate = 0
+	switch {
+	case ch >= 0xD800 && ch < 0xDC00:
+		if high != 0 {
+			r.emit(st, utf8.RuneError)
+		}
+		r.surrogate = ch
+		return
+	case high != 0 && ch >= 0xDC00 && ch < 0xE000:
+		ch = utf16.DecodeRune(high, ch)
+	case high != 0:
+		r.emit(st, utf8.RuneError)
+	}
+	if utf16.IsSurrogate(ch) {
+		ch = utf8.RuneError
+	}
+	r.emit(st, ch)
+}
+
+// emit writes one rune of visible text to both outputs.
+func (r *rtfRenderer) emit(st *rtfState, ch rune) {
+	if st.dest != destText {
+		return
+	}
+	if r.skip > 0 {
+		r.skip--
+		return
+	}
+	if r.surrogate != 0 {
+		r.surrogate = 0
+		r.emit(st, utf8.RuneError)
+	}
+	r.text.WriteRune(ch)
+
+	if ch == '\n' {
+		r.closeFormat()
+		r.html.WriteString("<br>\n")
+		return
+	}
+	r.setFormat(st.bold, st.italic, st.underline)
+	switch ch {
+	case '&':
+		r.html.WriteString("&amp;")
+	case '<':
+		r.html.WriteString("&lt;")
+	case '>':
+		r.html.WriteString("&gt;")
+	case '"':
+		r.html.WriteString("&quot;")
+	default:
+		r.html.WriteRune(ch)
+	}
+}
+
+// setFormat opens or closes HTML formatting tags to match the state.
+func (r *rtfRenderer) setFormat(b, i, u bool) {
+	if b == r.openBold && i == r.openItalic && u == r.openUnderline {
+		return
+	}
+	r.closeFormat()
+	if b {
+		r.html.WriteString("<b>")
+	}
+	if i {
+		r.html.WriteString("<i>")
+	}
+	if u {
+		r.html.WriteString("<u>")
+	}
+	r.openBold, r.openItalic, r.openUnderline = b, i, u
+}
+
+// closeFormat closes any open formatting tags.
+func (r *rtfRenderer) closeFormat() {
+	if r.openUnderline {
+		r.html.WriteString("</u>")
+	}
+	if r.openItalic {
+		r.html.WriteString("</i>")
+	}
+	if r.openBold {
+		r.html.WriteString("</b>")
+	}
+	r.openBold, r.openItalic, r.openUnderline = false, false, false
+}
+
+// pictWord records a picture property control word.
+func (r *rtfRenderer) pictWord(p *rtfPict, word string, param int) {
+	switch word {
+	case "pngblip", "jpegblip", "emfblip", "wmetafile", "dibitmap", "macpict":
+		p.kind = word
+	case "picwgoal":
+		p.width = param / 15 // twips to pixels at 96 DPI
+	case "pichgoal":
+		p.height = param / 15
+	}
+}
+
+// addPicture decodes a finished picture and references it from the HTML.
+func (r *rtfRenderer) addPicture(p *rtfPict) {
+	data := p.raw
+	if len(p.hex) > 0 {
+		data = decodeHex(p.hex)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	ext, mime, inline := ".bin", "application/octet-stream", false
+	switch p.kind {
+	case "pngblip":
+		ext, mime, inline = ".png", "image/png", true
+	case "jpegblip":
+		ext, mime, inline = ".jpg", "image/jpeg", true
+	case "emfblip":
+		ext, mime = ".emf", "image/emf"
+	case "wmetafile":
+		ext, mime = ".wmf", "image/wmf"
+	case "macpict":
+		ext, mime = ".pict", "image/x-pict"
+	case "dibitmap":
+		if bmp := dibToBMP(data); bmp != nil {
+			data, ext, mime, inline = bmp, ".bmp", "image/bmp", true
+		}
+	}
+
+	pic := RTFPicture{
+		Name:     fmt.Sprintf("rtf_image%03d%s", len(r.pictures)+1, ext),
+		MimeType: mime,
+		Data:     data,
+		Width:    p.width,
+		Height:   p.height,
+	}
+	r.pictures = append(r.pictures, pic)
+	if !inline {
+		return
+	}
+	r.closeFormat()
+	fmt.Fprintf(&r.html, "<img src=\"cid:%s\"", pic.Name)
+	if pic.Width > 0 && pic.Height > 0 {
+		fmt.Fprintf(&r.html, " width=\"%d\" height=\"%d\"", pic.Width, pic.Height)
+	}
+	r.html.WriteString(" alt=\"\">")
+}
+
+// addObject unwraps a finished \objdata group and links it from the HTML.
+func (r *rtfRenderer) addObject(hex []byte) {
+	class, name, data, ok := unwrapObject(decodeHex(hex))
+	if !ok || len(data) == 0 {
+		return
+	}
+	if name == "" {
+		name = fmt.Sprintf("rtf_object%03d%s", len(r.objects)+1, objectExtension(class))
+	}
+	r.objects = append(r.objects, RTFObject{Name: name, ClassName: class, Data: data})
+	r.closeFormat()
+	fmt.Fprintf(&r.html, "<a href=\"cid:%s\" download=\"%s\">%s</a>",
+		html.EscapeString(name), html.EscapeString(name), html.EscapeString(name))
+}
+
+// decodeHex decodes pairs of hex digits; a trailing odd digit is dropped.
+func decodeHex(hex []byte) []byte {
+	out := make([]byte, len(hex)/2)
+	for k := range out {
+		out[k] = byte(unhex(hex[2*k])<<4 | unhex(hex[2*k+1]))
+	}
+	return out
+}
+
+// dibToBMP prepends a BITMAPFILEHEADER to a device-independent bitmap so
+// that it can be viewed as a .bmp file.
+func dibToBMP(dib []byte) []byte {
+	if len(dib) < 40 {
+		return nil
+	}
+	hdrSize := int(le32(dib[0:4]))
+	bitCount := int(dib[14]) | int(dib[15])<<8
+	colors := int(le32(dib[32:36]))
+	if colors == 0 && bitCount <= 8 {
+		colors = 1 << bitCount
+	}
+	offset := 14 + hdrSize + colors*4
+	out := make([]byte, 14, 14+len(dib))
+	out[0], out[1] = 'B', 'M'
+	putLE32(out[2:6], uint32(14+len(dib)))
+	putLE32(out[10:14], uint32(offset))
+	return append(out, dib...)
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+}
+
+// hyperlinkTarget returns the target URL of a HYPERLINK field
+// instruction, or "" for any other field.
+func hyperlinkTarget(instr string) string {
+	fields := strings.Fields(instr)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "HYPERLINK") {
+		return ""
+	}
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, `\`) {
+			continue // switches such as \l or \o
+		}
+		if url := strings.Trim(f, `"`); utf8.ValidString(url) {
+			return url
+		}
+		return ""
+	}
+	return ""
+}
+
+// linkableURL reports whether url is an http, https, or mailto URL,
+// which alone are rendered as clickable links.
+func linkableURL(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:")
+}
+
+// CP1252High maps Windows-1252 bytes 0x80-0x9F to Unicode; other high
+// bytes are identical to Latin-1. Bytes undefined in the code page map
+// to U+FFFD.
+var CP1252High = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+// cp1252 decodes one Windows-1252 byte.
+func cp1252(c byte) rune {
+	if c >= 0x80 && c < 0xA0 {
+		return CP1252High[c-0x80]
+	}
+	return rune(c)
+}
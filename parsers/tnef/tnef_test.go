@@ -1,8 +1,12 @@
 package tnef
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func validTNEFHeader() []byte {
@@ -44,3 +48,240 @@ func TestDeencapsulateHTMLEmpty(t *testing.T) {
 		t.Fatalf("expected empty result, got %d bytes", len(result))
 	}
 }
+
+func TestRenderRTF(t *testing.T) {
+	rtf := []byte(`{\rtf1\ansi\ansicpg1252{\fonttbl{\f0 Arial;}}{\*\generator Test;}` +
+		`\pard Hello {\b bold} caf\'e9 \u8364?\par ` +
+		`{\field{\*\fldinst HYPERLINK "https://example.com/"}{\fldrslt link}}\par ` +
+		`{\field{\*\fldinst HYPERLINK "javascript:alert(1)"}{\fldrslt x}}` +
+		`{\*\shppict{\pict\pngblip\picwgoal300\pichgoal150 89504e47}}{\nonshppict{\pict\wmetafile8 0102}}}`)
+	r := RenderRTF(rtf)
+
+	if got, want := string(r.Text), "Hello bold café €\nlink\nx"; got != want {
+		t.Errorf("Text = %q, want %q", got, want)
+	}
+	html := string(r.HTML)
+	for _, want := range []string{"<b>bold</b>", `<a href="https://example.com/">link</a>`, `<a data-href="javascript:alert(1)">x</a>`, `<img src="cid:rtf_image001.png" width="20" height="10"`} {
+		if !bytes.Contains(r.HTML, []byte(want)) {
+			t.Errorf("HTML missing %q:\n%s", want, html)
+		}
+	}
+	if len(r.Pictures) != 1 || r.Pictures[0].Name != "rtf_image001.png" || !bytes.Equal(r.Pictures[0].Data, []byte{0x89, 'P', 'N', 'G'}) {
+		t.Errorf("Pictures = %+v", r.Pictures)
+	}
+	if !bytes.Contains(r.HTML, []byte("Hello <b>")) {
+		t.Errorf("spaces must be left to white-space: pre-wrap:\n%s", html)
+	}
+
+	// \uN surrogate pairs form one rune; unpaired halves become U+FFFD.
+	for rtf, want := range map[string]string{
+		`{\rtf1 Hi \u-10179?\u-8704?!}`:         "Hi 😀!",
+		`{\rtf1\uc0 \u-10179\u-8704 }`:          "😀",
+		`{\rtf1 a\u-10179?b\u-8704?c\u-10179?}`: "a\uFFFDb\uFFFDc\uFFFD",
+	} {
+		if got := string(RenderRTF([]byte(rtf)).Text); got != want {
+			t.Errorf("%s: Text = %q, want %q", rtf, got, want)
+		}
+	}
+
+	// Huge \bin lengths must not overflow past the end of the input.
+	for _, rtf := range []string{
+		`{\rtf1 \bin9223372036854775807 x}`,
+		`{\rtf1 {\pict\pngblip\bin9223372036854775807 x}}`,
+		`{\rtf1 {\*\unknown \bin9223372036854775807 x}}`,
+	} {
+		RenderRTF([]byte(rtf))
+	}
+}
+
+func TestRenderRTFObjects(t *testing.T) {
+	// OLE Packager native data wrapping notes.txt.
+	var native []byte
+	native = append(native, 2, 0)
+	native = append(native, "notes.txt\x00C:\\tmp\\notes.txt\x00"...)
+	native = append(native, 0, 0, 3, 0)
+	native = binary.LittleEndian.AppendUint32(native, 4)
+	native = append(native, "C:\\\x00"...)
+	native = binary.LittleEndian.AppendUint32(native, 5)
+	native = append(native, "hello"...)
+
+	var obj []byte
+	obj = binary.LittleEndian.AppendUint32(obj, 0x0501)
+	obj = binary.LittleEndian.AppendUint32(obj, 2)
+	for _, s := range []string{"Package\x00", "", ""} {
+		obj = binary.LittleEndian.AppendUint32(obj, uint32(len(s)))
+		obj = append(obj, s...)
+	}
+	obj = binary.LittleEndian.AppendUint32(obj, uint32(len(native)))
+	obj = append(obj, native...)
+
+	rtf := fmt.Sprintf(`{\rtf1\ansi See {\object\objemb{\*\objclass Package}{\*\objdata %x}{\result x}}\par}`, obj)
+	msg := &Message{}
+	mela := binary.LittleEndian.AppendUint32(nil, uint32(12+len(rtf)))
+	mela = binary.LittleEndian.AppendUint32(mela, uint32(len(rtf)))
+	mela = append(mela, "MELA\x00\x00\x00\x00"...)
+	msg.ApplyAttributes([]MAPIAttr{{Type: PropTypeBinary, Name: MAPIRtfCompressed, Data: append(mela, rtf...)}})
+
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename() != "notes.txt" || string(msg.Attachments[0].Data) != "hello" {
+		t.Fatalf("attachments = %+v", msg.Attachments)
+	}
+	if !bytes.Contains(msg.BodyRTFHTML, []byte(`href="cid:notes.txt"`)) {
+		t.Errorf("object not linked from HTML:\n%s", msg.BodyRTFHTML)
+	}
+	if string(msg.Body) != "See x" {
+		t.Errorf("Body = %q", msg.Body)
+	}
+}
+
+func TestResolveContentIDs(t *testing.T) {
+	msg := &Message{
+		BodyHTML:    []byte(`<img src="cid:Logo@x"><img src='CID:missing'>`),
+		BodyRTFHTML: []byte(`<td background="cid:logo@X">`),
+		Attachments: []*Attachment{{LongName: "logo.png", ContentID: "logo@x"}, {LongName: "plain.txt"}},
+	}
+	msg.ResolveContentIDs(func(att *Attachment) string { return "file:" + att.Filename() })
+	if got := string(msg.BodyHTML); got != `<img src="file:logo.png"><img src='CID:missing'>` {
+		t.Errorf("BodyHTML = %s", got)
+	}
+	if got := string(msg.BodyRTFHTML); got != `<td background="file:logo.png">` {
+		t.Errorf("BodyRTFHTML = %s", got)
+	}
+}
+
+func TestResolvePlaceholders(t *testing.T) {
+	rtf := `{\rtf1\ansi\fromtext First {\*\objattph } then \objattph\par}`
+	mela := binary.LittleEndian.AppendUint32(nil, uint32(12+len(rtf)))
+	mela = binary.LittleEndian.AppendUint32(mela, uint32(len(rtf)))
+	mela = append(mela, "MELA\x00\x00\x00\x00"...)
+	msg := &Message{}
+	msg.ApplyAttributes([]MAPIAttr{{Type: PropTypeBinary, Name: MAPIRtfCompressed, Data: append(mela, rtf...)}})
+
+	pos := func(p uint32) []MAPIAttr {
+		return []MAPIAttr{{Type: PropTypeLong, Name: MAPIRenderingPos, Data: binary.LittleEndian.AppendUint32(nil, p)}}
+	}
+	second := &Attachment{LongName: "report.pdf", Data: []byte("pdf"), Attributes: pos(20)}
+	// Without PR_RENDERING_POSITION, the attAttachRendData position is used.
+	first := &Attachment{LongName: "chart.png", Data: []byte("png"), Rendering: &Rendering{Type: RenderFile, Position: 6}}
+	hidden := &Attachment{LongName: "hidden.txt", Data: []byte("x"), Attributes: pos(0xFFFFFFFF)}
+	msg.Attachments = append(msg.Attachments, second, hidden, first)
+
+	msg.ResolvePlaceholders(func(att *Attachment) string { return "file:" + att.Filename() })
+	got := string(msg.BodyRTFHTML)
+	want := `First <img src="file:chart.png" alt="chart.png"> then <a href="file:report.pdf" download="report.pdf">report.pdf</a>`
+	if !strings.Contains(got, want) {
+		t.Errorf("BodyRTFHTML = %s\nwant it to contain %s", got, want)
+	}
+}
+
+func TestDecodeRendData(t *testing.T) {
+	attr := func(id int, d []byte) []byte {
+		b := []byte{lvlAttachment}
+		b = binary.LittleEndian.AppendUint16(b, uint16(id))
+		b = binary.LittleEndian.AppendUint16(b, 0x0006)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(d)))
+		b = append(b, d...)
+		return append(b, 0, 0) // checksum, not verified
+	}
+	rend := binary.LittleEndian.AppendUint16(nil, RenderFile)
+	rend = binary.LittleEndian.AppendUint32(rend, 42)
+	rend = binary.LittleEndian.AppendUint16(rend, 32)
+	rend = binary.LittleEndian.AppendUint16(rend, 16)
+	rend = binary.LittleEndian.AppendUint32(rend, RenderMacBinary)
+
+	data := validTNEFHeader()
+	data = append(data, attr(attrAttachRendData, rend)...)
+	data = append(data, attr(attrAttachMetaFile, []byte("wmf"))...)
+	msg, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(msg.Attachments))
+	}
+	att := msg.Attachments[0]
+	want := Rendering{Type: RenderFile, Position: 42, Width: 32, Height: 16, Flags: RenderMacBinary}
+	if att.Rendering == nil || *att.Rendering != want {
+		t.Errorf("Rendering = %+v, want %+v", att.Rendering, want)
+	}
+	if string(att.MetaFile) != "wmf" {
+		t.Errorf("MetaFile = %q", att.MetaFile)
+	}
+}
+
+func TestAttachmentMetadata(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	long := func(id int, v uint32) MAPIAttr {
+		return MAPIAttr{Type: PropTypeLong, Name: id, Data: binary.LittleEndian.AppendUint32(nil, v)}
+	}
+	att := &Attachment{}
+	att.ApplyAttributes([]MAPIAttr{
+		TimeAttr(MAPICreationTime, created),
+		long(MAPIAttachSize, 1234),
+		long(MAPIAttachFlags, AttachMHTMLRef),
+		{Type: PropTypeBoolean, Name: MAPIAttachHidden, Data: []byte{1, 0, 0, 0}},
+		StringAttr(MAPIAttachExtension, ".pdf"),
+		StringAttr(MAPIAttachContentLoc, "http://example.com/a.pdf"),
+	})
+	if !att.Created.Equal(created) || att.Size != 1234 || !att.Hidden || att.Flags != AttachMHTMLRef {
+		t.Errorf("got created=%v size=%d hidden=%v flags=%#x", att.Created, att.Size, att.Hidden, att.Flags)
+	}
+	if att.Extension != ".pdf" || att.ContentLocation != "http://example.com/a.pdf" || !att.Inline() {
+		t.Errorf("got extension=%q location=%q inline=%v", att.Extension, att.ContentLocation, att.Inline())
+	}
+
+	// atpDate: 2023-12-25 08:15:30, Monday.
+	var date []byte
+	for _, v := range []uint16{2023, 12, 25, 8, 15, 30, 1} {
+		date = binary.LittleEndian.AppendUint16(date, v)
+	}
+	if got, want := parseDate(date), time.Date(2023, 12, 25, 8, 15, 30, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("parseDate = %v, want %v", got, want)
+	}
+	if got := parseDate(make([]byte, 14)); !got.IsZero() {
+		t.Errorf("parseDate(zero) = %v, want zero time", got)
+	}
+}
+
+func TestReferenceAttachment(t *testing.T) {
+	utf16le := func(s string) []byte {
+		var b []byte
+		for _, r := range s {
+			b = binary.LittleEndian.AppendUint16(b, uint16(r))
+		}
+		return b
+	}
+	// One string-named property at index 2 (ID 0x8002).
+	name := utf16le(NameProviderType)
+	strs := binary.LittleEndian.AppendUint32(nil, uint32(len(name)))
+	strs = append(strs, name...)
+	entries := binary.LittleEndian.AppendUint32(nil, 0) // offset into strs
+	entries = binary.LittleEndian.AppendUint16(entries, 1)
+	entries = binary.LittleEndian.AppendUint16(entries, 2)
+	names := DecodeNameMap(entries, strs)
+	if names[0x8002] != NameProviderType {
+		t.Fatalf("DecodeNameMap = %v", names)
+	}
+
+	attrs := []MAPIAttr{
+		{Type: PropTypeLong, Name: MAPIAttachMethod, Data: binary.LittleEndian.AppendUint32(nil, AttachByWebRef)},
+		StringAttr(MAPIAttachLongPath, "https://contoso.sharepoint.com/Shared/Plan.docx?web=1"),
+		StringAttr(0x8002, "OneDrivePro"),
+	}
+	NameAttrs(attrs, names)
+	att := &Attachment{}
+	att.ApplyAttributes(attrs)
+	if !att.IsReference() || att.ProviderType != "OneDrivePro" || att.Filename() != "Plan.docx" {
+		t.Errorf("got reference=%v provider=%q name=%q", att.IsReference(), att.ProviderType, att.Filename())
+	}
+
+	tests := []struct{ path, want string }{
+		{"https://example.com/a", "https://example.com/a"},
+		{`\\server\share\a.txt`, "file://server/share/a.txt"},
+		{`C:\Docs\a.txt`, "file:///C:/Docs/a.txt"},
+	}
+	for _, tt := range tests {
+		if got := (&Attachment{Pathname: tt.path}).TargetURL(); got != tt.want {
+			t.Errorf("TargetURL(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -5,7 +5,17 @@ package tnef
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/avaropoint/converter/formats"
 )
 
 // Message holds the decoded contents of a TNEF stream.
@@ -15,7 +25,64 @@ type Message struct {
 	BodyRTF     []byte        // Decompressed RTF (from PR_RTF_COMPRESSED).
 	BodyRTFHTML []byte        // HTML extracted from fromhtml1 RTF, if applicable.
 	Attachments []*Attachment // File and embedded message attachments.
+	Recipients  []*Recipient  // Recipient table rows, if the format carries one.
 	Attributes  []MAPIAttr    // All decoded MAPI properties.
+	Signatures  []*Signature  // S/MIME signers, if the message was signed.
+
+	Encrypted    bool   // The message carried S/MIME encrypted (enveloped) content.
+	DecryptError string // Why encrypted content was not decrypted; empty on success.
+}
+
+// Signature describes one S/MIME signer of a message and the result of
+// verifying it.
+type Signature struct {
+	Signer      string    // Signer certificate common name, or its full subject.
+	Email       string    // Signer email address from the certificate.
+	Issuer      string    // Issuer common name.
+	SigningTime time.Time // Signing time attribute, if present.
+	Valid       bool      // The signature matches the signed content.
+	Trusted     bool      // The signer certificate chains to a trusted root.
+	Error       string    // Why validation or trust failed, if it did.
+}
+
+// ApplyAttributes appends attrs to the message and populates the body
+// fields from PR_BODY, PR_BODY_HTML, and PR_RTF_COMPRESSED. Format
+// parsers other than Decode (such as MSG) use it to share body handling.
+func (m *Message) ApplyAttributes(attrs []MAPIAttr) {
+	m.Attributes = append(m.Attributes, attrs...)
+	for _, a := range attrs {
+		switch a.Name {
+		case MAPIBody:
+			m.Body = a.TextBytes()
+		case MAPIBodyHTML:
+			m.BodyHTML = a.TextBytes()
+		case MAPIRtfCompressed:
+			if rtf, err := DecompressRTF(a.Data); err == nil {
+				m.BodyRTF = rtf
+				if html := DeencapsulateHTML(rtf); html != nil {
+					m.BodyRTFHTML = html
+				} else {
+					m.applyRenderedRTF(rtf)
+				}
+			}
+		}
+	}
+}
+
+// applyRenderedRTF renders an RTF body that is not HTML-encapsulated into
+// BodyRTFHTML and adds its embedded pictures and objects as attachments.
+// Bodies converted from plain text (\fromtext) are left alone unless
+// they place attachments with \objattph.
+func (m *Message) applyRenderedRTF(rtf []byte) {
+	if bytes.Contains(rtf, []byte(`\fromtext`)) && !bytes.Contains(rtf, []byte(`\objattph`)) {
+		return
+	}
+	r := RenderRTF(rtf)
+	m.BodyRTFHTML = r.HTML
+	if len(m.Body) == 0 {
+		m.Body = r.Text
+	}
+	m.Attachments = append(m.Attachments, r.Attachments()...)
 }
 
 // GetAttr returns the first MAPI attribute matching the given property ID,
@@ -33,20 +100,194 @@ func (m *Message) GetAttr(propID int) *MAPIAttr {
 // propID, with null bytes and surrounding whitespace removed.
 func (m *Message) GetAttrString(propID int) string {
 	if a := m.GetAttr(propID); a != nil {
-		return strings.TrimSpace(strings.ReplaceAll(string(a.Data), "\x00", ""))
+		return cleanStr(a.Text())
 	}
 	return ""
 }
 
+// GetAttrTime returns the PT_SYSTIME value of the first MAPI attribute
+// matching propID, or the zero time if it is absent.
+func (m *Message) GetAttrTime(propID int) time.Time {
+	if a := m.GetAttr(propID); a != nil {
+		return a.Time()
+	}
+	return time.Time{}
+}
+
 // Attachment holds a single attachment (file, embedded message, or OLE object).
 type Attachment struct {
-	Title       string   // Short filename (8.3 format).
-	LongName    string   // Long filename.
-	Data        []byte   // Raw attachment content.
-	MimeType    string   // MIME type, if available.
-	ContentID   string   // Content-ID for inline images (cid: references).
-	Method      int      // AttachByValue, AttachEmbeddedMsg, or AttachOLE.
-	EmbeddedMsg *Message // Decoded nested message, if Method is AttachEmbeddedMsg.
+	Title       string     // Short filename (8.3 format).
+	LongName    string     // Long filename.
+	Data        []byte     // Raw attachment content.
+	MimeType    string     // MIME type, if available.
+	ContentID   string     // Content-ID for inline images (cid: references).
+	Method      int        // AttachByValue, AttachEmbeddedMsg, or AttachOLE.
+	EmbeddedMsg *Message   // Decoded nested message, if Method is AttachEmbeddedMsg.
+	Attributes  []MAPIAttr // All decoded MAPI properties of the attachment.
+	Rendering   *Rendering // Decoded attAttachRendData, if present.
+	MetaFile    []byte     // Windows metafile icon (attAttachMetaFile or PR_ATTACH_RENDERING).
+
+	Created         time.Time // attAttachCreateDate or PR_CREATION_TIME.
+	Modified        time.Time // attAttachModifyDate or PR_LAST_MODIFICATION_TIME.
+	Size            int       // PR_ATTACH_SIZE: size of the attachment object, including properties.
+	Hidden          bool      // PR_ATTACHMENT_HIDDEN.
+	Flags           uint32    // PR_ATTACH_FLAGS (AttachInvisibleInHTML, ...).
+	ContentLocation string    // PR_ATTACH_CONTENT_LOCATION.
+	Extension       string    // PR_ATTACH_EXTENSION, e.g. ".pdf".
+	Disposition     string    // MIME Content-Disposition ("inline" or "attachment"), if known.
+
+	Pathname         string // PR_ATTACH_LONG_PATHNAME or PR_ATTACH_PATHNAME of a reference attachment.
+	ProviderType     string // Cloud provider of a web reference (AttachmentProviderType).
+	ProviderEndpoint string // Provider endpoint URL (AttachmentProviderEndpointUrl).
+}
+
+// Rendering describes how an attachment is shown in the message body,
+// decoded from the TNEF attAttachRendData structure.
+type Rendering struct {
+	Type     int    // RenderNone, RenderFile, RenderOLE, or RenderPicture.
+	Position uint32 // Character position in the body; 0xFFFFFFFF if hidden.
+	Width    int    // Icon width, in pixels.
+	Height   int    // Icon height, in pixels.
+	Flags    uint32 // RenderMacBinary, if set.
+}
+
+// TypeName returns a readable name for the rendering type.
+func (r *Rendering) TypeName() string {
+	switch r.Type {
+	case RenderFile:
+		return "file"
+	case RenderOLE:
+		return "ole"
+	case RenderPicture:
+		return "picture"
+	}
+	return "none"
+}
+
+// ApplyAttributes appends attrs to the attachment and populates the
+// filename, MIME type, content-ID, method, icon, date, and flag fields.
+// PR_DISPLAY_NAME is used as the title when no filename is present.
+// PR_ATTACH_DATA_OBJ is left to the caller because its encoding is
+// format-specific.
+func (a *Attachment) ApplyAttributes(attrs []MAPIAttr) {
+	a.Attributes = append(a.Attributes, attrs...)
+	var display string
+	for _, p := range attrs {
+		switch p.Name {
+		case MAPIDisplayName:
+			display = cleanStr(p.Text())
+		case MAPIAttachFilename:
+			if a.Title == "" {
+				a.Title = cleanStr(p.Text())
+			}
+		case MAPIAttachLongFname:
+			a.LongName = cleanStr(p.Text())
+		case MAPIAttachMimeTag:
+			a.MimeType = cleanStr(p.Text())
+		case MAPIAttachContentID:
+			a.ContentID = cleanStr(p.Text())
+		case MAPIAttachMethod:
+			if len(p.Data) >= 4 {
+				a.Method = int(binary.LittleEndian.Uint32(p.Data))
+			}
+		case MAPIAttachRendering:
+			if len(a.MetaFile) == 0 {
+				a.MetaFile = p.Data
+			}
+		case MAPICreationTime:
+			if t := p.Time(); !t.IsZero() {
+				a.Created = t
+			}
+		case MAPILastModTime:
+			if t := p.Time(); !t.IsZero() {
+				a.Modified = t
+			}
+		case MAPIAttachSize:
+			if len(p.Data) >= 4 {
+				a.Size = int(binary.LittleEndian.Uint32(p.Data))
+			}
+		case MAPIAttachHidden:
+			a.Hidden = len(p.Data) > 0 && p.Data[0] != 0
+		case MAPIAttachFlags:
+			if len(p.Data) >= 4 {
+				a.Flags = binary.LittleEndian.Uint32(p.Data)
+			}
+		case MAPIAttachContentLoc:
+			a.ContentLocation = cleanStr(p.Text())
+		case MAPIAttachExtension:
+			a.Extension = cleanStr(p.Text())
+		case MAPIAttachLongPath:
+			a.Pathname = cleanStr(p.Text())
+		case MAPIAttachPathname:
+			if a.Pathname == "" {
+				a.Pathname = cleanStr(p.Text())
+			}
+		}
+		switch p.PropName {
+		case NameProviderType:
+			a.ProviderType = cleanStr(p.Text())
+		case NameProviderEndpoint:
+			a.ProviderEndpoint = cleanStr(p.Text())
+		}
+	}
+	// Embedded messages often carry only a display name.
+	if a.Title == "" && a.LongName == "" {
+		a.Title = display
+	}
+	// Reference attachments may carry only their path.
+	if a.Title == "" && a.LongName == "" && a.Pathname != "" {
+		p := a.Pathname
+		if i := strings.IndexAny(p, "?#"); i > 0 && strings.Contains(p, "://") {
+			p = p[:i]
+		}
+		a.Title = path.Base(strings.ReplaceAll(p, "\\", "/"))
+	}
+}
+
+// IsReference reports whether the attachment links to a file or URL
+// instead of carrying its content (methods 2-4 and 7).
+func (a *Attachment) IsReference() bool {
+	switch a.Method {
+	case AttachByReference, AttachByRefResolve, AttachByRefOnly, AttachByWebRef:
+		return true
+	}
+	return false
+}
+
+// TargetURL returns the reference target as a URL: web references and
+// URLs unchanged, UNC and drive paths as file: URLs. It returns "" if the
+// attachment has no path.
+func (a *Attachment) TargetURL() string {
+	p := a.Pathname
+	switch {
+	case p == "":
+		return ""
+	case strings.Contains(p, "://") || strings.HasPrefix(strings.ToLower(p), "mailto:"):
+		return p
+	case strings.HasPrefix(p, `\\`):
+		return "file:" + strings.ReplaceAll(p, `\`, "/")
+	case len(p) >= 2 && p[1] == ':':
+		return "file:///" + strings.ReplaceAll(p, `\`, "/")
+	}
+	return "file:" + strings.ReplaceAll(p, `\`, "/")
+}
+
+// Inline reports whether the attachment is part of the message body
+// (hidden, an inline MIME part, or referenced by the HTML) rather than a
+// file the sender attached.
+func (a *Attachment) Inline() bool {
+	return a.Hidden || a.Disposition == "inline" || a.Flags&AttachMHTMLRef != 0
+}
+
+// GetAttr returns the first MAPI attribute of the attachment matching
+// propID, or nil if not found.
+func (a *Attachment) GetAttr(propID int) *MAPIAttr {
+	for i := range a.Attributes {
+		if a.Attributes[i].Name == propID {
+			return &a.Attributes[i]
+		}
+	}
+	return nil
 }
 
 // Filename returns the best available display name for the attachment,
@@ -61,48 +302,201 @@ func (a *Attachment) Filename() string {
 	return "unnamed"
 }
 
+// Recipient holds a single row of a message's recipient table.
+type Recipient struct {
+	Name       string     // Display name (PR_DISPLAY_NAME).
+	Email      string     // SMTP address, or PR_EMAIL_ADDRESS if none.
+	Type       int        // RecipientTo, RecipientCc, or RecipientBcc.
+	Attributes []MAPIAttr // All decoded MAPI properties of the recipient.
+}
+
+// NewRecipient builds a Recipient from its MAPI properties.
+func NewRecipient(attrs []MAPIAttr) *Recipient {
+	r := &Recipient{Attributes: attrs}
+	for _, a := range attrs {
+		switch a.Name {
+		case MAPIDisplayName:
+			r.Name = cleanStr(a.Text())
+		case MAPISMTPAddress:
+			r.Email = cleanStr(a.Text())
+		case MAPIEmailAddress:
+			if r.Email == "" {
+				r.Email = cleanStr(a.Text())
+			}
+		case MAPIRecipientType:
+			if len(a.Data) >= 4 {
+				r.Type = int(binary.LittleEndian.Uint32(a.Data))
+			}
+		}
+	}
+	return r
+}
+
 // MAPIAttr holds a single decoded MAPI property.
 type MAPIAttr struct {
-	Type int    // MAPI property type (e.g. PT_LONG, PT_STRING8, PT_BINARY).
-	Name int    // MAPI property ID (e.g. 0x0037 for PR_SUBJECT).
-	Data []byte // Raw property value bytes.
+	Type     int    // MAPI property type (e.g. PT_LONG, PT_STRING8, PT_BINARY).
+	Name     int    // MAPI property ID (e.g. 0x0037 for PR_SUBJECT).
+	Data     []byte // Raw property value bytes.
+	PropName string // String name of a named property (ID >= 0x8000), if known.
+}
+
+// Text returns the property value as a string. PT_UNICODE values are
+// decoded from UTF-16LE; all other types are returned as raw bytes.
+func (a *MAPIAttr) Text() string {
+	if a.Type != PropTypeUnicode {
+		return string(a.Data)
+	}
+	u := make([]uint16, 0, len(a.Data)/2)
+	for i := 0; i+1 < len(a.Data); i += 2 {
+		u = append(u, binary.LittleEndian.Uint16(a.Data[i:]))
+	}
+	return string(utf16.Decode(u))
+}
+
+// Time returns a PT_SYSTIME value (a Windows FILETIME counting 100 ns
+// intervals since 1601-01-01 UTC), or the zero time if the attribute is
+// not a valid timestamp.
+func (a *MAPIAttr) Time() time.Time {
+	if a.Type != PropTypeSysTime || len(a.Data) < 8 {
+		return time.Time{}
+	}
+	ft := binary.LittleEndian.Uint64(a.Data)
+	if ft == 0 || ft < filetimeEpochOffset || ft == 0x7FFFFFFFFFFFFFFF {
+		return time.Time{}
+	}
+	ticks := ft - filetimeEpochOffset
+	return time.Unix(int64(ticks/1e7), int64(ticks%1e7)*100).UTC()
+}
+
+// filetimeEpochOffset is the number of 100 ns intervals between the
+// FILETIME epoch (1601) and the Unix epoch (1970).
+const filetimeEpochOffset = 116444736000000000
+
+// StringAttr builds a PT_STRING8 attribute holding s. Parsers for
+// formats without MAPI properties (such as MIME) use it to populate
+// the fields that view and the converters read.
+func StringAttr(propID int, s string) MAPIAttr {
+	return MAPIAttr{Type: PropTypeString8, Name: propID, Data: []byte(s)}
+}
+
+// TimeAttr builds a PT_SYSTIME attribute holding t.
+func TimeAttr(propID int, t time.Time) MAPIAttr {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100)+filetimeEpochOffset)
+	return MAPIAttr{Type: PropTypeSysTime, Name: propID, Data: b}
+}
+
+// TextBytes is like Text but returns a byte slice, avoiding a copy for
+// non-Unicode values. Trailing null terminators are removed.
+func (a *MAPIAttr) TextBytes() []byte {
+	if a.Type != PropTypeUnicode {
+		return bytes.TrimRight(a.Data, "\x00")
+	}
+	return []byte(strings.TrimRight(a.Text(), "\x00"))
 }
 
 // ResolveContentIDs replaces cid: references in BodyHTML and BodyRTFHTML
-// with the filenames returned by mapper for each attachment that has a
-// Content-ID.
+// with the URLs returned by mapper for the attachments they name, using
+// formats.ResolveContentIDs. Content-IDs are matched exactly, then
+// ignoring case; references mapper returns "" for are left as-is.
 func (m *Message) ResolveContentIDs(mapper func(att *Attachment) string) {
-	// Build CID → replacement filename map from attachments.
-	cidMap := make(map[string]string)
+	byCID := make(map[string]*Attachment)
 	for _, att := range m.Attachments {
 		if att.ContentID == "" {
 			continue
 		}
-		name := mapper(att)
-		if name == "" {
-			continue
+		byCID[att.ContentID] = att
+		if lower := strings.ToLower(att.ContentID); byCID[lower] == nil {
+			byCID[lower] = att
 		}
-		cidMap[att.ContentID] = name
 	}
-	if len(cidMap) == 0 {
+	if len(byCID) == 0 {
 		return
 	}
+	lookup := func(cid string) string {
+		att := byCID[cid]
+		if att == nil {
+			att = byCID[strings.ToLower(cid)]
+		}
+		if att == nil {
+			return ""
+		}
+		return mapper(att)
+	}
+	m.BodyHTML = formats.ResolveContentIDs(m.BodyHTML, lookup)
+	m.BodyRTFHTML = formats.ResolveContentIDs(m.BodyRTFHTML, lookup)
+}
+
+// ResolvePlaceholders replaces the \objattph markers in BodyRTFHTML with
+// the attachments they stand for. Placeholders are matched in order to
+// the attachments sorted by PR_RENDERING_POSITION, or by the position
+// in attAttachRendData when the property is absent; attachments without
+// a position (or with 0xFFFFFFFF) are not rendered inline. mapper returns
+// the URL for an attachment's content, or "" if it has none. Images are
+// placed as <img> elements and other attachments as download links.
+func (m *Message) ResolvePlaceholders(mapper func(att *Attachment) string) {
+	if !bytes.Contains(m.BodyRTFHTML, []byte("<!--objattph:")) {
+		return
+	}
+	type placed struct {
+		att *Attachment
+		pos uint32
+	}
+	var list []placed
+	for _, att := range m.Attachments {
+		var pos uint32
+		if a := att.GetAttr(MAPIRenderingPos); a != nil && len(a.Data) >= 4 {
+			pos = binary.LittleEndian.Uint32(a.Data)
+		} else if att.Rendering != nil {
+			pos = att.Rendering.Position
+		} else {
+			continue
+		}
+		if pos != 0xFFFFFFFF {
+			list = append(list, placed{att, pos})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].pos < list[j].pos })
 
-	// Replace in both HTML bodies.
-	m.BodyHTML = replaceCIDs(m.BodyHTML, cidMap)
-	m.BodyRTFHTML = replaceCIDs(m.BodyRTFHTML, cidMap)
+	out := m.BodyRTFHTML
+	for i, p := range list {
+		marker := []byte(fmt.Sprintf(placeholderMarker, i+1))
+		if !bytes.Contains(out, marker) {
+			break
+		}
+		out = bytes.Replace(out, marker, []byte(placeholderHTML(p.att, mapper(p.att))), 1)
+	}
+	m.BodyRTFHTML = placeholderRe.ReplaceAll(out, nil)
 }
 
-// replaceCIDs substitutes all cid: references in html with the mapped values.
-func replaceCIDs(html []byte, cidMap map[string]string) []byte {
-	if len(html) == 0 {
-		return html
+// placeholderRe matches placeholder markers left without an attachment.
+var placeholderRe = regexp.MustCompile(`<!--objattph:\d+-->`)
+
+// placeholderHTML returns the inline rendering of an attachment.
+func placeholderHTML(att *Attachment, src string) string {
+	name := html.EscapeString(att.Filename())
+	if src == "" {
+		return "[" + name + "]"
 	}
-	result := html
-	for cid, filename := range cidMap {
-		old := []byte("cid:" + cid)
-		new := []byte(filename)
-		result = bytes.ReplaceAll(result, old, new)
+	src = html.EscapeString(src)
+	if att.IsImage() {
+		return `<img src="` + src + `" alt="` + name + `">`
+	}
+	return `<a href="` + src + `" download="` + name + `">` + name + `</a>`
+}
+
+// IsImage reports whether the attachment is an image a browser can
+// show inline, by its MIME type or filename extension.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.MimeType, "image/") || isImageName(a.Filename())
+}
+
+// isImageName reports whether a filename has a browser-viewable image
+// extension.
+func isImageName(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".webp":
+		return true
 	}
-	return result
+	return false
 }
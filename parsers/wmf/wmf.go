@@ -0,0 +1,653 @@
+// Package wmf rasterizes Windows Metafiles (MS-WMF) to PNG.
+//
+// It implements the small subset of records that Outlook uses for
+// attachment icons (attAttachMetaFile): window setup, device context
+// save/restore, pens, brushes, rectangles, polygons, lines, and the
+// DIB blit records that draw the icon bitmap with its mask. Text records
+// are ignored because no fonts are available. Files may carry the
+// optional placeable (Aldus) header.
+//
+// Zero external dependencies.
+package wmf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Header constants.
+const (
+	placeableKey   = 0x9AC6CDD7
+	placeableSize  = 22
+	headerWords    = 9
+	maxCanvas      = 512     // Longest output side, in pixels.
+	maxRecords     = 1 << 16 // Records processed before giving up.
+	maxObjectTable = 1024
+	maxDIBPixels   = 1 << 22 // Bitmap pixels decoded per metafile.
+	maxPainted     = 1 << 26 // Canvas pixels filled or blitted per metafile.
+)
+
+// Record functions.
+const (
+	recEOF                 = 0x0000
+	recSaveDC              = 0x001E
+	recCreatePalette       = 0x00F7
+	recRestoreDC           = 0x0127
+	recSelectObject        = 0x012D
+	recDeleteObject        = 0x01F0
+	recSetWindowOrg        = 0x020B
+	recSetWindowExt        = 0x020C
+	recLineTo              = 0x0213
+	recMoveTo              = 0x0214
+	recCreatePenIndirect   = 0x02FA
+	recCreateFontIndirect  = 0x02FB
+	recCreateBrushIndirect = 0x02FC
+	recPolygon             = 0x0324
+	recPolyline            = 0x0325
+	recRectangle           = 0x041B
+	recCreatePatternBrush  = 0x01F9
+	recCreateRegion        = 0x06FF
+	recDIBCreatePattern    = 0x0142
+	recDIBBitBlt           = 0x0940
+	recDIBStretchBlt       = 0x0B41
+	recStretchDIB          = 0x0F43
+)
+
+// Raster operations.
+const (
+	ropSrcCopy   = 0x00CC0020
+	ropSrcPaint  = 0x00EE0086
+	ropSrcAnd    = 0x008800C6
+	ropSrcInvert = 0x00660046
+	ropPatCopy   = 0x00F00021
+	ropBlackness = 0x00000042
+	ropWhiteness = 0x00FF0062
+)
+
+// Errors returned by ToPNG.
+var (
+	ErrNotWMF  = errors.New("not a Windows metafile")
+	ErrNoImage = errors.New("metafile has no drawable extent")
+)
+
+// object is an entry of the metafile object table.
+type object struct {
+	kind  int // objPen, objBrush, or objOther
+	color color.RGBA
+	null  bool // PS_NULL pen or BS_NULL brush
+}
+
+const (
+	objOther = iota
+	objPen
+	objBrush
+)
+
+// dc is the drawing state saved by SaveDC.
+type dc struct {
+	orgX, orgY int
+	extX, extY int
+	pen, brush object
+	curX, curY int
+}
+
+// rasterizer holds the canvas and state while playing records.
+type rasterizer struct {
+	img       *image.RGBA
+	w, h      int
+	dc        dc
+	saved     []dc
+	objects   []*object
+	dibPixels int // bitmap pixels decoded so far
+	painted   int // canvas pixels filled or blitted so far
+}
+
+// ToPNG renders a metafile to a PNG image.
+func ToPNG(data []byte) ([]byte, error) {
+	img, err := Render(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Render plays a metafile onto a new image sized from its window extent
+// (or placeable bounding box), scaled down to at most maxCanvas pixels.
+func Render(data []byte) (*image.RGBA, error) {
+	var bbox [4]int
+	placeable := len(data) >= placeableSize && binary.LittleEndian.Uint32(data[0:4]) == placeableKey
+	if placeable {
+		for k := range bbox {
+			bbox[k] = int(int16(binary.LittleEndian.Uint16(data[6+2*k:])))
+		}
+		data = data[placeableSize:]
+	}
+	if len(data) < 18 || binary.LittleEndian.Uint16(data[2:4]) != headerWords {
+		return nil, ErrNotWMF
+	}
+	if t := binary.LittleEndian.Uint16(data[0:2]); t != 1 && t != 2 {
+		return nil, ErrNotWMF
+	}
+
+	r := &rasterizer{
+		dc: dc{
+			pen:   object{kind: objPen, color: color.RGBA{0, 0, 0, 255}},
+			brush: object{kind: objBrush, color: color.RGBA{255, 255, 255, 255}},
+		},
+	}
+	if placeable {
+		r.dc.orgX, r.dc.orgY = bbox[0], bbox[1]
+		r.dc.extX, r.dc.extY = bbox[2]-bbox[0], bbox[3]-bbox[1]
+	}
+	records := data[18:]
+
+	// The canvas size comes from the first window extent when there is
+	// no placeable header.
+	if !placeable {
+		r.scanExtent(records)
+	}
+	w, h := abs(r.dc.extX), abs(r.dc.extY)
+	if w == 0 || h == 0 {
+		return nil, ErrNoImage
+	}
+	if w > maxCanvas || h > maxCanvas {
+		if w >= h {
+			w, h = maxCanvas, max(1, h*maxCanvas/w)
+		} else {
+			w, h = max(1, w*maxCanvas/h), maxCanvas
+		}
+	}
+	r.w, r.h = w, h
+	r.img = image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range r.img.Pix {
+		r.img.Pix[i] = 0xFF
+	}
+
+	r.play(records)
+	return r.img, nil
+}
+
+// scanExtent finds the window origin and extent set by the metafile.
+func (r *rasterizer) scanExtent(records []byte) {
+	for pos, n := 0, 0; pos+6 <= len(records) && n < maxRecords; n++ {
+		size := int(binary.LittleEndian.Uint32(records[pos:])) * 2
+		fn := binary.LittleEndian.Uint16(records[pos+4:])
+		if size < 6 || pos+size > len(records) || fn == recEOF {
+			return
+		}
+		p := records[pos+6 : pos+size]
+		switch fn {
+		case recSetWindowOrg:
+			if len(p) >= 4 {
+				r.dc.orgY, r.dc.orgX = i16(p, 0), i16(p, 1)
+			}
+		case recSetWindowExt:
+			if len(p) >= 4 {
+				r.dc.extY, r.dc.extX = i16(p, 0), i16(p, 1)
+				return
+			}
+		}
+		pos += size
+	}
+}
+
+// play executes every record.
+func (r *rasterizer) play(records []byte) {
+	for pos, n := 0, 0; pos+6 <= len(records) && n < maxRecords; n++ {
+		size := int(binary.LittleEndian.Uint32(records[pos:])) * 2
+		fn := binary.LittleEndian.Uint16(records[pos+4:])
+		if size < 6 || pos+size > len(records) || fn == recEOF {
+			return
+		}
+		r.record(fn, records[pos+6:pos+size])
+		pos += size
+	}
+}
+
+// record executes one record with parameters p.
+func (r *rasterizer) record(fn uint16, p []byte) {
+	words := len(p) / 2
+	switch fn {
+	case recSetWindowOrg:
+		if words >= 2 {
+			r.dc.orgY, r.dc.orgX = i16(p, 0), i16(p, 1)
+		}
+	case recSetWindowExt:
+		if words >= 2 {
+			r.dc.extY, r.dc.extX = i16(p, 0), i16(p, 1)
+		}
+	case recSaveDC:
+		if len(r.saved) < maxObjectTable {
+			r.saved = append(r.saved, r.dc)
+		}
+	case recRestoreDC:
+		// The parameter is relative (negative) to the top of the stack.
+		if words >= 1 && len(r.saved) > 0 {
+			n := -i16(p, 0)
+			if n < 1 || n > len(r.saved) {
+				n = 1
+			}
+			r.dc = r.saved[len(r.saved)-n]
+			r.saved = r.saved[:len(r.saved)-n]
+		}
+	case recCreatePenIndirect:
+		if words >= 5 {
+			style := i16(p, 0) & 0x0F
+			r.addObject(&object{kind: objPen, color: colorRef(p[6:10]), null: style == 5})
+		}
+	case recCreateBrushIndirect:
+		if words >= 4 {
+			style := i16(p, 0)
+			r.addObject(&object{kind: objBrush, color: colorRef(p[2:6]), null: style == 1})
+		}
+	case recCreateFontIndirect, recCreatePalette, recCreatePatternBrush,
+		recCreateRegion, recDIBCreatePattern:
+		r.addObject(&object{kind: objOther})
+	case recSelectObject:
+		if words >= 1 {
+			if o := r.object(i16(p, 0)); o != nil {
+				switch o.kind {
+				case objPen:
+					r.dc.pen = *o
+				case objBrush:
+					r.dc.brush = *o
+				}
+			}
+		}
+	case recDeleteObject:
+		if words >= 1 {
+			if k := i16(p, 0); k >= 0 && k < len(r.objects) {
+				r.objects[k] = nil
+			}
+		}
+	case recMoveTo:
+		if words >= 2 {
+			r.dc.curY, r.dc.curX = i16(p, 0), i16(p, 1)
+		}
+	case recLineTo:
+		if words >= 2 {
+			y, x := i16(p, 0), i16(p, 1)
+			r.line(r.dc.curX, r.dc.curY, x, y)
+			r.dc.curX, r.dc.curY = x, y
+		}
+	case recRectangle:
+		if words >= 4 {
+			bottom, right, top, left := i16(p, 0), i16(p, 1), i16(p, 2), i16(p, 3)
+			pts := [][2]int{{left, top}, {right, top}, {right, bottom}, {left, bottom}}
+			r.polygon(pts, true)
+		}
+	case recPolygon, recPolyline:
+		if words >= 1 {
+			n := i16(p, 0)
+			if n < 0 || 1+2*n > words {
+				return
+			}
+			pts := make([][2]int, n)
+			for k := range pts {
+				pts[k] = [2]int{i16(p, 1+2*k), i16(p, 2+2*k)}
+			}
+			r.polygon(pts, fn == recPolygon)
+		}
+	case recStretchDIB:
+		// RasterOp, ColorUsage, SrcHeight, SrcWidth, YSrc, XSrc,
+		// DestHeight, DestWidth, YDest, XDest, DIB.
+		if words >= 11 {
+			rop := binary.LittleEndian.Uint32(p[0:4])
+			r.blit(rop, p[22:], i16(p, 6), i16(p, 5), i16(p, 4), i16(p, 3),
+				i16(p, 10), i16(p, 9), i16(p, 8), i16(p, 7))
+		}
+	case recDIBStretchBlt:
+		rop := uint32(0)
+		if words >= 2 {
+			rop = binary.LittleEndian.Uint32(p[0:4])
+		}
+		if words == 11 {
+			// No bitmap: RasterOp, SrcHeight, SrcWidth, YSrc, XSrc,
+			// Reserved, DestHeight, DestWidth, YDest, XDest.
+			r.fill(rop, i16(p, 10), i16(p, 9), i16(p, 8), i16(p, 7))
+			return
+		}
+		// RasterOp, SrcHeight, SrcWidth, YSrc, XSrc, DestHeight,
+		// DestWidth, YDest, XDest, DIB.
+		if words >= 10 {
+			r.blit(rop, p[20:], i16(p, 5), i16(p, 4), i16(p, 3), i16(p, 2),
+				i16(p, 9), i16(p, 8), i16(p, 7), i16(p, 6))
+		}
+	case recDIBBitBlt:
+		// RasterOp, YSrc, XSrc, Height, Width, YDest, XDest, DIB.
+		if words >= 8 {
+			rop := binary.LittleEndian.Uint32(p[0:4])
+			h, w := i16(p, 4), i16(p, 5)
+			r.blit(rop, p[16:], i16(p, 3), i16(p, 2), w, h,
+				i16(p, 7), i16(p, 6), w, h)
+		}
+	}
+}
+
+// addObject stores o in the lowest free slot of the object table.
+func (r *rasterizer) addObject(o *object) {
+	for k, slot := range r.objects {
+		if slot == nil {
+			r.objects[k] = o
+			return
+		}
+	}
+	if len(r.objects) < maxObjectTable {
+		r.objects = append(r.objects, o)
+	}
+}
+
+// object returns object table entry k, or nil.
+func (r *rasterizer) object(k int) *object {
+	if k < 0 || k >= len(r.objects) {
+		return nil
+	}
+	return r.objects[k]
+}
+
+// toDevice maps a logical point to canvas pixels.
+func (r *rasterizer) toDevice(x, y int) (int, int) {
+	if r.dc.extX == 0 || r.dc.extY == 0 {
+		return x, y
+	}
+	return (x - r.dc.orgX) * r.w / r.dc.extX, (y - r.dc.orgY) * r.h / r.dc.extY
+}
+
+// polygon fills (if closed and a brush is selected) and outlines pts.
+func (r *rasterizer) polygon(pts [][2]int, closed bool) {
+	if len(pts) < 2 {
+		return
+	}
+	dev := make([][2]int, len(pts))
+	for k, pt := range pts {
+		dev[k][0], dev[k][1] = r.toDevice(pt[0], pt[1])
+	}
+	if closed && !r.dc.brush.null {
+		r.fillPolygon(dev, r.dc.brush.color)
+	}
+	if r.dc.pen.null {
+		return
+	}
+	for k := 0; k+1 < len(dev); k++ {
+		r.devLine(dev[k], dev[k+1])
+	}
+	if closed {
+		r.devLine(dev[len(dev)-1], dev[0])
+	}
+}
+
+// line strokes a logical line with the current pen.
+func (r *rasterizer) line(x0, y0, x1, y1 int) {
+	if r.dc.pen.null {
+		return
+	}
+	a, b := [2]int{}, [2]int{}
+	a[0], a[1] = r.toDevice(x0, y0)
+	b[0], b[1] = r.toDevice(x1, y1)
+	r.devLine(a, b)
+}
+
+// devLine draws a one-pixel line between canvas points (Bresenham).
+func (r *rasterizer) devLine(a, b [2]int) {
+	x0, y0, x1, y1 := a[0], a[1], b[0], b[1]
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for n := 0; n <= 2*(r.w+r.h) && n <= dx-dy; n++ {
+		r.set(x0, y0, r.dc.pen.color)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		if e2 := 2 * e; e2 >= dy {
+			e += dy
+			x0 += sx
+		} else {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+// fillPolygon fills a canvas polygon with the even-odd rule.
+func (r *rasterizer) fillPolygon(pts [][2]int, c color.RGBA) {
+	minY, maxY := pts[0][1], pts[0][1]
+	for _, p := range pts {
+		minY, maxY = min(minY, p[1]), max(maxY, p[1])
+	}
+	minY, maxY = max(minY, 0), min(maxY, r.h-1)
+	var xs []int
+	for y := minY; y <= maxY; y++ {
+		xs = xs[:0]
+		for k := range pts {
+			a, b := pts[k], pts[(k+1)%len(pts)]
+			if a[1] == b[1] {
+				continue
+			}
+			if a[1] > b[1] {
+				a, b = b, a
+			}
+			if y < a[1] || y >= b[1] {
+				continue
+			}
+			xs = append(xs, a[0]+(y-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+		}
+		sortInts(xs)
+		for k := 0; k+1 < len(xs); k += 2 {
+			for x := max(xs[k], 0); x < min(xs[k+1], r.w); x++ {
+				r.set(x, y, c)
+			}
+		}
+	}
+}
+
+// fill applies a bitmap-less raster operation to a logical rectangle.
+func (r *rasterizer) fill(rop uint32, x, y, w, h int) {
+	var c color.RGBA
+	switch rop {
+	case ropPatCopy:
+		c = r.dc.brush.color
+	case ropBlackness:
+		c = color.RGBA{0, 0, 0, 255}
+	case ropWhiteness:
+		c = color.RGBA{255, 255, 255, 255}
+	default:
+		return
+	}
+	x0, y0 := r.toDevice(x, y)
+	x1, y1 := r.toDevice(x+w, y+h)
+	x0, x1 = max(min(x0, x1), 0), min(max(x0, x1), r.w)
+	y0, y1 = max(min(y0, y1), 0), min(max(y0, y1), r.h)
+	if x0 >= x1 || y0 >= y1 || !r.paint((x1-x0)*(y1-y0)) {
+		return
+	}
+	for py := y0; py < y1; py++ {
+		for px := x0; px < x1; px++ {
+			r.img.SetRGBA(px, py, c)
+		}
+	}
+}
+
+// paint charges n canvas pixels to the metafile's painting budget and
+// reports whether they may be drawn.
+func (r *rasterizer) paint(n int) bool {
+	if r.painted+n > maxPainted {
+		return false
+	}
+	r.painted += n
+	return true
+}
+
+// blit draws the source rectangle of a DIB into a logical destination
+// rectangle using nearest-neighbour scaling and a raster operation.
+func (r *rasterizer) blit(rop uint32, dib []byte, sx, sy, sw, sh, dx, dy, dw, dh int) {
+	if sw == 0 || sh == 0 {
+		return
+	}
+	src, err := decodeDIB(dib, maxDIBPixels-r.dibPixels)
+	if err != nil {
+		return
+	}
+	r.dibPixels += src.Rect.Dx() * src.Rect.Dy()
+	x0, y0 := r.toDevice(dx, dy)
+	x1, y1 := r.toDevice(dx+dw, dy+dh)
+	flipX, flipY := x1 < x0, y1 < y0
+	if flipX {
+		x0, x1 = x1, x0
+	}
+	if flipY {
+		y0, y1 = y1, y0
+	}
+	if x1 == x0 || y1 == y0 {
+		return
+	}
+	if !r.paint(max(min(x1, r.w)-max(x0, 0), 0) * max(min(y1, r.h)-max(y0, 0), 0)) {
+		return
+	}
+	for py := max(y0, 0); py < min(y1, r.h); py++ {
+		fy := (py - y0) * sh / (y1 - y0)
+		if flipY {
+			fy = sh - 1 - fy
+		}
+		for px := max(x0, 0); px < min(x1, r.w); px++ {
+			fx := (px - x0) * sw / (x1 - x0)
+			if flipX {
+				fx = sw - 1 - fx
+			}
+			s := src.RGBAAt(sx+fx, sy+fy)
+			d := r.img.RGBAAt(px, py)
+			switch rop {
+			case ropSrcAnd:
+				d.R, d.G, d.B = d.R&s.R, d.G&s.G, d.B&s.B
+			case ropSrcPaint:
+				d.R, d.G, d.B = d.R|s.R, d.G|s.G, d.B|s.B
+			case ropSrcInvert:
+				d.R, d.G, d.B = d.R^s.R, d.G^s.G, d.B^s.B
+			default:
+				d = s
+			}
+			d.A = 255
+			r.img.SetRGBA(px, py, d)
+		}
+	}
+}
+
+// set paints one canvas pixel if it is in bounds.
+func (r *rasterizer) set(x, y int, c color.RGBA) {
+	if x >= 0 && y >= 0 && x < r.w && y < r.h {
+		r.img.SetRGBA(x, y, c)
+	}
+}
+
+// decodeDIB decodes an uncompressed device-independent bitmap with a
+// BITMAPINFOHEADER (or larger) and 1, 4, 8, 24, or 32 bits per pixel.
+// Bitmaps of more than maxPixels pixels are rejected.
+func decodeDIB(b []byte, maxPixels int) (*image.RGBA, error) {
+	if len(b) < 40 {
+		return nil, ErrNotWMF
+	}
+	hdr := int(binary.LittleEndian.Uint32(b[0:4]))
+	w := int(int32(binary.LittleEndian.Uint32(b[4:8])))
+	h := int(int32(binary.LittleEndian.Uint32(b[8:12])))
+	bpp := int(binary.LittleEndian.Uint16(b[14:16]))
+	comp := binary.LittleEndian.Uint32(b[16:20])
+	used := int(binary.LittleEndian.Uint32(b[32:36]))
+	topDown := h < 0
+	if topDown {
+		h = -h
+	}
+	if hdr < 40 || hdr > len(b) || w <= 0 || h <= 0 || w > 4096 || h > 4096 || w*h > maxPixels || comp != 0 {
+		return nil, ErrNotWMF
+	}
+	switch bpp {
+	case 1, 4, 8, 24, 32:
+	default:
+		return nil, ErrNotWMF
+	}
+	var palette []color.RGBA
+	if bpp <= 8 {
+		if used == 0 || used > 1<<bpp {
+			used = 1 << bpp
+		}
+		for k := 0; k < used; k++ {
+			off := hdr + 4*k
+			if off+4 > len(b) {
+				return nil, ErrNotWMF
+			}
+			palette = append(palette, color.RGBA{b[off+2], b[off+1], b[off], 255})
+		}
+	}
+	pix := b[hdr+4*len(palette):]
+	stride := ((w*bpp + 31) / 32) * 4
+	if stride*h > len(pix) {
+		return nil, ErrNotWMF
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := pix[y*stride : (y+1)*stride]
+		iy := h - 1 - y
+		if topDown {
+			iy = y
+		}
+		for x := 0; x < w; x++ {
+			var c color.RGBA
+			switch bpp {
+			case 1:
+				c = palette[int(row[x/8]>>(7-uint(x%8))&1)%len(palette)]
+			case 4:
+				c = palette[int(row[x/2]>>(4*(1-uint(x%2)))&0x0F)%len(palette)]
+			case 8:
+				c = palette[int(row[x])%len(palette)]
+			case 24:
+				c = color.RGBA{row[3*x+2], row[3*x+1], row[3*x], 255}
+			case 32:
+				c = color.RGBA{row[4*x+2], row[4*x+1], row[4*x], 255}
+			}
+			img.SetRGBA(x, iy, c)
+		}
+	}
+	return img, nil
+}
+
+// colorRef decodes a COLORREF (0x00BBGGRR).
+func colorRef(b []byte) color.RGBA {
+	return color.RGBA{b[0], b[1], b[2], 255}
+}
+
+// i16 returns signed 16-bit parameter k.
+func i16(p []byte, k int) int {
+	if 2*k+2 > len(p) {
+		return 0
+	}
+	return int(int16(binary.LittleEndian.Uint16(p[2*k:])))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// sortInts is an insertion sort for the few crossings of a scanline.
+func sortInts(a []int) {
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && a[j] < a[j-1]; j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+}
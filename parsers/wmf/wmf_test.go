@@ -0,0 +1,134 @@
+package wmf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// metafile assembles a WMF from records given as function and 16-bit
+// parameter words, optionally followed by raw trailing bytes.
+type metafile struct{ buf bytes.Buffer }
+
+func (m *metafile) record(fn uint16, words []uint16, tail []byte) {
+	size := 3 + len(words) + (len(tail)+1)/2
+	binary.Write(&m.buf, binary.LittleEndian, uint32(size))
+	binary.Write(&m.buf, binary.LittleEndian, fn)
+	binary.Write(&m.buf, binary.LittleEndian, words)
+	m.buf.Write(tail)
+	if len(tail)%2 == 1 {
+		m.buf.WriteByte(0)
+	}
+}
+
+func (m *metafile) bytes() []byte {
+	m.record(recEOF, nil, nil)
+	hdr := make([]byte, 18)
+	binary.LittleEndian.PutUint16(hdr[0:], 1)
+	binary.LittleEndian.PutUint16(hdr[2:], headerWords)
+	binary.LittleEndian.PutUint16(hdr[4:], 0x0300)
+	return append(hdr, m.buf.Bytes()...)
+}
+
+// dib24 builds a bottom-up 24-bit DIB of w×h pixels in a single colour.
+func dib24(w, h int, c color.RGBA) []byte {
+	stride := ((w*24 + 31) / 32) * 4
+	b := make([]byte, 40+stride*h)
+	binary.LittleEndian.PutUint32(b[0:], 40)
+	binary.LittleEndian.PutUint32(b[4:], uint32(w))
+	binary.LittleEndian.PutUint32(b[8:], uint32(h))
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], 24)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			off := 40 + y*stride + 3*x
+			b[off], b[off+1], b[off+2] = c.B, c.G, c.R
+		}
+	}
+	return b
+}
+
+func TestToPNG(t *testing.T) {
+	var m metafile
+	m.record(recSetWindowOrg, []uint16{0, 0}, nil)
+	m.record(recSetWindowExt, []uint16{32, 32}, nil) // y, x
+	// Red solid brush, null pen, rectangle over the left half.
+	m.record(recCreateBrushIndirect, []uint16{0, 0x00FF, 0x0000, 0}, nil)
+	m.record(recCreatePenIndirect, []uint16{5, 0, 0, 0, 0}, nil)
+	m.record(recSelectObject, []uint16{0}, nil)
+	m.record(recSelectObject, []uint16{1}, nil)
+	m.record(recRectangle, []uint16{32, 16, 0, 0}, nil) // bottom, right, top, left
+	// Blue 2×2 bitmap stretched over the bottom-right quarter.
+	blue := color.RGBA{0, 0, 255, 255}
+	m.record(recStretchDIB, []uint16{
+		0x0020, 0x00CC, // SRCCOPY
+		0,          // DIB_RGB_COLORS
+		2, 2, 0, 0, // src h, w, y, x
+		16, 16, 16, 16, // dest h, w, y, x
+	}, dib24(2, 2, blue))
+
+	data, err := ToPNG(m.bytes())
+	if err != nil {
+		t.Fatalf("ToPNG: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Fatalf("bounds = %v, want 32×32", b)
+	}
+	tests := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{4, 4, color.RGBA{255, 0, 0, 255}},
+		{24, 4, color.RGBA{255, 255, 255, 255}},
+		{24, 24, blue},
+	}
+	for _, tt := range tests {
+		r, g, b, a := img.At(tt.x, tt.y).RGBA()
+		got := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+		if got != tt.want {
+			t.Errorf("pixel (%d,%d) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestToPNGInvalid(t *testing.T) {
+	if _, err := ToPNG([]byte("not a metafile at all")); err != ErrNotWMF {
+		t.Errorf("err = %v, want ErrNotWMF", err)
+	}
+	var m metafile
+	if _, err := ToPNG(m.bytes()); err != ErrNoImage {
+		t.Errorf("empty extent: err = %v, want ErrNoImage", err)
+	}
+}
+
+func TestToPNGBounded(t *testing.T) {
+	// Huge destinations on a tiny canvas must be clipped, not looped over.
+	var m metafile
+	m.record(recSetWindowExt, []uint16{1, 1}, nil)
+	for range 1000 {
+		m.record(recDIBStretchBlt, []uint16{
+			0x0062, 0x00FF, // WHITENESS
+			0, 0, 0, 0, 0, // src h, w, y, x, reserved
+			0x7FFF, 0x7FFF, 0, 0, // dest h, w, y, x
+		}, nil)
+	}
+	if _, err := ToPNG(m.bytes()); err != nil {
+		t.Fatalf("ToPNG: %v", err)
+	}
+
+	// Only 1, 4, 8, 24, and 32 bits per pixel are decoded.
+	dib := dib24(2, 2, color.RGBA{})
+	binary.LittleEndian.PutUint16(dib[14:], 0)
+	if _, err := decodeDIB(dib, maxDIBPixels); err != ErrNotWMF {
+		t.Errorf("0 bpp: err = %v, want ErrNotWMF", err)
+	}
+	if _, err := decodeDIB(dib24(4, 4, color.RGBA{}), 15); err != ErrNotWMF {
+		t.Errorf("pixel budget: err = %v, want ErrNotWMF", err)
+	}
+}
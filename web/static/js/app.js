@@ -142,8 +142,10 @@
       var fileUrl = 'api/files/' + sid + '/' + encodeURIComponent(f.name);
 
       li.innerHTML =
-        '<div class="file-icon ' + escAttr(f.type) + '">' +
-          escHtml(iconLabel(f.type)) +
+        '<div class="file-icon ' + escAttr(f.type) + (f.icon ? ' custom' : '') + '">' +
+          (f.icon
+            ? '<img src="' + escAttr(f.icon) + '" alt="">'
+            : escHtml(iconLabel(f.type))) +
         '</div>' +
         '<div class="file-info">' +
           '<span class="file-name" title="' + escAttr(f.name) + '">' +
@@ -186,6 +188,7 @@
     pdf: 'PDF',
     document: 'DOC',
     spreadsheet: 'XLS',
+    link: 'LINK',
     file: 'FILE'
   };
 